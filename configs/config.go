@@ -19,15 +19,25 @@
 package configs
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	dockerconfig "github.com/containers/image/v5/pkg/docker/config"
+	"github.com/containers/image/v5/types"
 	"gopkg.in/ini.v1"
 	"gopkg.in/yaml.v2"
 	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"tkestack.io/image-transfer/pkg/image-transfer/options"
+	"tkestack.io/image-transfer/pkg/transfer"
 	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/utils"
 )
 
 
@@ -50,22 +60,354 @@ type Configs struct {
 	Conf     *ini.File
 	Security      map[string]Security
 	ImageList map[string]string
+	// Rules are the rules of ImageList with their options, keyed by source
+	Rules map[string]*Rule
 	Secret map[string]Secret
+	// CCRRepoFilter filters the repositories of ccr rules
+	CCRRepoFilter *utils.RepoFilter
+	// CatalogRepoFilter filters the repositories listed for the rules like registry/namespace/*
+	CatalogRepoFilter *utils.RepoFilter
+	// CCRRepoList are the namespace/repository of ccr listed in the ccr repo file, empty means all
+	CCRRepoList []string
+	// NamespaceMapping renames the target namespaces of ccr rules
+	NamespaceMapping map[string]string
+	// TCRRoutes route ccr namespaces to tcr instances, the first matched route is used
+	TCRRoutes []*TCRRoute
+	// RewriteRules rewrite the sources whose targets are empty to targets, the first matched rule is used
+	RewriteRules []*RewriteRule
+	// securityMutex guards Security which is updated when the auth information from a secret backend is refreshed
+	securityMutex sync.RWMutex
+	// rawSecurity keeps the entries of the security file before they are resolved, a secret
+	// provider is queried again with them when the credential may have rotated
+	rawSecurity map[string]Security
+	// dockerConfigAuth caches the auth information found in the docker config file, keyed by registry
+	dockerConfigAuth      map[string]*Security
+	dockerConfigAuthMutex sync.Mutex
 	//ConfMap       map[string]interface{}
 	//ConfMapString map[string]string
 }
 
+// DefaultSecurityKey is the key of the security entry which anonymous pulls fall back to
+const DefaultSecurityKey = "default"
+
 // Security describes the authentication information of a registry
 type Security struct {
 	Username string `json:"username" yaml:"username"`
 	Password string `json:"password" yaml:"password"`
 	Insecure bool   `json:"insecure" yaml:"insecure"`
+	// QuayToken is the OAuth token of quay api, used to create missing repositories
+	QuayToken string `json:"quayToken" yaml:"quayToken"`
+	// UsernameEnv and PasswordEnv are the environment variables of username and password,
+	// they are used instead of Username and Password
+	UsernameEnv string `json:"usernameEnv" yaml:"usernameEnv"`
+	PasswordEnv string `json:"passwordEnv" yaml:"passwordEnv"`
+	// FromDockerConfig reads the auth information of the registry from the docker config file,
+	// ~/.docker/config.json is used if dockerConfig is not set
+	FromDockerConfig bool `json:"fromDockerConfig" yaml:"fromDockerConfig"`
+	// Source is the secret provider of username and password: plain(default), env, vault or ssm,
+	// see SecretProvider
+	Source string `json:"source" yaml:"source"`
+	// VaultAddress and VaultPath locate the secret in the KV v2 engine of vault, VaultPath is
+	// <mount>/<path> like secret/registry/harbor, VAULT_ADDR is used if VaultAddress is empty
+	VaultAddress string `json:"vaultAddress" yaml:"vaultAddress"`
+	VaultPath    string `json:"vaultPath" yaml:"vaultPath"`
+	// SSMSecretName, SSMRegion and SSMVersionID locate the secret in tencent cloud secrets manager,
+	// SSMVersionID is SSM_Current by default
+	SSMSecretName string `json:"ssmSecretName" yaml:"ssmSecretName"`
+	SSMRegion     string `json:"ssmRegion" yaml:"ssmRegion"`
+	SSMVersionID  string `json:"ssmVersionId" yaml:"ssmVersionId"`
+	// UsernameKey and PasswordKey are the keys of username and password in a vault or ssm secret,
+	// they are username and password by default
+	UsernameKey string `json:"usernameKey" yaml:"usernameKey"`
+	PasswordKey string `json:"passwordKey" yaml:"passwordKey"`
+	// Token is a long-lived bearer token sent to the registry directly instead of logging in with
+	// username and password, e.g. a personal access token. It can not be set with them
+	Token string `json:"token" yaml:"token"`
+
+	// entry is the key of the security file which the auth information comes from
+	entry string
+	// usernameSecret is true if the username comes from the environment or a secret backend,
+	// it is never logged
+	usernameSecret bool
+}
+
+// LogUsername returns the username to log, a username from the environment or a secret backend
+// is fully masked
+func (s Security) LogUsername() string {
+	if s.Username == utils.BearerTokenUsername {
+		return "(token)"
+	}
+	if s.usernameSecret {
+		return "***(from " + s.sourceName() + ")"
+	}
+	return log.Redact(s.Username)
 }
 
-// Secret describes secret info for tencent cloud
+// Secret describes secret info for tencent cloud, the "swr" entry holds
+// the AK/SK of huawei cloud
 type Secret struct {
 	SecretID string `json:"secretId" yaml:"secretId"`
 	SecretKey string `json:"secretKey" yaml:"secretKey"`
+	// RoleArn is the CAM role assumed by STS with SecretID and SecretKey,
+	// the temporary credentials of the role are used if it is set
+	RoleArn string `json:"roleArn" yaml:"roleArn"`
+	RoleSessionName string `json:"roleSessionName" yaml:"roleSessionName"`
+	// DurationSeconds is the validity period of the temporary credentials, default value is 7200
+	DurationSeconds uint64 `json:"durationSeconds" yaml:"durationSeconds"`
+	// SecretIDEnv and SecretKeyEnv are the environment variables of SecretID and SecretKey,
+	// they are used instead of SecretID and SecretKey
+	SecretIDEnv string `json:"secretIdEnv" yaml:"secretIdEnv"`
+	SecretKeyEnv string `json:"secretKeyEnv" yaml:"secretKeyEnv"`
+}
+
+
+// Rule is a transfer rule, in the rule file the value of a source is a target url or a Rule
+type Rule struct {
+	Target string `json:"target" yaml:"target"`
+	// Semver is a semantic version constraint like ">=1.20,<2.0", only the matched tags
+	// are transferred when all tags of the source are listed
+	Semver string `json:"semver" yaml:"semver"`
+	// Tags is an explicit list of tags to transfer, the tags of the source are not listed if it is set
+	Tags []string `json:"tags" yaml:"tags"`
+	// TagMapping maps source tags to differently named target tags, only these tags are transferred. A rule
+	// which is only a map of tags like {"1.0": "stable"} is the TagMapping of a rule without target,
+	// unless all of the tags are named like the string fields of Rule, e.g. target
+	TagMapping map[string]string `json:"tagMapping" yaml:"tagMapping"`
+	// IncludeTags and ExcludeTags are regular expressions of the whole tag, the listed tags of the source
+	// are transferred only if they match any of IncludeTags and none of ExcludeTags
+	IncludeTags []string `json:"includeTags" yaml:"includeTags"`
+	ExcludeTags []string `json:"excludeTags" yaml:"excludeTags"`
+	// Platforms like linux/arm64 keep only these instances of manifest lists
+	Platforms []string `json:"platforms" yaml:"platforms"`
+	// IfExists overrides the flag ifExists for the images of the rule
+	IfExists string `json:"ifExists" yaml:"ifExists"`
+	// SourceAuth and TargetAuth are keys of the security file, their auth information is used for
+	// the source and the target instead of the key matched by registry
+	SourceAuth string `json:"sourceAuth" yaml:"sourceAuth"`
+	TargetAuth string `json:"targetAuth" yaml:"targetAuth"`
+	// RepoRewrite are the strategies like prefix=bitnami- or flatten which rewrite the repositories below
+	// the target namespace of a wildcard or default target, they override the flag targetRepoRewrite
+	RepoRewrite []string `json:"repoRewrite" yaml:"repoRewrite"`
+
+	// source is the source of the rule in the rule file
+	source           string
+	repoRewrite      utils.RepoRewrite
+	semverConstraint *utils.SemverConstraint
+	includeTags      []*regexp.Regexp
+	excludeTags      []*regexp.Regexp
+}
+
+// ruleEntry is an entry of the list format of rule files, a rule with its source. Rule is not
+// embedded, or its UnmarshalYAML would decode the whole entry
+type ruleEntry struct {
+	Source string `yaml:"source"`
+	Rule   Rule   `yaml:",inline"`
+}
+
+// ruleDocument is the rules of a rule file by source. A rule file is a map of sources to target urls or
+// rules, or a list of rule entries
+type ruleDocument map[string]*Rule
+
+// UnmarshalYAML decodes the map or list format of a rule file
+func (f *ruleDocument) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var rules map[string]*Rule
+	mapErr := unmarshal(&rules)
+	if mapErr == nil {
+		*f = rules
+		return nil
+	}
+	// the errors of a TypeError share the array of the decoder which is reused by the next unmarshal
+	if typeErr, ok := mapErr.(*yaml.TypeError); ok {
+		mapErr = &yaml.TypeError{Errors: append([]string{}, typeErr.Errors...)}
+	}
+
+	// the error of the map format is reported unless the file is a list
+	var list []interface{}
+	if unmarshal(&list) != nil {
+		return mapErr
+	}
+	var entries []ruleEntry
+	if err := unmarshal(&entries); err != nil {
+		return err
+	}
+	*f = make(ruleDocument)
+	for i := range entries {
+		entry := &entries[i]
+		if entry.Source == "" {
+			return fmt.Errorf("entry %v of the rule list has no source", i+1)
+		}
+		if _, ok := (*f)[entry.Source]; ok {
+			return fmt.Errorf("entry %v of the rule list is invalid: %s is listed more than once", i+1, entry.Source)
+		}
+		(*f)[entry.Source] = &entry.Rule
+	}
+	return nil
+}
+
+// UnmarshalYAML decodes a target url or a Rule
+func (r *Rule) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var target string
+	if err := unmarshal(&target); err == nil {
+		r.Target = target
+		return nil
+	}
+
+	// a map of strings is a tag mapping unless all of its keys are string fields of Rule
+	var tagMapping map[string]string
+	if err := unmarshal(&tagMapping); err == nil && len(tagMapping) > 0 && isTagMapping(tagMapping) {
+		r.TagMapping = tagMapping
+		return nil
+	}
+
+	// avoid calling UnmarshalYAML recursively
+	type rule Rule
+	return unmarshal((*rule)(r))
+}
+
+// isTagMapping checks if a map of strings is a tag mapping rather than a Rule. A key which is not
+// the yaml key of a string field of Rule can only be a tag, e.g. "1.0", or "tags" whose value would
+// be a list in a Rule. A map like {target: ..., semver: ...} is a Rule, the tags named like these keys
+// are mapped by the tagMapping field of a Rule
+func isTagMapping(values map[string]string) bool {
+	ruleType := reflect.TypeOf(Rule{})
+	stringKeys := make(map[string]bool)
+	for i := 0; i < ruleType.NumField(); i++ {
+		field := ruleType.Field(i)
+		if key := strings.Split(field.Tag.Get("yaml"), ",")[0]; key != "" && field.Type.Kind() == reflect.String {
+			stringKeys[key] = true
+		}
+	}
+	for key := range values {
+		if !stringKeys[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// SemverConstraint returns the parsed semver constraint, it is nil if no constraint
+func (r *Rule) SemverConstraint() *utils.SemverConstraint {
+	if r == nil {
+		return nil
+	}
+	return r.semverConstraint
+}
+
+// GetRepoRewrite returns the parsed repo rewrite of the rule, it is nil if the rule has no repoRewrite
+func (r *Rule) GetRepoRewrite() utils.RepoRewrite {
+	if r == nil {
+		return nil
+	}
+	return r.repoRewrite
+}
+
+// GetSource returns the source of the rule in the rule file, it is empty if unknown
+func (r *Rule) GetSource() string {
+	if r == nil {
+		return ""
+	}
+	return r.source
+}
+
+// GetTags returns the explicit tags of the rule, they are the sorted source tags of TagMapping if it
+// is set. It is nil if no tags
+func (r *Rule) GetTags() []string {
+	if r == nil {
+		return nil
+	}
+	if len(r.TagMapping) > 0 {
+		tags := make([]string, 0, len(r.TagMapping))
+		for tag := range r.TagMapping {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+		return tags
+	}
+	return r.Tags
+}
+
+// TargetTag returns the target tag of a source tag, it is the source tag if TagMapping does not map it
+func (r *Rule) TargetTag(tag string) string {
+	if r == nil {
+		return tag
+	}
+	if targetTag, ok := r.TagMapping[tag]; ok {
+		return targetTag
+	}
+	return tag
+}
+
+// FilterTags returns the tags which match the IncludeTags and ExcludeTags of the rule
+func (r *Rule) FilterTags(tags []string) []string {
+	if r == nil || (len(r.includeTags) == 0 && len(r.excludeTags) == 0) {
+		return tags
+	}
+	var filtered []string
+	for _, tag := range tags {
+		if (len(r.includeTags) == 0 || matchAny(r.includeTags, tag)) && !matchAny(r.excludeTags, tag) {
+			filtered = append(filtered, tag)
+		}
+	}
+	return filtered
+}
+
+// matchAny checks if value matches any of patterns
+func matchAny(patterns []*regexp.Regexp, value string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetPlatforms returns the platforms of the rule, it is nil if all platforms are transferred
+func (r *Rule) GetPlatforms() []string {
+	if r == nil {
+		return nil
+	}
+	return r.Platforms
+}
+
+// GetIfExists returns the ifExists policy of the rule, it is empty if the flag is used
+func (r *Rule) GetIfExists() string {
+	if r == nil {
+		return ""
+	}
+	return r.IfExists
+}
+
+// GetSourceAuth returns the security key of the source, it is empty if the key is matched by registry
+func (r *Rule) GetSourceAuth() string {
+	if r == nil {
+		return ""
+	}
+	return r.SourceAuth
+}
+
+// GetTargetAuth returns the security key of the target, it is empty if the key is matched by registry
+func (r *Rule) GetTargetAuth() string {
+	if r == nil {
+		return ""
+	}
+	return r.TargetAuth
+}
+
+// TCRRoute routes the ccr namespaces matched by Namespace to a tcr instance
+type TCRRoute struct {
+	// Namespace is a regular expression which matches the whole namespace name
+	Namespace string `json:"namespace" yaml:"namespace"`
+	TCRName   string `json:"tcrName" yaml:"tcrName"`
+	// TCRRegion is the region of the instance, the flag tcrRegion is used if it is empty
+	TCRRegion string `json:"tcrRegion" yaml:"tcrRegion"`
+
+	namespaceRegexp *regexp.Regexp
+}
+
+// RepoFilterPatterns is the yaml file of repository filter patterns
+type RepoFilterPatterns struct {
+	Include []string `json:"include" yaml:"include"`
+	Exclude []string `json:"exclude" yaml:"exclude"`
 }
 
 
@@ -78,34 +420,128 @@ func InitConfigs(opts *options.ClientOptions) (*Configs, error) {
 		instance.FlagConf = opts
 	})
 
-	if instance.FlagConf.Config.CCRToTCR == true {
+	// the config files are fetched before any job starts, a fetch failure fails the run
+	fetcher, err := newRemoteConfigFetcher(instance.FlagConf.Config)
+	if err != nil {
+		return nil, err
+	}
+	configFetcher = fetcher
+
+	// the verify and diff modes walk the same rules as transfer, they transfer nothing
+	if instance.FlagConf.Config.Mode == "verify" || instance.FlagConf.Config.Mode == "diff" {
+		instance.FlagConf.Config.VerifyOnly = true
+	}
+
+	rewriteRules, err := instance.GetRewriteRules()
+	if err != nil {
+		return nil, err
+	}
+	instance.RewriteRules = rewriteRules
+	// testRewrite only prints the targets of the given sources, no rule or security file is needed
+	if len(instance.FlagConf.Config.TestRewrite) != 0 {
+		return instance, nil
+	}
+
+	modes := 0
+	for _, enabled := range []bool{instance.FlagConf.Config.CCRToTCR, instance.FlagConf.Config.SWRToTCR,
+		instance.FlagConf.Config.TCRToTCR, instance.FlagConf.Config.TCRToCCR,
+		instance.FlagConf.Config.CCRToRegistry} {
+		if enabled {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return nil, errors.New("only one of ccrToTcr, swrToTcr, tcrToTcr, tcrToCcr and ccrToRegistry can be used, Exit")
+	}
+
+	if modes == 1 {
 		if len(instance.FlagConf.Config.SecretFile) == 0 || len(instance.FlagConf.Config.SecurityFile) == 0 {
 			return nil, errors.New("no SecretFile or security file is provided, Exit")
-		} else if len(instance.FlagConf.Config.TCRName) == 0 {
+		} else if instance.FlagConf.Config.CCRToRegistry && len(instance.FlagConf.Config.TargetTemplate) == 0 {
+			return nil, errors.New("no target template is provided, Exit")
+		} else if !instance.FlagConf.Config.CCRToRegistry && len(instance.FlagConf.Config.TCRName) == 0 &&
+			!(instance.FlagConf.Config.CCRToTCR && len(instance.FlagConf.Config.TCRRouting) != 0 &&
+				!instance.FlagConf.Config.UnroutedNsFallback) {
 			return nil, errors.New("no tcr name is provided, Exit")
+		} else if instance.FlagConf.Config.TCRToTCR && len(instance.FlagConf.Config.SourceTCRName) == 0 {
+			return nil, errors.New("no source tcr name is provided, Exit")
+		} else if instance.FlagConf.Config.TCRToTCR &&
+			instance.FlagConf.Config.SourceTCRName == instance.FlagConf.Config.TCRName {
+			return nil, errors.New("source tcr and target tcr should not be the same instance, Exit")
 		} else {
 			secret, err := instance.GetSecret()
 			if err != nil {
 				return nil, err
 			}
+			if err := instance.ValidateSecret(secret); err != nil {
+				return nil, err
+			}
 			instance.Secret = secret
 			securityList, err := instance.GetSecurity()
 			if err != nil {
 				return nil, err
 			}
 			instance.Security = securityList
+			repoFilter, err := instance.GetCCRRepoFilter()
+			if err != nil {
+				return nil, err
+			}
+			instance.CCRRepoFilter = repoFilter
+			namespaceMapping, err := instance.GetNamespaceMapping()
+			if err != nil {
+				return nil, err
+			}
+			instance.NamespaceMapping = namespaceMapping
+			tcrRoutes, err := instance.GetTCRRoutes()
+			if err != nil {
+				return nil, err
+			}
+			instance.TCRRoutes = tcrRoutes
 		}
 	} else {
-		if len(instance.FlagConf.Config.RuleFile) == 0 || len(instance.FlagConf.Config.SecurityFile) == 0 {
+		mirrorRegistry := instance.FlagConf.Config.MirrorRegistry
+		ruleFiles := len(instance.FlagConf.Config.RuleFile) + len(instance.FlagConf.Config.ImageListFile)
+		if (ruleFiles == 0 && mirrorRegistry == "" &&
+			instance.FlagConf.Config.FromKubeconfig == "" && len(instance.FlagConf.Config.FromManifests) == 0 &&
+			instance.FlagConf.Config.FromChart == "") ||
+			len(instance.FlagConf.Config.SecurityFile) == 0 {
 			return nil, errors.New("no rule file or security file is provided, Exit")
 		}
-		instance.ImageList = instance.GetImageList()
+		rules := make(map[string]*Rule)
+		if ruleFiles != 0 {
+			var err error
+			if rules, err = instance.GetRules(); err != nil {
+				return nil, err
+			}
+		}
+		// a full mirror is a rule of all repositories of the registry
+		if mirrorRegistry != "" {
+			source := strings.TrimSuffix(mirrorRegistry, "/") + "/*"
+			rules[source] = &Rule{
+				Target: instance.FlagConf.Config.DefaultRegistry + "/" + instance.FlagConf.Config.DefaultNamespace + "/*",
+				source: source,
+			}
+		}
+		instance.Rules = rules
+		catalogRepoFilter, err := utils.NewRepoFilter(instance.FlagConf.Config.CatalogRepoInclude,
+			instance.FlagConf.Config.CatalogRepoExclude)
+		if err != nil {
+			return nil, err
+		}
+		instance.CatalogRepoFilter = catalogRepoFilter
+		instance.ImageList = make(map[string]string)
+		for source, rule := range rules {
+			instance.ImageList[source] = rule.Target
+		}
 
 		securityList, err := instance.GetSecurity()
 		if err != nil {
 			return nil, err
 		}
 		instance.Security = securityList
+		if err := validateRuleAuth(rules, securityList); err != nil {
+			return nil, err
+		}
 
 
 	}
@@ -132,18 +568,197 @@ func GetConfigs() *Configs {
 	return instance
 }
 
-// GetImageList get images list of configs instance
-func (c *Configs) GetImageList() map[string]string {
-	var imageList map[string]string
+// GetRules get rules of configs instance, the options of rules are validated. The rule files and then
+// the image lists are merged in order, a source in several files is overridden by the later file or fails
+// by ruleConflict
+func (c *Configs) GetRules() (map[string]*Rule, error) {
+	rules := make(map[string]*Rule)
+	ruleFiles := make(map[string]string)
+	merge := func(ruleFile string, fileRules map[string]*Rule) error {
+		for source, rule := range fileRules {
+			if previous, ok := ruleFiles[source]; ok {
+				if c.FlagConf.Config.RuleConflict == "error" {
+					return fmt.Errorf("rule of %s is in both rule files %s and %s", source, previous, ruleFile)
+				}
+				log.Warnf("rule of %s in rule file %s overrides the one in %s", source, ruleFile, previous)
+			}
+			rules[source] = rule
+			ruleFiles[source] = ruleFile
+		}
+		return nil
+	}
 
+	for _, ruleFile := range c.FlagConf.Config.RuleFile {
+		var fileRules ruleDocument
+		if err := openAndDecode(ruleFile, &fileRules); err != nil {
+			log.Errorf("decode config file %v error: %v", ruleFile, err)
+			return nil, err
+		}
+		if err := merge(ruleFile, fileRules); err != nil {
+			return nil, err
+		}
+	}
+	for _, imageList := range c.FlagConf.Config.ImageListFile {
+		listRules, err := readImageList(imageList)
+		if err != nil {
+			return nil, err
+		}
+		if err := merge(imageListName(imageList), listRules); err != nil {
+			return nil, err
+		}
+	}
 
-	if err := openAndDecode(c.FlagConf.Config.RuleFile, &imageList); err != nil {
-		log.Errorf("decode config file %v error: %v", c.FlagConf.Config.RuleFile, err)
-		return nil
+	for source, rule := range rules {
+		if _, _, ok := utils.SplitWildcardRepo(source); ok {
+			if rule != nil && rule.Target != "" && !utils.IsTargetTemplate(rule.Target) {
+				if _, _, _, ok := utils.SplitWildcardTarget(rule.Target); !ok {
+					return nil, fmt.Errorf("rule of %s is invalid: target %s should be like registry/namespace/* "+
+						"or registry/namespace/prefix-*", source, rule.Target)
+				}
+			}
+		}
+		if rule == nil {
+			rules[source] = &Rule{source: source}
+			continue
+		}
+		rule.source = source
+		if utils.IsTargetTemplate(rule.Target) {
+			if _, err := utils.ParseTargetTemplate(rule.Target); err != nil {
+				return nil, fmt.Errorf("rule of %s is invalid: %v", source, err)
+			}
+		}
+		if rule.Semver != "" {
+			constraint, err := utils.ParseSemverConstraint(rule.Semver)
+			if err != nil {
+				return nil, fmt.Errorf("rule of %s is invalid: %v", source, err)
+			}
+			rule.semverConstraint = constraint
+		}
+		for _, tag := range rule.Tags {
+			if !options.IsValidTag(tag) {
+				return nil, fmt.Errorf("rule of %s is invalid: tag %q is illegal", source, tag)
+			}
+		}
+		if err := validateTagMapping(rule); err != nil {
+			return nil, fmt.Errorf("rule of %s is invalid: %v", source, err)
+		}
+		var err error
+		if rule.repoRewrite, err = utils.ParseRepoRewrite(rule.RepoRewrite); err != nil {
+			return nil, fmt.Errorf("rule of %s is invalid: %v", source, err)
+		}
+		if rule.includeTags, err = compileTagPatterns(rule.IncludeTags); err != nil {
+			return nil, fmt.Errorf("rule of %s is invalid: includeTags %v", source, err)
+		}
+		if rule.excludeTags, err = compileTagPatterns(rule.ExcludeTags); err != nil {
+			return nil, fmt.Errorf("rule of %s is invalid: excludeTags %v", source, err)
+		}
+		for _, platform := range rule.Platforms {
+			if !transfer.ValidPlatform(platform) {
+				return nil, fmt.Errorf("rule of %s is invalid: platform %q should be like os/arch or "+
+					"os/arch/variant", source, platform)
+			}
+		}
+		if rule.IfExists != "" && !utils.IsContain(transfer.IfExistsPolicies, rule.IfExists) {
+			return nil, fmt.Errorf("rule of %s is invalid: ifExists should be one of %v, got %s", source,
+				transfer.IfExistsPolicies, rule.IfExists)
+		}
 	}
 
+	warnDuplicateTargets(rules)
+	return rules, nil
+}
 
-	return imageList
+// validateTagMapping checks the tags of TagMapping are legal and no two source tags are mapped to
+// the same target tag
+func validateTagMapping(rule *Rule) error {
+	if len(rule.TagMapping) > 0 && len(rule.Tags) > 0 {
+		return fmt.Errorf("tags and tagMapping should not be used together")
+	}
+	mapped := make(map[string]string)
+	for _, sourceTag := range rule.GetTags() {
+		targetTag := rule.TagMapping[sourceTag]
+		for _, tag := range []string{sourceTag, targetTag} {
+			if !options.IsValidTag(tag) {
+				return fmt.Errorf("tag %q of tagMapping is illegal", tag)
+			}
+		}
+		if previous, ok := mapped[targetTag]; ok {
+			return fmt.Errorf("tags %s and %s of tagMapping are both mapped to %s", previous, sourceTag, targetTag)
+		}
+		mapped[targetTag] = sourceTag
+	}
+	return nil
+}
+
+// compileTagPatterns compiles the regular expressions of tags, they match the whole tag
+func compileTagPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("%q is invalid: %v", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// validateRuleAuth checks the security keys referred by the rules exist
+func validateRuleAuth(rules map[string]*Rule, securityList map[string]Security) error {
+	for source, rule := range rules {
+		for _, key := range []string{rule.SourceAuth, rule.TargetAuth} {
+			if _, ok := securityList[key]; key != "" && !ok {
+				return fmt.Errorf("rule of %s is invalid: %s is not a key of the security file", source, key)
+			}
+		}
+	}
+	return nil
+}
+
+// GetSecurityProfile returns the auth information of a key of the security file for registry,
+// the rules refer to the keys by sourceAuth and targetAuth
+func (c *Configs) GetSecurityProfile(key, registry string) (Security, bool) {
+	c.securityMutex.RLock()
+	defer c.securityMutex.RUnlock()
+
+	security, ok := c.Security[key]
+	if !ok {
+		return Security{}, false
+	}
+	log.Debugf("Use auth information of %s for %s", key, registry)
+	return c.resolveDockerConfigAuth(registry, security)
+}
+
+// warnDuplicateTargets warns the targets of rules from different source repositories, the images of
+// the same tag overwrite each other. The tags of a source repository may be the rules of one target
+func warnDuplicateTargets(rules map[string]*Rule) {
+	sources := make(map[string]map[string]bool)
+	for source, rule := range rules {
+		// a target template is rendered to different targets for its sources
+		if rule.Target == "" || utils.IsTargetTemplate(rule.Target) {
+			continue
+		}
+		repo := source
+		if repoURL, err := utils.NewRepoURL(source); err == nil && !repoURL.IsLocal() {
+			repo = repoURL.GetRegistry() + "/" + repoURL.GetRepoWithNamespace()
+		}
+		if sources[rule.Target] == nil {
+			sources[rule.Target] = make(map[string]bool)
+		}
+		sources[rule.Target][repo] = true
+	}
+
+	for target, repos := range sources {
+		if len(repos) < 2 {
+			continue
+		}
+		repoList := make([]string, 0, len(repos))
+		for repo := range repos {
+			repoList = append(repoList, repo)
+		}
+		sort.Strings(repoList)
+		log.Warnf("%v are all transferred to %s, their images with the same tag will conflict", repoList, target)
+	}
 }
 
 // GetSecurity gets the Security information in Config
@@ -155,24 +770,334 @@ func (c *Configs) GetSecurity() (map[string]Security, error) {
 		return securityList, err
 	}
 
+	rawSecurity := make(map[string]Security, len(securityList))
+	for registry, security := range securityList {
+		var err error
+		rawSecurity[registry] = security
+		if keyAndPattern := strings.SplitN(registry, "/", 2); len(keyAndPattern) == 2 {
+			if _, err := path.Match(keyAndPattern[1], ""); err != nil {
+				return nil, fmt.Errorf("pattern of %s in security file %s is invalid: %v", registry,
+					c.FlagConf.Config.SecurityFile, err)
+			}
+		}
+		if security, err = c.resolveSecurity(registry, security); err != nil {
+			return nil, err
+		}
+		securityList[registry] = security
+	}
 
+	if securityList == nil {
+		securityList = make(map[string]Security)
+	}
+	if err := c.readPasswordStdin(securityList); err != nil {
+		return nil, err
+	}
+
+	c.securityMutex.Lock()
+	c.rawSecurity = rawSecurity
+	c.securityMutex.Unlock()
 	return securityList, nil
 }
 
 
-// GetSecuritySpecific gets the specific authentication information in Config
-func (c *Configs) GetSecuritySpecific(registry string, namespace string) (Security, bool) {
+// GetCCRRepoFilter creates the ccr repository filter from flags and the filter file
+func (c *Configs) GetCCRRepoFilter() (*utils.RepoFilter, error) {
+	include := append([]string{}, c.FlagConf.Config.CCRRepoInclude...)
+	exclude := append([]string{}, c.FlagConf.Config.CCRRepoExclude...)
 
-	// key of each AuthList item can be "registry/namespace" or "registry" only
-	registryAndNamespace := registry + "/" + namespace
+	if len(c.FlagConf.Config.CCRRepoFilterFile) != 0 {
+		var patterns RepoFilterPatterns
+		if err := openAndDecode(c.FlagConf.Config.CCRRepoFilterFile, &patterns); err != nil {
+			log.Errorf("decode repo filter file %v error: %v", c.FlagConf.Config.CCRRepoFilterFile, err)
+			return nil, err
+		}
+		include = append(include, patterns.Include...)
+		exclude = append(exclude, patterns.Exclude...)
+	}
 
-	if moreSpecificAuth, exist := c.Security[registryAndNamespace]; exist {
-		return moreSpecificAuth, exist
+	filter, err := utils.NewRepoFilter(include, exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.FlagConf.Config.CCRRepoFile) != 0 {
+		repoList, err := utils.ReadListFile(c.FlagConf.Config.CCRRepoFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ccr repo file %s error: %v", c.FlagConf.Config.CCRRepoFile, err)
+		}
+		for _, repo := range repoList {
+			if nsAndRepo := strings.SplitN(repo, "/", 2); len(nsAndRepo) != 2 || nsAndRepo[0] == "" ||
+				nsAndRepo[1] == "" {
+				return nil, fmt.Errorf("%s in ccr repo file %s should be namespace/repository",
+					repo, c.FlagConf.Config.CCRRepoFile)
+			}
+		}
+		if len(repoList) == 0 {
+			return nil, fmt.Errorf("ccr repo file %s has no repository", c.FlagConf.Config.CCRRepoFile)
+		}
+		filter.LimitTo(repoList)
+		c.CCRRepoList = repoList
 	}
-	auth, exist := c.Security[registry]
+
+	return filter, nil
+}
+
+// GetNamespaceMapping gets the namespace mapping from the mapping file, the mappings which rename
+// several namespaces to one namespace are reported, their repositories may conflict
+func (c *Configs) GetNamespaceMapping() (map[string]string, error) {
+	mapping := make(map[string]string)
+
+	if len(c.FlagConf.Config.NamespaceMapping) == 0 {
+		return mapping, nil
+	}
+
+	if err := openAndDecode(c.FlagConf.Config.NamespaceMapping, &mapping); err != nil {
+		log.Errorf("decode namespace mapping file %v error: %v", c.FlagConf.Config.NamespaceMapping, err)
+		return nil, err
+	}
+
+	sources := make(map[string][]string)
+	for source, target := range mapping {
+		if target == "" {
+			return nil, fmt.Errorf("target namespace of %s should not be empty in namespace mapping", source)
+		}
+		sources[target] = append(sources[target], source)
+	}
+	for target, sourceList := range sources {
+		if len(sourceList) > 1 {
+			log.Warnf("namespaces %v are all mapped to %s, their repositories with the same name will conflict",
+				sourceList, target)
+		}
+	}
+
+	return mapping, nil
+}
+
+// GetTCRRoutes get the routes of ccr namespaces to tcr instances
+func (c *Configs) GetTCRRoutes() ([]*TCRRoute, error) {
+	var routes []*TCRRoute
+
+	if len(c.FlagConf.Config.TCRRouting) == 0 {
+		return routes, nil
+	}
+
+	if err := openAndDecode(c.FlagConf.Config.TCRRouting, &routes); err != nil {
+		log.Errorf("decode tcr routing file %v error: %v", c.FlagConf.Config.TCRRouting, err)
+		return nil, err
+	}
+
+	for i, route := range routes {
+		if route == nil || route.Namespace == "" || route.TCRName == "" {
+			return nil, fmt.Errorf("route %v of tcr routing should have a namespace and a tcrName", i)
+		}
+		namespaceRegexp, err := regexp.Compile("^(?:" + route.Namespace + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("namespace %s of tcr routing is invalid: %v", route.Namespace, err)
+		}
+		route.namespaceRegexp = namespaceRegexp
+		if route.TCRRegion == "" {
+			route.TCRRegion = c.FlagConf.Config.TCRRegion
+		}
+	}
+
+	return routes, nil
+}
+
+// GetTCRRoute returns the first route which matches a ccr namespace, it is nil if no route matches
+func (c *Configs) GetTCRRoute(ns string) *TCRRoute {
+	for _, route := range c.TCRRoutes {
+		if route.namespaceRegexp.MatchString(ns) {
+			return route
+		}
+	}
+	return nil
+}
+
+// GetSecuritySpecific gets the specific authentication information in Config, repository is
+// the path of a repository like namespace/repo. A key of the security file is a registry, or a registry
+// followed by a glob pattern of the leading path components of repositories, e.g. harbor.example.com/*,
+// harbor.example.com/team-* or harbor.example.com/ns/app. The most specific matched key wins:
+// the key with more path components, then the one without wildcards, then the longer pattern.
+// The registered credential providers, the docker config file and the prompted auth information are
+// used in order for the registries without a matched key.
+func (c *Configs) GetSecuritySpecific(registry string, repository string) (Security, bool) {
+
+	// the auth information of docker hub may be configured with any of its domains
+	registries := []string{registry}
+	if registry == utils.DockerHubRegistry || utils.IsContain(utils.DockerHubAliases, registry) {
+		for _, domain := range append([]string{utils.DockerHubRegistry}, utils.DockerHubAliases...) {
+			if domain != registry {
+				registries = append(registries, domain)
+			}
+		}
+	}
+
+	c.securityMutex.RLock()
+	defer c.securityMutex.RUnlock()
+
+	var bestKey string
+	var best *securityMatch
+	for key := range c.Security {
+		match := matchSecurityKey(key, registries, repository)
+		// equally specific keys are chosen by name for a deterministic result
+		if match != nil && (best == nil || match.moreSpecific(best) ||
+			(!best.moreSpecific(match) && key < bestKey)) {
+			bestKey, best = key, match
+		}
+	}
+	if best != nil {
+		log.Debugf("Use auth information of %s for %s/%s", bestKey, registry, repository)
+		return c.resolveDockerConfigAuth(registry, c.Security[bestKey])
+	}
+
+	// explicit entries take precedence over the credential providers, the docker config file
+	// and the prompted auth information
+	if auth, exist := providerSecurity(registry, repository); exist {
+		return auth, exist
+	}
+	if auth, exist := c.GetDockerConfigAuth(registry); exist {
+		return auth, exist
+	}
+	return getPromptedSecurity(registry)
+}
+
+// securityMatch is the specificity of a key of the security file which matches a repository
+type securityMatch struct {
+	components  int
+	literal     bool
+	length      int
+	exactDomain bool
+}
+
+// moreSpecific checks if the match is more specific than o
+func (m *securityMatch) moreSpecific(o *securityMatch) bool {
+	if m.components != o.components {
+		return m.components > o.components
+	}
+	if m.literal != o.literal {
+		return m.literal
+	}
+	if m.length != o.length {
+		return m.length > o.length
+	}
+	return m.exactDomain && !o.exactDomain
+}
+
+// matchSecurityKey matches a key of the security file against a repository of one of registries,
+// the first registry is the registry of the repository and the others are its aliases,
+// nil is returned if the key does not match
+func matchSecurityKey(key string, registries []string, repository string) *securityMatch {
+	keyAndPattern := strings.SplitN(key, "/", 2)
+	i := 0
+	for ; i < len(registries); i++ {
+		if keyAndPattern[0] == registries[i] {
+			break
+		}
+	}
+	if i == len(registries) {
+		return nil
+	}
+
+	match := &securityMatch{literal: true, exactDomain: i == 0}
+	if len(keyAndPattern) == 1 || keyAndPattern[1] == "" {
+		return match
+	}
+
+	pattern := keyAndPattern[1]
+	components := strings.Split(repository, "/")
+	match.components = len(strings.Split(pattern, "/"))
+	if match.components > len(components) {
+		return nil
+	}
+	if ok, err := path.Match(pattern, strings.Join(components[:match.components], "/")); err != nil || !ok {
+		return nil
+	}
+	match.literal = !strings.ContainsAny(pattern, "*?[")
+	match.length = len(pattern)
+	return match
+}
+
+// resolveDockerConfigAuth returns the auth information of the docker config file for an entry
+// with fromDockerConfig, the insecure of the entry is kept
+func (c *Configs) resolveDockerConfigAuth(registry string, security Security) (Security, bool) {
+	if !security.FromDockerConfig {
+		return security, true
+	}
+
+	auth, exist := c.dockerConfigAuthOf(registry, c.dockerConfigPath(true))
+	auth.Insecure = security.Insecure
 	return auth, exist
 }
 
+// dockerConfigPath returns the docker config file to read, it is dockerConfig if set, or
+// the default config.json of docker if useDockerConfig or force is true, otherwise empty
+func (c *Configs) dockerConfigPath(force bool) string {
+	if c.FlagConf.Config.DockerConfig != "" {
+		return c.FlagConf.Config.DockerConfig
+	}
+	if !c.FlagConf.Config.UseDockerConfig && !force {
+		return ""
+	}
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		log.Warnf("get home directory for docker config error: %v", err)
+		return ""
+	}
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+// GetDefaultSecurity gets the "default" entry of the security file, it is used for the
+// registries without auth information when anonymous pulls are unauthorized
+func (c *Configs) GetDefaultSecurity() (Security, bool) {
+	c.securityMutex.RLock()
+	defer c.securityMutex.RUnlock()
+
+	security, exist := c.Security[DefaultSecurityKey]
+	return security, exist && security.Username != ""
+}
+
+// GetDockerConfigAuth gets the authentication information of a registry from the docker config file,
+// both auth fields and credential helpers in the file are supported
+func (c *Configs) GetDockerConfigAuth(registry string) (Security, bool) {
+	return c.dockerConfigAuthOf(registry, c.dockerConfigPath(false))
+}
+
+// dockerConfigAuthOf gets the authentication information of a registry from a docker config file,
+// a credential helper which fails is warned and the registry is accessed anonymously
+func (c *Configs) dockerConfigAuthOf(registry, path string) (Security, bool) {
+	if path == "" {
+		return Security{}, false
+	}
+
+	c.dockerConfigAuthMutex.Lock()
+	defer c.dockerConfigAuthMutex.Unlock()
+
+	if c.dockerConfigAuth == nil {
+		c.dockerConfigAuth = make(map[string]*Security)
+	}
+	if auth, ok := c.dockerConfigAuth[registry]; ok {
+		return *auth, auth.Username != ""
+	}
+
+	auth := &Security{}
+	username, password, err := dockerconfig.GetAuthentication(&types.SystemContext{
+		AuthFilePath: path,
+	}, registry)
+	if err != nil {
+		log.Warnf("get auth information of %s from docker config %s error: %v", registry, path, err)
+	} else {
+		auth.Username = username
+		auth.Password = password
+		log.AddSecrets(password)
+	}
+	c.dockerConfigAuth[registry] = auth
+
+	return *auth, auth.Username != ""
+}
+
 // GetSecret get secret from secret file
 func (c *Configs) GetSecret() (map[string]Secret, error) {
 	var secret map[string]Secret
@@ -181,29 +1106,137 @@ func (c *Configs) GetSecret() (map[string]Secret, error) {
 		log.Errorf("decode secret file %v error: %v", c.FlagConf.Config.SecretFile, err)
 		return secret, err
 	}
+	for name, s := range secret {
+		var err error
+		var idFromEnv bool
+		if s.SecretID, idFromEnv, err = resolveEnv(s.SecretID, s.SecretIDEnv); err != nil {
+			return nil, fmt.Errorf("secretId of %s in secret file %s is invalid: %v", name,
+				c.FlagConf.Config.SecretFile, err)
+		}
+		if s.SecretKey, _, err = resolveEnv(s.SecretKey, s.SecretKeyEnv); err != nil {
+			return nil, fmt.Errorf("secretKey of %s in secret file %s is invalid: %v", name,
+				c.FlagConf.Config.SecretFile, err)
+		}
+		secret[name] = s
+		log.AddSecrets(s.SecretKey)
+		if idFromEnv {
+			log.AddSecrets(s.SecretID)
+		}
+	}
 
 	return secret, nil
 
 }
 
+// ValidateSecret checks the secrets required by the transfer mode, a "ccr" secret and a "tcr" secret
+// can be used for each other unless crossAccount is true
+func (c *Configs) ValidateSecret(secret map[string]Secret) error {
+	config := c.FlagConf.Config
+
+	var sides []string
+	switch {
+	case config.CCRToTCR, config.TCRToCCR:
+		sides = []string{"ccr", "tcr"}
+	case config.CCRToRegistry:
+		sides = []string{"ccr"}
+	case config.TCRToTCR:
+		sides = []string{"tcr"}
+	case config.SWRToTCR:
+		sides = []string{"swr", "tcr"}
+	}
+
+	for _, side := range sides {
+		s, ok := secret[side]
+		if !ok && !config.CrossAccount {
+			switch side {
+			case "ccr":
+				s, ok = secret["tcr"]
+			case "tcr":
+				s, ok = secret["ccr"]
+			}
+		}
+		if !ok {
+			return fmt.Errorf("no %s secret is provided in secret file %s, Exit", side, config.SecretFile)
+		}
+		if s.SecretID == "" || s.SecretKey == "" {
+			return fmt.Errorf("secretId or secretKey of %s secret is empty in secret file %s, Exit",
+				side, config.SecretFile)
+		}
+	}
+
+	return nil
+}
+
+
+// envReferenceRegexp matches a reference ${NAME} to an environment variable, $${NAME} is the escaped
+// literal ${NAME}. A bare $ like the one of pa$$word is not a reference
+var envReferenceRegexp = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${NAME} in a value with the environment variable, an unset variable is an error.
+// Other $ in the value are kept as they are and $${NAME} is kept as ${NAME}
+func expandEnv(value string) (string, error) {
+	var unset []string
+	expanded := envReferenceRegexp.ReplaceAllStringFunc(value, func(reference string) string {
+		if strings.HasPrefix(reference, "$$") {
+			return reference[1:]
+		}
+		name := envReferenceRegexp.FindStringSubmatch(reference)[1]
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			unset = append(unset, name)
+		}
+		return env
+	})
+	if len(unset) != 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(unset, ", "))
+	}
+	return expanded, nil
+}
+
+// hasEnvReference checks if a value references an environment variable by ${NAME}
+func hasEnvReference(value string) bool {
+	for _, reference := range envReferenceRegexp.FindAllString(value, -1) {
+		if !strings.HasPrefix(reference, "$$") {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveEnv returns the value of the environment variable envName if it is not empty, otherwise
+// value with ${NAME} expanded, whether the result comes from the environment is also returned
+func resolveEnv(value, envName string) (string, bool, error) {
+	if envName == "" {
+		expanded, err := expandEnv(value)
+		return expanded, hasEnvReference(value), err
+	}
+	if value != "" {
+		return "", false, fmt.Errorf("value and environment variable %s should not be both set", envName)
+	}
+	env, ok := os.LookupEnv(envName)
+	if !ok {
+		return "", false, fmt.Errorf("environment variable %s is not set", envName)
+	}
+	return env, true, nil
+}
 
-// Open yaml file and decode into target interface
+// Open yaml file and decode into target interface, the file may be a remote url
 func openAndDecode(filePath string, target interface{}) error {
-	if !strings.HasSuffix(filePath, ".yaml") {
+	if !strings.HasSuffix(configPathName(filePath), ".yaml") {
 		return fmt.Errorf("only support yaml format file")
 	}
 
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+	if _, err := os.Stat(filePath); !isRemoteConfig(filePath) && os.IsNotExist(err) {
 		return fmt.Errorf("file %v not exist: %v", filePath, err)
 	}
 
-	file, err := os.OpenFile(filePath, os.O_RDONLY, 0666)
+	data, err := configFetcher.read(filePath)
 	if err != nil {
-		return fmt.Errorf("open file %v error: %v", filePath, err)
+		return err
 	}
 
 
-	decoder := yaml.NewDecoder(file)
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
 	if err := decoder.Decode(target); err != nil {
 		return fmt.Errorf("unmarshal config error: %v", err)
 	}
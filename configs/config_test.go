@@ -0,0 +1,274 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package configs
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+
+	"tkestack.io/image-transfer/pkg/image-transfer/options"
+)
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("IMAGE_TRANSFER_TEST_PASSWORD", "from-env")
+	defer os.Unsetenv("IMAGE_TRANSFER_TEST_PASSWORD")
+	os.Unsetenv("IMAGE_TRANSFER_TEST_UNSET")
+
+	cases := []struct {
+		value    string
+		expected string
+		fromEnv  bool
+	}{
+		{value: "password", expected: "password"},
+		{value: "pa$$word", expected: "pa$$word"},
+		{value: "Abc$123", expected: "Abc$123"},
+		{value: "s3cr3t$x", expected: "s3cr3t$x"},
+		{value: "$", expected: "$"},
+		{value: "$IMAGE_TRANSFER_TEST_PASSWORD", expected: "$IMAGE_TRANSFER_TEST_PASSWORD"},
+		{value: "${IMAGE_TRANSFER_TEST_PASSWORD}", expected: "from-env", fromEnv: true},
+		{value: "x-${IMAGE_TRANSFER_TEST_PASSWORD}-$$", expected: "x-from-env-$$", fromEnv: true},
+		{value: "$${IMAGE_TRANSFER_TEST_UNSET}", expected: "${IMAGE_TRANSFER_TEST_UNSET}"},
+		{value: "${1abc}", expected: "${1abc}"},
+	}
+	for _, c := range cases {
+		expanded, fromEnv, err := resolveEnv(c.value, "")
+		if err != nil {
+			t.Errorf("resolveEnv(%q) error: %v", c.value, err)
+			continue
+		}
+		if expanded != c.expected || fromEnv != c.fromEnv {
+			t.Errorf("resolveEnv(%q) = %q, %v, expected %q, %v", c.value, expanded, fromEnv, c.expected, c.fromEnv)
+		}
+	}
+}
+
+func TestExpandEnvUnset(t *testing.T) {
+	os.Unsetenv("IMAGE_TRANSFER_TEST_UNSET")
+	_, err := expandEnv("pa$$word-${IMAGE_TRANSFER_TEST_UNSET}")
+	if err == nil || !strings.Contains(err.Error(), "IMAGE_TRANSFER_TEST_UNSET") {
+		t.Errorf("expandEnv of an unset variable should fail with its name, got %v", err)
+	}
+}
+
+func TestResolveEnvName(t *testing.T) {
+	os.Setenv("IMAGE_TRANSFER_TEST_PASSWORD", "pa$$word")
+	defer os.Unsetenv("IMAGE_TRANSFER_TEST_PASSWORD")
+
+	value, fromEnv, err := resolveEnv("", "IMAGE_TRANSFER_TEST_PASSWORD")
+	if err != nil || value != "pa$$word" || !fromEnv {
+		t.Errorf("resolveEnv of passwordEnv = %q, %v, %v, expected pa$$word from env", value, fromEnv, err)
+	}
+	if _, _, err := resolveEnv("password", "IMAGE_TRANSFER_TEST_PASSWORD"); err == nil {
+		t.Errorf("resolveEnv with both value and env name should fail")
+	}
+	if _, _, err := resolveEnv("", "IMAGE_TRANSFER_TEST_UNSET"); err == nil {
+		t.Errorf("resolveEnv of an unset env name should fail")
+	}
+}
+
+// newSecurityConfigs returns a Configs whose security file has the entries of keys, the username
+// of an entry is its key
+func newSecurityConfigs(keys ...string) *Configs {
+	c := &Configs{FlagConf: options.NewClientOptions(), Security: map[string]Security{}}
+	for _, key := range keys {
+		c.Security[key] = Security{Username: key, Password: "password"}
+	}
+	return c
+}
+
+func TestGetSecuritySpecificDockerHub(t *testing.T) {
+	cases := []struct {
+		key      string
+		registry string
+	}{
+		{key: "docker.io", registry: "docker.io"},
+		{key: "index.docker.io", registry: "docker.io"},
+		{key: "registry-1.docker.io", registry: "docker.io"},
+		{key: "docker.io", registry: "index.docker.io"},
+		{key: "registry.hub.docker.com/library/*", registry: "docker.io"},
+	}
+	for _, tc := range cases {
+		security, exist := newSecurityConfigs(tc.key).GetSecuritySpecific(tc.registry, "library/nginx")
+		if !exist || security.Username != tc.key {
+			t.Errorf("auth of %s/library/nginx with key %s = %q, %v", tc.registry, tc.key, security.Username, exist)
+		}
+	}
+
+	// the key of the registry itself wins over its aliases
+	c := newSecurityConfigs("index.docker.io", "docker.io")
+	if security, _ := c.GetSecuritySpecific("docker.io", "library/nginx"); security.Username != "docker.io" {
+		t.Errorf("auth of docker.io/library/nginx = %q, expected docker.io", security.Username)
+	}
+	if _, exist := newSecurityConfigs("docker.io").GetSecuritySpecific("quay.io", "library/nginx"); exist {
+		t.Errorf("auth of docker.io should not be used for quay.io")
+	}
+}
+
+func TestGetSecuritySpecificPrecedence(t *testing.T) {
+	c := newSecurityConfigs(
+		"harbor.example.com",
+		"harbor.example.com/*",
+		"harbor.example.com/team-*",
+		"harbor.example.com/team-a*",
+		"harbor.example.com/team-a",
+		"harbor.example.com/team-a/robot-app",
+		"harbor.example.com/team-?/app-*",
+		"harbor.example.com/ops/*/deploy",
+	)
+	cases := []struct {
+		repository string
+		key        string
+	}{
+		// a repository override wins over its namespace
+		{repository: "team-a/robot-app", key: "harbor.example.com/team-a/robot-app"},
+		// the exact namespace wins over the globs of the same components
+		{repository: "team-a/web", key: "harbor.example.com/team-a"},
+		// a glob of two components wins over the namespace
+		{repository: "team-a/app-web", key: "harbor.example.com/team-?/app-*"},
+		// the longest glob wins
+		{repository: "team-ab/web", key: "harbor.example.com/team-a*"},
+		{repository: "team-b/web", key: "harbor.example.com/team-*"},
+		{repository: "other/web", key: "harbor.example.com/*"},
+		{repository: "ops/prod/deploy", key: "harbor.example.com/ops/*/deploy"},
+		{repository: "ops/prod/build", key: "harbor.example.com/*"},
+		// a pattern with more components than the repository does not match it
+		{repository: "web", key: "harbor.example.com/*"},
+	}
+	for _, tc := range cases {
+		// the result does not depend on the order the map is iterated
+		for i := 0; i < 10; i++ {
+			security, exist := c.GetSecuritySpecific("harbor.example.com", tc.repository)
+			if !exist || security.Username != tc.key {
+				t.Errorf("auth of %s = %q, %v, expected %s", tc.repository, security.Username, exist, tc.key)
+				break
+			}
+		}
+	}
+
+	// the registry key is used when no pattern matches
+	c = newSecurityConfigs("harbor.example.com", "harbor.example.com/team-*")
+	if security, _ := c.GetSecuritySpecific("harbor.example.com", "ops/app"); security.Username !=
+		"harbor.example.com" {
+		t.Errorf("auth of ops/app = %q, expected harbor.example.com", security.Username)
+	}
+	if _, exist := newSecurityConfigs("harbor.example.com/team-*").GetSecuritySpecific("harbor.example.com",
+		"ops/app"); exist {
+		t.Errorf("auth of ops/app should not be found by harbor.example.com/team-*")
+	}
+}
+
+func TestGetSecuritySpecificTieBreak(t *testing.T) {
+	// equally specific keys are chosen by name
+	c := newSecurityConfigs("harbor.example.com/team-?", "harbor.example.com/team-*", "harbor.example.com/t?am-a")
+	for i := 0; i < 10; i++ {
+		if security, _ := c.GetSecuritySpecific("harbor.example.com", "team-a/app"); security.Username !=
+			"harbor.example.com/t?am-a" {
+			t.Fatalf("auth of team-a/app = %q, expected harbor.example.com/t?am-a", security.Username)
+		}
+		if security, _ := c.GetSecuritySpecific("harbor.example.com", "team-b/app"); security.Username !=
+			"harbor.example.com/team-*" {
+			t.Fatalf("auth of team-b/app = %q, expected harbor.example.com/team-*", security.Username)
+		}
+	}
+}
+
+func TestMatchSecurityKey(t *testing.T) {
+	registries := []string{"harbor.example.com"}
+	cases := []struct {
+		key        string
+		repository string
+		match      *securityMatch
+	}{
+		{key: "harbor.example.com", repository: "ns/app", match: &securityMatch{literal: true, exactDomain: true}},
+		{key: "harbor.example.com/", repository: "ns/app", match: &securityMatch{literal: true, exactDomain: true}},
+		{key: "harbor.example.com/ns", repository: "ns/app",
+			match: &securityMatch{components: 1, literal: true, length: 2, exactDomain: true}},
+		{key: "harbor.example.com/n*", repository: "ns/app",
+			match: &securityMatch{components: 1, length: 2, exactDomain: true}},
+		{key: "harbor.example.com/ns/app", repository: "ns/app",
+			match: &securityMatch{components: 2, literal: true, length: 6, exactDomain: true}},
+		{key: "harbor.example.com/ns/app/x", repository: "ns/app"},
+		{key: "harbor.example.com/other", repository: "ns/app"},
+		{key: "harbor.example.com/[", repository: "ns/app"},
+		{key: "quay.io", repository: "ns/app"},
+	}
+	for _, tc := range cases {
+		if match := matchSecurityKey(tc.key, registries, tc.repository); !reflect.DeepEqual(match, tc.match) {
+			t.Errorf("matchSecurityKey(%s, %s) = %+v, expected %+v", tc.key, tc.repository, match, tc.match)
+		}
+	}
+}
+
+func TestRuleUnmarshalYAML(t *testing.T) {
+	cases := []struct {
+		value string
+		rule  Rule
+	}{
+		{value: `reg.example.com/ns/app`, rule: Rule{Target: "reg.example.com/ns/app"}},
+		{value: `{"1.0": stable, "1.1": next}`, rule: Rule{TagMapping: map[string]string{"1.0": "stable", "1.1": "next"}}},
+		// the tags named like keys of Rule
+		{value: `{target: stable, "1.1": next}`, rule: Rule{TagMapping: map[string]string{"target": "stable",
+			"1.1": "next"}}},
+		{value: `{tags: stable}`, rule: Rule{TagMapping: map[string]string{"tags": "stable"}}},
+		{value: `{tags: stable, platforms: next}`, rule: Rule{TagMapping: map[string]string{"tags": "stable",
+			"platforms": "next"}}},
+		{value: `{tagMapping: {target: stable}}`, rule: Rule{TagMapping: map[string]string{"target": "stable"}}},
+		// the maps of string fields of Rule
+		{value: `{target: reg.example.com/ns/app}`, rule: Rule{Target: "reg.example.com/ns/app"}},
+		{value: `{target: reg.example.com/ns/app, semver: ">=1.0", ifExists: skip}`,
+			rule: Rule{Target: "reg.example.com/ns/app", Semver: ">=1.0", IfExists: "skip"}},
+		{value: `{target: reg.example.com/ns/app, tags: [v1, v2]}`,
+			rule: Rule{Target: "reg.example.com/ns/app", Tags: []string{"v1", "v2"}}},
+		{value: `{target: reg.example.com/ns/app, tagMapping: {"1.0": stable}}`,
+			rule: Rule{Target: "reg.example.com/ns/app", TagMapping: map[string]string{"1.0": "stable"}}},
+	}
+	for _, tc := range cases {
+		var rules ruleDocument
+		if err := yaml.Unmarshal([]byte("reg.example.com/src/app: "+tc.value), &rules); err != nil {
+			t.Errorf("unmarshal %s error: %v", tc.value, err)
+			continue
+		}
+		if rule := rules["reg.example.com/src/app"]; rule == nil || !reflect.DeepEqual(*rule, tc.rule) {
+			t.Errorf("unmarshal %s = %+v, expected %+v", tc.value, rule, tc.rule)
+		}
+	}
+}
+
+func TestValidateTagMapping(t *testing.T) {
+	cases := []struct {
+		rule  Rule
+		valid bool
+	}{
+		{rule: Rule{TagMapping: map[string]string{"1.0": "stable", "1.1": "next"}}, valid: true},
+		{rule: Rule{TagMapping: map[string]string{"target": "stable", "tags": "target"}}, valid: true},
+		{rule: Rule{TagMapping: map[string]string{"1.0": "stable", "1.1": "stable"}}},
+		{rule: Rule{TagMapping: map[string]string{"1.0": "stable"}, Tags: []string{"1.0"}}},
+		{rule: Rule{TagMapping: map[string]string{"1.0": "-stable"}}},
+		{rule: Rule{TagMapping: map[string]string{"1.0": ""}}},
+	}
+	for _, tc := range cases {
+		if err := validateTagMapping(&tc.rule); (err == nil) != tc.valid {
+			t.Errorf("validateTagMapping(%+v) = %v, expected valid %v", tc.rule, err, tc.valid)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package configs
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+// CredentialProvider resolves the auth information of the registries matched by its host pattern, e.g. the
+// token of a cloud registry. A token is sent as a bearer token, username and password are ignored with it.
+// Resolve is called again when the auth information is rejected, a provider caches short-lived tokens itself
+type CredentialProvider interface {
+	Resolve(host, namespace string) (username, password, token string, insecure bool, err error)
+}
+
+var (
+	credentialProvidersMutex sync.RWMutex
+	// credentialProviders are the providers keyed by host pattern
+	credentialProviders = make(map[string]CredentialProvider)
+)
+
+// RegisterCredentialProvider registers the provider of the registries matched by a host pattern, the pattern
+// is a registry or a glob pattern like *.dkr.ecr.*.amazonaws.com. The entries of the security file take
+// precedence over the providers, and the providers take precedence over the docker config file
+func RegisterCredentialProvider(hostPattern string, provider CredentialProvider) error {
+	if _, err := path.Match(hostPattern, ""); err != nil {
+		return fmt.Errorf("host pattern %s of credential provider is invalid: %v", hostPattern, err)
+	}
+
+	credentialProvidersMutex.Lock()
+	defer credentialProvidersMutex.Unlock()
+	credentialProviders[hostPattern] = provider
+	return nil
+}
+
+// credentialProviderOf returns the provider of a registry, a registry is preferred to a glob pattern and
+// a longer pattern is preferred to a shorter one, equally specific patterns are chosen by name
+func credentialProviderOf(registry string) (string, CredentialProvider, bool) {
+	credentialProvidersMutex.RLock()
+	defer credentialProvidersMutex.RUnlock()
+
+	if provider, ok := credentialProviders[registry]; ok {
+		return registry, provider, true
+	}
+
+	var bestPattern string
+	for pattern := range credentialProviders {
+		if matched, _ := path.Match(pattern, registry); !matched {
+			continue
+		}
+		if bestPattern == "" || len(pattern) > len(bestPattern) ||
+			(len(pattern) == len(bestPattern) && pattern < bestPattern) {
+			bestPattern = pattern
+		}
+	}
+	if bestPattern == "" {
+		return "", nil, false
+	}
+	return bestPattern, credentialProviders[bestPattern], true
+}
+
+// providerSecurity gets the auth information of a registry repository from the registered credential
+// provider, a provider which fails is warned and the next source of auth information is used
+func providerSecurity(registry, repository string) (Security, bool) {
+	pattern, provider, ok := credentialProviderOf(registry)
+	if !ok {
+		return Security{}, false
+	}
+
+	namespace := strings.SplitN(repository, "/", 2)[0]
+	username, password, token, insecure, err := provider.Resolve(registry, namespace)
+	if err != nil {
+		log.Warnf("Resolve auth information of %s/%s by the credential provider of %s error: %v",
+			registry, namespace, pattern, err)
+		return Security{}, false
+	}
+
+	security := Security{
+		Username: username,
+		Password: password,
+		Insecure: insecure,
+	}
+	if token != "" {
+		security.Username, security.Password = utils.BearerTokenUsername, token
+	}
+	if security.Password == "" {
+		return Security{}, false
+	}
+	log.AddSecrets(security.Password)
+	log.Debugf("Use auth information of the credential provider of %s for %s/%s", pattern, registry, repository)
+	return security, true
+}
@@ -0,0 +1,156 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package configs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+var (
+	// promptMutex serializes the prompts of the generating workers, a registry is prompted only once
+	promptMutex sync.Mutex
+	// promptedAuth holds the prompted auth information in memory for the run, keyed by registry
+	promptedAuth = make(map[string]Security)
+	// stdinReader reads stdin for both passwordStdin and prompts
+	stdinReader = bufio.NewReader(os.Stdin)
+)
+
+// readPasswordStdin reads the password of the registry given by passwordStdin from stdin, the username
+// is stdinUsername or the username of the registry in the security file
+func (c *Configs) readPasswordStdin(securityList map[string]Security) error {
+	registry := c.FlagConf.Config.PasswordStdin
+	if registry == "" {
+		return nil
+	}
+
+	security := securityList[registry]
+	if c.FlagConf.Config.StdinUsername != "" {
+		security.Username = c.FlagConf.Config.StdinUsername
+	}
+	if security.Username == "" {
+		return fmt.Errorf("username of %s should be given by stdinUsername or the security file "+
+			"when the password is read from stdin", registry)
+	}
+
+	password, err := readLine(stdinReader)
+	if err != nil {
+		return fmt.Errorf("read password of %s from stdin error: %v", registry, err)
+	}
+	if password == "" {
+		return fmt.Errorf("password of %s read from stdin is empty", registry)
+	}
+	security.Password = password
+	log.AddSecrets(password)
+
+	securityList[registry] = security
+	return nil
+}
+
+// PromptSecurity asks the username and password of a registry on the terminal if promptCredentials
+// is true, the answer is kept in memory and used for the registry during the run. It fails fast
+// if stdin is not a terminal.
+func (c *Configs) PromptSecurity(registry string) (Security, bool, error) {
+	if !c.FlagConf.Config.PromptCredentials {
+		return Security{}, false, nil
+	}
+
+	promptMutex.Lock()
+	defer promptMutex.Unlock()
+
+	if security, ok := promptedAuth[registry]; ok {
+		return security, security.Username != "", nil
+	}
+
+	if !isTerminal(os.Stdin) {
+		return Security{}, false, fmt.Errorf("%s needs auth information but stdin is not a terminal to prompt, "+
+			"configure it in the security file or use passwordStdin", registry)
+	}
+
+	fmt.Fprintf(os.Stderr, "Username for %s(empty to access anonymously): ", registry)
+	username, err := readLine(stdinReader)
+	if err != nil {
+		return Security{}, false, fmt.Errorf("read username of %s error: %v", registry, err)
+	}
+
+	security := Security{Username: username}
+	if username != "" {
+		fmt.Fprintf(os.Stderr, "Password for %s@%s: ", username, registry)
+		if security.Password, err = readPassword(); err != nil {
+			return Security{}, false, fmt.Errorf("read password of %s error: %v", registry, err)
+		}
+		log.AddSecrets(security.Password)
+	}
+
+	// an empty username is also kept so that the registry is not prompted again
+	promptedAuth[registry] = security
+	return security, username != "", nil
+}
+
+// getPromptedSecurity returns the prompted auth information of a registry
+func getPromptedSecurity(registry string) (Security, bool) {
+	promptMutex.Lock()
+	defer promptMutex.Unlock()
+
+	security, ok := promptedAuth[registry]
+	return security, ok && security.Username != ""
+}
+
+// isTerminal checks if a file is a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// readPassword reads a line from the terminal with echo disabled by stty, the line is
+// echoed if stty is not available
+func readPassword() (string, error) {
+	if err := stty("-echo"); err != nil {
+		log.Warnf("disable echo of the terminal error, the password will be echoed: %v", err)
+	} else {
+		defer func() {
+			_ = stty("echo")
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+	return readLine(stdinReader)
+}
+
+// stty changes the settings of the terminal on stdin
+func stty(args ...string) error {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
+
+// readLine reads a line without the line break, the last line may have no line break
+func readLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
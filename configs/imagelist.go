@@ -0,0 +1,97 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package configs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+// stdinImageList is the path of imageList which reads the image list from stdin
+const stdinImageList = "-"
+
+// readImageList reads a plain image list from a file, a remote url or stdin, every line is "source" or "source target" separated by
+// whitespaces. The blank lines and the lines starting with # are skipped
+func readImageList(path string) (map[string]*Rule, error) {
+	var data []byte
+	var err error
+	if path == stdinImageList {
+		if data, err = ioutil.ReadAll(stdinReader); err == nil {
+			err = configFetcher.verify(path, data)
+		}
+	} else {
+		data, err = configFetcher.read(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read image list %s error: %v", imageListName(path), err)
+	}
+	return parseImageList(imageListName(path), bytes.NewReader(data))
+}
+
+// parseImageList parses the lines of a plain image list, the errors report the line number
+func parseImageList(name string, reader io.Reader) (map[string]*Rule, error) {
+	rules := make(map[string]*Rule)
+	scanner := bufio.NewScanner(reader)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("line %v of image list %s should be \"source [target]\", got %q",
+				number, name, line)
+		}
+		for _, url := range fields {
+			if _, _, ok := utils.SplitWildcardRepo(url); ok {
+				continue
+			}
+			if _, err := utils.NewRepoURL(url); err != nil {
+				return nil, fmt.Errorf("line %v of image list %s is invalid: %v", number, name, err)
+			}
+		}
+		rule := &Rule{}
+		if len(fields) == 2 {
+			rule.Target = fields[1]
+		}
+		if _, ok := rules[fields[0]]; ok {
+			return nil, fmt.Errorf("line %v of image list %s is invalid: %s is listed more than once",
+				number, name, fields[0])
+		}
+		rules[fields[0]] = rule
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read image list %s error: %v", name, err)
+	}
+	return rules, nil
+}
+
+// imageListName returns the name of an image list in messages
+func imageListName(path string) string {
+	if path == stdinImageList {
+		return "stdin"
+	}
+	return path
+}
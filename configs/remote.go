@@ -0,0 +1,315 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package configs
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"tkestack.io/image-transfer/pkg/image-transfer/options"
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+const (
+	// emptyPayloadHash is the sha256 of the empty body of a GET request
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	// defaultS3Region is the region of s3 urls if neither AWS_REGION nor AWS_DEFAULT_REGION is set
+	defaultS3Region = "us-east-1"
+)
+
+// configFetcher reads the config files which may be remote urls, it is set by InitConfigs
+var configFetcher = &remoteConfigFetcher{}
+
+// remoteConfigFetcher reads the local config files and fetches the http(s)://, s3:// and cos:// config
+// files. The fetched files are kept in memory, they are written to cacheDir only if it is set
+type remoteConfigFetcher struct {
+	httpClient *http.Client
+	// headers are sent to the http(s) urls, the values are expanded with the environment variables
+	headers map[string]string
+	// checksums are the expected sha256 of the config files keyed by path
+	checksums map[string]string
+	cacheDir  string
+}
+
+// newRemoteConfigFetcher creates the fetcher of the config files by the options
+func newRemoteConfigFetcher(config *options.ConfigOptions) (*remoteConfigFetcher, error) {
+	fetcher := &remoteConfigFetcher{
+		httpClient: &http.Client{Timeout: config.RemoteConfigTimeout},
+		headers:    make(map[string]string),
+		checksums:  make(map[string]string),
+		cacheDir:   config.CacheConfigDir,
+	}
+	for _, header := range config.RemoteConfigHeader {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("remoteConfigHeader %q should be \"Name: value\"", header)
+		}
+		value, err := expandEnv(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("remoteConfigHeader %s error: %v", strings.TrimSpace(parts[0]), err)
+		}
+		log.AddSecrets(value)
+		fetcher.headers[strings.TrimSpace(parts[0])] = value
+	}
+	// the checksum is for the only rule file or image list
+	if config.ImageListSha256 != "" {
+		for _, ruleFile := range append(append([]string{}, config.RuleFile...), config.ImageListFile...) {
+			fetcher.checksums[ruleFile] = strings.ToLower(config.ImageListSha256)
+		}
+	}
+	return fetcher, nil
+}
+
+// isRemoteConfig checks if a config path is a http(s)://, s3:// or cos:// url
+func isRemoteConfig(path string) bool {
+	for _, scheme := range []string{"http://", "https://", "s3://", "cos://"} {
+		if strings.HasPrefix(path, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// configPathName returns the file path of a config path, the path of a url without the query
+func configPathName(configPath string) string {
+	if !isRemoteConfig(configPath) {
+		return configPath
+	}
+	if u, err := url.Parse(configPath); err == nil {
+		return u.Path
+	}
+	return configPath
+}
+
+// read reads a local config file or fetches a remote one, its sha256 is verified if a checksum is given
+func (f *remoteConfigFetcher) read(configPath string) ([]byte, error) {
+	var data []byte
+	var err error
+	if isRemoteConfig(configPath) {
+		if data, err = f.fetch(configPath); err != nil {
+			return nil, fmt.Errorf("fetch %s error: %v", configPath, err)
+		}
+	} else if data, err = ioutil.ReadFile(configPath); err != nil {
+		return nil, fmt.Errorf("read file %v error: %v", configPath, err)
+	}
+
+	if err := f.verify(configPath, data); err != nil {
+		return nil, err
+	}
+
+	if isRemoteConfig(configPath) && f.cacheDir != "" {
+		if err := f.cache(configPath, data); err != nil {
+			log.Warnf("Cache %s to %s error: %v", configPath, f.cacheDir, err)
+		}
+	}
+	return data, nil
+}
+
+// verify checks the sha256 of a config file if its checksum is given
+func (f *remoteConfigFetcher) verify(configPath string, data []byte) error {
+	expected, ok := f.checksums[configPath]
+	if !ok {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	if actual := hex.EncodeToString(sum[:]); actual != expected {
+		return fmt.Errorf("sha256 of %s is %s, expected %s", configPath, actual, expected)
+	}
+	return nil
+}
+
+// fetch gets a remote config file, the s3 and cos urls are signed with the credentials in the environment
+func (f *remoteConfigFetcher) fetch(configURL string) ([]byte, error) {
+	u, err := url.Parse(configURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var req *http.Request
+	switch u.Scheme {
+	case "s3":
+		req, err = newS3Request(u.Host, strings.TrimPrefix(u.Path, "/"))
+	case "cos":
+		req, err = newCOSRequest(u.Host, strings.TrimPrefix(u.Path, "/"))
+	default:
+		if req, err = http.NewRequest(http.MethodGet, configURL, nil); err == nil {
+			for name, value := range f.headers {
+				req.Header.Set(name, value)
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := f.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// cache writes a fetched config file to cacheDir, the file name is unique for the url
+func (f *remoteConfigFetcher) cache(configURL string, data []byte) error {
+	if err := os.MkdirAll(f.cacheDir, 0700); err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(configURL))
+	name := hex.EncodeToString(sum[:])[:16] + "-" + path.Base(configPathName(configURL))
+	return ioutil.WriteFile(filepath.Join(f.cacheDir, name), data, 0600)
+}
+
+// newS3Request creates a GET request of an s3 object signed by AWS signature version 4, the bucket
+// is a bucket name or a host of the virtual-hosted style. AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+// and AWS_SESSION_TOKEN are used, the request is anonymous without them
+func newS3Request(bucket, key string) (*http.Request, error) {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = defaultS3Region
+	}
+	host := bucket
+	if !strings.Contains(bucket, ".") {
+		host = bucket + ".s3." + region + ".amazonaws.com"
+	}
+	req, err := http.NewRequest(http.MethodGet, "https://"+host+"/"+uriEncodePath(key), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return req, nil
+	}
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	headers := [][2]string{{"host", host}, {"x-amz-content-sha256", emptyPayloadHash}, {"x-amz-date", amzDate}}
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		headers = append(headers, [2]string{"x-amz-security-token", token})
+	}
+	var canonicalHeaders, signedHeaders []string
+	for _, header := range headers {
+		if header[0] != "host" {
+			req.Header.Set(header[0], header[1])
+		}
+		canonicalHeaders = append(canonicalHeaders, header[0]+":"+header[1]+"\n")
+		signedHeaders = append(signedHeaders, header[0])
+	}
+
+	canonicalRequest := strings.Join([]string{http.MethodGet, "/" + uriEncodePath(key), "",
+		strings.Join(canonicalHeaders, ""), strings.Join(signedHeaders, ";"), emptyPayloadHash}, "\n")
+	scope := amzDate[:8] + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+secretKey), amzDate[:8])
+	for _, part := range []string{region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, strings.Join(signedHeaders, ";"), hex.EncodeToString(hmacSHA256(signingKey, stringToSign))))
+	return req, nil
+}
+
+// newCOSRequest creates a GET request of a cos object signed by the cos signature, the bucket is
+// bucketname-appid with the region in COS_REGION, or the host of the bucket. TENCENTCLOUD_SECRET_ID,
+// TENCENTCLOUD_SECRET_KEY and TENCENTCLOUD_SESSION_TOKEN are used, the request is anonymous without them
+func newCOSRequest(bucket, key string) (*http.Request, error) {
+	host := bucket
+	if !strings.Contains(bucket, ".") {
+		region := os.Getenv("COS_REGION")
+		if region == "" {
+			return nil, fmt.Errorf("COS_REGION should be set for the bucket %s", bucket)
+		}
+		host = bucket + ".cos." + region + ".myqcloud.com"
+	}
+	req, err := http.NewRequest(http.MethodGet, "https://"+host+"/"+uriEncodePath(key), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	secretID, secretKey := os.Getenv("TENCENTCLOUD_SECRET_ID"), os.Getenv("TENCENTCLOUD_SECRET_KEY")
+	if secretID == "" || secretKey == "" {
+		return req, nil
+	}
+	if token := os.Getenv("TENCENTCLOUD_SESSION_TOKEN"); token != "" {
+		req.Header.Set("x-cos-security-token", token)
+	}
+	now := time.Now().Unix()
+	keyTime := strconv.FormatInt(now-60, 10) + ";" + strconv.FormatInt(now+3600, 10)
+	httpString := "get\n/" + key + "\n\nhost=" + url.QueryEscape(host) + "\n"
+	httpStringHash := sha1.Sum([]byte(httpString))
+	stringToSign := "sha1\n" + keyTime + "\n" + hex.EncodeToString(httpStringHash[:]) + "\n"
+	signKey := hex.EncodeToString(hmacSHA1([]byte(secretKey), keyTime))
+	req.Header.Set("Authorization", fmt.Sprintf("q-sign-algorithm=sha1&q-ak=%s&q-sign-time=%s&q-key-time=%s"+
+		"&q-header-list=host&q-url-param-list=&q-signature=%s", secretID, keyTime, keyTime,
+		hex.EncodeToString(hmacSHA1([]byte(signKey), stringToSign))))
+	return req, nil
+}
+
+// uriEncodePath encodes a path by RFC 3986, the slashes are kept
+func uriEncodePath(value string) string {
+	var encoded strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', b == '/':
+			encoded.WriteByte(b)
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// hmacSHA1 returns the HMAC-SHA1 of data
+func hmacSHA1(key []byte, data string) []byte {
+	h := hmac.New(sha1.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
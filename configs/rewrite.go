@@ -0,0 +1,79 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package configs
+
+import (
+	"fmt"
+	"regexp"
+
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+// RewriteRule rewrites a source reference to a target by a regular expression
+type RewriteRule struct {
+	// Match is a regular expression which matches the whole source reference, e.g. docker.io/library/nginx:1.21
+	Match string `json:"match" yaml:"match"`
+	// Replace is the target, $1 or ${name} are replaced by the submatches of Match
+	Replace string `json:"replace" yaml:"replace"`
+
+	matchRegexp *regexp.Regexp
+}
+
+// rewriteRulesFile is the yaml file of the flag rewriteRules
+type rewriteRulesFile struct {
+	RewriteRules []*RewriteRule `json:"rewrite_rules" yaml:"rewrite_rules"`
+}
+
+// GetRewriteRules gets the ordered rewrite rules of the sources whose targets are empty
+func (c *Configs) GetRewriteRules() ([]*RewriteRule, error) {
+	var file rewriteRulesFile
+
+	if len(c.FlagConf.Config.RewriteRules) == 0 {
+		return file.RewriteRules, nil
+	}
+
+	if err := openAndDecode(c.FlagConf.Config.RewriteRules, &file); err != nil {
+		log.Errorf("decode rewrite rules file %v error: %v", c.FlagConf.Config.RewriteRules, err)
+		return nil, err
+	}
+
+	for i, rule := range file.RewriteRules {
+		if rule == nil || rule.Match == "" || rule.Replace == "" {
+			return nil, fmt.Errorf("rewrite rule %v should have a match and a replace", i)
+		}
+		matchRegexp, err := regexp.Compile("^(?:" + rule.Match + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("match %s of rewrite rule %v is invalid: %v", rule.Match, i, err)
+		}
+		rule.matchRegexp = matchRegexp
+	}
+
+	return file.RewriteRules, nil
+}
+
+// RewriteTarget rewrites a source reference by the first rewrite rule which matches it, the matched
+// rule is nil if no rule matches
+func (c *Configs) RewriteTarget(source string) (string, *RewriteRule) {
+	for _, rule := range c.RewriteRules {
+		if rule.matchRegexp.MatchString(source) {
+			return rule.matchRegexp.ReplaceAllString(source, rule.Replace), rule
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,296 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package configs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+const (
+	// SecretSourcePlain reads username and password from the security file, ${var} in them is expanded
+	SecretSourcePlain = "plain"
+	// SecretSourceEnv reads username and password from the environment variables of usernameEnv and passwordEnv
+	SecretSourceEnv = "env"
+	// SecretSourceVault reads username and password from the KV v2 engine of vault
+	SecretSourceVault = "vault"
+	// SecretSourceSSM reads username and password from tencent cloud secrets manager
+	SecretSourceSSM = "ssm"
+
+	vaultTimeout = 30 * time.Second
+)
+
+// SecretProvider resolves the username and password of an entry of the security file
+// from a secret backend, it is queried again when the credential may have rotated
+type SecretProvider interface {
+	Resolve(c *Configs, entry string, security Security) (username, password string, err error)
+}
+
+var (
+	secretProvidersMutex sync.RWMutex
+	// secretProviders are the providers keyed by the source of entries
+	secretProviders = map[string]SecretProvider{
+		SecretSourcePlain: plainSecretProvider{},
+		SecretSourceEnv:   envSecretProvider{},
+		SecretSourceVault: vaultSecretProvider{},
+	}
+)
+
+// RegisterSecretProvider registers the provider of a source, the provider which needs the
+// tencent cloud api like ssm is registered by the client to avoid an import cycle
+func RegisterSecretProvider(source string, provider SecretProvider) {
+	secretProvidersMutex.Lock()
+	defer secretProvidersMutex.Unlock()
+	secretProviders[source] = provider
+}
+
+// sourceName returns the source of the auth information, plain by default
+func (s Security) sourceName() string {
+	if s.Source == "" {
+		if s.UsernameEnv != "" || s.PasswordEnv != "" {
+			return SecretSourceEnv
+		}
+		return SecretSourcePlain
+	}
+	return s.Source
+}
+
+// resolveSecurity fills the username and password of an entry of the security file by its provider
+func (c *Configs) resolveSecurity(entry string, security Security) (Security, error) {
+	if security.Token != "" {
+		if security.Username != "" || security.Password != "" || security.UsernameEnv != "" ||
+			security.PasswordEnv != "" || security.Source != "" || security.FromDockerConfig {
+			return security, fmt.Errorf("token of %s in security file %s can not be set with username, "+
+				"password or other sources of them", entry, c.FlagConf.Config.SecurityFile)
+		}
+		token, err := expandEnv(security.Token)
+		if err != nil {
+			return security, fmt.Errorf("resolve token of %s in security file %s error: %v", entry,
+				c.FlagConf.Config.SecurityFile, err)
+		}
+		security.Username, security.Password = utils.BearerTokenUsername, token
+		// a personal access token of ghcr.io is exchanged for a registry token by basic auth
+		if isGHCREntry(entry) {
+			security.Username = utils.GHCRUsername
+		}
+		security.entry = entry
+		log.AddSecrets(token, security.QuayToken)
+		return security, nil
+	}
+
+	source := security.sourceName()
+	secretProvidersMutex.RLock()
+	provider, ok := secretProviders[source]
+	secretProvidersMutex.RUnlock()
+	if !ok {
+		return security, fmt.Errorf("source %s of %s in security file %s is not supported", source, entry,
+			c.FlagConf.Config.SecurityFile)
+	}
+
+	username, password, err := provider.Resolve(c, entry, security)
+	if err != nil {
+		return security, fmt.Errorf("resolve auth information of %s in security file %s by %s provider error: %v",
+			entry, c.FlagConf.Config.SecurityFile, source, err)
+	}
+
+	// a plain username is redacted in logs, a username from elsewhere is never logged
+	security.usernameSecret = source != SecretSourcePlain || hasEnvReference(security.Username)
+	security.Username, security.Password = username, password
+	if isGHCREntry(entry) && security.Username == "" && security.Password != "" {
+		security.Username = utils.GHCRUsername
+	}
+	security.entry = entry
+	log.AddSecrets(security.Password, security.QuayToken)
+	if security.usernameSecret {
+		log.AddSecrets(security.Username)
+	}
+	return security, nil
+}
+
+// isGHCREntry checks if an entry of the security file is ghcr.io or its repositories
+func isGHCREntry(entry string) bool {
+	return strings.SplitN(entry, "/", 2)[0] == utils.GHCRRegistry
+}
+
+// RefreshSecurity queries the provider of an entry again after the auth information is rejected,
+// the credential in a secret backend may have rotated during the run. The refreshed auth information
+// is returned, and whether it differs from security.
+func (c *Configs) RefreshSecurity(security Security) (Security, bool, error) {
+	source := security.sourceName()
+	if security.entry == "" || source == SecretSourcePlain || source == SecretSourceEnv {
+		return security, false, nil
+	}
+
+	c.securityMutex.RLock()
+	raw, ok := c.rawSecurity[security.entry]
+	c.securityMutex.RUnlock()
+	if !ok {
+		return security, false, nil
+	}
+
+	refreshed, err := c.resolveSecurity(security.entry, raw)
+	if err != nil {
+		return security, false, err
+	}
+	changed := refreshed.Username != security.Username || refreshed.Password != security.Password
+	if changed {
+		log.Infof("Auth information of %s is refreshed from %s", security.entry, source)
+		c.securityMutex.Lock()
+		c.Security[security.entry] = refreshed
+		c.securityMutex.Unlock()
+	}
+	return refreshed, changed, nil
+}
+
+// RefreshAuth queries the auth information of a registry repository again after it is rejected, the secret
+// provider of the security file entry, the registered credential provider or the credential helper of the
+// docker config file is invoked again.
+// The auth information which can not be refreshed, e.g. a plain password, is returned as is
+func (c *Configs) RefreshAuth(registry, repository string) (Security, error) {
+	security, exist := c.GetSecuritySpecific(registry, repository)
+	if !exist {
+		return security, nil
+	}
+	if security.entry != "" {
+		refreshed, _, err := c.RefreshSecurity(security)
+		return refreshed, err
+	}
+
+	// the auth information of the docker config file is cached by registry
+	c.dockerConfigAuthMutex.Lock()
+	delete(c.dockerConfigAuth, registry)
+	c.dockerConfigAuthMutex.Unlock()
+	security, _ = c.GetSecuritySpecific(registry, repository)
+	return security, nil
+}
+
+// plainSecretProvider reads username and password from the security file, ${NAME} in them
+// is expanded, usernameEnv and passwordEnv are also supported
+type plainSecretProvider struct{}
+
+// Resolve implements SecretProvider
+func (plainSecretProvider) Resolve(c *Configs, entry string, security Security) (string, string, error) {
+	username, _, err := resolveEnv(security.Username, security.UsernameEnv)
+	if err != nil {
+		return "", "", fmt.Errorf("username is invalid: %v", err)
+	}
+	password, _, err := resolveEnv(security.Password, security.PasswordEnv)
+	if err != nil {
+		return "", "", fmt.Errorf("password is invalid: %v", err)
+	}
+	return username, password, nil
+}
+
+// envSecretProvider reads username and password from the environment variables of usernameEnv and passwordEnv
+type envSecretProvider struct{}
+
+// Resolve implements SecretProvider
+func (envSecretProvider) Resolve(c *Configs, entry string, security Security) (string, string, error) {
+	if security.UsernameEnv == "" || security.PasswordEnv == "" {
+		return "", "", fmt.Errorf("usernameEnv and passwordEnv should be set")
+	}
+	return plainSecretProvider{}.Resolve(c, entry, security)
+}
+
+// vaultSecretProvider reads username and password from the KV v2 engine of vault, the token
+// is read from the VAULT_TOKEN environment variable
+type vaultSecretProvider struct{}
+
+// Resolve implements SecretProvider
+func (vaultSecretProvider) Resolve(c *Configs, entry string, security Security) (string, string, error) {
+	address := security.VaultAddress
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	switch {
+	case address == "":
+		return "", "", fmt.Errorf("vaultAddress or VAULT_ADDR should be set")
+	case token == "":
+		return "", "", fmt.Errorf("VAULT_TOKEN should be set")
+	}
+	mountAndPath := strings.SplitN(strings.Trim(security.VaultPath, "/"), "/", 2)
+	if len(mountAndPath) != 2 {
+		return "", "", fmt.Errorf("vaultPath should be <mount>/<path>, got %s", security.VaultPath)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(address, "/")+"/v1/"+mountAndPath[0]+
+		"/data/"+mountAndPath[1], nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+
+	resp, err := (&http.Client{Timeout: vaultTimeout}).Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("read %s from vault error: status %s", security.VaultPath, resp.Status)
+	}
+
+	var secret struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", "", fmt.Errorf("decode %s from vault error: %v", security.VaultPath, err)
+	}
+	return SecretKeyValues(secret.Data.Data, security)
+}
+
+// SecretKeyValues picks username and password of a security entry from the key values of a secret,
+// the username of the entry is used if the secret has no username
+func SecretKeyValues(values map[string]interface{}, security Security) (string, string, error) {
+	usernameKey, passwordKey := security.UsernameKey, security.PasswordKey
+	if usernameKey == "" {
+		usernameKey = "username"
+	}
+	if passwordKey == "" {
+		passwordKey = "password"
+	}
+
+	username := security.Username
+	if value, ok := values[usernameKey].(string); ok && value != "" {
+		username = value
+	}
+	password, ok := values[passwordKey].(string)
+	if !ok || password == "" {
+		return "", "", fmt.Errorf("secret has no %s", passwordKey)
+	}
+	return username, password, nil
+}
@@ -0,0 +1,91 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package configs
+
+import (
+	"os"
+	"testing"
+
+	"tkestack.io/image-transfer/pkg/image-transfer/options"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+func TestResolveSecurityLiteralDollar(t *testing.T) {
+	os.Setenv("IMAGE_TRANSFER_TEST_USERNAME", "robot")
+	defer os.Unsetenv("IMAGE_TRANSFER_TEST_USERNAME")
+	c := &Configs{FlagConf: options.NewClientOptions()}
+
+	cases := []struct {
+		security Security
+		username string
+		password string
+		secret   bool
+	}{
+		{security: Security{Username: "admin", Password: "pa$$word"}, username: "admin", password: "pa$$word"},
+		{security: Security{Username: "admin", Password: "Abc$123"}, username: "admin", password: "Abc$123"},
+		{security: Security{Username: "$admin", Password: "s3cr3t$x"}, username: "$admin", password: "s3cr3t$x"},
+		{security: Security{Username: "${IMAGE_TRANSFER_TEST_USERNAME}", Password: "$${x}"}, username: "robot",
+			password: "${x}", secret: true},
+	}
+	for _, tc := range cases {
+		security, err := c.resolveSecurity("registry.example.com", tc.security)
+		if err != nil {
+			t.Errorf("resolveSecurity(%+v) error: %v", tc.security, err)
+			continue
+		}
+		if security.Username != tc.username || security.Password != tc.password ||
+			security.usernameSecret != tc.secret {
+			t.Errorf("resolveSecurity(%+v) = %q, %q, %v, expected %q, %q, %v", tc.security, security.Username,
+				security.Password, security.usernameSecret, tc.username, tc.password, tc.secret)
+		}
+	}
+
+	if _, err := c.resolveSecurity("registry.example.com", Security{Username: "admin",
+		Password: "${IMAGE_TRANSFER_TEST_UNSET}"}); err == nil {
+		t.Errorf("resolveSecurity with an unset variable should fail")
+	}
+}
+
+func TestResolveSecurityGHCRUsername(t *testing.T) {
+	c := &Configs{FlagConf: options.NewClientOptions()}
+	cases := []struct {
+		entry    string
+		security Security
+		username string
+	}{
+		{entry: "ghcr.io", security: Security{Password: "ghp_token"}, username: "github"},
+		{entry: "ghcr.io/my-org/*", security: Security{Password: "ghp_token"}, username: "github"},
+		{entry: "ghcr.io", security: Security{Username: "anything", Password: "ghp_token"}, username: "anything"},
+		{entry: "ghcr.io", security: Security{Token: "ghp_token"}, username: "github"},
+		{entry: "ghcr.io/my-org/platform/base", security: Security{Token: "ghp_token"}, username: "github"},
+		{entry: "quay.io", security: Security{Password: "ghp_token"}, username: ""},
+		{entry: "ghcr.io.example.com", security: Security{Token: "ghp_token"}, username: utils.BearerTokenUsername},
+	}
+	for _, tc := range cases {
+		security, err := c.resolveSecurity(tc.entry, tc.security)
+		if err != nil {
+			t.Errorf("resolveSecurity(%s) error: %v", tc.entry, err)
+			continue
+		}
+		if security.Username != tc.username || security.Password != "ghp_token" {
+			t.Errorf("resolveSecurity(%s, %+v) = %q, %q, expected username %q", tc.entry, tc.security,
+				security.Username, security.Password, tc.username)
+		}
+	}
+}
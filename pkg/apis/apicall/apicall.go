@@ -0,0 +1,116 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package apicall
+
+import (
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
+	sdkerrors "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/errors"
+	"tkestack.io/image-transfer/pkg/apis/stsapis"
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+const (
+	baseBackoff = 500 * time.Millisecond
+	maxBackoff  = 30 * time.Second
+)
+
+// MaxAttempts is the max number of attempts of a tencent cloud api call
+var MaxAttempts = 5
+
+// retryableCodePrefixes are the error codes of throttling and server errors which are worth retrying
+var retryableCodePrefixes = []string{
+	"RequestLimitExceeded",
+	"InternalError",
+	"ClientError.NetworkError",
+	"ClientError.HttpStatusCodeError",
+}
+
+// permanentCodePrefixes are the error codes of requests which fail again if retried
+var permanentCodePrefixes = []string{
+	"InvalidParameter",
+	"MissingParameter",
+	"UnknownParameter",
+	"UnsupportedOperation",
+	"UnauthorizedOperation",
+	"AuthFailure",
+	"LimitExceeded",
+}
+
+// Do calls a tencent cloud api by fn with the credential of a secret id and key. The calls
+// failed for throttling or server errors are retried with exponential backoff and jitter,
+// and the call failed for expired temporary credentials is retried with refreshed credentials
+func Do(secretID, secretKey string, fn func(credential *common.Credential) error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn(stsapis.NewCredential(secretID, secretKey))
+		if err == nil || attempt >= MaxAttempts {
+			return err
+		}
+
+		if stsapis.InvalidateExpired(secretID, err) {
+			log.Warnf("temporary credentials are expired, refresh them and retry: %v", err)
+			continue
+		}
+		if !isRetryable(err) {
+			return err
+		}
+
+		backoff := backoffOf(attempt)
+		log.Warnf("tencent cloud api call failed, retry in %v (attempt %v/%v): %v", backoff, attempt,
+			MaxAttempts, err)
+		time.Sleep(backoff)
+	}
+}
+
+// isRetryable checks if an error is a throttling or server error
+func isRetryable(err error) bool {
+	return hasCodePrefix(err, retryableCodePrefixes)
+}
+
+// IsPermanentError checks if an api error fails again if retried, e.g. an invalid parameter or an exceeded quota
+func IsPermanentError(err error) bool {
+	return hasCodePrefix(err, permanentCodePrefixes)
+}
+
+// hasCodePrefix checks if an error is a tencent cloud sdk error whose code starts with one of prefixes
+func hasCodePrefix(err error, prefixes []string) bool {
+	sdkErr, ok := err.(*sdkerrors.TencentCloudSDKError)
+	if !ok {
+		return false
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(sdkErr.GetCode(), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// backoffOf returns the exponential backoff of an attempt with jitter in [0.5, 1.5)
+func backoffOf(attempt int) time.Duration {
+	backoff := baseBackoff << uint(attempt-1)
+	if backoff > maxBackoff || backoff <= 0 {
+		backoff = maxBackoff
+	}
+	return time.Duration(float64(backoff) * (0.5 + rand.Float64()))
+}
@@ -0,0 +1,102 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+// Package apitest serves a fake tencent cloud api for the tests of the api clients
+package apitest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// Handler answers the params of a call with the response of an action, see Error for a failed call
+type Handler func(params map[string]interface{}) interface{}
+
+// FakeAPI serves the actions of tencent cloud api by their handlers over tls, the calls of every
+// action are counted
+type FakeAPI struct {
+	server   *httptest.Server
+	mutex    sync.Mutex
+	handlers map[string]Handler
+	calls    map[string]int
+}
+
+// NewFakeAPI starts a FakeAPI, the actions without handler fail with InvalidAction
+func NewFakeAPI(handlers map[string]Handler) *FakeAPI {
+	api := &FakeAPI{
+		handlers: make(map[string]Handler),
+		calls:    make(map[string]int),
+	}
+	for action, handler := range handlers {
+		api.handlers[action] = handler
+	}
+	api.server = httptest.NewTLSServer(api)
+	return api
+}
+
+// ServeHTTP answers a call of tencent cloud api, the action is in the X-TC-Action header
+func (f *FakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	action := r.Header.Get("X-TC-Action")
+	params := make(map[string]interface{})
+	json.NewDecoder(r.Body).Decode(&params)
+
+	f.mutex.Lock()
+	f.calls[action]++
+	handler, ok := f.handlers[action]
+	f.mutex.Unlock()
+
+	response := Error("InvalidAction", "unknown action "+action)
+	if ok {
+		response = handler(params)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"Response": response})
+}
+
+// Endpoint returns the endpoint of the api, it is set to the api clients by WithEndpoint
+func (f *FakeAPI) Endpoint() string {
+	return strings.TrimPrefix(f.server.URL, "https://")
+}
+
+// Transport returns the transport which trusts the certificate of the api
+func (f *FakeAPI) Transport() http.RoundTripper {
+	return f.server.Client().Transport
+}
+
+// Calls returns the number of calls of an action
+func (f *FakeAPI) Calls(action string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.calls[action]
+}
+
+// Close shuts down the api
+func (f *FakeAPI) Close() {
+	f.server.Close()
+}
+
+// Error is the response of a failed call with the error code like RequestLimitExceeded
+func Error(code, message string) interface{} {
+	return map[string]interface{}{
+		"Error":     map[string]string{"Code": code, "Message": message},
+		"RequestId": "test",
+	}
+}
@@ -23,13 +23,17 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
 	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
 	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/profile"
 	tcr "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/tcr/v20190924"
 	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/apis/apicall"
+	"tkestack.io/image-transfer/pkg/apis/stsapis"
 	"tkestack.io/image-transfer/pkg/log"
 	"tkestack.io/image-transfer/pkg/utils"
 )
@@ -38,8 +42,21 @@ import (
 type CCRAPIClient struct {
 	httpClient *http.Client
 	url        string
+
+	// endpoint is the domain of tencent cloud api, it may be a private endpoint
+	endpoint string
+
+	// nsCache caches the namespace listing of ccr, keyed by region
+	nsCache      map[string][]string
+	nsCacheMutex sync.Mutex
 }
 
+// DefaultEndpoint is the public domain of tencent cloud api of tcr and ccr
+const DefaultEndpoint = "tcr.tencentcloudapi.com"
+
+// maxPages is the safety cap of a paged listing, it stops a listing which never reaches the total count
+const maxPages = 10000
+
 var regionPrefix = map[string]string{
 	"ap-guangzhou":     "ccr",
 	"ap-shanghai":      "ccr",
@@ -68,11 +85,25 @@ var regionPrefix = map[string]string{
 // NewCCRAPIClient is new return *CCRAPIClient
 func NewCCRAPIClient() *CCRAPIClient {
 	httpclient := http.Client{}
-	ai := CCRAPIClient{httpClient: &httpclient}
+	ai := CCRAPIClient{
+		httpClient: &httpclient,
+		endpoint:   DefaultEndpoint,
+		nsCache:    make(map[string][]string),
+	}
 
 	return &ai
 }
 
+// WithEndpoint sets the domain of tencent cloud api and the transport to call it,
+// a transport with a custom CA is required by a private endpoint with a private certificate
+func (ai *CCRAPIClient) WithEndpoint(endpoint string, transport http.RoundTripper) *CCRAPIClient {
+	if endpoint != "" {
+		ai.endpoint = endpoint
+	}
+	ai.httpClient.Transport = transport
+	return ai
+}
+
 // GetAllNamespaceByName get all ns from ccr name
 func (ai *CCRAPIClient) GetAllNamespaceByName(secret map[string]configs.Secret, region string) ([]string, error) {
 
@@ -81,7 +112,7 @@ func (ai *CCRAPIClient) GetAllNamespaceByName(secret map[string]configs.Secret,
 	secretID, secretKey, err := GetCcrSecret(secret)
 
 	if err != nil {
-		log.Errorf("GetCcrSecret error: ", err)
+		log.Errorf("GetCcrSecret error: %v", err)
 		return nsList, err
 	}
 
@@ -89,10 +120,10 @@ func (ai *CCRAPIClient) GetAllNamespaceByName(secret map[string]configs.Secret,
 	count := 0
 	limit := int64(100)
 
-	for {
+	for page := 1; ; page++ {
 		resp, err := ai.DescribeNamespacePersonal(secretID, secretKey, region, offset, limit)
 		if err != nil {
-			log.Errorf("GetAllNamespaceByName error, ", err)
+			log.Errorf("GetAllNamespaceByName error, %v", err)
 			return nsList, err
 		}
 		namespaceCount := *resp.Response.Data.NamespaceCount
@@ -101,29 +132,188 @@ func (ai *CCRAPIClient) GetAllNamespaceByName(secret map[string]configs.Secret,
 		for _, ns := range resp.Response.Data.NamespaceInfo {
 			nsList = append(nsList, *ns.Namespace)
 		}
+		log.Infof("Get ccr namespaces of %s: %v/%v", region, count, namespaceCount)
 
 		if int64(count) >= namespaceCount {
 			break
-		} else {
-			offset += limit
 		}
+		if len(resp.Response.Data.NamespaceInfo) == 0 {
+			return nsList, fmt.Errorf("ccr returned an empty page of namespaces, only %v of %v namespaces "+
+				"are listed", count, namespaceCount)
+		}
+		if page >= maxPages {
+			return nsList, fmt.Errorf("listing ccr namespaces exceeds the safety cap of %v pages", maxPages)
+		}
+		// ccr may return less than limit items in a page
+		offset += int64(len(resp.Response.Data.NamespaceInfo))
 
 	}
 
+	ai.nsCacheMutex.Lock()
+	ai.nsCache[region] = append([]string{}, nsList...)
+	ai.nsCacheMutex.Unlock()
+
 	return nsList, nil
 
 }
 
-//GenerateAllCcrRules generate all ccr rules
+// NamespaceVisibility is the visibility of a ccr namespace, ccr has no visibility
+// of namespaces, it is derived from the visibility of repositories
+type NamespaceVisibility struct {
+	PublicRepos  int
+	PrivateRepos int
+}
+
+// IsPublic returns true if all repositories of the namespace are public
+func (v *NamespaceVisibility) IsPublic() bool {
+	return v != nil && v.PublicRepos != 0 && v.PrivateRepos == 0
+}
+
+// GetNamespaceVisibility gets the visibility of ccr namespaces which have repositories
+func (ai *CCRAPIClient) GetNamespaceVisibility(secret map[string]configs.Secret,
+	region string) (map[string]*NamespaceVisibility, error) {
+
+	repos, err := ai.ListRepositories(secret, region)
+	if err != nil {
+		return nil, err
+	}
+
+	visibility := make(map[string]*NamespaceVisibility)
+	for _, repo := range repos {
+		ns := strings.SplitN(*repo.RepoName, "/", 2)[0]
+		if _, ok := visibility[ns]; !ok {
+			visibility[ns] = &NamespaceVisibility{}
+		}
+		if repo.Public != nil && *repo.Public == 1 {
+			visibility[ns].PublicRepos++
+		} else {
+			visibility[ns].PrivateRepos++
+		}
+	}
+
+	return visibility, nil
+}
+
+// GetRepoDescriptions gets the descriptions of ccr repositories, keyed by namespace/repo,
+// the repositories without description are not included
+func (ai *CCRAPIClient) GetRepoDescriptions(secret map[string]configs.Secret,
+	region string) (map[string]string, error) {
+
+	repos, err := ai.ListRepositories(secret, region)
+	if err != nil {
+		return nil, err
+	}
+
+	descriptions := make(map[string]string)
+	for _, repo := range repos {
+		if repo.Description != nil && *repo.Description != "" {
+			descriptions[*repo.RepoName] = *repo.Description
+		}
+	}
+
+	return descriptions, nil
+}
+
+// ListRepositories lists all repositories of ccr
+func (ai *CCRAPIClient) ListRepositories(secret map[string]configs.Secret, region string) ([]*tcr.RepoInfo, error) {
+
+	secretID, secretKey, err := GetCcrSecret(secret)
+	if err != nil {
+		log.Errorf("GetCcrSecret error: %v", err)
+		return nil, err
+	}
+
+	var repos []*tcr.RepoInfo
+	offset := int64(0)
+	limit := int64(100)
+
+	for page := 1; ; page++ {
+		resp, err := ai.DescribeRepositoryOwnerPersonal(secretID, secretKey, region, offset, limit)
+		if err != nil {
+			log.Errorf("get ccr repo error, %v", err)
+			return nil, err
+		}
+		repoCount := *resp.Response.Data.TotalCount
+		repos = append(repos, resp.Response.Data.RepoInfo...)
+
+		if int64(len(repos)) >= repoCount {
+			break
+		}
+		if len(resp.Response.Data.RepoInfo) == 0 {
+			return nil, fmt.Errorf("ccr returned an empty page of repositories, only %v of %v repositories "+
+				"are listed", len(repos), repoCount)
+		}
+		if page >= maxPages {
+			return nil, fmt.Errorf("listing ccr repositories exceeds the safety cap of %v pages", maxPages)
+		}
+		// ccr may return less than limit items in a page
+		offset += int64(len(resp.Response.Data.RepoInfo))
+	}
+
+	return repos, nil
+}
+
+// GetCachedNamespaceByName get all ns of ccr, the cached listing is returned
+// if exists, GetAllNamespaceByName is called when no cache or forceRefresh is true
+func (ai *CCRAPIClient) GetCachedNamespaceByName(secret map[string]configs.Secret,
+	region string, forceRefresh bool) ([]string, error) {
+
+	if !forceRefresh {
+		ai.nsCacheMutex.Lock()
+		nsList, ok := ai.nsCache[region]
+		ai.nsCacheMutex.Unlock()
+		if ok {
+			return append([]string{}, nsList...), nil
+		}
+	}
+
+	return ai.GetAllNamespaceByName(secret, region)
+}
+
+// AddCachedNamespace adds a namespace which is created successfully to the cached listing
+func (ai *CCRAPIClient) AddCachedNamespace(region string, nsName string) {
+	ai.nsCacheMutex.Lock()
+	defer ai.nsCacheMutex.Unlock()
+
+	nsList, ok := ai.nsCache[region]
+	if !ok || utils.IsContain(nsList, nsName) {
+		return
+	}
+	ai.nsCache[region] = append(nsList, nsName)
+}
+
+// GetRegistryDomain returns the registry domain of ccr in a region
+func GetRegistryDomain(region string) string {
+	return regionPrefix[region] + ".ccs.tencentyun.com"
+}
+
+// RulesOptions are the options of generating ccr rules
+type RulesOptions struct {
+	// TargetTemplate renders the targets, see utils.RenderTargetTemplate
+	TargetTemplate string
+	// NamespaceTemplates overrides TargetTemplate for some namespaces,
+	// the namespaces whose template is empty generate no rules
+	NamespaceTemplates map[string]string
+	// RulesFile is the file where the rules are saved
+	RulesFile string
+	// RepoFilter filters the repositories, it may be nil
+	RepoFilter *utils.RepoFilter
+	// MaxTagsPerRepo is the number of newest tags to transfer in a repository, 0 means unlimited
+	MaxTagsPerRepo int
+	// NamespaceMapping renames the target namespaces, unmapped namespaces keep their names
+	NamespaceMapping map[string]string
+}
+
+//GenerateAllCcrRules generate all ccr rules of the namespaces which are not in failedNsList
 func (ai *CCRAPIClient) GenerateAllCcrRules(secret map[string]configs.Secret, ccrRegion string,
-	failedNsList []string, tcrRegion string, tcrName string) (map[string]string, error) {
+	failedNsList []string, opts *RulesOptions) (map[string]string, error) {
 
 	rulesMap := make(map[string]string)
 
 	secretID, secretKey, err := GetCcrSecret(secret)
 
 	if err != nil {
-		log.Errorf("GetCcrSecret error: ", err)
+		log.Errorf("GetCcrSecret error: %v", err)
 		return rulesMap, err
 	}
 
@@ -131,19 +321,37 @@ func (ai *CCRAPIClient) GenerateAllCcrRules(secret map[string]configs.Secret, cc
 	count := 0
 	limit := int64(100)
 
-	for {
+	// matched and total repositories of namespaces
+	matchedCount := make(map[string]int)
+	totalCount := make(map[string]int)
+
+	// source repositories of targets, two source repositories mapped to one target are conflicts
+	targetSources := make(map[string]string)
+	var conflicts []string
+
+	for page := 1; ; page++ {
 		resp, err := ai.DescribeRepositoryOwnerPersonal(secretID, secretKey, ccrRegion, offset, limit)
 		if err != nil {
-			log.Errorf("get ccr repo error, ", err)
+			log.Errorf("get ccr repo error, %v", err)
 			return rulesMap, err
 		}
 		repoCount := *resp.Response.Data.TotalCount
 		count += len(resp.Response.Data.RepoInfo)
 
 		for _, repo := range resp.Response.Data.RepoInfo {
-			ns := strings.Split(*repo.RepoName, "/")[0]
-			if len(failedNsList) == 0 || !utils.IsContain(failedNsList, ns) {
-				tags, err := ai.getRepoTags(secretID, secretKey, ccrRegion, *repo.RepoName)
+			nsAndRepo := strings.SplitN(*repo.RepoName, "/", 2)
+			ns := nsAndRepo[0]
+			targetTemplate := opts.TargetTemplate
+			if nsTemplate, ok := opts.NamespaceTemplates[ns]; ok {
+				targetTemplate = nsTemplate
+			}
+			if targetTemplate != "" && (len(failedNsList) == 0 || !utils.IsContain(failedNsList, ns)) {
+				totalCount[ns]++
+				if !opts.RepoFilter.Match(*repo.RepoName) {
+					continue
+				}
+				matchedCount[ns]++
+				tags, err := ai.getRepoTags(secretID, secretKey, ccrRegion, *repo.RepoName, opts.MaxTagsPerRepo)
 				if err != nil {
 					return nil, err
 				}
@@ -152,25 +360,61 @@ func (ai *CCRAPIClient) GenerateAllCcrRules(secret map[string]configs.Secret, cc
 				}
 				tagStr := strings.Join(tags, ",")
 				source := fmt.Sprintf("%s%s%s:%s", regionPrefix[ccrRegion], ".ccs.tencentyun.com/", *repo.RepoName, tagStr)
-				target := tcrName + ".tencentcloudcr.com/" + *repo.RepoName
+				targetNs := ns
+				if mappedNs, ok := opts.NamespaceMapping[ns]; ok {
+					targetNs = mappedNs
+				}
+				target := utils.RenderTargetTemplate(targetTemplate, targetNs, nsAndRepo[len(nsAndRepo)-1])
+				if sourceRepo, ok := targetSources[target]; ok {
+					conflicts = append(conflicts, fmt.Sprintf("%s and %s to %s", sourceRepo, *repo.RepoName, target))
+					continue
+				}
+				targetSources[target] = *repo.RepoName
 				rulesMap[target] = source
 			}
 		}
+		log.Infof("Get ccr repositories of %s: %v/%v", ccrRegion, count, repoCount)
 
 		if int64(count) >= repoCount {
 			break
-		} else {
-			offset += limit
 		}
+		if len(resp.Response.Data.RepoInfo) == 0 {
+			return nil, fmt.Errorf("ccr returned an empty page of repositories, only %v of %v repositories "+
+				"are listed", count, repoCount)
+		}
+		if page >= maxPages {
+			return nil, fmt.Errorf("listing ccr repositories exceeds the safety cap of %v pages", maxPages)
+		}
+		// ccr may return less than limit items in a page
+		offset += int64(len(resp.Response.Data.RepoInfo))
 
 	}
 
+	if len(conflicts) != 0 {
+		for _, conflict := range conflicts {
+			log.Errorf("conflicting ccr rules: %s", conflict)
+		}
+		return nil, fmt.Errorf("%v ccr repositories are mapped to the same targets, check the namespace mapping",
+			len(conflicts))
+	}
+
+	if !opts.RepoFilter.IsEmpty() {
+		var nsList []string
+		for ns := range totalCount {
+			nsList = append(nsList, ns)
+		}
+		sort.Strings(nsList)
+		for _, ns := range nsList {
+			log.Infof("namespace %s: %v/%v repositories matched by filters", ns, matchedCount[ns], totalCount[ns])
+		}
+	}
+
 	jsonStr, err := json.Marshal(rulesMap)
 	if err != nil {
 		log.Errorf("Marshal ccr rules map error %v, ", err)
 	}
 	go func() {
-		err = ioutil.WriteFile("./ccr_to_tcr_rules", []byte(jsonStr), 0666)
+		err = ioutil.WriteFile(opts.RulesFile, []byte(jsonStr), 0666)
 		if err != nil {
 			log.Errorf("WriteFile ccr rules error %v, ", err)
 		}
@@ -180,7 +424,9 @@ func (ai *CCRAPIClient) GenerateAllCcrRules(secret map[string]configs.Secret, cc
 
 }
 
-func (ai *CCRAPIClient) getRepoTags(secretID, secretKey, ccrRegion, repoName string) ([]string, error) {
+// getRepoTags gets the tags of a repository in the order of DescribeImagePersonal(newest first),
+// only the newest maxTags tags are returned if maxTags is larger than 0
+func (ai *CCRAPIClient) getRepoTags(secretID, secretKey, ccrRegion, repoName string, maxTags int) ([]string, error) {
 
 	offset := int64(0)
 	count := int64(0)
@@ -188,7 +434,7 @@ func (ai *CCRAPIClient) getRepoTags(secretID, secretKey, ccrRegion, repoName str
 
 	var result []string
 
-	for {
+	for page := 1; ; page++ {
 		resp, err := ai.DescribeImagePersonal(secretID, secretKey, ccrRegion, repoName, offset, limit)
 		if err != nil {
 			return nil, err
@@ -209,34 +455,104 @@ func (ai *CCRAPIClient) getRepoTags(secretID, secretKey, ccrRegion, repoName str
 			result = append(result, *tagInfo.TagName)
 		}
 
+		if maxTags > 0 && len(result) >= maxTags {
+			result = result[:maxTags]
+			break
+		}
+
+		log.Debugf("Get tags of ccr repository %s: %v/%v", repoName, count, tagCount)
+
 		if count >= tagCount {
 			break
-		} else {
-			offset += limit
 		}
+		if len(resp.Response.Data.TagInfo) == 0 {
+			return nil, fmt.Errorf("ccr returned an empty page of tags, only %v of %v tags of %s are listed",
+				count, tagCount, repoName)
+		}
+		if page >= maxPages {
+			return nil, fmt.Errorf("listing tags of ccr repository %s exceeds the safety cap of %v pages",
+				repoName, maxPages)
+		}
+		// ccr may return less than limit items in a page
+		offset += int64(len(resp.Response.Data.TagInfo))
 
 	}
 
 	return result, nil
 }
 
+// GetRepoSize gets the total size of the tags of a ccr repository, the layers shared by tags
+// are counted repeatedly so it is an upper bound of the storage used by the repository
+func (ai *CCRAPIClient) GetRepoSize(secret map[string]configs.Secret, ccrRegion, repoName string) (int64, error) {
+
+	secretID, secretKey, err := GetCcrSecret(secret)
+	if err != nil {
+		return 0, err
+	}
+
+	offset := int64(0)
+	count := int64(0)
+	limit := int64(100)
+
+	var size int64
+
+	for page := 1; ; page++ {
+		resp, err := ai.DescribeImagePersonal(secretID, secretKey, ccrRegion, repoName, offset, limit)
+		if err != nil {
+			return 0, err
+		}
+		if resp.Response == nil || resp.Response.Data == nil {
+			return 0, errors.New("DescribeImagePersonal resp is nil")
+		}
+		tagCount := *resp.Response.Data.TagCount
+
+		count += int64(len(resp.Response.Data.TagInfo))
+		for _, tagInfo := range resp.Response.Data.TagInfo {
+			if tagInfo.SizeByte != nil {
+				size += *tagInfo.SizeByte
+			}
+		}
+
+		if count >= tagCount {
+			break
+		}
+		if len(resp.Response.Data.TagInfo) == 0 {
+			return 0, fmt.Errorf("ccr returned an empty page of tags, only %v of %v tags of %s are listed",
+				count, tagCount, repoName)
+		}
+		if page >= maxPages {
+			return 0, fmt.Errorf("listing tags of ccr repository %s exceeds the safety cap of %v pages",
+				repoName, maxPages)
+		}
+		// ccr may return less than limit items in a page
+		offset += int64(len(resp.Response.Data.TagInfo))
+
+	}
+
+	return size, nil
+}
+
 func (ai *CCRAPIClient) DescribeImagePersonal(secretID, secretKey,
 	region, repoName string, offset, limit int64) (*tcr.DescribeImagePersonalResponse, error) {
 
-	credential := common.NewCredential(
-		secretID,
-		secretKey,
-	)
 	cpf := profile.NewClientProfile()
-	cpf.HttpProfile.Endpoint = "tcr.tencentcloudapi.com"
-	client, _ := tcr.NewClient(credential, region, cpf)
+	cpf.HttpProfile.Endpoint = ai.endpoint
 
 	request := tcr.NewDescribeImagePersonalRequest()
 
 	request.Limit = common.Int64Ptr(limit)
 	request.Offset = common.Int64Ptr(offset)
 	request.RepoName = common.StringPtr(repoName)
-	response, err := client.DescribeImagePersonal(request)
+	var response *tcr.DescribeImagePersonalResponse
+	err := apicall.Do(secretID, secretKey, func(credential *common.Credential) error {
+		client, _ := tcr.NewClient(credential, region, cpf)
+		if ai.httpClient.Transport != nil {
+			client.WithHttpTransport(ai.httpClient.Transport)
+		}
+		var err error
+		response, err = client.DescribeImagePersonal(request)
+		return err
+	})
 
 	if err != nil {
 		log.Errorf("An error has returned: %s", err)
@@ -251,13 +567,8 @@ func (ai *CCRAPIClient) DescribeImagePersonal(secretID, secretKey,
 func (ai *CCRAPIClient) DescribeNamespacePersonal(secretID, secretKey,
 	region string, offset, limit int64) (*tcr.DescribeNamespacePersonalResponse, error) {
 
-	credential := common.NewCredential(
-		secretID,
-		secretKey,
-	)
 	cpf := profile.NewClientProfile()
-	cpf.HttpProfile.Endpoint = "tcr.tencentcloudapi.com"
-	client, _ := tcr.NewClient(credential, region, cpf)
+	cpf.HttpProfile.Endpoint = ai.endpoint
 
 	request := tcr.NewDescribeNamespacePersonalRequest()
 
@@ -265,7 +576,47 @@ func (ai *CCRAPIClient) DescribeNamespacePersonal(secretID, secretKey,
 	request.Limit = common.Int64Ptr(limit)
 	request.Offset = common.Int64Ptr(offset)
 
-	response, err := client.DescribeNamespacePersonal(request)
+	var response *tcr.DescribeNamespacePersonalResponse
+	err := apicall.Do(secretID, secretKey, func(credential *common.Credential) error {
+		client, _ := tcr.NewClient(credential, region, cpf)
+		if ai.httpClient.Transport != nil {
+			client.WithHttpTransport(ai.httpClient.Transport)
+		}
+		var err error
+		response, err = client.DescribeNamespacePersonal(request)
+		return err
+	})
+
+	if err != nil {
+		log.Errorf("An error has returned: %s", err)
+		return nil, err
+	}
+
+	return response, nil
+
+}
+
+// CreateNamespacePersonal is ccr api CreateNamespacePersonal
+func (ai *CCRAPIClient) CreateNamespacePersonal(secretID, secretKey,
+	region string, nsName string) (*tcr.CreateNamespacePersonalResponse, error) {
+
+	cpf := profile.NewClientProfile()
+	cpf.HttpProfile.Endpoint = ai.endpoint
+
+	request := tcr.NewCreateNamespacePersonalRequest()
+
+	request.Namespace = common.StringPtr(nsName)
+
+	var response *tcr.CreateNamespacePersonalResponse
+	err := apicall.Do(secretID, secretKey, func(credential *common.Credential) error {
+		client, _ := tcr.NewClient(credential, region, cpf)
+		if ai.httpClient.Transport != nil {
+			client.WithHttpTransport(ai.httpClient.Transport)
+		}
+		var err error
+		response, err = client.CreateNamespacePersonal(request)
+		return err
+	})
 
 	if err != nil {
 		log.Errorf("An error has returned: %s", err)
@@ -280,20 +631,24 @@ func (ai *CCRAPIClient) DescribeNamespacePersonal(secretID, secretKey,
 func (ai *CCRAPIClient) DescribeRepositoryOwnerPersonal(secretID, secretKey,
 	region string, offset, limit int64) (*tcr.DescribeRepositoryOwnerPersonalResponse, error) {
 
-	credential := common.NewCredential(
-		secretID,
-		secretKey,
-	)
 	cpf := profile.NewClientProfile()
-	cpf.HttpProfile.Endpoint = "tcr.tencentcloudapi.com"
-	client, _ := tcr.NewClient(credential, region, cpf)
+	cpf.HttpProfile.Endpoint = ai.endpoint
 
 	request := tcr.NewDescribeRepositoryOwnerPersonalRequest()
 
 	request.Limit = common.Int64Ptr(limit)
 	request.Offset = common.Int64Ptr(offset)
 
-	response, err := client.DescribeRepositoryOwnerPersonal(request)
+	var response *tcr.DescribeRepositoryOwnerPersonalResponse
+	err := apicall.Do(secretID, secretKey, func(credential *common.Credential) error {
+		client, _ := tcr.NewClient(credential, region, cpf)
+		if ai.httpClient.Transport != nil {
+			client.WithHttpTransport(ai.httpClient.Transport)
+		}
+		var err error
+		response, err = client.DescribeRepositoryOwnerPersonal(request)
+		return err
+	})
 
 	if err != nil {
 		log.Errorf("An error has returned: %s", err)
@@ -306,20 +661,18 @@ func (ai *CCRAPIClient) DescribeRepositoryOwnerPersonal(secretID, secretKey,
 
 // GetCcrSecret get ccr secret from configs
 func GetCcrSecret(secret map[string]configs.Secret) (string, string, error) {
-	var secretID string
-	var secretKey string
+	var sideSecret configs.Secret
 
 	if ccr, ok := secret["ccr"]; ok {
 		//ccr secret存在
-		secretID = ccr.SecretID
-		secretKey = ccr.SecretKey
+		sideSecret = ccr
 	} else if tcr, ok := secret["tcr"]; ok {
 		//用tcr secret代替ccr
-		secretID = tcr.SecretID
-		secretKey = tcr.SecretKey
+		sideSecret = tcr
 	} else {
 		return "", "", errors.New("no matched secret provided in secret file")
 	}
 
-	return secretID, secretKey, nil
+	// the temporary credentials are used if a role is set
+	return stsapis.GetSecret(sideSecret)
 }
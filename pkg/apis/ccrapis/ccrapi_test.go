@@ -0,0 +1,268 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package ccrapis
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/apis/apitest"
+)
+
+// newFakeAPIClient starts a fake tencent cloud api and creates a client calling it
+func newFakeAPIClient(handlers map[string]apitest.Handler) (*CCRAPIClient, *apitest.FakeAPI) {
+	api := apitest.NewFakeAPI(handlers)
+	return NewCCRAPIClient().WithEndpoint(api.Endpoint(), api.Transport()), api
+}
+
+// page returns the items of the page of offset and limit in the params
+func page(items []map[string]interface{}, params map[string]interface{}) []map[string]interface{} {
+	offset, limit := int(params["Offset"].(float64)), int(params["Limit"].(float64))
+	if offset >= len(items) {
+		return []map[string]interface{}{}
+	}
+	end := offset + limit
+	if end > len(items) {
+		end = len(items)
+	}
+	return items[offset:end]
+}
+
+var testSecret = map[string]configs.Secret{"ccr": {SecretID: "id", SecretKey: "key"}}
+
+func TestGetAllNamespaceByNamePages(t *testing.T) {
+	var namespaces []map[string]interface{}
+	for i := 0; i < 250; i++ {
+		namespaces = append(namespaces, map[string]interface{}{"Namespace": fmt.Sprintf("ns%03d", i)})
+	}
+	client, api := newFakeAPIClient(map[string]apitest.Handler{
+		"DescribeNamespacePersonal": func(params map[string]interface{}) interface{} {
+			return map[string]interface{}{
+				"Data": map[string]interface{}{
+					"NamespaceInfo":  page(namespaces, params),
+					"NamespaceCount": len(namespaces),
+				},
+			}
+		},
+	})
+	defer api.Close()
+
+	nsList, err := client.GetAllNamespaceByName(testSecret, "ap-guangzhou")
+	if err != nil {
+		t.Fatalf("GetAllNamespaceByName error: %v", err)
+	}
+	if len(nsList) != 250 || nsList[0] != "ns000" || nsList[249] != "ns249" {
+		t.Errorf("GetAllNamespaceByName listed %v namespaces, expected ns000 to ns249", len(nsList))
+	}
+	if calls := api.Calls("DescribeNamespacePersonal"); calls != 3 {
+		t.Errorf("GetAllNamespaceByName requested %v pages, expected 3", calls)
+	}
+
+	// the listing is cached
+	cached, err := client.GetCachedNamespaceByName(testSecret, "ap-guangzhou", false)
+	if err != nil || len(cached) != 250 || api.Calls("DescribeNamespacePersonal") != 3 {
+		t.Errorf("GetCachedNamespaceByName = %v namespaces, %v with %v pages requested", len(cached), err,
+			api.Calls("DescribeNamespacePersonal"))
+	}
+}
+
+// capped returns the items of the page like page, but at most 30 items in a page whatever the limit is
+func capped(items []map[string]interface{}, params map[string]interface{}) []map[string]interface{} {
+	if params["Limit"].(float64) > 30 {
+		params["Limit"] = float64(30)
+	}
+	return page(items, params)
+}
+
+func TestGetAllNamespaceByNameShortPage(t *testing.T) {
+	// the total count is larger than the namespaces ever returned, the empty page fails the listing
+	client, api := newFakeAPIClient(map[string]apitest.Handler{
+		"DescribeNamespacePersonal": func(params map[string]interface{}) interface{} {
+			namespaces := []map[string]interface{}{{"Namespace": "a"}, {"Namespace": "b"}}
+			return map[string]interface{}{
+				"Data": map[string]interface{}{"NamespaceInfo": page(namespaces, params), "NamespaceCount": 5},
+			}
+		},
+	})
+	defer api.Close()
+
+	if _, err := client.GetAllNamespaceByName(testSecret, "ap-guangzhou"); err == nil ||
+		!strings.Contains(err.Error(), "only 2 of 5 namespaces are listed") {
+		t.Errorf("GetAllNamespaceByName stopping short of the total count should fail, got %v", err)
+	}
+	if calls := api.Calls("DescribeNamespacePersonal"); calls != 2 {
+		t.Errorf("GetAllNamespaceByName requested %v pages, expected 2", calls)
+	}
+	// the partial listing is not cached
+	if _, err := client.GetCachedNamespaceByName(testSecret, "ap-guangzhou", false); err == nil ||
+		api.Calls("DescribeNamespacePersonal") != 4 {
+		t.Errorf("GetCachedNamespaceByName should list again and fail, %v pages requested, %v",
+			api.Calls("DescribeNamespacePersonal"), err)
+	}
+}
+
+func TestGetAllNamespaceByNameCappedPage(t *testing.T) {
+	var namespaces []map[string]interface{}
+	for i := 0; i < 250; i++ {
+		namespaces = append(namespaces, map[string]interface{}{"Namespace": fmt.Sprintf("ns%03d", i)})
+	}
+	// ccr returns 30 namespaces in a page for the limit of 100
+	client, api := newFakeAPIClient(map[string]apitest.Handler{
+		"DescribeNamespacePersonal": func(params map[string]interface{}) interface{} {
+			return map[string]interface{}{
+				"Data": map[string]interface{}{
+					"NamespaceInfo":  capped(namespaces, params),
+					"NamespaceCount": len(namespaces),
+				},
+			}
+		},
+	})
+	defer api.Close()
+
+	nsList, err := client.GetAllNamespaceByName(testSecret, "ap-guangzhou")
+	if err != nil {
+		t.Fatalf("GetAllNamespaceByName error: %v", err)
+	}
+	for i, ns := range nsList {
+		if expected := fmt.Sprintf("ns%03d", i); ns != expected {
+			t.Fatalf("namespace %v is %s, expected %s", i, ns, expected)
+		}
+	}
+	if len(nsList) != 250 || api.Calls("DescribeNamespacePersonal") != 9 {
+		t.Errorf("GetAllNamespaceByName listed %v namespaces in %v pages, expected 250 in 9 pages", len(nsList),
+			api.Calls("DescribeNamespacePersonal"))
+	}
+}
+
+func TestGenerateAllCcrRulesPages(t *testing.T) {
+	var repositories []map[string]interface{}
+	for i := 0; i < 230; i++ {
+		repositories = append(repositories, map[string]interface{}{"RepoName": fmt.Sprintf("ns%d/app%03d", i%3, i)})
+	}
+	var tags []map[string]interface{}
+	for i := 0; i < 120; i++ {
+		tags = append(tags, map[string]interface{}{"TagName": fmt.Sprintf("v%03d", i)})
+	}
+	client, api := newFakeAPIClient(map[string]apitest.Handler{
+		"DescribeRepositoryOwnerPersonal": func(params map[string]interface{}) interface{} {
+			return map[string]interface{}{
+				"Data": map[string]interface{}{"RepoInfo": page(repositories, params), "TotalCount": len(repositories)},
+			}
+		},
+		"DescribeImagePersonal": func(params map[string]interface{}) interface{} {
+			return map[string]interface{}{
+				"Data": map[string]interface{}{"TagInfo": page(tags, params), "TagCount": len(tags)},
+			}
+		},
+	})
+	defer api.Close()
+
+	dir, err := ioutil.TempDir("", "ccrapis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rules, err := client.GenerateAllCcrRules(testSecret, "ap-guangzhou", []string{"ns2"}, &RulesOptions{
+		TargetTemplate: "tcr.example.com",
+		RulesFile:      filepath.Join(dir, "rules.json"),
+	})
+	if err != nil {
+		t.Fatalf("GenerateAllCcrRules error: %v", err)
+	}
+	// the repositories of the failed namespace ns2 are skipped
+	if len(rules) != 154 {
+		t.Errorf("GenerateAllCcrRules generated %v rules, expected 154", len(rules))
+	}
+	if calls := api.Calls("DescribeRepositoryOwnerPersonal"); calls != 3 {
+		t.Errorf("GenerateAllCcrRules requested %v pages of repositories, expected 3", calls)
+	}
+	source := rules["tcr.example.com/ns0/app000"]
+	if !strings.HasPrefix(source, "ccr.ccs.tencentyun.com/ns0/app000:v000,") || strings.Count(source, ",") != 119 {
+		t.Errorf("source of ns0/app000 should hold all 120 tags, got %.80s", source)
+	}
+	// every repository lists its 120 tags in 2 pages
+	if calls := api.Calls("DescribeImagePersonal"); calls != 2*154 {
+		t.Errorf("GenerateAllCcrRules requested %v pages of tags, expected %v", calls, 2*154)
+	}
+}
+
+func TestGetRepoTagsCappedAndShortPages(t *testing.T) {
+	var tags []map[string]interface{}
+	for i := 0; i < 100; i++ {
+		tags = append(tags, map[string]interface{}{"TagName": fmt.Sprintf("v%03d", i)})
+	}
+	tagCount := len(tags)
+	client, api := newFakeAPIClient(map[string]apitest.Handler{
+		"DescribeImagePersonal": func(params map[string]interface{}) interface{} {
+			return map[string]interface{}{
+				"Data": map[string]interface{}{"TagInfo": capped(tags, params), "TagCount": tagCount},
+			}
+		},
+	})
+	defer api.Close()
+
+	all, err := client.getRepoTags("id", "key", "ap-guangzhou", "ns/app", 0)
+	if err != nil || len(all) != 100 || all[30] != "v030" || all[99] != "v099" {
+		t.Errorf("getRepoTags of capped pages = %v tags, %v, expected v000 to v099", len(all), err)
+	}
+	if calls := api.Calls("DescribeImagePersonal"); calls != 4 {
+		t.Errorf("getRepoTags requested %v capped pages, expected 4", calls)
+	}
+
+	tagCount = 120
+	if _, err := client.getRepoTags("id", "key", "ap-guangzhou", "ns/app", 0); err == nil {
+		t.Errorf("getRepoTags stopping short of the tag count should fail")
+	}
+	if _, err := client.GetRepoSize(testSecret, "ap-guangzhou", "ns/app"); err == nil {
+		t.Errorf("GetRepoSize stopping short of the tag count should fail")
+	}
+}
+
+func TestGetRepoTagsMaxTags(t *testing.T) {
+	var tags []map[string]interface{}
+	for i := 0; i < 250; i++ {
+		tags = append(tags, map[string]interface{}{"TagName": fmt.Sprintf("v%03d", i)})
+	}
+	client, api := newFakeAPIClient(map[string]apitest.Handler{
+		"DescribeImagePersonal": func(params map[string]interface{}) interface{} {
+			return map[string]interface{}{
+				"Data": map[string]interface{}{"TagInfo": page(tags, params), "TagCount": len(tags)},
+			}
+		},
+	})
+	defer api.Close()
+
+	all, err := client.getRepoTags("id", "key", "ap-guangzhou", "ns/app", 0)
+	if err != nil || len(all) != 250 {
+		t.Errorf("getRepoTags = %v tags, %v, expected 250", len(all), err)
+	}
+	// the listing stops at the page holding the newest maxTags tags
+	calls := api.Calls("DescribeImagePersonal")
+	newest, err := client.getRepoTags("id", "key", "ap-guangzhou", "ns/app", 10)
+	if err != nil || len(newest) != 10 || newest[9] != "v009" || api.Calls("DescribeImagePersonal") != calls+1 {
+		t.Errorf("getRepoTags with maxTags 10 = %v, %v with %v pages requested", newest, err,
+			api.Calls("DescribeImagePersonal")-calls)
+	}
+}
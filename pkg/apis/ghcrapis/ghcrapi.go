@@ -0,0 +1,99 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package ghcrapis
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// GitHubAPIURL is the url of github api the clients created by NewGHCRAPIClient call
+var GitHubAPIURL = "https://api.github.com"
+
+// GHCRAPIClient queries the container packages of ghcr.io by github api
+type GHCRAPIClient struct {
+	httpClient *http.Client
+	url        string
+	token      string
+}
+
+// NewGHCRAPIClient creates a GHCRAPIClient, token is a github personal access token
+// with the read:packages scope
+func NewGHCRAPIClient(token string) *GHCRAPIClient {
+	return &GHCRAPIClient{
+		httpClient: &http.Client{},
+		url:        GitHubAPIURL,
+		token:      token,
+	}
+}
+
+// PackageVisibility returns the visibility(public, private or internal) of the container package
+// ghcr.io/owner/name, owner is an organization or a user
+func (ai *GHCRAPIClient) PackageVisibility(owner, name string) (string, error) {
+	var lastErr error
+	for _, kind := range []string{"orgs", "users"} {
+		path := fmt.Sprintf("/%s/%s/packages/container/%s", kind, url.PathEscape(owner), url.PathEscape(name))
+		statusCode, body, err := ai.do(http.MethodGet, path)
+		if err != nil {
+			return "", err
+		}
+
+		switch statusCode {
+		case http.StatusOK:
+			var pkg struct {
+				Visibility string `json:"visibility"`
+			}
+			if err := json.Unmarshal(body, &pkg); err != nil {
+				return "", fmt.Errorf("decode package %s/%s error: %v", owner, name, err)
+			}
+			return pkg.Visibility, nil
+		case http.StatusNotFound:
+			// owner may be a user rather than an organization
+			lastErr = fmt.Errorf("get package %s/%s returned %d: %s", owner, name, statusCode, string(body))
+		default:
+			return "", fmt.Errorf("get package %s/%s returned %d: %s", owner, name, statusCode, string(body))
+		}
+	}
+	return "", lastErr
+}
+
+func (ai *GHCRAPIClient) do(method, path string) (int, []byte, error) {
+	req, err := http.NewRequest(method, ai.url+path, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+ai.token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	resp, err := ai.httpClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, err
+	}
+
+	return resp.StatusCode, body, nil
+}
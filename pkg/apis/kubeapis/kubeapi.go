@@ -0,0 +1,338 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package kubeapis
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// podListLimit is the page size of listing pods
+const podListLimit = 500
+
+// kubeconfig is the part of a kubeconfig file which is needed to access the api server
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string      `yaml:"name"`
+		Cluster kubeCluster `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Users []struct {
+		Name string   `yaml:"name"`
+		User kubeUser `yaml:"user"`
+	} `yaml:"users"`
+}
+
+// kubeCluster is a cluster of kubeconfig
+type kubeCluster struct {
+	Server                   string `yaml:"server"`
+	CertificateAuthority     string `yaml:"certificate-authority"`
+	CertificateAuthorityData string `yaml:"certificate-authority-data"`
+	InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+}
+
+// kubeUser is a user of kubeconfig, an exec credential plugin like aws or gke-gcloud-auth-plugin
+// is run to get the token or the client certificate
+type kubeUser struct {
+	Token                 string `yaml:"token"`
+	TokenFile             string `yaml:"tokenFile"`
+	ClientCertificate     string `yaml:"client-certificate"`
+	ClientCertificateData string `yaml:"client-certificate-data"`
+	ClientKey             string `yaml:"client-key"`
+	ClientKeyData         string `yaml:"client-key-data"`
+	Username              string `yaml:"username"`
+	Password              string `yaml:"password"`
+	Exec                  *struct {
+		APIVersion string   `yaml:"apiVersion"`
+		Command    string   `yaml:"command"`
+		Args       []string `yaml:"args"`
+		Env        []struct {
+			Name  string `yaml:"name"`
+			Value string `yaml:"value"`
+		} `yaml:"env"`
+	} `yaml:"exec"`
+	AuthProvider *struct {
+		Name string `yaml:"name"`
+	} `yaml:"auth-provider"`
+}
+
+// KubeAPIClient lists the pods of a kubernetes cluster by the api server
+type KubeAPIClient struct {
+	httpClient *http.Client
+	server     string
+	token      string
+	username   string
+	password   string
+}
+
+// NewKubeAPIClient creates a KubeAPIClient with the current context of a kubeconfig file
+func NewKubeAPIClient(path string) (*KubeAPIClient, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read kubeconfig %s error: %v", path, err)
+	}
+	var config kubeconfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("decode kubeconfig %s error: %v", path, err)
+	}
+
+	var clusterName, userName string
+	for _, context := range config.Contexts {
+		if context.Name == config.CurrentContext {
+			clusterName, userName = context.Context.Cluster, context.Context.User
+		}
+	}
+	if clusterName == "" {
+		return nil, fmt.Errorf("current context %q is not found in kubeconfig %s", config.CurrentContext, path)
+	}
+	var cluster *kubeCluster
+	for i := range config.Clusters {
+		if config.Clusters[i].Name == clusterName {
+			cluster = &config.Clusters[i].Cluster
+		}
+	}
+	if cluster == nil || cluster.Server == "" {
+		return nil, fmt.Errorf("cluster %s is not found in kubeconfig %s", clusterName, path)
+	}
+	user := &kubeUser{}
+	for i := range config.Users {
+		if config.Users[i].Name == userName {
+			user = &config.Users[i].User
+		}
+	}
+
+	// the relative files are relative to the kubeconfig file
+	dir := filepath.Dir(path)
+	tlsConfig := &tls.Config{InsecureSkipVerify: cluster.InsecureSkipTLSVerify}
+	caData, err := readData(dir, cluster.CertificateAuthorityData, cluster.CertificateAuthority)
+	if err != nil {
+		return nil, fmt.Errorf("read certificate authority of cluster %s error: %v", clusterName, err)
+	}
+	if len(caData) != 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("no certificate is found in certificate authority of cluster %s", clusterName)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	ai := &KubeAPIClient{
+		server:   strings.TrimSuffix(cluster.Server, "/"),
+		username: user.Username,
+		password: user.Password,
+	}
+	var certData, keyData []byte
+	switch {
+	case user.AuthProvider != nil:
+		return nil, fmt.Errorf("auth provider %s of user %s is not supported, use an exec plugin instead",
+			user.AuthProvider.Name, userName)
+	case user.Exec != nil:
+		if ai.token, certData, keyData, err = runExecPlugin(user); err != nil {
+			return nil, fmt.Errorf("run exec plugin %s of user %s error: %v", user.Exec.Command, userName, err)
+		}
+	default:
+		ai.token = user.Token
+		if ai.token == "" && user.TokenFile != "" {
+			token, err := readData(dir, "", user.TokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("read token file of user %s error: %v", userName, err)
+			}
+			ai.token = strings.TrimSpace(string(token))
+		}
+		if certData, err = readData(dir, user.ClientCertificateData, user.ClientCertificate); err != nil {
+			return nil, fmt.Errorf("read client certificate of user %s error: %v", userName, err)
+		}
+		if keyData, err = readData(dir, user.ClientKeyData, user.ClientKey); err != nil {
+			return nil, fmt.Errorf("read client key of user %s error: %v", userName, err)
+		}
+	}
+	if len(certData) != 0 && len(keyData) != 0 {
+		cert, err := tls.X509KeyPair(certData, keyData)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate of user %s error: %v", userName, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	ai.httpClient = &http.Client{Transport: transport}
+	return ai, nil
+}
+
+// readData returns the base64 decoded data, or the content of file if data is empty
+func readData(dir, data, file string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if file == "" {
+		return nil, nil
+	}
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(dir, file)
+	}
+	return ioutil.ReadFile(file)
+}
+
+// runExecPlugin runs the exec credential plugin of a user, it returns the token or the client certificate
+func runExecPlugin(user *kubeUser) (string, []byte, []byte, error) {
+	cmd := exec.Command(user.Exec.Command, user.Exec.Args...)
+	cmd.Env = os.Environ()
+	for _, env := range user.Exec.Env {
+		cmd.Env = append(cmd.Env, env.Name+"="+env.Value)
+	}
+	cmd.Env = append(cmd.Env, fmt.Sprintf(`KUBERNETES_EXEC_INFO={"apiVersion":%q,"kind":"ExecCredential",`+
+		`"spec":{"interactive":false}}`, user.Exec.APIVersion))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var credential struct {
+		Status struct {
+			Token                 string `json:"token"`
+			ClientCertificateData string `json:"clientCertificateData"`
+			ClientKeyData         string `json:"clientKeyData"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal(output, &credential); err != nil {
+		return "", nil, nil, fmt.Errorf("decode exec credential error: %v", err)
+	}
+	return credential.Status.Token, []byte(credential.Status.ClientCertificateData),
+		[]byte(credential.Status.ClientKeyData), nil
+}
+
+// ListPodImages returns the images of the containers, init containers and ephemeral containers of
+// the pods in namespaces, the pods of all namespaces are listed if namespaces is empty. The images
+// are returned as they are in the pod specs, they may be duplicated
+func (ai *KubeAPIClient) ListPodImages(namespaces []string) ([]string, error) {
+	paths := []string{"/api/v1/pods"}
+	if len(namespaces) != 0 {
+		paths = paths[:0]
+		for _, namespace := range namespaces {
+			paths = append(paths, "/api/v1/namespaces/"+url.PathEscape(namespace)+"/pods")
+		}
+	}
+
+	var images []string
+	for _, path := range paths {
+		continueToken := ""
+		for {
+			query := url.Values{}
+			query.Set("limit", fmt.Sprint(podListLimit))
+			if continueToken != "" {
+				query.Set("continue", continueToken)
+			}
+			statusCode, body, err := ai.do(http.MethodGet, path+"?"+query.Encode())
+			if err != nil {
+				return nil, err
+			}
+			if statusCode != http.StatusOK {
+				return nil, fmt.Errorf("list pods by %s returned %d: %s", path, statusCode, string(body))
+			}
+
+			var pods podList
+			if err := json.Unmarshal(body, &pods); err != nil {
+				return nil, fmt.Errorf("decode pods of %s error: %v", path, err)
+			}
+			for _, pod := range pods.Items {
+				for _, containers := range [][]container{pod.Spec.Containers, pod.Spec.InitContainers,
+					pod.Spec.EphemeralContainers} {
+					for _, c := range containers {
+						if c.Image != "" {
+							images = append(images, c.Image)
+						}
+					}
+				}
+			}
+
+			if continueToken = pods.Metadata.Continue; continueToken == "" {
+				break
+			}
+		}
+	}
+	return images, nil
+}
+
+// container is a container of a pod spec
+type container struct {
+	Image string `json:"image"`
+}
+
+// podList is the part of a pod list which holds the images
+type podList struct {
+	Metadata struct {
+		Continue string `json:"continue"`
+	} `json:"metadata"`
+	Items []struct {
+		Spec struct {
+			Containers          []container `json:"containers"`
+			InitContainers      []container `json:"initContainers"`
+			EphemeralContainers []container `json:"ephemeralContainers"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+func (ai *KubeAPIClient) do(method, path string) (int, []byte, error) {
+	req, err := http.NewRequest(method, ai.server+path, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	if ai.token != "" {
+		req.Header.Set("Authorization", "Bearer "+ai.token)
+	} else if ai.username != "" {
+		req.SetBasicAuth(ai.username, ai.password)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := ai.httpClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, err
+	}
+
+	return resp.StatusCode, body, nil
+}
@@ -0,0 +1,279 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package kubeapis
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeAPIServer is a tls kubernetes api server which lists a page of one pod per request, the
+// pods of a namespace are named by the namespace and the page number
+type fakeAPIServer struct {
+	*httptest.Server
+	pages int
+
+	mu            sync.Mutex
+	authorization []string
+	paths         []string
+}
+
+func newFakeAPIServer(pages int) *fakeAPIServer {
+	s := &fakeAPIServer{pages: pages}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.authorization = append(s.authorization, r.Header.Get("Authorization"))
+		s.paths = append(s.paths, r.URL.Path)
+		s.mu.Unlock()
+
+		namespace := "all"
+		if parts := strings.Split(r.URL.Path, "/"); len(parts) == 6 && parts[3] == "namespaces" {
+			namespace = parts[4]
+		} else if r.URL.Path != "/api/v1/pods" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("limit") != fmt.Sprint(podListLimit) {
+			http.Error(w, "unexpected limit", http.StatusBadRequest)
+			return
+		}
+		page := 0
+		if token := r.URL.Query().Get("continue"); token != "" {
+			fmt.Sscanf(token, "page-%d", &page)
+		}
+		continueToken := ""
+		if page+1 < s.pages {
+			continueToken = fmt.Sprintf("page-%d", page+1)
+		}
+		fmt.Fprintf(w, `{"metadata":{"continue":%q},"items":[{"spec":{"containers":[{"image":"%s:%d"}],`+
+			`"initContainers":[{"image":"init"}],"ephemeralContainers":[{"image":""}]}}]}`,
+			continueToken, namespace, page)
+	}))
+	return s
+}
+
+// caPEM returns the pem encoded certificate of the server
+func (s *fakeAPIServer) caPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+}
+
+// writeKubeconfig writes the files to a temporary directory and returns the path of kubeconfig in it
+func writeKubeconfig(t *testing.T, kubeconfig string, files map[string][]byte) string {
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, "kubeconfig")
+	if err := ioutil.WriteFile(path, []byte(kubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testKubeconfig returns a kubeconfig whose current context uses the cluster and the user, the other
+// context points to a cluster which does not exist
+func testKubeconfig(cluster, user string) string {
+	return `apiVersion: v1
+kind: Config
+current-context: test
+clusters:
+- name: other
+  cluster:
+    server: https://127.0.0.1:1
+- name: test
+  cluster:
+` + cluster + `
+contexts:
+- name: other
+  context:
+    cluster: other
+    user: other
+- name: test
+  context:
+    cluster: test
+    user: test
+users:
+- name: other
+  user:
+    token: other-token
+- name: test
+  user:
+` + user + "\n"
+}
+
+func TestNewKubeAPIClientAuth(t *testing.T) {
+	server := newFakeAPIServer(1)
+	defer server.Close()
+	caData := base64.StdEncoding.EncodeToString(server.caPEM())
+	basicAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:secret"))
+
+	cases := []struct {
+		name          string
+		cluster       string
+		user          string
+		authorization string
+	}{
+		{"token", "    server: " + server.URL + "/\n    certificate-authority-data: " + caData,
+			"    token: abc", "Bearer abc"},
+		{"token file", "    server: " + server.URL + "\n    certificate-authority: ca.crt",
+			"    tokenFile: token", "Bearer file-token"},
+		{"basic auth", "    server: " + server.URL + "\n    insecure-skip-tls-verify: true",
+			"    username: admin\n    password: secret", basicAuth},
+		{"exec plugin", "    server: " + server.URL + "\n    certificate-authority: ca.crt",
+			`    exec:
+      apiVersion: client.authentication.k8s.io/v1beta1
+      command: sh
+      args:
+      - -c
+      - 'echo "{\"status\":{\"token\":\"$PREFIX-$(echo $KUBERNETES_EXEC_INFO | grep -c v1beta1)\"}}"'
+      env:
+      - name: PREFIX
+        value: exec`, "Bearer exec-1"},
+		{"anonymous", "    server: " + server.URL + "\n    certificate-authority: ca.crt", "    {}", ""},
+	}
+	for _, c := range cases {
+		path := writeKubeconfig(t, testKubeconfig(c.cluster, c.user), map[string][]byte{
+			"ca.crt": server.caPEM(),
+			"token":  []byte("file-token\n"),
+		})
+		ai, err := NewKubeAPIClient(path)
+		if err != nil {
+			t.Errorf("%s: NewKubeAPIClient error: %v", c.name, err)
+			continue
+		}
+		images, err := ai.ListPodImages(nil)
+		if err != nil {
+			t.Errorf("%s: ListPodImages error: %v", c.name, err)
+			continue
+		}
+		if expected := []string{"all:0", "init"}; !reflect.DeepEqual(images, expected) {
+			t.Errorf("%s: expected images %v, got %v", c.name, expected, images)
+		}
+		server.mu.Lock()
+		authorization := server.authorization[len(server.authorization)-1]
+		server.mu.Unlock()
+		if authorization != c.authorization {
+			t.Errorf("%s: expected authorization %q, got %q", c.name, c.authorization, authorization)
+		}
+	}
+}
+
+func TestNewKubeAPIClientUntrustedServer(t *testing.T) {
+	server := newFakeAPIServer(1)
+	defer server.Close()
+
+	path := writeKubeconfig(t, testKubeconfig("    server: "+server.URL, "    token: abc"), nil)
+	ai, err := NewKubeAPIClient(path)
+	if err != nil {
+		t.Fatalf("NewKubeAPIClient error: %v", err)
+	}
+	if _, err := ai.ListPodImages(nil); err == nil {
+		t.Errorf("ListPodImages of a server signed by an unknown authority should fail")
+	}
+}
+
+func TestNewKubeAPIClientInvalid(t *testing.T) {
+	cases := []struct {
+		name       string
+		kubeconfig string
+		files      map[string][]byte
+		err        string
+	}{
+		{"not yaml", "clusters: [", nil, "decode kubeconfig"},
+		{"missing context", strings.Replace(testKubeconfig("    server: https://127.0.0.1", "    token: abc"),
+			"current-context: test", "current-context: missing", 1), nil, `current context "missing" is not found`},
+		{"missing server", testKubeconfig("    insecure-skip-tls-verify: true", "    token: abc"), nil,
+			"cluster test is not found"},
+		{"missing ca file", testKubeconfig("    server: https://127.0.0.1\n    certificate-authority: ca.crt",
+			"    token: abc"), nil, "read certificate authority of cluster test"},
+		{"invalid ca", testKubeconfig("    server: https://127.0.0.1\n    certificate-authority: ca.crt",
+			"    token: abc"), map[string][]byte{"ca.crt": []byte("not a certificate")},
+			"no certificate is found in certificate authority of cluster test"},
+		{"invalid ca data", testKubeconfig("    server: https://127.0.0.1\n    certificate-authority-data: '!'",
+			"    token: abc"), nil, "read certificate authority of cluster test"},
+		{"missing token file", testKubeconfig("    server: https://127.0.0.1", "    tokenFile: token"), nil,
+			"read token file of user test"},
+		{"invalid client certificate", testKubeconfig("    server: https://127.0.0.1",
+			"    client-certificate: tls.crt\n    client-key: tls.key"),
+			map[string][]byte{"tls.crt": []byte("cert"), "tls.key": []byte("key")},
+			"load client certificate of user test"},
+		{"auth provider", testKubeconfig("    server: https://127.0.0.1", "    auth-provider:\n      name: gcp"), nil,
+			"auth provider gcp of user test is not supported"},
+		{"failed exec plugin", testKubeconfig("    server: https://127.0.0.1",
+			"    exec:\n      command: sh\n      args: ['-c', 'echo expired >&2; exit 1']"), nil,
+			"run exec plugin sh of user test error: exit status 1: expired"},
+		{"invalid exec credential", testKubeconfig("    server: https://127.0.0.1",
+			"    exec:\n      command: sh\n      args: ['-c', 'echo token']"), nil, "decode exec credential error"},
+	}
+	for _, c := range cases {
+		path := writeKubeconfig(t, c.kubeconfig, c.files)
+		if _, err := NewKubeAPIClient(path); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expected error containing %q, got %v", c.name, c.err, err)
+		}
+	}
+	if _, err := NewKubeAPIClient(filepath.Join(os.TempDir(), "missing-kubeconfig")); err == nil ||
+		!strings.Contains(err.Error(), "read kubeconfig") {
+		t.Errorf("expected a read error of a missing kubeconfig, got %v", err)
+	}
+}
+
+func TestListPodImagesPages(t *testing.T) {
+	server := newFakeAPIServer(3)
+	defer server.Close()
+
+	path := writeKubeconfig(t, testKubeconfig("    server: "+server.URL+"\n    certificate-authority: ca.crt",
+		"    token: abc"), map[string][]byte{"ca.crt": server.caPEM()})
+	ai, err := NewKubeAPIClient(path)
+	if err != nil {
+		t.Fatalf("NewKubeAPIClient error: %v", err)
+	}
+	images, err := ai.ListPodImages([]string{"default", "kube system"})
+	if err != nil {
+		t.Fatalf("ListPodImages error: %v", err)
+	}
+	expected := []string{"default:0", "init", "default:1", "init", "default:2", "init",
+		"kube system:0", "init", "kube system:1", "init", "kube system:2", "init"}
+	if !reflect.DeepEqual(images, expected) {
+		t.Errorf("expected images %v, got %v", expected, images)
+	}
+	if len(server.paths) != 6 || server.paths[5] != "/api/v1/namespaces/kube system/pods" {
+		t.Errorf("expected 3 pages of each namespace, got requests of %v", server.paths)
+	}
+
+	server.pages = 1
+	if _, err := ai.ListPodImages([]string{"a/b"}); err == nil || !strings.Contains(err.Error(), "returned 404") {
+		t.Errorf("expected a 404 error of an unknown path, got %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package quayapis
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+const (
+	// VisibilityPublic is the visibility of a public quay repository
+	VisibilityPublic = "public"
+	// VisibilityPrivate is the visibility of a private quay repository
+	VisibilityPrivate = "private"
+)
+
+// QuayAPIClient wrap http client
+type QuayAPIClient struct {
+	httpClient *http.Client
+	url        string
+	token      string
+}
+
+type createRepositoryRequest struct {
+	Namespace   string `json:"namespace"`
+	Repository  string `json:"repository"`
+	Visibility  string `json:"visibility"`
+	Description string `json:"description"`
+	RepoKind    string `json:"repo_kind"`
+}
+
+// NewQuayAPIClient is new return *QuayAPIClient, registry is the host of quay,
+// token is the OAuth token of a quay application
+func NewQuayAPIClient(registry, token string, insecure bool) *QuayAPIClient {
+	httpclient := http.Client{}
+	if insecure {
+		httpclient.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+	}
+
+	return &QuayAPIClient{
+		httpClient: &httpclient,
+		url:        "https://" + registry + "/api/v1",
+		token:      token,
+	}
+}
+
+// RepositoryExist checks if the repository exists in quay
+func (ai *QuayAPIClient) RepositoryExist(namespace, repository string) (bool, error) {
+	path := fmt.Sprintf("/repository/%s/%s", url.PathEscape(namespace), url.PathEscape(repository))
+	statusCode, body, err := ai.do(http.MethodGet, path, nil)
+	if err != nil {
+		return false, err
+	}
+
+	switch statusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("get quay repository %s/%s returned %d: %s",
+			namespace, repository, statusCode, string(body))
+	}
+}
+
+// CreateRepository creates a repository in quay with the visibility
+func (ai *QuayAPIClient) CreateRepository(namespace, repository, visibility string) error {
+	reqBody, err := json.Marshal(&createRepositoryRequest{
+		Namespace:  namespace,
+		Repository: repository,
+		Visibility: visibility,
+		RepoKind:   "image",
+	})
+	if err != nil {
+		return err
+	}
+
+	statusCode, body, err := ai.do(http.MethodPost, "/repository", reqBody)
+	if err != nil {
+		return err
+	}
+
+	if statusCode != http.StatusCreated && statusCode != http.StatusOK {
+		return fmt.Errorf("create quay repository %s/%s returned %d: %s",
+			namespace, repository, statusCode, string(body))
+	}
+
+	return nil
+}
+
+// EnsureRepository creates the repository if not exists, an existing repository is left untouched
+func (ai *QuayAPIClient) EnsureRepository(namespace, repository, visibility string) (bool, error) {
+	exist, err := ai.RepositoryExist(namespace, repository)
+	if err != nil {
+		return false, err
+	}
+	if exist {
+		return false, nil
+	}
+
+	if err := ai.CreateRepository(namespace, repository, visibility); err != nil {
+		// the repository may be created by another job at the same time
+		if exist, checkErr := ai.RepositoryExist(namespace, repository); checkErr == nil && exist {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (ai *QuayAPIClient) do(method, path string, reqBody []byte) (int, []byte, error) {
+	req, err := http.NewRequest(method, ai.url+path, bytes.NewReader(reqBody))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+ai.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := ai.httpClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, err
+	}
+
+	return resp.StatusCode, body, nil
+}
@@ -0,0 +1,116 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package ssmapis
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
+	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/profile"
+	ssm "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/ssm/v20190923"
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/apis/apicall"
+	"tkestack.io/image-transfer/pkg/apis/stsapis"
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+const (
+	ssmEndpoint      = "ssm.tencentcloudapi.com"
+	defaultVersionID = "SSM_Current"
+)
+
+// secretNames are the entries of the secret file which are tried in order for the ssm api
+var secretNames = []string{"ssm", "tcr", "ccr"}
+
+// SecretProvider reads username and password of security entries from tencent cloud secrets manager
+type SecretProvider struct{}
+
+// Resolve implements configs.SecretProvider, the secret is a json object with the username and
+// password keys, or the password itself
+func (SecretProvider) Resolve(c *configs.Configs, entry string, security configs.Security) (string, string, error) {
+	if security.SSMSecretName == "" || security.SSMRegion == "" {
+		return "", "", fmt.Errorf("ssmSecretName and ssmRegion should be set")
+	}
+	secretID, secretKey, err := credentialOf(c)
+	if err != nil {
+		return "", "", err
+	}
+
+	versionID := security.SSMVersionID
+	if versionID == "" {
+		versionID = defaultVersionID
+	}
+	cpf := profile.NewClientProfile()
+	cpf.HttpProfile.Endpoint = ssmEndpoint
+
+	request := ssm.NewGetSecretValueRequest()
+	request.SecretName = common.StringPtr(security.SSMSecretName)
+	request.VersionId = common.StringPtr(versionID)
+
+	var response *ssm.GetSecretValueResponse
+	err = apicall.Do(secretID, secretKey, func(credential *common.Credential) error {
+		client, _ := ssm.NewClient(credential, security.SSMRegion, cpf)
+		var err error
+		response, err = client.GetSecretValue(request)
+		return err
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("get secret %s error: %v", security.SSMSecretName, err)
+	}
+	if response.Response == nil || response.Response.SecretString == nil {
+		return "", "", fmt.Errorf("secret %s has no secret string", security.SSMSecretName)
+	}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal([]byte(*response.Response.SecretString), &values); err != nil {
+		if security.Username == "" {
+			return "", "", fmt.Errorf("secret %s is not a json object and username is not set",
+				security.SSMSecretName)
+		}
+		return security.Username, *response.Response.SecretString, nil
+	}
+	return configs.SecretKeyValues(values, security)
+}
+
+// credentialOf returns the secret id and key to call the ssm api, the "ssm", "tcr" or "ccr" entry of
+// the secret file is used, or TENCENTCLOUD_SECRET_ID and TENCENTCLOUD_SECRET_KEY if there is none
+func credentialOf(c *configs.Configs) (string, string, error) {
+	secret := c.Secret
+	if secret == nil && c.FlagConf.Config.SecretFile != "" {
+		var err error
+		if secret, err = c.GetSecret(); err != nil {
+			return "", "", err
+		}
+	}
+	for _, name := range secretNames {
+		if s, ok := secret[name]; ok {
+			return stsapis.GetSecret(s)
+		}
+	}
+
+	secretID, secretKey := os.Getenv("TENCENTCLOUD_SECRET_ID"), os.Getenv("TENCENTCLOUD_SECRET_KEY")
+	if secretID == "" || secretKey == "" {
+		return "", "", fmt.Errorf("no ssm, tcr or ccr entry in secret file and " +
+			"TENCENTCLOUD_SECRET_ID or TENCENTCLOUD_SECRET_KEY is not set")
+	}
+	log.AddSecrets(secretKey)
+	return secretID, secretKey, nil
+}
@@ -0,0 +1,179 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package stsapis
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
+	sdkerrors "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/errors"
+	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/profile"
+	sts "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/sts/v20180813"
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+const (
+	defaultRoleSessionName = "image-transfer"
+	defaultDurationSeconds = 7200
+	// temporary credentials are refreshed when they expire in refreshBefore
+	refreshBefore = 5 * time.Minute
+	stsRegion     = "ap-guangzhou"
+)
+
+// temporaryCredential is the temporary credential of a role
+type temporaryCredential struct {
+	secretID   string
+	secretKey  string
+	token      string
+	expiration time.Time
+
+	// secret is used to assume the role again
+	secret configs.Secret
+}
+
+var (
+	// roleCredentials caches the temporary credentials, keyed by role arn
+	roleCredentials = make(map[string]*temporaryCredential)
+	// secretIDRoles are the role arns of temporary secret ids, the old secret ids
+	// are kept to find the refreshed credentials of their roles
+	secretIDRoles = make(map[string]string)
+	mutex         sync.Mutex
+)
+
+// GetSecret returns the secret id and key of a secret, the temporary credentials
+// of the role are returned if RoleArn is set
+func GetSecret(secret configs.Secret) (string, string, error) {
+	if secret.RoleArn == "" {
+		return secret.SecretID, secret.SecretKey, nil
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	credential, err := getRoleCredential(secret)
+	if err != nil {
+		return "", "", err
+	}
+	return credential.secretID, credential.secretKey, nil
+}
+
+// NewCredential creates the credential of a secret id and key, the token is added for temporary
+// credentials, and the temporary credentials are refreshed if they are about to expire
+func NewCredential(secretID, secretKey string) *common.Credential {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	roleArn, ok := secretIDRoles[secretID]
+	if !ok {
+		return common.NewCredential(secretID, secretKey)
+	}
+
+	credential, err := getRoleCredential(roleCredentials[roleArn].secret)
+	if err != nil {
+		// the call fails with the old credential and is retried by callers
+		log.Errorf("refresh temporary credentials of %s error: %v", roleArn, err)
+		credential = roleCredentials[roleArn]
+	}
+	return common.NewTokenCredential(credential.secretID, credential.secretKey, credential.token)
+}
+
+// InvalidateExpired drops the temporary credentials of a secret id if err means they are expired,
+// they are refreshed by the next NewCredential
+func InvalidateExpired(secretID string, err error) bool {
+	sdkErr, ok := err.(*sdkerrors.TencentCloudSDKError)
+	if !ok || (sdkErr.GetCode() != "AuthFailure.TokenFailure" &&
+		sdkErr.GetCode() != "AuthFailure.SecretIdNotFound") {
+		return false
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	roleArn, ok := secretIDRoles[secretID]
+	if !ok {
+		return false
+	}
+	roleCredentials[roleArn].expiration = time.Time{}
+	return true
+}
+
+// getRoleCredential returns the cached temporary credential of a role, the role is
+// assumed if no credential is cached or it is about to expire, mutex should be held
+func getRoleCredential(secret configs.Secret) (*temporaryCredential, error) {
+	credential, ok := roleCredentials[secret.RoleArn]
+	if ok && time.Now().Add(refreshBefore).Before(credential.expiration) {
+		return credential, nil
+	}
+
+	credential, err := assumeRole(secret)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("assume role %s successfully, the temporary credentials expire at %v",
+		secret.RoleArn, credential.expiration)
+
+	// the old secret ids of the role are kept to find the new credential
+	roleCredentials[secret.RoleArn] = credential
+	secretIDRoles[credential.secretID] = secret.RoleArn
+	return credential, nil
+}
+
+// assumeRole is sts api AssumeRole
+func assumeRole(secret configs.Secret) (*temporaryCredential, error) {
+	cpf := profile.NewClientProfile()
+	cpf.HttpProfile.Endpoint = "sts.tencentcloudapi.com"
+	client, _ := sts.NewClient(common.NewCredential(secret.SecretID, secret.SecretKey), stsRegion, cpf)
+
+	sessionName := secret.RoleSessionName
+	if sessionName == "" {
+		sessionName = defaultRoleSessionName
+	}
+	durationSeconds := secret.DurationSeconds
+	if durationSeconds == 0 {
+		durationSeconds = defaultDurationSeconds
+	}
+
+	request := sts.NewAssumeRoleRequest()
+	request.RoleArn = common.StringPtr(secret.RoleArn)
+	request.RoleSessionName = common.StringPtr(sessionName)
+	request.DurationSeconds = common.Uint64Ptr(durationSeconds)
+
+	response, err := client.AssumeRole(request)
+	if err != nil {
+		return nil, fmt.Errorf("assume role %s error: %v", secret.RoleArn, err)
+	}
+
+	credentials := response.Response.Credentials
+	if credentials == nil || credentials.TmpSecretId == nil || credentials.TmpSecretKey == nil ||
+		credentials.Token == nil || response.Response.ExpiredTime == nil {
+		return nil, fmt.Errorf("assume role %s returned incomplete credentials", secret.RoleArn)
+	}
+	log.AddSecrets(*credentials.TmpSecretKey, *credentials.Token)
+
+	return &temporaryCredential{
+		secretID:   *credentials.TmpSecretId,
+		secretKey:  *credentials.TmpSecretKey,
+		token:      *credentials.Token,
+		expiration: time.Unix(*response.Response.ExpiredTime, 0),
+		secret:     secret,
+	}, nil
+}
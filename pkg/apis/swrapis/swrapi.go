@@ -0,0 +1,293 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package swrapis
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+const (
+	signAlgorithm = "SDK-HMAC-SHA256"
+	sdkDateFormat = "20060102T150405Z"
+	headerSdkDate = "X-Sdk-Date"
+)
+
+// SWRAPIClient wrap http client
+type SWRAPIClient struct {
+	httpClient *http.Client
+	url        string
+}
+
+// Namespace is a swr organization
+type Namespace struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	CreatorName string `json:"creator_name"`
+	Auth        int64  `json:"auth"`
+}
+
+// Repository is a swr repository
+type Repository struct {
+	Name        string `json:"name"`
+	Namespace   string `json:"namespace"`
+	Category    string `json:"category"`
+	Description string `json:"description"`
+	IsPublic    bool   `json:"is_public"`
+	NumImages   int64  `json:"num_images"`
+	Path        string `json:"path"`
+}
+
+type namespaceListResp struct {
+	Namespaces []Namespace `json:"namespaces"`
+}
+
+// NewSWRAPIClient is new return *SWRAPIClient
+func NewSWRAPIClient() *SWRAPIClient {
+	httpclient := http.Client{}
+	ai := SWRAPIClient{httpClient: &httpclient}
+
+	return &ai
+}
+
+// GetAllNamespaceByName get all organizations of swr
+func (ai *SWRAPIClient) GetAllNamespaceByName(secret map[string]configs.Secret, region string) ([]string, error) {
+
+	var nsList []string
+
+	ak, sk, err := GetSwrSecret(secret)
+	if err != nil {
+		log.Errorf("GetSwrSecret error: %v", err)
+		return nsList, err
+	}
+
+	var resp namespaceListResp
+	if _, err := ai.doRequest(ak, sk, region, "/v2/manage/namespaces", nil, &resp); err != nil {
+		log.Errorf("ListNamespaces error, %v", err)
+		return nsList, err
+	}
+
+	for _, ns := range resp.Namespaces {
+		nsList = append(nsList, ns.Name)
+	}
+
+	return nsList, nil
+}
+
+// GenerateAllSwrRules generate all swr rules, the key of rules map is target and value is source
+func (ai *SWRAPIClient) GenerateAllSwrRules(secret map[string]configs.Secret, swrRegion string,
+	nsList []string, failedNsList []string, tcrName string) (map[string]string, error) {
+
+	rulesMap := make(map[string]string)
+
+	ak, sk, err := GetSwrSecret(secret)
+	if err != nil {
+		log.Errorf("GetSwrSecret error: %v", err)
+		return rulesMap, err
+	}
+
+	for _, ns := range nsList {
+		if utils.IsContain(failedNsList, ns) {
+			continue
+		}
+
+		repos, err := ai.ListRepositories(ak, sk, swrRegion, ns)
+		if err != nil {
+			log.Errorf("get swr repo of namespace %s error: %v", ns, err)
+			return nil, err
+		}
+
+		for _, repo := range repos {
+			// tags are listed by the registry api when the jobs are generated
+			source := fmt.Sprintf("swr.%s.myhuaweicloud.com/%s/%s", swrRegion, ns, repo.Name)
+			target := tcrName + ".tencentcloudcr.com/" + ns + "/" + repo.Name
+			rulesMap[target] = source
+		}
+	}
+
+	jsonStr, err := json.Marshal(rulesMap)
+	if err != nil {
+		log.Errorf("Marshal swr rules map error %v, ", err)
+	}
+	go func() {
+		err = ioutil.WriteFile("./swr_to_tcr_rules", []byte(jsonStr), 0666)
+		if err != nil {
+			log.Errorf("WriteFile swr rules error %v, ", err)
+		}
+	}()
+
+	return rulesMap, nil
+}
+
+// ListRepositories is swr api ListReposDetails, return all repositories of a namespace
+func (ai *SWRAPIClient) ListRepositories(ak, sk, region, namespace string) ([]Repository, error) {
+	var result []Repository
+
+	offset := 0
+	limit := 100
+
+	for {
+		query := url.Values{}
+		query.Set("namespace", namespace)
+		query.Set("offset", strconv.Itoa(offset))
+		query.Set("limit", strconv.Itoa(limit))
+
+		var repos []Repository
+		if _, err := ai.doRequest(ak, sk, region, "/v2/manage/repos", query, &repos); err != nil {
+			return nil, err
+		}
+		result = append(result, repos...)
+
+		if len(repos) < limit {
+			break
+		}
+		offset += limit
+	}
+
+	return result, nil
+}
+
+// doRequest sends a signed GET request to swr api and decode the response body into target
+func (ai *SWRAPIClient) doRequest(ak, sk, region, path string, query url.Values,
+	target interface{}) (*http.Response, error) {
+
+	u := url.URL{
+		Scheme:   "https",
+		Host:     fmt.Sprintf("swr-api.%s.myhuaweicloud.com", region),
+		Path:     path,
+		RawQuery: query.Encode(),
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	signRequest(req, ak, sk, nil, time.Now().UTC())
+
+	resp, err := ai.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp, fmt.Errorf("swr api %s returned %d: %s", path, resp.StatusCode, string(body))
+	}
+
+	if err := json.Unmarshal(body, target); err != nil {
+		return resp, fmt.Errorf("decode swr api %s response error: %v", path, err)
+	}
+
+	return resp, nil
+}
+
+// signRequest signs a request with huawei cloud AK/SK (SDK-HMAC-SHA256)
+func signRequest(req *http.Request, ak, sk string, body []byte, now time.Time) {
+	sdkDate := now.Format(sdkDateFormat)
+	req.Header.Set(headerSdkDate, sdkDate)
+	req.Header.Set("Host", req.URL.Host)
+
+	signedHeaders := make([]string, 0, len(req.Header))
+	headerValues := make(map[string]string)
+	for name, values := range req.Header {
+		lowerName := strings.ToLower(name)
+		signedHeaders = append(signedHeaders, lowerName)
+		headerValues[lowerName] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	sort.Strings(signedHeaders)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range signedHeaders {
+		canonicalHeaders.WriteString(name + ":" + headerValues[name] + "\n")
+	}
+
+	canonicalURI := req.URL.EscapedPath()
+	if !strings.HasSuffix(canonicalURI, "/") {
+		canonicalURI += "/"
+	}
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var canonicalQuery []string
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			canonicalQuery = append(canonicalQuery, url.QueryEscape(k)+"="+url.QueryEscape(v))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		strings.Join(canonicalQuery, "&"),
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		hashHex(body),
+	}, "\n")
+
+	stringToSign := strings.Join([]string{signAlgorithm, sdkDate, hashHex([]byte(canonicalRequest))}, "\n")
+
+	mac := hmac.New(sha256.New, []byte(sk))
+	mac.Write([]byte(stringToSign))
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Access=%s, SignedHeaders=%s, Signature=%s",
+		signAlgorithm, ak, strings.Join(signedHeaders, ";"), signature))
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// GetSwrSecret get swr AK/SK from configs
+func GetSwrSecret(secret map[string]configs.Secret) (string, string, error) {
+	if swr, ok := secret["swr"]; ok {
+		return swr.SecretID, swr.SecretKey, nil
+	}
+
+	return "", "", errors.New("no swr secret provided in secret file")
+}
@@ -19,30 +19,90 @@
 package tcrapis
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"regexp"
+	"strings"
+	"sync"
 
 	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
 	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/profile"
 	tcr "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/tcr/v20190924"
 	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/apis/apicall"
+	"tkestack.io/image-transfer/pkg/apis/stsapis"
 	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/utils"
 )
 
+// namespaceNameRegexp is the naming rule of tcr namespace: lower case letters and digits,
+// which can be separated by ".", "_" or "-"
+var namespaceNameRegexp = regexp.MustCompile(`^[a-z0-9]+(?:[._-][a-z0-9]+)*$`)
+
+// DefaultEndpoint is the public domain of tencent cloud api of tcr and ccr
+const DefaultEndpoint = "tcr.tencentcloudapi.com"
+
+// maxPages is the safety cap of a paged listing, it stops a listing which never reaches the total count
+const maxPages = 10000
+
+// SpecQuota is the default quotas of a tcr instance specification
+type SpecQuota struct {
+	Namespaces   int64
+	Repositories int64
+}
+
+// SpecQuotas are the default quotas of tcr instance specifications keyed by registry type,
+// the quotas raised by a ticket are not reflected
+var SpecQuotas = map[string]SpecQuota{
+	"basic":    {Namespaces: 50, Repositories: 500},
+	"standard": {Namespaces: 100, Repositories: 3000},
+	"premium":  {Namespaces: 500, Repositories: 5000},
+}
+
 // TCRAPIClient wrap http client
 type TCRAPIClient struct {
 	httpClient *http.Client
 	url        string
+
+	// endpoint is the domain of tencent cloud api, it may be a private endpoint
+	endpoint string
+
+	// nsCache caches the namespace listing of a tcr instance, keyed by tcr name
+	nsCache      map[string]*namespaceCache
+	nsCacheMutex sync.Mutex
+}
+
+// namespaceCache is the cached namespace listing of a tcr instance
+type namespaceCache struct {
+	tcrID      string
+	namespaces []string
 }
 
 // NewTCRAPIClient is new return *CCRAPIClient
 func NewTCRAPIClient() *TCRAPIClient {
 	httpclient := http.Client{}
-	ai := TCRAPIClient{httpClient: &httpclient}
+	ai := TCRAPIClient{
+		httpClient: &httpclient,
+		endpoint:   DefaultEndpoint,
+		nsCache:    make(map[string]*namespaceCache),
+	}
 
 	return &ai
 }
 
+// WithEndpoint sets the domain of tencent cloud api and the transport to call it,
+// a transport with a custom CA is required by a private endpoint with a private certificate
+func (ai *TCRAPIClient) WithEndpoint(endpoint string, transport http.RoundTripper) *TCRAPIClient {
+	if endpoint != "" {
+		ai.endpoint = endpoint
+	}
+	ai.httpClient.Transport = transport
+	return ai
+}
+
 // GetAllNamespaceByName get all ns from tcr name
 func (ai *TCRAPIClient) GetAllNamespaceByName(secret map[string]configs.Secret,
 	region string, tcrName string) ([]string, string, error) {
@@ -52,7 +112,7 @@ func (ai *TCRAPIClient) GetAllNamespaceByName(secret map[string]configs.Secret,
 	secretID, secretKey, err := GetTcrSecret(secret)
 
 	if err != nil {
-		log.Errorf("GetTcrSecret error: ", err)
+		log.Errorf("GetTcrSecret error: %v", err)
 		return nsList, tcrID, err
 	}
 
@@ -60,10 +120,13 @@ func (ai *TCRAPIClient) GetAllNamespaceByName(secret map[string]configs.Secret,
 	filterValues := []string{tcrName}
 	resp, err := ai.DescribeInstances(secretID, secretKey, region, 0, 100, "RegistryName", filterValues)
 	if err != nil {
-		log.Errorf("DescribeInstances error, ", err)
+		log.Errorf("DescribeInstances error, %v", err)
 		return nsList, tcrID, err
 	}
 
+	if resp.Response == nil || len(resp.Response.Registries) == 0 {
+		return nsList, tcrID, fmt.Errorf("tcr instance %s is not found in %s", tcrName, region)
+	}
 	tcrID = *resp.Response.Registries[0].RegistryId
 
 	// tcr offset means page number, currently :(
@@ -71,10 +134,10 @@ func (ai *TCRAPIClient) GetAllNamespaceByName(secret map[string]configs.Secret,
 	count := 0
 	limit := int64(100)
 
-	for {
+	for page := 1; ; page++ {
 		resp, err := ai.DescribeNamespaces(secretID, secretKey, region, offset, limit, tcrID)
 		if err != nil {
-			log.Errorf("DescribeNamespaces error, ", err)
+			log.Errorf("DescribeNamespaces error, %v", err)
 			return nsList, tcrID, err
 		}
 		namespaceCount := *resp.Response.TotalCount
@@ -82,30 +145,210 @@ func (ai *TCRAPIClient) GetAllNamespaceByName(secret map[string]configs.Secret,
 		for _, ns := range resp.Response.NamespaceList {
 			nsList = append(nsList, *ns.Name)
 		}
+		log.Infof("Get tcr namespaces of %s: %v/%v", tcrName, count, namespaceCount)
 
 		if int64(count) >= namespaceCount {
 			break
-		} else {
-			offset += 1
 		}
+		if len(resp.Response.NamespaceList) == 0 {
+			return nsList, tcrID, fmt.Errorf("tcr returned an empty page of namespaces, only %v of %v namespaces "+
+				"of %s are listed", count, namespaceCount, tcrName)
+		}
+		if page >= maxPages {
+			return nsList, tcrID, fmt.Errorf("listing namespaces of tcr %s exceeds the safety cap of %v pages",
+				tcrName, maxPages)
+		}
+		offset += 1
+
+	}
 
+	ai.nsCacheMutex.Lock()
+	ai.nsCache[tcrName] = &namespaceCache{
+		tcrID:      tcrID,
+		namespaces: append([]string{}, nsList...),
 	}
+	ai.nsCacheMutex.Unlock()
 
 	return nsList, tcrID, nil
 
 }
 
+// GetCachedNamespaceByName get all ns from tcr name, the cached listing is returned
+// if exists, GetAllNamespaceByName is called when no cache or forceRefresh is true
+func (ai *TCRAPIClient) GetCachedNamespaceByName(secret map[string]configs.Secret,
+	region string, tcrName string, forceRefresh bool) ([]string, string, error) {
+
+	if !forceRefresh {
+		ai.nsCacheMutex.Lock()
+		cache, ok := ai.nsCache[tcrName]
+		if ok {
+			nsList := append([]string{}, cache.namespaces...)
+			ai.nsCacheMutex.Unlock()
+			return nsList, cache.tcrID, nil
+		}
+		ai.nsCacheMutex.Unlock()
+	}
+
+	return ai.GetAllNamespaceByName(secret, region, tcrName)
+}
+
+// AddCachedNamespace adds a namespace which is created successfully to the cached listing
+func (ai *TCRAPIClient) AddCachedNamespace(tcrName string, nsName string) {
+	ai.nsCacheMutex.Lock()
+	defer ai.nsCacheMutex.Unlock()
+
+	cache, ok := ai.nsCache[tcrName]
+	if !ok {
+		return
+	}
+	for _, ns := range cache.namespaces {
+		if ns == nsName {
+			return
+		}
+	}
+	cache.namespaces = append(cache.namespaces, nsName)
+}
+
+// InvalidateNamespaceCache drops the cached listing of a tcr instance,
+// the next GetCachedNamespaceByName call will refresh it
+func (ai *TCRAPIClient) InvalidateNamespaceCache(tcrName string) {
+	ai.nsCacheMutex.Lock()
+	defer ai.nsCacheMutex.Unlock()
+
+	delete(ai.nsCache, tcrName)
+}
+
+// GetAllRepositories get all repositories of a tcr namespace, repositories are returned with namespace
+func (ai *TCRAPIClient) GetAllRepositories(secretID, secretKey, region, tcrID, nsName string) ([]string, error) {
+
+	var repoList []string
+
+	// tcr offset means page number, currently :(
+	offset := int64(1)
+	count := 0
+	limit := int64(100)
+
+	for page := 1; ; page++ {
+		resp, err := ai.DescribeRepositories(secretID, secretKey, region, offset, limit, tcrID, nsName)
+		if err != nil {
+			log.Errorf("DescribeRepositories error, %v", err)
+			return nil, err
+		}
+		repoCount := *resp.Response.TotalCount
+		count += len(resp.Response.RepositoryList)
+		for _, repo := range resp.Response.RepositoryList {
+			repoName := *repo.Name
+			if !strings.HasPrefix(repoName, nsName+"/") {
+				repoName = nsName + "/" + repoName
+			}
+			repoList = append(repoList, repoName)
+		}
+
+		log.Debugf("Get repositories of tcr namespace %s: %v/%v", nsName, count, repoCount)
+
+		if int64(count) >= repoCount {
+			break
+		}
+		if len(resp.Response.RepositoryList) == 0 {
+			return nil, fmt.Errorf("tcr returned an empty page of repositories, only %v of %v repositories "+
+				"of %s are listed", count, repoCount, nsName)
+		}
+		if page >= maxPages {
+			return nil, fmt.Errorf("listing repositories of tcr namespace %s exceeds the safety cap of %v pages",
+				nsName, maxPages)
+		}
+		offset += 1
+
+	}
+
+	return repoList, nil
+}
+
+// CountRepositories gets the number of repositories of a tcr namespace
+func (ai *TCRAPIClient) CountRepositories(secretID, secretKey, region, tcrID, nsName string) (int64, error) {
+	resp, err := ai.DescribeRepositories(secretID, secretKey, region, 1, 1, tcrID, nsName)
+	if err != nil {
+		return 0, err
+	}
+	if resp.Response == nil || resp.Response.TotalCount == nil {
+		return 0, fmt.Errorf("DescribeRepositories of tcr namespace %s returned no total count", nsName)
+	}
+	return *resp.Response.TotalCount, nil
+}
+
+// GetRegistryType gets the specification of a tcr instance, e.g. basic, standard or premium
+func (ai *TCRAPIClient) GetRegistryType(secret map[string]configs.Secret, region, tcrName string) (string, error) {
+	secretID, secretKey, err := GetTcrSecret(secret)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := ai.DescribeInstances(secretID, secretKey, region, 0, 100, "RegistryName", []string{tcrName})
+	if err != nil {
+		return "", err
+	}
+	if resp.Response == nil || len(resp.Response.Registries) == 0 {
+		return "", fmt.Errorf("tcr instance %s is not found in %s", tcrName, region)
+	}
+	if resp.Response.Registries[0].RegistryType == nil {
+		return "", nil
+	}
+	return *resp.Response.Registries[0].RegistryType, nil
+}
+
+// GenerateAllTcrRules generate rules of a tcr instance transfer to targetRegistry(another tcr or ccr),
+// repositories of nsList are transferred except the namespaces in failedNsList, rules are saved to rulesFile.
+// Source urls have no tags, all tags will be listed from the source registry.
+func (ai *TCRAPIClient) GenerateAllTcrRules(secret map[string]configs.Secret, sourceRegion string,
+	sourceTcrName string, sourceTcrID string, nsList []string, failedNsList []string,
+	targetRegistry string, rulesFile string) (map[string]string, error) {
+
+	rulesMap := make(map[string]string)
+
+	secretID, secretKey, err := GetTcrSecret(secret)
+	if err != nil {
+		log.Errorf("GetTcrSecret error: %v", err)
+		return rulesMap, err
+	}
+
+	for _, ns := range nsList {
+		if utils.IsContain(failedNsList, ns) {
+			continue
+		}
+
+		repoList, err := ai.GetAllRepositories(secretID, secretKey, sourceRegion, sourceTcrID, ns)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, repo := range repoList {
+			source := sourceTcrName + ".tencentcloudcr.com/" + repo
+			target := targetRegistry + "/" + repo
+			rulesMap[target] = source
+		}
+	}
+
+	jsonStr, err := json.Marshal(rulesMap)
+	if err != nil {
+		log.Errorf("Marshal tcr rules map error %v, ", err)
+	}
+	go func() {
+		err = ioutil.WriteFile(rulesFile, []byte(jsonStr), 0666)
+		if err != nil {
+			log.Errorf("WriteFile tcr rules error %v, ", err)
+		}
+	}()
+
+	return rulesMap, nil
+
+}
+
 // DescribeInstances is tcr api DescribeInstances
 func (ai *TCRAPIClient) DescribeInstances(secretID, secretKey, region string, offset,
 	limit int64, filterName string, filterValues []string) (*tcr.DescribeInstancesResponse, error) {
 
-	credential := common.NewCredential(
-		secretID,
-		secretKey,
-	)
 	cpf := profile.NewClientProfile()
-	cpf.HttpProfile.Endpoint = "tcr.tencentcloudapi.com"
-	client, _ := tcr.NewClient(credential, region, cpf)
+	cpf.HttpProfile.Endpoint = ai.endpoint
 
 	request := tcr.NewDescribeInstancesRequest()
 
@@ -116,7 +359,16 @@ func (ai *TCRAPIClient) DescribeInstances(secretID, secretKey, region string, of
 		},
 	}
 
-	response, err := client.DescribeInstances(request)
+	var response *tcr.DescribeInstancesResponse
+	err := apicall.Do(secretID, secretKey, func(credential *common.Credential) error {
+		client, _ := tcr.NewClient(credential, region, cpf)
+		if ai.httpClient.Transport != nil {
+			client.WithHttpTransport(ai.httpClient.Transport)
+		}
+		var err error
+		response, err = client.DescribeInstances(request)
+		return err
+	})
 
 	if err != nil {
 		log.Errorf("An error has returned: %s", err)
@@ -131,13 +383,8 @@ func (ai *TCRAPIClient) DescribeInstances(secretID, secretKey, region string, of
 func (ai *TCRAPIClient) DescribeNamespaces(secretID, secretKey, region string, offset,
 	limit int64, registryID string) (*tcr.DescribeNamespacesResponse, error) {
 
-	credential := common.NewCredential(
-		secretID,
-		secretKey,
-	)
 	cpf := profile.NewClientProfile()
-	cpf.HttpProfile.Endpoint = "tcr.tencentcloudapi.com"
-	client, _ := tcr.NewClient(credential, region, cpf)
+	cpf.HttpProfile.Endpoint = ai.endpoint
 
 	request := tcr.NewDescribeNamespacesRequest()
 
@@ -145,7 +392,50 @@ func (ai *TCRAPIClient) DescribeNamespaces(secretID, secretKey, region string, o
 	request.Limit = common.Int64Ptr(limit)
 	request.Offset = common.Int64Ptr(offset)
 
-	response, err := client.DescribeNamespaces(request)
+	var response *tcr.DescribeNamespacesResponse
+	err := apicall.Do(secretID, secretKey, func(credential *common.Credential) error {
+		client, _ := tcr.NewClient(credential, region, cpf)
+		if ai.httpClient.Transport != nil {
+			client.WithHttpTransport(ai.httpClient.Transport)
+		}
+		var err error
+		response, err = client.DescribeNamespaces(request)
+		return err
+	})
+
+	if err != nil {
+		log.Errorf("An error has returned: %s", err)
+		return nil, err
+	}
+
+	return response, nil
+
+}
+
+// DescribeRepositories is tcr api DescribeRepositories
+func (ai *TCRAPIClient) DescribeRepositories(secretID, secretKey, region string, offset,
+	limit int64, registryID string, nsName string) (*tcr.DescribeRepositoriesResponse, error) {
+
+	cpf := profile.NewClientProfile()
+	cpf.HttpProfile.Endpoint = ai.endpoint
+
+	request := tcr.NewDescribeRepositoriesRequest()
+
+	request.RegistryId = common.StringPtr(registryID)
+	request.NamespaceName = common.StringPtr(nsName)
+	request.Limit = common.Int64Ptr(limit)
+	request.Offset = common.Int64Ptr(offset)
+
+	var response *tcr.DescribeRepositoriesResponse
+	err := apicall.Do(secretID, secretKey, func(credential *common.Credential) error {
+		client, _ := tcr.NewClient(credential, region, cpf)
+		if ai.httpClient.Transport != nil {
+			client.WithHttpTransport(ai.httpClient.Transport)
+		}
+		var err error
+		response, err = client.DescribeRepositories(request)
+		return err
+	})
 
 	if err != nil {
 		log.Errorf("An error has returned: %s", err)
@@ -158,23 +448,131 @@ func (ai *TCRAPIClient) DescribeNamespaces(secretID, secretKey, region string, o
 
 // CreateNamespace is tcr api CreateNamespace
 func (ai *TCRAPIClient) CreateNamespace(secretID, secretKey, region string,
-	registryID string, nsName string) (*tcr.CreateNamespaceResponse, error) {
+	registryID string, nsName string, isPublic bool) (*tcr.CreateNamespaceResponse, error) {
 
-	credential := common.NewCredential(
-		secretID,
-		secretKey,
-	)
 	cpf := profile.NewClientProfile()
-	cpf.HttpProfile.Endpoint = "tcr.tencentcloudapi.com"
-	client, _ := tcr.NewClient(credential, region, cpf)
+	cpf.HttpProfile.Endpoint = ai.endpoint
 
 	request := tcr.NewCreateNamespaceRequest()
 
 	request.RegistryId = common.StringPtr(registryID)
 	request.NamespaceName = common.StringPtr(nsName)
-	request.IsPublic = common.BoolPtr(false)
+	request.IsPublic = common.BoolPtr(isPublic)
 
-	response, err := client.CreateNamespace(request)
+	var response *tcr.CreateNamespaceResponse
+	err := apicall.Do(secretID, secretKey, func(credential *common.Credential) error {
+		client, _ := tcr.NewClient(credential, region, cpf)
+		if ai.httpClient.Transport != nil {
+			client.WithHttpTransport(ai.httpClient.Transport)
+		}
+		var err error
+		response, err = client.CreateNamespace(request)
+		return err
+	})
+
+	if err != nil {
+		log.Errorf("An error has returned: %s", err)
+		return nil, err
+	}
+
+	return response, nil
+
+}
+
+// CreateRepository is tcr api CreateRepository
+func (ai *TCRAPIClient) CreateRepository(secretID, secretKey, region string, registryID string,
+	nsName string, repoName string, briefDescription string, description string) (*tcr.CreateRepositoryResponse, error) {
+
+	cpf := profile.NewClientProfile()
+	cpf.HttpProfile.Endpoint = ai.endpoint
+
+	request := tcr.NewCreateRepositoryRequest()
+
+	request.RegistryId = common.StringPtr(registryID)
+	request.NamespaceName = common.StringPtr(nsName)
+	request.RepositoryName = common.StringPtr(repoName)
+	request.BriefDescription = common.StringPtr(briefDescription)
+	request.Description = common.StringPtr(description)
+
+	var response *tcr.CreateRepositoryResponse
+	err := apicall.Do(secretID, secretKey, func(credential *common.Credential) error {
+		client, _ := tcr.NewClient(credential, region, cpf)
+		if ai.httpClient.Transport != nil {
+			client.WithHttpTransport(ai.httpClient.Transport)
+		}
+		var err error
+		response, err = client.CreateRepository(request)
+		return err
+	})
+
+	if err != nil {
+		log.Errorf("An error has returned: %s", err)
+		return nil, err
+	}
+
+	return response, nil
+
+}
+
+// DeleteImage is tcr api DeleteImage, it deletes a tag of a repository
+func (ai *TCRAPIClient) DeleteImage(secretID, secretKey, region string, registryID string,
+	nsName string, repoName string, tag string) (*tcr.DeleteImageResponse, error) {
+
+	cpf := profile.NewClientProfile()
+	cpf.HttpProfile.Endpoint = ai.endpoint
+
+	request := tcr.NewDeleteImageRequest()
+
+	request.RegistryId = common.StringPtr(registryID)
+	request.NamespaceName = common.StringPtr(nsName)
+	request.RepositoryName = common.StringPtr(repoName)
+	request.ImageVersion = common.StringPtr(tag)
+
+	var response *tcr.DeleteImageResponse
+	err := apicall.Do(secretID, secretKey, func(credential *common.Credential) error {
+		client, _ := tcr.NewClient(credential, region, cpf)
+		if ai.httpClient.Transport != nil {
+			client.WithHttpTransport(ai.httpClient.Transport)
+		}
+		var err error
+		response, err = client.DeleteImage(request)
+		return err
+	})
+
+	if err != nil {
+		log.Errorf("An error has returned: %s", err)
+		return nil, err
+	}
+
+	return response, nil
+
+}
+
+// ModifyRepository is tcr api ModifyRepository
+func (ai *TCRAPIClient) ModifyRepository(secretID, secretKey, region string, registryID string,
+	nsName string, repoName string, briefDescription string, description string) (*tcr.ModifyRepositoryResponse, error) {
+
+	cpf := profile.NewClientProfile()
+	cpf.HttpProfile.Endpoint = ai.endpoint
+
+	request := tcr.NewModifyRepositoryRequest()
+
+	request.RegistryId = common.StringPtr(registryID)
+	request.NamespaceName = common.StringPtr(nsName)
+	request.RepositoryName = common.StringPtr(repoName)
+	request.BriefDescription = common.StringPtr(briefDescription)
+	request.Description = common.StringPtr(description)
+
+	var response *tcr.ModifyRepositoryResponse
+	err := apicall.Do(secretID, secretKey, func(credential *common.Credential) error {
+		client, _ := tcr.NewClient(credential, region, cpf)
+		if ai.httpClient.Transport != nil {
+			client.WithHttpTransport(ai.httpClient.Transport)
+		}
+		var err error
+		response, err = client.ModifyRepository(request)
+		return err
+	})
 
 	if err != nil {
 		log.Errorf("An error has returned: %s", err)
@@ -187,20 +585,30 @@ func (ai *TCRAPIClient) CreateNamespace(secretID, secretKey, region string,
 
 // GetTcrSecret get tcr secret from config
 func GetTcrSecret(secret map[string]configs.Secret) (string, string, error) {
-	var secretID string
-	var secretKey string
+	var sideSecret configs.Secret
 
 	if tcr, ok := secret["tcr"]; ok {
 		//tcr secret存在
-		secretID = tcr.SecretID
-		secretKey = tcr.SecretKey
+		sideSecret = tcr
 	} else if ccr, ok := secret["ccr"]; ok {
 		//用ccr secret代替tcr
-		secretID = ccr.SecretID
-		secretKey = ccr.SecretKey
+		sideSecret = ccr
 	} else {
 		return "", "", errors.New("no matched secret provided in secret file")
 	}
 
-	return secretID, secretKey, nil
+	// the temporary credentials are used if a role is set
+	return stsapis.GetSecret(sideSecret)
+}
+
+// ValidateNamespaceName checks if a name is valid for a tcr namespace
+func ValidateNamespaceName(name string) error {
+	if len(name) < 2 || len(name) > 30 {
+		return fmt.Errorf("namespace %s should be 2-30 characters", name)
+	}
+	if !namespaceNameRegexp.MatchString(name) {
+		return fmt.Errorf("namespace %s should only contain lower case letters, digits "+
+			"and separators(., _, -), and should not start or end with a separator", name)
+	}
+	return nil
 }
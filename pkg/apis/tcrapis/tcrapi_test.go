@@ -0,0 +1,176 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package tcrapis
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/apis/apitest"
+)
+
+// newFakeAPIClient starts a fake tencent cloud api and creates a client calling it
+func newFakeAPIClient(handlers map[string]apitest.Handler) (*TCRAPIClient, *apitest.FakeAPI) {
+	api := apitest.NewFakeAPI(handlers)
+	return NewTCRAPIClient().WithEndpoint(api.Endpoint(), api.Transport()), api
+}
+
+// page returns the items of the page in the params, the offset of tcr is the page number from 1
+func page(items []map[string]interface{}, params map[string]interface{}) []map[string]interface{} {
+	limit := int(params["Limit"].(float64))
+	start := (int(params["Offset"].(float64)) - 1) * limit
+	if start >= len(items) {
+		return []map[string]interface{}{}
+	}
+	end := start + limit
+	if end > len(items) {
+		end = len(items)
+	}
+	return items[start:end]
+}
+
+// describeInstances answers DescribeInstances with the tcr instance test
+func describeInstances(map[string]interface{}) interface{} {
+	return map[string]interface{}{
+		"Registries": []map[string]interface{}{{"RegistryId": "tcr-test", "RegistryName": "test"}},
+		"TotalCount": 1,
+	}
+}
+
+var testSecret = map[string]configs.Secret{"tcr": {SecretID: "id", SecretKey: "key"}}
+
+func TestGetAllNamespaceByNamePages(t *testing.T) {
+	var namespaces []map[string]interface{}
+	for i := 0; i < 320; i++ {
+		namespaces = append(namespaces, map[string]interface{}{"Name": fmt.Sprintf("ns%03d", i)})
+	}
+	client, api := newFakeAPIClient(map[string]apitest.Handler{
+		"DescribeInstances": describeInstances,
+		"DescribeNamespaces": func(params map[string]interface{}) interface{} {
+			return map[string]interface{}{"NamespaceList": page(namespaces, params), "TotalCount": len(namespaces)}
+		},
+	})
+	defer api.Close()
+
+	nsList, tcrID, err := client.GetAllNamespaceByName(testSecret, "ap-guangzhou", "test")
+	if err != nil {
+		t.Fatalf("GetAllNamespaceByName error: %v", err)
+	}
+	if tcrID != "tcr-test" || len(nsList) != 320 || nsList[0] != "ns000" || nsList[319] != "ns319" {
+		t.Errorf("GetAllNamespaceByName = %v namespaces of %s, expected ns000 to ns319 of tcr-test", len(nsList),
+			tcrID)
+	}
+	if calls := api.Calls("DescribeNamespaces"); calls != 4 {
+		t.Errorf("GetAllNamespaceByName requested %v pages, expected 4", calls)
+	}
+
+	// the cached listing is used until it is invalidated
+	if _, _, err := client.GetCachedNamespaceByName(testSecret, "ap-guangzhou", "test", false); err != nil ||
+		api.Calls("DescribeNamespaces") != 4 {
+		t.Errorf("GetCachedNamespaceByName should use the cache, %v pages requested, %v",
+			api.Calls("DescribeNamespaces"), err)
+	}
+	client.InvalidateNamespaceCache("test")
+	if _, _, err := client.GetCachedNamespaceByName(testSecret, "ap-guangzhou", "test", false); err != nil ||
+		api.Calls("DescribeNamespaces") != 8 {
+		t.Errorf("GetCachedNamespaceByName should list again after invalidation, %v pages requested, %v",
+			api.Calls("DescribeNamespaces"), err)
+	}
+}
+
+func TestGetAllNamespaceByNameNotFound(t *testing.T) {
+	client, api := newFakeAPIClient(map[string]apitest.Handler{
+		"DescribeInstances": func(map[string]interface{}) interface{} {
+			return map[string]interface{}{"Registries": []interface{}{}, "TotalCount": 0}
+		},
+	})
+	defer api.Close()
+
+	if _, _, err := client.GetAllNamespaceByName(testSecret, "ap-guangzhou", "missing"); err == nil {
+		t.Errorf("GetAllNamespaceByName of a missing tcr instance should fail")
+	}
+	if _, _, err := client.GetAllNamespaceByName(map[string]configs.Secret{}, "ap-guangzhou", "test"); err == nil {
+		t.Errorf("GetAllNamespaceByName without tcr secret should fail")
+	}
+}
+
+func TestGetAllRepositoriesPages(t *testing.T) {
+	var repositories []map[string]interface{}
+	for i := 0; i < 205; i++ {
+		name := fmt.Sprintf("team/app%03d", i)
+		// some tcr versions return the repository names without namespace
+		if i%2 == 0 {
+			name = fmt.Sprintf("app%03d", i)
+		}
+		repositories = append(repositories, map[string]interface{}{"Name": name})
+	}
+	client, api := newFakeAPIClient(map[string]apitest.Handler{
+		"DescribeRepositories": func(params map[string]interface{}) interface{} {
+			return map[string]interface{}{"RepositoryList": page(repositories, params),
+				"TotalCount": len(repositories)}
+		},
+	})
+	defer api.Close()
+
+	repoList, err := client.GetAllRepositories("id", "key", "ap-guangzhou", "tcr-test", "team")
+	if err != nil {
+		t.Fatalf("GetAllRepositories error: %v", err)
+	}
+	if len(repoList) != 205 || repoList[0] != "team/app000" || repoList[1] != "team/app001" {
+		t.Errorf("GetAllRepositories = %v repositories like %v, expected 205 with namespace", len(repoList),
+			repoList[:2])
+	}
+	if calls := api.Calls("DescribeRepositories"); calls != 3 {
+		t.Errorf("GetAllRepositories requested %v pages, expected 3", calls)
+	}
+
+	count, err := client.CountRepositories("id", "key", "ap-guangzhou", "tcr-test", "team")
+	if err != nil || count != 205 {
+		t.Errorf("CountRepositories = %v, %v, expected 205", count, err)
+	}
+}
+
+func TestGetAllListingsShortPage(t *testing.T) {
+	// the total counts are larger than the items ever returned
+	items := []map[string]interface{}{{"Name": "team"}, {"Name": "team/app"}}
+	client, api := newFakeAPIClient(map[string]apitest.Handler{
+		"DescribeInstances": describeInstances,
+		"DescribeNamespaces": func(params map[string]interface{}) interface{} {
+			return map[string]interface{}{"NamespaceList": page(items[:1], params), "TotalCount": 150}
+		},
+		"DescribeRepositories": func(params map[string]interface{}) interface{} {
+			return map[string]interface{}{"RepositoryList": page(items[1:], params), "TotalCount": 150}
+		},
+	})
+	defer api.Close()
+
+	if _, _, err := client.GetAllNamespaceByName(testSecret, "ap-guangzhou", "test"); err == nil ||
+		!strings.Contains(err.Error(), "only 1 of 150 namespaces") {
+		t.Errorf("GetAllNamespaceByName stopping short of the total count should fail, got %v", err)
+	}
+	if _, err := client.GetAllRepositories("id", "key", "ap-guangzhou", "tcr-test", "team"); err == nil ||
+		!strings.Contains(err.Error(), "only 1 of 150 repositories") {
+		t.Errorf("GetAllRepositories stopping short of the total count should fail, got %v", err)
+	}
+	if calls := api.Calls("DescribeNamespaces") + api.Calls("DescribeRepositories"); calls != 4 {
+		t.Errorf("the listings requested %v pages, expected 2 of each", calls)
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"tkestack.io/image-transfer/pkg/image-transfer/options"
 	"github.com/spf13/cobra"
 	flagUtil "tkestack.io/image-transfer/pkg/flag"
+	"tkestack.io/image-transfer/pkg/version"
 	"os"
 )
 
@@ -38,10 +39,12 @@ func NewImageTransferCommand(basename string) *cobra.Command {
 
 	opts := options.NewClientOptions()
 	cmd := &cobra.Command{
-		Use:  basename,
-		Long: "image-transfer",
-		Run:  run(opts),
+		Use:     basename,
+		Long:    "image-transfer",
+		Version: version.Version().String(),
+		Run:     run(opts),
 	}
+	cmd.SetVersionTemplate("{{.Version}}\n")
 
 	opts.AddFlags(cmd.Flags())
 	log.AddFlags(cmd.Flags())
@@ -53,8 +56,15 @@ func run(opts *options.ClientOptions) RunFunc {
 		log.InitLogger()
 		defer log.FlushLogger()
 
+		log.Infof("image-transfer %s", version.Version())
 		flagUtil.PrintFlags(cmd.Flags())
 
+		if errs := opts.Validate(); len(errs) != 0 {
+			for _, err := range errs {
+				log.Errorf("invalid flag: %v", err)
+			}
+			os.Exit(1)
+		}
 
 		client, err := NewTransferClient(opts)
 		if err != nil {
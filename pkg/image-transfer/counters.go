@@ -0,0 +1,96 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"sync/atomic"
+
+	"tkestack.io/image-transfer/pkg/transfer"
+)
+
+// Counters is a snapshot of the live job counts of a run
+type Counters struct {
+	// Generated is the number of jobs generated from url pairs, a retried job is not generated again
+	Generated int64
+	// Succeeded is the number of job runs which transferred the image
+	Succeeded int64
+	// Failed is the number of failed job runs and failed job generations, the failed attempts of
+	// retries are counted
+	Failed int64
+	// Skipped is the number of job runs which found the same digest on target
+	Skipped int64
+	// SkippedImmutable is the number of skipped job runs rejected by an immutable target tag
+	// with the same digest, they are counted in Skipped too
+	SkippedImmutable int64
+	// Filtered is the number of job runs which skipped the image as its labels do not match labelFilter,
+	// they are not counted in Skipped
+	Filtered int64
+	// Retried is the number of failed jobs and url pairs put back by retries
+	Retried int64
+	// Inflight is the number of jobs running now
+	Inflight int64
+}
+
+// counters are updated atomically by the handlers, the int64 fields are first to be 64-bit aligned
+type counters struct {
+	generated int64
+	succeeded int64
+	failed    int64
+	skipped   int64
+	immutable int64
+	filtered  int64
+	retried   int64
+	inflight  int64
+}
+
+// jobStarted counts a job which starts to run
+func (c *counters) jobStarted() {
+	atomic.AddInt64(&c.inflight, 1)
+}
+
+// jobFinished counts the result of a job run
+func (c *counters) jobFinished(err error, stats transfer.JobStats) {
+	if err != nil {
+		atomic.AddInt64(&c.failed, 1)
+	} else if stats.Filtered {
+		atomic.AddInt64(&c.filtered, 1)
+	} else if stats.Skipped {
+		atomic.AddInt64(&c.skipped, 1)
+		if stats.Immutable {
+			atomic.AddInt64(&c.immutable, 1)
+		}
+	} else {
+		atomic.AddInt64(&c.succeeded, 1)
+	}
+	atomic.AddInt64(&c.inflight, -1)
+}
+
+// Snapshot returns the current job counts, it is safe to be called while the run is in progress
+func (c *Client) Snapshot() Counters {
+	return Counters{
+		Generated:        atomic.LoadInt64(&c.counters.generated),
+		Succeeded:        atomic.LoadInt64(&c.counters.succeeded),
+		Failed:           atomic.LoadInt64(&c.counters.failed),
+		Skipped:          atomic.LoadInt64(&c.counters.skipped),
+		Retried:          atomic.LoadInt64(&c.counters.retried),
+		Inflight:         atomic.LoadInt64(&c.counters.inflight),
+		SkippedImmutable: atomic.LoadInt64(&c.counters.immutable),
+		Filtered:         atomic.LoadInt64(&c.counters.filtered),
+	}
+}
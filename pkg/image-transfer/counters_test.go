@@ -0,0 +1,137 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package imagetransfer
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"tkestack.io/image-transfer/pkg/image-transfer/options"
+	"tkestack.io/image-transfer/pkg/transfer"
+)
+
+// these tests are meant to be run with -race
+
+func TestCountersConcurrent(t *testing.T) {
+	c := &Client{counters: &counters{}}
+	results := []struct {
+		err   error
+		stats transfer.JobStats
+	}{
+		{},
+		{err: errors.New("push error")},
+		{stats: transfer.JobStats{Skipped: true}},
+		{stats: transfer.JobStats{Skipped: true, Immutable: true}},
+		{stats: transfer.JobStats{Filtered: true}},
+	}
+
+	const workers, jobs = 8, 500
+	stop := make(chan struct{})
+	var reader sync.WaitGroup
+	reader.Add(1)
+	go func() {
+		defer reader.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if snapshot := c.Snapshot(); snapshot.Inflight < 0 || snapshot.Inflight > workers {
+				t.Errorf("inflight %d is out of [0, %d]", snapshot.Inflight, workers)
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < jobs; j++ {
+				result := results[j%len(results)]
+				c.counters.jobStarted()
+				c.counters.jobFinished(result.err, result.stats)
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	reader.Wait()
+
+	each := int64(workers * jobs / len(results))
+	expected := Counters{Succeeded: each, Failed: each, Skipped: 2 * each, SkippedImmutable: each, Filtered: each}
+	if snapshot := c.Snapshot(); snapshot != expected {
+		t.Errorf("Snapshot() = %+v, expected %+v", snapshot, expected)
+	}
+}
+
+func TestSnapshotDuringRun(t *testing.T) {
+	tags := []string{"v1", "v2", "v3", "v4", "v5", "v6"}
+	source, _ := writeOCILayout(t, tags...)
+	target, err := ioutil.TempDir("", "image-transfer-oci")
+	if err != nil {
+		t.Fatalf("create target directory error: %v", err)
+	}
+	defer os.RemoveAll(target)
+
+	c := newPipelineTestClient(&options.ConfigOptions{RoutineNums: 3, JobBufferSize: 1})
+	// the tags of the source are listed and a job is generated for each of them
+	c.PutURLPairs([]*URLPair{{source: "oci:" + source, target: "oci:" + target}})
+
+	stop := make(chan struct{})
+	var reader sync.WaitGroup
+	reader.Add(1)
+	go func() {
+		defer reader.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			snapshot := c.Snapshot()
+			if snapshot.Succeeded+snapshot.Skipped+snapshot.Failed > snapshot.Generated {
+				t.Errorf("more jobs finished than generated: %+v", snapshot)
+				return
+			}
+		}
+	}()
+
+	jobListChan := c.newJobListChan()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.jobsHandler(jobListChan)
+	}()
+	c.rulesHandler(jobListChan)
+	wg.Wait()
+	close(stop)
+	reader.Wait()
+
+	snapshot := c.Snapshot()
+	if snapshot.Generated != int64(len(tags)) || snapshot.Succeeded+snapshot.Skipped != int64(len(tags)) ||
+		snapshot.Failed != 0 || snapshot.Inflight != 0 {
+		t.Errorf("Snapshot() = %+v, expected %d jobs generated and finished", snapshot, len(tags))
+	}
+}
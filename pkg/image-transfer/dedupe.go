@@ -0,0 +1,104 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"strings"
+
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+// urlPairSet dedupes the url pairs put into urlPairList by their normalized references, and skips the
+// pairs whose source and target are the same image. It is reset by every run of url pairs, the retried
+// pairs are not checked. It is guarded by urlPairListMutex
+type urlPairSet struct {
+	defaultSourceRegistry string
+	// seen counts the normalized pairs, a duplicate or no-op pair is only logged the first time
+	seen map[string]int
+
+	duplicates int
+	noops      int
+}
+
+// newURLPairSet creates an empty urlPairSet, the sources without registry are pulled from
+// defaultSourceRegistry
+func newURLPairSet(defaultSourceRegistry string) *urlPairSet {
+	return &urlPairSet{
+		defaultSourceRegistry: defaultSourceRegistry,
+		seen:                  make(map[string]int),
+	}
+}
+
+// add checks a url pair, it returns false if the pair is a duplicate of an added one or its source and
+// target are the same image
+func (s *urlPairSet) add(urlPair *URLPair) bool {
+	source := normalizeReference(utils.AddDefaultRegistry(urlPair.source, s.defaultSourceRegistry), "")
+	// a target without tag gets the tags of the source
+	var sourceTag string
+	if sourceURL, err := utils.NewRepoURL(source); err == nil {
+		sourceTag = sourceURL.GetTag()
+	}
+	target := normalizeReference(urlPair.target, sourceTag)
+
+	key := source + " " + target
+	s.seen[key]++
+	switch {
+	case target != "" && source == target:
+		s.noops++
+		if s.seen[key] == 1 {
+			log.Warnf("Skip %s to %s, the source and the target are the same image", urlPair.source,
+				urlPair.target)
+		}
+		return false
+	case s.seen[key] > 1:
+		s.duplicates++
+		if s.seen[key] == 2 {
+			log.Infof("Skip the duplicate url pairs of %s to %s", urlPair.source, urlPair.target)
+		}
+		return false
+	}
+	return true
+}
+
+// normalizeReference normalizes a url to compare with others, the registry is lower case and defaultTag
+// is used if the url has neither tag nor digest. The empty urls, templates and the urls which can not be
+// parsed are returned as they are
+func normalizeReference(url, defaultTag string) string {
+	if url == "" || utils.IsTargetTemplate(url) {
+		return url
+	}
+	repoURL, err := utils.NewRepoURL(url)
+	if err != nil || repoURL.IsLocal() {
+		return url
+	}
+
+	normalized := strings.ToLower(repoURL.GetRegistry()) + "/" + repoURL.GetRepoWithNamespace()
+	tag := repoURL.GetTag()
+	if tag == "" && repoURL.GetDigest() == "" {
+		tag = defaultTag
+	}
+	if tag != "" {
+		normalized += ":" + tag
+	}
+	if repoURL.GetDigest() != "" {
+		normalized += "@" + repoURL.GetDigest()
+	}
+	return normalized
+}
@@ -0,0 +1,249 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	"tkestack.io/image-transfer/pkg/apis/tcrapis"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/transfer"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+// mirroredRepo is a target repository whose source tags are all listed, the target tags which are
+// not in sourceTags are extraneous
+type mirroredRepo struct {
+	target     *utils.RepoURL
+	sourceTags map[string]bool
+}
+
+// mirroredRepos are the repositories to delete extraneous tags from, keyed by the target url without tag
+type mirroredRepos struct {
+	repos map[string]*mirroredRepo
+	// failed are the target repositories with permanently failed jobs
+	failed map[string]bool
+	mutex  sync.Mutex
+
+	// results are the deleted, dry-run and refused tags of every repository for the summary
+	results []string
+}
+
+// newMirroredRepos creates an empty mirroredRepos
+func newMirroredRepos() *mirroredRepos {
+	return &mirroredRepos{
+		repos:  make(map[string]*mirroredRepo),
+		failed: make(map[string]bool),
+	}
+}
+
+// Record records the source tags of a target repository after filters
+func (m *mirroredRepos) Record(target *utils.RepoURL, sourceTags []string) {
+	repo := &mirroredRepo{target: target, sourceTags: make(map[string]bool, len(sourceTags))}
+	for _, tag := range sourceTags {
+		repo.sourceTags[tag] = true
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.repos[target.GetURLWithoutTag()] = repo
+}
+
+// MarkFailed marks a target repository(registry/namespace/repository) which is not synced successfully
+func (m *mirroredRepos) MarkFailed(repo string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.failed[repo] = true
+}
+
+// deleteExtraneousTags deletes the target tags which do not exist at source after filters from the
+// repositories whose all tags are synced successfully. A repository is refused if more than maxDeletePercent
+// of its tags would be deleted unless forceDelete is true, and nothing is deleted by deleteDryRun
+func (c *Client) deleteExtraneousTags() {
+	for e := c.failedJobList.Front(); e != nil; e = e.Next() {
+		job := e.Value.(*transfer.Job)
+		c.mirroredRepos.MarkFailed(job.Target.GetRegistry() + "/" + job.Target.GetRepository())
+	}
+	for e := c.failedJobGenerateList.Front(); e != nil; e = e.Next() {
+		if targetURL, err := utils.NewRepoURL(e.Value.(*URLPair).target); err == nil {
+			c.mirroredRepos.MarkFailed(targetURL.GetURLWithoutTag())
+		}
+	}
+
+	var keys []string
+	for key := range c.mirroredRepos.repos {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if c.mirroredRepos.failed[key] {
+			log.Warnf("%s is not synced successfully, its extraneous tags are not deleted", key)
+			continue
+		}
+		result, err := c.deleteRepoExtraneousTags(c.mirroredRepos.repos[key])
+		if err != nil {
+			log.Errorf("Delete extraneous tags of %s error: %v", key, err)
+			result = fmt.Sprintf("%s: %v", key, err)
+		}
+		if result != "" {
+			c.mirroredRepos.results = append(c.mirroredRepos.results, result)
+		}
+	}
+}
+
+// deleteRepoExtraneousTags deletes the extraneous tags of a repository, the result for the summary is returned
+func (c *Client) deleteRepoExtraneousTags(repo *mirroredRepo) (string, error) {
+	config := c.config.FlagConf.Config
+	targetURL := repo.target
+	security, _ := c.config.GetSecuritySpecific(targetURL.GetRegistry(), targetURL.GetRepoWithNamespace())
+	imageTarget, err := transfer.NewImageTarget(targetURL.GetRegistry(), targetURL.GetRepoWithNamespace(), "",
+		security.Username, security.Password, security.Insecure)
+	if err != nil {
+		return "", err
+	}
+
+	targetTags, err := imageTarget.GetRepoTags(config.ListTimeout)
+	if err != nil {
+		return "", fmt.Errorf("list tags error: %v", err)
+	}
+	var extraneous []string
+	for _, tag := range targetTags {
+		if !repo.sourceTags[tag] {
+			extraneous = append(extraneous, tag)
+		}
+	}
+	if len(extraneous) == 0 {
+		return "", nil
+	}
+	sort.Strings(extraneous)
+
+	name := targetURL.GetURLWithoutTag()
+	if percent := len(extraneous) * 100 / len(targetTags); percent > config.MaxDeletePercent && !config.ForceDelete {
+		log.Warnf("%v of %v tags of %s are extraneous, more than maxDeletePercent %v%%, set --forceDelete=true "+
+			"to delete them: %v", len(extraneous), len(targetTags), name, config.MaxDeletePercent, extraneous)
+		return fmt.Sprintf("%s: refused to delete %v of %v tags %v", name, len(extraneous), len(targetTags),
+			extraneous), nil
+	}
+	return c.deleteTags(imageTarget, targetURL, extraneous, targetTags, repo.sourceTags), nil
+}
+
+// deleteTags deletes tags of the target repository, the other tags of targetTags in keptTags are kept.
+// Nothing is deleted by deleteDryRun, the deletions are recorded in the report and the result for the
+// summary is returned
+func (c *Client) deleteTags(imageTarget *transfer.ImageTarget, targetURL *utils.RepoURL, tags []string,
+	targetTags []string, keptTags map[string]bool) string {
+	name := targetURL.GetURLWithoutTag()
+	if c.config.FlagConf.Config.DeleteDryRun {
+		log.Infof("%v tags of %s would be deleted: %v", len(tags), name, tags)
+		for _, tag := range tags {
+			c.recordDeletion(name+":"+tag, ReportStatusDeleteDryRun)
+		}
+		return fmt.Sprintf("%s: would delete %v tags %v", name, len(tags), tags)
+	}
+
+	deleteTag := c.registryTagDeleter(imageTarget, targetURL, targetTags, keptTags)
+	if strings.HasSuffix(targetURL.GetRegistry(), tcrDomainSuffix) && c.config.Secret != nil {
+		deleteTag = c.tcrTagDeleter(targetURL)
+	}
+	var deleted, failed []string
+	for _, tag := range tags {
+		if err := deleteTag(tag); err != nil {
+			log.Errorf("Delete %s:%s error: %v", name, tag, err)
+			c.recordDeletion(name+":"+tag, ReportStatusFailed)
+			failed = append(failed, tag)
+			continue
+		}
+		log.Infof("Delete tag %s:%s", name, tag)
+		c.recordDeletion(name+":"+tag, ReportStatusDeleted)
+		deleted = append(deleted, tag)
+	}
+	if len(failed) != 0 {
+		return fmt.Sprintf("%s: deleted %v tags %v, failed to delete %v tags %v", name, len(deleted), deleted,
+			len(failed), failed)
+	}
+	return fmt.Sprintf("%s: deleted %v tags %v", name, len(deleted), deleted)
+}
+
+// recordDeletion records a deleted target tag in the report if it is required
+func (c *Client) recordDeletion(target, status string) {
+	if c.report != nil {
+		c.report.RecordDeletion(target, status)
+	}
+}
+
+// tcrDomainSuffix is the domain suffix of tcr instances
+const tcrDomainSuffix = ".tencentcloudcr.com"
+
+// tcrTagDeleter deletes the tags of a tcr repository by tcr api DeleteImage
+func (c *Client) tcrTagDeleter(targetURL *utils.RepoURL) func(tag string) error {
+	return func(tag string) error {
+		secretID, secretKey, err := tcrapis.GetTcrSecret(c.config.Secret)
+		if err != nil {
+			return err
+		}
+		region := c.config.FlagConf.Config.TCRRegion
+		tcrName := strings.TrimSuffix(targetURL.GetRegistry(), tcrDomainSuffix)
+		tcrClient := c.newTCRAPIClient()
+		_, tcrID, err := tcrClient.GetCachedNamespaceByName(c.config.Secret, region, tcrName, false)
+		if err != nil {
+			return err
+		}
+		ns := targetURL.GetNamespace()
+		_, err = tcrClient.DeleteImage(secretID, secretKey, region, tcrID, ns,
+			strings.TrimPrefix(targetURL.GetRepoWithNamespace(), ns+"/"), tag)
+		return err
+	}
+}
+
+// registryTagDeleter deletes the tags of a repository by the registry api, the digests of the kept
+// tags are got when the registry can only delete manifests by digest
+func (c *Client) registryTagDeleter(imageTarget *transfer.ImageTarget, targetURL *utils.RepoURL,
+	targetTags []string, keptTags map[string]bool) func(tag string) error {
+	var keptDigests map[digest.Digest]bool
+	shared := func(d digest.Digest) (bool, error) {
+		if keptDigests == nil {
+			keptDigests = make(map[digest.Digest]bool)
+			security, _ := c.config.GetSecuritySpecific(targetURL.GetRegistry(), targetURL.GetRepoWithNamespace())
+			for _, tag := range targetTags {
+				if !keptTags[tag] {
+					continue
+				}
+				kept, err := transfer.NewImageTarget(targetURL.GetRegistry(), targetURL.GetRepoWithNamespace(), tag,
+					security.Username, security.Password, security.Insecure)
+				if err != nil {
+					return false, err
+				}
+				keptDigest, err := kept.GetManifestDigest()
+				if err != nil {
+					keptDigests = nil
+					return false, fmt.Errorf("get digest of kept tag %s error: %v", tag, err)
+				}
+				keptDigests[keptDigest] = true
+			}
+		}
+		return keptDigests[d], nil
+	}
+	return func(tag string) error {
+		return imageTarget.DeleteTag(tag, shared)
+	}
+}
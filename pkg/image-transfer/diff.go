@@ -0,0 +1,90 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/transfer"
+)
+
+// Diff checks which targets of url pairs are missing, the rules are expanded as transfer does but only
+// the tags of target repositories are listed, every repository once. The missing source and target
+// pairs are written to diffOutput as a rule file which can be used by the next run
+func (c *Client) Diff(urlPairs []*URLPair) error {
+	c.verifying = true
+	c.jobOptions = &transfer.JobOptions{
+		DiffOnly:   true,
+		TargetTags: transfer.NewTagListCache(c.config.FlagConf.Config.ListTimeout),
+		Context:    c.failFast.ctx,
+	}
+
+	if !log.Quiet() {
+		fmt.Println("Start to diff targets, please wait ...")
+	}
+	c.runURLPairs(urlPairs)
+	c.failFast.Summary()
+	if err := c.failFast.Err(); err != nil {
+		return err
+	}
+
+	missing := make(map[string]string)
+	present := 0
+	for _, record := range c.verifyReport.Records() {
+		switch transfer.VerifyResult(record.Status) {
+		case transfer.VerifyMissing:
+			missing[record.Source] = record.Target
+		case transfer.VerifyPresent:
+			present++
+		}
+	}
+
+	failed := c.failedJobList.Len() + c.failedJobGenerateList.Len() + c.permanentFailedList.Len()
+	log.Summaryf("################# diff results: %v present, %v missing, %v failed to check #################",
+		present, len(missing), failed)
+	for e := c.failedJobList.Front(); e != nil; e = e.Next() {
+		job := e.Value.(*transfer.Job)
+		log.Summaryf("%s/%s:%s", job.Target.GetRegistry(), job.Target.GetRepository(), job.Target.GetTag())
+	}
+	for e := c.failedJobGenerateList.Front(); e != nil; e = e.Next() {
+		log.Summaryf("%s: %s", e.Value.(*URLPair).source, e.Value.(*URLPair).target)
+	}
+	for e := c.permanentFailedList.Front(); e != nil; e = e.Next() {
+		log.Summaryf("%s: %v", e.Value.(*PermanentFailure).name, e.Value.(*PermanentFailure).err)
+	}
+
+	// a json object is a valid yaml rule file, the keys are sorted
+	data, err := json.MarshalIndent(missing, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := c.config.FlagConf.Config.DiffOutput
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("write missing targets to %s error: %v", path, err)
+	}
+	log.Summaryf("%v missing targets are written to %s, use it as the rule file of the next run", len(missing), path)
+
+	if failed != 0 {
+		return fmt.Errorf("diff failed, %v targets failed to check", failed)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/transfer"
+)
+
+// DigestPin is the digests of a source image transferred by a rule
+type DigestPin struct {
+	Target       string `json:"target" yaml:"target"`
+	SourceDigest string `json:"sourceDigest" yaml:"sourceDigest"`
+	TargetDigest string `json:"targetDigest" yaml:"targetDigest"`
+}
+
+// digestLockFile is the content of the digest lock file, the pins are keyed by the source of the rule
+// and then the source image
+type digestLockFile struct {
+	Rules map[string]map[string]*DigestPin `json:"rules" yaml:"rules"`
+}
+
+// DigestLock records the digests transferred by every rule, the pins of the last run are loaded to find
+// the source tags which upstream mutated. The pins of the images not transferred by this run are kept
+type DigestLock struct {
+	pins map[string]map[string]*DigestPin
+	// previous are the pins loaded from the lock file
+	previous map[string]map[string]*DigestPin
+	// mutated are the source images whose digests differ from the previous pins, they are only
+	// collected and warned if warnMutated is true
+	mutated     []string
+	warnMutated bool
+	mutex       sync.Mutex
+}
+
+// LoadDigestLock loads the pins of the last run from the lock file, a missing file has no pins
+func LoadDigestLock(path string, warnMutated bool) (*DigestLock, error) {
+	var file digestLockFile
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read digest lock %s error: %v", path, err)
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("decode digest lock %s error: %v", path, err)
+	}
+	if file.Rules == nil {
+		file.Rules = make(map[string]map[string]*DigestPin)
+	}
+	return &DigestLock{
+		pins:        make(map[string]map[string]*DigestPin),
+		previous:    file.Rules,
+		warnMutated: warnMutated,
+	}, nil
+}
+
+// RecordJob pins the digests of a successful transfer job by its rule, the jobs without rule are pinned by
+// their source repositories. A job which skipped the image by labels transferred nothing
+func (l *DigestLock) RecordJob(job *transfer.Job) {
+	stats := job.Stats()
+	if stats.Filtered || stats.SourceDigest == "" {
+		return
+	}
+
+	repository := job.Source.GetRegistry() + "/" + job.Source.GetRepository()
+	rule := job.Rule
+	if rule == "" {
+		rule = repository
+	}
+	source := repository + ":" + job.Source.GetTag()
+	pin := &DigestPin{
+		Target:       job.Target.GetRegistry() + "/" + job.Target.GetRepository() + ":" + job.Target.GetTag(),
+		SourceDigest: stats.SourceDigest.String(),
+		TargetDigest: stats.ManifestDigest.String(),
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	previous, ok := l.previous[rule][source]
+	if ok && l.warnMutated && previous.SourceDigest != pin.SourceDigest {
+		l.mutated = append(l.mutated, fmt.Sprintf("%s of rule %s: %s -> %s", source, rule,
+			previous.SourceDigest, pin.SourceDigest))
+		log.Warnf("Source %s of rule %s is mutated upstream, its digest was %s and is %s now", source, rule,
+			previous.SourceDigest, pin.SourceDigest)
+	}
+	if l.pins[rule] == nil {
+		l.pins[rule] = make(map[string]*DigestPin)
+	}
+	l.pins[rule][source] = pin
+}
+
+// Mutated returns the sorted source images whose digests differ from the pins of the last run
+func (l *DigestLock) Mutated() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	mutated := append([]string{}, l.mutated...)
+	sort.Strings(mutated)
+	return mutated
+}
+
+// Write writes the pins of this run and the previous pins of the images not transferred by it
+func (l *DigestLock) Write(path string) error {
+	l.mutex.Lock()
+	rules := make(map[string]map[string]*DigestPin)
+	for _, pins := range []map[string]map[string]*DigestPin{l.previous, l.pins} {
+		for rule, sources := range pins {
+			if rules[rule] == nil {
+				rules[rule] = make(map[string]*DigestPin)
+			}
+			for source, pin := range sources {
+				rules[rule][source] = pin
+			}
+		}
+	}
+	l.mutex.Unlock()
+
+	// the keys of maps are sorted by yaml
+	data, err := yaml.Marshal(&digestLockFile{Rules: rules})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("write digest lock to %s error: %v", path, err)
+	}
+	return nil
+}
+
+// writeDigestLock writes the digest lock file and lists the source tags mutated upstream
+func (c *Client) writeDigestLock() {
+	path := c.config.FlagConf.Config.DigestLock
+	if mutated := c.digestLock.Mutated(); len(mutated) != 0 {
+		log.Summaryf("################# %v source tags are mutated upstream since the last run: #################",
+			len(mutated))
+		for _, source := range mutated {
+			log.Summaryf("%s", source)
+		}
+	}
+	if err := c.digestLock.Write(path); err != nil {
+		log.Errorf("%v", err)
+		return
+	}
+	log.Summaryf("Digest lock is written to %s", path)
+}
@@ -0,0 +1,176 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+const (
+	// kustomizationFile is the file written to the emitKustomize directory
+	kustomizationFile = "kustomization.yaml"
+	// kustomizeAPIVersion is the apiVersion of the kustomization written by emitKustomize
+	kustomizeAPIVersion = "kustomize.config.k8s.io/v1beta1"
+)
+
+// repoRewrite is the target which a source repository is rewritten to, the tag and digest of target are
+// set only if a single tag of the source repository is transferred
+type repoRewrite struct {
+	source ImageReference
+	target ImageReference
+}
+
+// kustomizeImage is an entry of the images of a kustomization
+type kustomizeImage struct {
+	Name    string `yaml:"name"`
+	NewName string `yaml:"newName,omitempty"`
+	NewTag  string `yaml:"newTag,omitempty"`
+	Digest  string `yaml:"digest,omitempty"`
+}
+
+// kustomization is the kustomization.yaml written by emitKustomize
+type kustomization struct {
+	APIVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Images     []*kustomizeImage `yaml:"images"`
+}
+
+// helmImage is the image of a source repository in the values written by emitHelmValues
+type helmImage struct {
+	Registry   string `yaml:"registry"`
+	Repository string `yaml:"repository"`
+	Tag        string `yaml:"tag,omitempty"`
+	Digest     string `yaml:"digest,omitempty"`
+}
+
+// helmValues is the values fragment written by emitHelmValues, the images are keyed by source repository
+type helmValues struct {
+	Images map[string]*helmImage `yaml:"images"`
+}
+
+// repoRewrites groups the entries by source repository. The tags of a source repository are transferred
+// to one target repository normally, conflicting targets are warned and the last entry by the order of
+// Entries is picked, so the result is deterministic
+func (m *RewriteMap) repoRewrites() []*repoRewrite {
+	var names []string
+	groups := make(map[string][]*RewriteEntry)
+	for _, entry := range m.Entries() {
+		name := entry.Source.Registry + "/" + entry.Source.Repository
+		if _, ok := groups[name]; !ok {
+			names = append(names, name)
+		}
+		groups[name] = append(groups[name], entry)
+	}
+
+	rewrites := make([]*repoRewrite, 0, len(names))
+	for _, name := range names {
+		entries := groups[name]
+		last := entries[len(entries)-1]
+		targets := make(map[string]bool)
+		retagged := false
+		for _, entry := range entries {
+			targets[entry.Target.Registry+"/"+entry.Target.Repository] = true
+			retagged = retagged || entry.Target.Tag != entry.Source.Tag
+		}
+		if len(targets) > 1 {
+			log.Warnf("%s is transferred to %v repositories, %s/%s is picked", name, len(targets),
+				last.Target.Registry, last.Target.Repository)
+		}
+
+		rewrite := &repoRewrite{
+			source: ImageReference{
+				Registry:   last.Source.Registry,
+				Repository: last.Source.Repository,
+			},
+			target: ImageReference{
+				Registry:   last.Target.Registry,
+				Repository: last.Target.Repository,
+			},
+		}
+		if len(entries) == 1 {
+			rewrite.target.Tag = last.Target.Tag
+			rewrite.target.Digest = last.Target.Digest
+		} else if retagged {
+			log.Warnf("%v tags of %s are transferred with different tag names, only the repository is rewritten",
+				len(entries), name)
+		}
+		rewrites = append(rewrites, rewrite)
+	}
+	return rewrites
+}
+
+// writeKustomize writes the images of a kustomization.yaml to dir
+func writeKustomize(dir string, rewrites []*repoRewrite) error {
+	k := &kustomization{
+		APIVersion: kustomizeAPIVersion,
+		Kind:       "Kustomization",
+		Images:     []*kustomizeImage{},
+	}
+	for _, rewrite := range rewrites {
+		k.Images = append(k.Images, &kustomizeImage{
+			Name:    rewrite.source.Registry + "/" + rewrite.source.Repository,
+			NewName: rewrite.target.Registry + "/" + rewrite.target.Repository,
+			NewTag:  rewrite.target.Tag,
+			Digest:  rewrite.target.Digest,
+		})
+	}
+
+	data, err := yaml.Marshal(k)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("create kustomize directory %s error: %v", dir, err)
+	}
+	path := filepath.Join(dir, kustomizationFile)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("write kustomization to %s error: %v", path, err)
+	}
+	return nil
+}
+
+// writeHelmValues writes the images keyed by source repository to a helm values file
+func writeHelmValues(path string, rewrites []*repoRewrite) error {
+	values := &helmValues{
+		Images: make(map[string]*helmImage),
+	}
+	for _, rewrite := range rewrites {
+		values.Images[rewrite.source.Registry+"/"+rewrite.source.Repository] = &helmImage{
+			Registry:   rewrite.target.Registry,
+			Repository: rewrite.target.Repository,
+			Tag:        rewrite.target.Tag,
+			Digest:     rewrite.target.Digest,
+		}
+	}
+
+	data, err := yaml.Marshal(values)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("write helm values to %s error: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"fmt"
+	"strings"
+
+	"tkestack.io/image-transfer/pkg/apis/tcrapis"
+)
+
+// maxBriefDescriptionLen is the max length of the brief description of a tcr repository
+const maxBriefDescriptionLen = 100
+
+// NamespaceEnsurer creates the missing namespaces of a target registry before transfer
+type NamespaceEnsurer interface {
+	// EnsureNamespaces creates the namespaces which are not exist,
+	// the namespaces which failed to create are returned
+	EnsureNamespaces(namespaces []string) ([]string, error)
+}
+
+// TcrNsEnsurer creates the missing namespaces in a tcr instance
+type TcrNsEnsurer struct {
+	client    *Client
+	tcrClient *tcrapis.TCRAPIClient
+	region    string
+	tcrName   string
+}
+
+// NewTcrNsEnsurer creates a TcrNsEnsurer for a tcr instance
+func NewTcrNsEnsurer(client *Client, tcrClient *tcrapis.TCRAPIClient, region, tcrName string) *TcrNsEnsurer {
+	return &TcrNsEnsurer{
+		client:    client,
+		tcrClient: tcrClient,
+		region:    region,
+		tcrName:   tcrName,
+	}
+}
+
+// EnsureNamespaces creates the missing namespaces in tcr
+func (e *TcrNsEnsurer) EnsureNamespaces(namespaces []string) ([]string, error) {
+	return e.client.EnsureTcrNs(e.tcrClient, e.region, e.tcrName, namespaces)
+}
+
+// NoopNsEnsurer is used for the registries which create namespaces automatically when pushing
+type NoopNsEnsurer struct{}
+
+// EnsureNamespaces does nothing
+func (e *NoopNsEnsurer) EnsureNamespaces(namespaces []string) ([]string, error) {
+	return nil, nil
+}
+
+// RepoMetadataSyncer sets the metadata of repositories in a target registry
+type RepoMetadataSyncer interface {
+	// SyncDescription sets the description of a repository, the repository is created if not exist
+	SyncDescription(namespace, repo, description string) error
+}
+
+// TcrRepoMetadataSyncer sets the metadata of repositories in a tcr instance
+type TcrRepoMetadataSyncer struct {
+	client    *Client
+	tcrClient *tcrapis.TCRAPIClient
+	region    string
+	tcrName   string
+}
+
+// NewTcrRepoMetadataSyncer creates a TcrRepoMetadataSyncer for a tcr instance
+func NewTcrRepoMetadataSyncer(client *Client, tcrClient *tcrapis.TCRAPIClient,
+	region, tcrName string) *TcrRepoMetadataSyncer {
+	return &TcrRepoMetadataSyncer{
+		client:    client,
+		tcrClient: tcrClient,
+		region:    region,
+		tcrName:   tcrName,
+	}
+}
+
+// SyncDescription creates the tcr repository with description, the description
+// of an existing repository is modified
+func (s *TcrRepoMetadataSyncer) SyncDescription(namespace, repo, description string) error {
+	secretID, secretKey, err := tcrapis.GetTcrSecret(s.client.config.Secret)
+	if err != nil {
+		return err
+	}
+
+	_, tcrID, err := s.tcrClient.GetCachedNamespaceByName(s.client.config.Secret, s.region, s.tcrName, false)
+	if err != nil {
+		return err
+	}
+
+	brief := briefDescription(description)
+	_, createErr := s.tcrClient.CreateRepository(secretID, secretKey, s.region, tcrID, namespace, repo,
+		brief, description)
+	if createErr == nil {
+		return nil
+	}
+
+	// the repository may exist already
+	if _, err := s.tcrClient.ModifyRepository(secretID, secretKey, s.region, tcrID, namespace, repo,
+		brief, description); err != nil {
+		return fmt.Errorf("create repository error: %v, modify repository error: %v", createErr, err)
+	}
+	return nil
+}
+
+// briefDescription returns the first line of a description which is cut to maxBriefDescriptionLen
+func briefDescription(description string) string {
+	brief := []rune(strings.TrimSpace(strings.SplitN(strings.TrimSpace(description), "\n", 2)[0]))
+	if len(brief) > maxBriefDescriptionLen {
+		brief = brief[:maxBriefDescriptionLen]
+	}
+	return string(brief)
+}
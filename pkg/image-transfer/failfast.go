@@ -0,0 +1,120 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+// failFastMinRuns is the number of finished jobs and url pairs before failFastRate is checked,
+// a few early failures should not abort the run
+const failFastMinRuns = 20
+
+// failFast aborts a run once the failures exceed maxFailures or failFastRate of the finished
+// jobs and url pairs, the jobs in progress are cancelled by the context
+type failFast struct {
+	maxFailures int
+	rate        float64
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mutex    sync.Mutex
+	finished int
+	failed   int
+	reason   string
+	// dropped is the number of jobs and url pairs which are not run after the abort
+	dropped int
+}
+
+// newFailFast creates a failFast, it never aborts if maxFailures and rate are 0
+func newFailFast(maxFailures int, rate float64) *failFast {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &failFast{
+		maxFailures: maxFailures,
+		rate:        rate,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// Record counts a finished job or url pair, the run is aborted if the failures exceed the threshold
+func (f *failFast) Record(err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.finished++
+	if err == nil {
+		return
+	}
+	f.failed++
+	if f.reason != "" {
+		return
+	}
+
+	switch {
+	case f.maxFailures > 0 && f.failed >= f.maxFailures:
+		f.reason = fmt.Sprintf("%v failures reached maxFailures %v", f.failed, f.maxFailures)
+	case f.rate > 0 && f.finished >= failFastMinRuns && float64(f.failed) >= f.rate*float64(f.finished):
+		f.reason = fmt.Sprintf("%v failures of %v finished jobs exceed failFastRate %v", f.failed,
+			f.finished, f.rate)
+	default:
+		return
+	}
+	log.Errorf("Abort the run, the remaining jobs are cancelled: %s, the last error: %v", f.reason, err)
+	f.cancel()
+}
+
+// Aborted checks if the run is aborted, the caller drops its job or url pair if it is
+func (f *failFast) Aborted() bool {
+	if f.ctx.Err() == nil {
+		return false
+	}
+	f.mutex.Lock()
+	f.dropped++
+	f.mutex.Unlock()
+	return true
+}
+
+// Err returns the error of an aborted run, nil if the run is not aborted
+func (f *failFast) Err() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.reason == "" {
+		return nil
+	}
+	return fmt.Errorf("the run is aborted early: %s", f.reason)
+}
+
+// Summary logs why the run is aborted and the jobs which are not run
+func (f *failFast) Summary() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.reason == "" {
+		return
+	}
+	log.Summaryf("################# the run is aborted early: %s, %v jobs are not run #################",
+		f.reason, f.dropped)
+}
@@ -0,0 +1,90 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"tkestack.io/image-transfer/pkg/apis/ghcrapis"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/transfer"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+// ghcrPackages are the ghcr.io packages whose visibility is checked after the first push. A package
+// is created by its first push and is private by default, github api can not change its visibility
+type ghcrPackages struct {
+	checked map[string]bool
+	// diffs are the packages whose visibility is different from repoVisibility
+	diffs []string
+	mutex sync.Mutex
+}
+
+// newGHCRPackages creates an empty ghcrPackages
+func newGHCRPackages() *ghcrPackages {
+	return &ghcrPackages{
+		checked: make(map[string]bool),
+	}
+}
+
+// checkGHCRVisibility checks the visibility of the ghcr.io package pushed by a job with github api
+// when createRepoIfMissing is true, a visibility different from repoVisibility is reported as it
+// has to be changed in the package settings of github. Every package is checked once.
+func (c *Client) checkGHCRVisibility(target *transfer.ImageTarget) {
+	if !c.config.FlagConf.Config.CreateRepoIfMissing || target.GetRegistry() != utils.GHCRRegistry ||
+		target.IsLocal() {
+		return
+	}
+	ownerAndName := strings.SplitN(target.GetRepository(), "/", 2)
+	if len(ownerAndName) != 2 {
+		return
+	}
+
+	key := target.GetRegistry() + "/" + target.GetRepository()
+	c.ghcrPackages.mutex.Lock()
+	checked := c.ghcrPackages.checked[key]
+	c.ghcrPackages.checked[key] = true
+	c.ghcrPackages.mutex.Unlock()
+	if checked {
+		return
+	}
+
+	security, exist := c.config.GetSecuritySpecific(target.GetRegistry(), target.GetRepository())
+	if !exist || security.Password == "" {
+		return
+	}
+	visibility, err := ghcrapis.NewGHCRAPIClient(security.Password).PackageVisibility(ownerAndName[0],
+		ownerAndName[1])
+	if err != nil {
+		log.Warnf("Get visibility of ghcr package %s error: %v", key, err)
+		return
+	}
+	if visibility == c.config.FlagConf.Config.RepoVisibility {
+		return
+	}
+
+	log.Warnf("ghcr package %s is %s rather than %s, change it in the package settings of github", key,
+		visibility, c.config.FlagConf.Config.RepoVisibility)
+	c.ghcrPackages.mutex.Lock()
+	c.ghcrPackages.diffs = append(c.ghcrPackages.diffs, fmt.Sprintf("%s: %s, expected %s", key, visibility,
+		c.config.FlagConf.Config.RepoVisibility))
+	c.ghcrPackages.mutex.Unlock()
+}
@@ -0,0 +1,166 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package imagetransfer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/apis/ghcrapis"
+	"tkestack.io/image-transfer/pkg/image-transfer/options"
+	"tkestack.io/image-transfer/pkg/transfer"
+)
+
+// fakeGitHub is a fake github api which answers the visibility of container packages,
+// a package of a user is not found under orgs like github does
+type fakeGitHub struct {
+	orgs  map[string]string
+	users map[string]string
+	mutex sync.Mutex
+	calls map[string]int
+}
+
+func (f *fakeGitHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	f.calls[r.URL.EscapedPath()]++
+	f.mutex.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer ghp_token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	// the path is /{orgs,users}/owner/packages/container/name with an escaped name
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+	packages := f.orgs
+	if parts[0] == "users" {
+		packages = f.users
+	}
+	visibility, ok := packages[parts[1]+"/"+strings.Join(parts[4:], "/")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "Package not found."}`))
+		return
+	}
+	w.Write([]byte(`{"name": "package", "visibility": "` + visibility + `"}`))
+}
+
+// newGHCRTestClient creates a client which checks the ghcr packages with a fake github api
+func newGHCRTestClient(t *testing.T, config *options.ConfigOptions) (*Client, *fakeGitHub) {
+	github := &fakeGitHub{
+		orgs: map[string]string{
+			"my-org/app":              "public",
+			"my-org/platform%2Fbase":  "private",
+			"my-org/internal%2Ftools": "internal",
+		},
+		users: map[string]string{"alice/tool": "private"},
+		calls: make(map[string]int),
+	}
+	server := httptest.NewServer(github)
+	url := ghcrapis.GitHubAPIURL
+	ghcrapis.GitHubAPIURL = server.URL
+	t.Cleanup(func() {
+		ghcrapis.GitHubAPIURL = url
+		server.Close()
+	})
+
+	c := newTestClient(config)
+	c.config.Security = map[string]configs.Security{"ghcr.io": {Username: "github", Password: "ghp_token"}}
+	c.ghcrPackages = newGHCRPackages()
+	return c, github
+}
+
+// newGHCRTarget creates the target of a push to registry
+func newGHCRTarget(t *testing.T, registry, repository string) *transfer.ImageTarget {
+	target, err := transfer.NewImageTarget(registry, repository, "v1", "", "", false)
+	if err != nil {
+		t.Fatalf("NewImageTarget(%s/%s) error: %v", registry, repository, err)
+	}
+	t.Cleanup(func() { target.Close() })
+	return target
+}
+
+func TestCheckGHCRVisibility(t *testing.T) {
+	c, github := newGHCRTestClient(t, &options.ConfigOptions{CreateRepoIfMissing: true, RepoVisibility: "public"})
+	for _, repository := range []string{"my-org/app", "my-org/platform/base", "my-org/platform/base",
+		"alice/tool", "my-org/internal/tools", "my-org/missing"} {
+		c.checkGHCRVisibility(newGHCRTarget(t, "ghcr.io", repository))
+	}
+
+	expected := []string{
+		"ghcr.io/my-org/platform/base: private, expected public",
+		"ghcr.io/alice/tool: private, expected public",
+		"ghcr.io/my-org/internal/tools: internal, expected public",
+	}
+	if !reflect.DeepEqual(c.ghcrPackages.diffs, expected) {
+		t.Errorf("diffs = %q, expected %q", c.ghcrPackages.diffs, expected)
+	}
+	// every package is checked once, a package of a user is looked up under orgs first
+	calls := map[string]int{
+		"/orgs/my-org/packages/container/app":              1,
+		"/orgs/my-org/packages/container/platform%2Fbase":  1,
+		"/orgs/alice/packages/container/tool":              1,
+		"/users/alice/packages/container/tool":             1,
+		"/orgs/my-org/packages/container/internal%2Ftools": 1,
+		"/orgs/my-org/packages/container/missing":          1,
+		"/users/my-org/packages/container/missing":         1,
+	}
+	if !reflect.DeepEqual(github.calls, calls) {
+		t.Errorf("calls of github api = %v, expected %v", github.calls, calls)
+	}
+}
+
+func TestCheckGHCRVisibilitySkipped(t *testing.T) {
+	cases := []struct {
+		config     *options.ConfigOptions
+		registry   string
+		repository string
+	}{
+		{config: &options.ConfigOptions{RepoVisibility: "public"}, registry: "ghcr.io",
+			repository: "my-org/platform/base"},
+		{config: &options.ConfigOptions{CreateRepoIfMissing: true, RepoVisibility: "public"},
+			registry: "quay.io", repository: "my-org/platform/base"},
+		{config: &options.ConfigOptions{CreateRepoIfMissing: true, RepoVisibility: "public"},
+			registry: "ghcr.io.example.com", repository: "my-org/platform/base"},
+		{config: &options.ConfigOptions{CreateRepoIfMissing: true, RepoVisibility: "private"},
+			registry: "ghcr.io", repository: "my-org/platform/base"},
+	}
+	for _, tc := range cases {
+		c, github := newGHCRTestClient(t, tc.config)
+		c.checkGHCRVisibility(newGHCRTarget(t, tc.registry, tc.repository))
+		if len(c.ghcrPackages.diffs) != 0 {
+			t.Errorf("%s/%s with %+v should not be reported: %q", tc.registry, tc.repository, tc.config,
+				c.ghcrPackages.diffs)
+		}
+		if tc.registry != "ghcr.io" && len(github.calls) != 0 {
+			t.Errorf("github api should not be called for %s: %v", tc.registry, github.calls)
+		}
+	}
+
+	// a package can not be checked without a token
+	c, github := newGHCRTestClient(t, &options.ConfigOptions{CreateRepoIfMissing: true, RepoVisibility: "public"})
+	c.config.Security = map[string]configs.Security{"ghcr.io": {Username: "github"}}
+	c.checkGHCRVisibility(newGHCRTarget(t, "ghcr.io", "my-org/platform/base"))
+	if len(c.ghcrPackages.diffs) != 0 || len(github.calls) != 0 {
+		t.Errorf("a package should not be checked without a token: %q, %v", c.ghcrPackages.diffs, github.calls)
+	}
+}
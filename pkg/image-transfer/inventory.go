@@ -0,0 +1,142 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+// Inventory lists the tags of every source repo of the image list and prints them as a json object of
+// repo to tags, nothing is transferred. The wildcard sources are expanded by the catalog api as transfer
+// does, and the tags are listed with the same auth information. The repos which fail to list are logged
+// and the error is returned after the inventory is printed
+func (c *Client) Inventory(imageList map[string]string) error {
+	repos, failed := c.inventoryRepos(imageList)
+
+	var (
+		mutex     sync.Mutex
+		wg        sync.WaitGroup
+		repoChan  = make(chan *utils.RepoURL)
+		inventory = make(map[string][]string)
+	)
+	for i := 0; i < c.config.FlagConf.Config.RoutineNums; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for repoURL := range repoChan {
+				tags, err := c.inventoryTags(repoURL)
+				mutex.Lock()
+				if err != nil {
+					log.Errorf("Get tags of %s error: %v", repoURL.GetURL(), err)
+					failed++
+				} else {
+					inventory[repoURL.GetURL()] = tags
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, repoURL := range repos {
+		repoChan <- repoURL
+	}
+	close(repoChan)
+	wg.Wait()
+
+	// a json object is printed with sorted keys
+	data, err := json.MarshalIndent(inventory, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	log.Summaryf("################# inventory: tags of %v repos are listed, %v failed, nothing is transferred "+
+		"#################", len(inventory), failed)
+	if failed > 0 {
+		return fmt.Errorf("%v sources failed to list tags", failed)
+	}
+	return nil
+}
+
+// inventoryRepos returns the source repos of the image list without tags and digests, every repo once.
+// Local sources and archives have no tags and are skipped
+func (c *Client) inventoryRepos(imageList map[string]string) ([]*utils.RepoURL, int) {
+	failed := 0
+	var sources []string
+	for rule := range imageList {
+		source := utils.AddDefaultRegistry(rule, c.config.FlagConf.Config.DefaultSourceRegistry)
+		if registry, namespace, ok := utils.SplitWildcardRepo(source); ok {
+			urlPairs, err := c.expandWildcardRepo(registry, namespace, "", c.config.Rules[rule])
+			if err != nil {
+				log.Errorf("Expand %s error: %v", source, err)
+				failed++
+				continue
+			}
+			for _, urlPair := range urlPairs {
+				sources = append(sources, urlPair.source)
+			}
+			continue
+		}
+		sources = append(sources, source)
+	}
+
+	seen := make(map[string]bool)
+	var repos []*utils.RepoURL
+	for _, source := range sources {
+		sourceURL, err := utils.NewRepoURL(source)
+		if err != nil {
+			log.Errorf("Url %s format error: %v", source, err)
+			failed++
+			continue
+		}
+		if sourceURL.IsLocal() || seen[sourceURL.GetURLWithoutTag()] {
+			continue
+		}
+		seen[sourceURL.GetURLWithoutTag()] = true
+		repoURL, err := utils.NewRepoURL(sourceURL.GetURLWithoutTag())
+		if err != nil {
+			log.Errorf("Url %s format error: %v", sourceURL.GetURLWithoutTag(), err)
+			failed++
+			continue
+		}
+		repos = append(repos, repoURL)
+	}
+	sort.Slice(repos, func(i, j int) bool {
+		return repos[i].GetURL() < repos[j].GetURL()
+	})
+	return repos, failed
+}
+
+// inventoryTags lists the sorted tags of a source repo
+func (c *Client) inventoryTags(repoURL *utils.RepoURL) ([]string, error) {
+	imageSource, err := c.NewImageSource(repoURL)
+	if err != nil {
+		return nil, err
+	}
+	_, tags, err := c.getSourceRepoTags(repoURL, imageSource, "")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
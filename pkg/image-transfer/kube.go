@@ -0,0 +1,146 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"tkestack.io/image-transfer/pkg/apis/kubeapis"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+// latestTag is the tag which kubernetes pulls for an image without tag and digest, it is also
+// the only tag transferred with latestOnly
+const latestTag = "latest"
+
+// discoverKubeImages lists the images of the pods in fromKubeconfig and adds them to the image list
+func (c *Client) discoverKubeImages() error {
+	config := c.config.FlagConf.Config
+	kubeClient, err := kubeapis.NewKubeAPIClient(config.FromKubeconfig)
+	if err != nil {
+		return err
+	}
+	images, err := kubeClient.ListPodImages(config.KubeNamespaces)
+	if err != nil {
+		return fmt.Errorf("list images of pods error: %v", err)
+	}
+
+	return c.addDiscoveredImages(images, config.KubeRegistries, "container images of pods")
+}
+
+// addDiscoveredImages adds the discovered images of from to the image list, the images out of registries
+// are skipped unless registries is empty. A source which is in the rule files keeps its rule
+func (c *Client) addDiscoveredImages(images, registries []string, from string) error {
+	pairs := make(map[string]string)
+	for _, image := range images {
+		source, target, ok, err := c.discoveredImagePair(image, registries)
+		if err != nil {
+			log.Warnf("Skip image %s of %s: %v", image, from, err)
+			continue
+		}
+		if ok {
+			pairs[source] = target
+		}
+	}
+
+	for source, target := range pairs {
+		if _, ok := c.config.ImageList[source]; ok {
+			log.Debugf("%s discovered from %s is in the rule files, its rule is kept", source, from)
+			continue
+		}
+		c.config.ImageList[source] = target
+	}
+	log.Summaryf("################# %v images are discovered from %v %s #################",
+		len(pairs), len(images), from)
+	return nil
+}
+
+// discoveredImagePair returns the source and target of a discovered image, ok is false if the image is
+// out of registries or it is on the target registry already. An image referenced by digest is
+// transferred by digest, its tag is sha256-<hex> if it has no tag
+func (c *Client) discoveredImagePair(image string, registries []string) (string, string, bool, error) {
+	config := c.config.FlagConf.Config
+	sourceURL, err := utils.NewRepoURL(image)
+	if err != nil {
+		return "", "", false, err
+	}
+	if sourceURL.IsLocal() {
+		return "", "", false, fmt.Errorf("it is not a registry image")
+	}
+	if len(registries) != 0 && !utils.IsContain(registries, sourceURL.GetRegistry()) {
+		return "", "", false, nil
+	}
+
+	source := sourceURL.GetRegistry() + "/" + sourceURL.GetRepoWithNamespace()
+	tag := sourceURL.GetTag()
+	switch {
+	case tag != "":
+		source += ":" + tag
+	case sourceURL.GetDigest() == "":
+		tag = latestTag
+		source += ":" + tag
+	default:
+		tag = strings.Replace(sourceURL.GetDigest(), ":", "-", 1)
+	}
+	if sourceURL.GetDigest() != "" {
+		source += "@" + sourceURL.GetDigest()
+	}
+
+	var target string
+	if config.TargetTemplate != "" {
+		template, err := utils.ParseTargetTemplate(utils.CompleteTargetTemplate(config.TargetTemplate))
+		if err != nil {
+			return "", "", false, err
+		}
+		tagURL, err := utils.NewRepoURL(sourceURL.GetURLWithoutTag() + ":" + tag)
+		if err != nil {
+			return "", "", false, err
+		}
+		if target, err = template.Render(tagURL); err != nil {
+			return "", "", false, err
+		}
+		if !template.HasTag() {
+			target += ":" + tag
+		}
+	} else if config.DefaultRegistry != "" && config.DefaultNamespace != "" {
+		target = config.DefaultRegistry + "/" + config.DefaultNamespace + "/" + sourceURL.GetRepo() + ":" + tag
+	} else {
+		return "", "", false, fmt.Errorf("targetTemplate or the default registry and namespace should be set")
+	}
+	if strings.SplitN(target, "/", 2)[0] == sourceURL.GetRegistry() {
+		return "", "", false, nil
+	}
+	return source, target, true, nil
+}
+
+// printImageList prints the image list as a rule file which can be reviewed and used by the next run
+func (c *Client) printImageList() error {
+	// a json object is a valid yaml rule file, the keys are sorted
+	data, err := json.MarshalIndent(c.config.ImageList, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	log.Summaryf("################# dry run: %v rules are printed, nothing is transferred #################",
+		len(c.config.ImageList))
+	return nil
+}
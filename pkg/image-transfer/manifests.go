@@ -0,0 +1,419 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+// templateImagePattern matches an image field with a literal value in a line of a chart template,
+// the values with template actions are found in the values of the chart instead
+var templateImagePattern = regexp.MustCompile(`(?m)^\s*(?:-\s+)?[A-Za-z]*[Ii]mage:\s*["']?([^"'\s{}#]+)["']?\s*(?:#.*)?$`)
+
+// discoverManifestImages extracts the images of the manifests in fromManifests and the chart of fromChart,
+// and adds them to the image list
+func (c *Client) discoverManifestImages() error {
+	config := c.config.FlagConf.Config
+	if len(config.FromManifests) != 0 {
+		var images []string
+		for _, path := range config.FromManifests {
+			found, err := manifestImages(path)
+			if err != nil {
+				return fmt.Errorf("extract images of manifests %s error: %v", path, err)
+			}
+			images = append(images, found...)
+		}
+		if err := c.addDiscoveredImages(uniqueImages(images), nil, "images of manifests"); err != nil {
+			return err
+		}
+	}
+	if config.FromChart != "" {
+		images, err := chartImages(config.FromChart, config.ChartValues)
+		if err != nil {
+			return fmt.Errorf("extract images of chart %s error: %v", config.FromChart, err)
+		}
+		if err := c.addDiscoveredImages(uniqueImages(images), nil, "images of chart"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// manifestImages walks the yaml and json files of a directory, or reads a single file, and returns the
+// images of them. The documents which can not be parsed are skipped with a warning
+func manifestImages(root string) ([]string, error) {
+	var images []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml", ".json":
+		default:
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		images = append(images, documentImages(path, data)...)
+		return nil
+	})
+	return images, err
+}
+
+// documentImages returns the images of the yaml documents in data, json is parsed as yaml. The rest
+// of a file is skipped with a warning once a document can not be parsed
+func documentImages(name string, data []byte) []string {
+	var images []string
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for i := 1; ; i++ {
+		var document yamlNode
+		err := decoder.Decode(&document)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Warnf("Skip document %v and the rest of %s, it can not be parsed: %v", i, name, err)
+			break
+		}
+		collectImages(document.value, "", &images)
+	}
+	return images
+}
+
+// yamlNode is a parsed yaml value whose scalars are kept as their original text, e.g. an unquoted
+// tag 1.10 is "1.10" rather than the float 1.1. A mapping is a map[interface{}]interface{} and
+// a sequence is a []interface{} like yaml.v2 decodes them
+type yamlNode struct {
+	value interface{}
+}
+
+// UnmarshalYAML decodes a scalar, a mapping or a sequence
+func (n *yamlNode) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var scalar *string
+	if err := unmarshal(&scalar); err == nil {
+		if scalar != nil {
+			n.value = *scalar
+		}
+		return nil
+	}
+
+	var mapping map[interface{}]yamlNode
+	if err := unmarshal(&mapping); err == nil {
+		value := make(map[interface{}]interface{}, len(mapping))
+		for key, child := range mapping {
+			value[key] = child.value
+		}
+		n.value = value
+		return nil
+	}
+
+	var sequence []yamlNode
+	if err := unmarshal(&sequence); err != nil {
+		return err
+	}
+	value := make([]interface{}, len(sequence))
+	for i, child := range sequence {
+		value[i] = child.value
+	}
+	n.value = value
+	return nil
+}
+
+// unmarshalValues parses the values of a chart, the scalars are kept as their original text
+func unmarshalValues(data []byte) (map[interface{}]interface{}, error) {
+	var node yamlNode
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, err
+	}
+	if node.value == nil {
+		return make(map[interface{}]interface{}), nil
+	}
+	values, ok := node.value.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("values should be a map")
+	}
+	return values, nil
+}
+
+// collectImages walks a parsed document and collects the values of the fields named image or ending
+// with Image, like spec.image of custom resources and initImage. A field whose value is a map of
+// registry, repository, tag and digest, which is common in the values of charts, is joined to an image,
+// defaultTag is used if the map has neither tag nor digest
+func collectImages(node interface{}, defaultTag string, images *[]string) {
+	switch value := node.(type) {
+	case map[interface{}]interface{}:
+		for key, child := range value {
+			name, ok := key.(string)
+			if ok && (name == "image" || strings.HasSuffix(name, "Image")) {
+				switch image := child.(type) {
+				case string:
+					if isImageValue(image) {
+						*images = append(*images, image)
+					}
+				case map[interface{}]interface{}:
+					if image, ok := imageOfFields(image, defaultTag); ok {
+						*images = append(*images, image)
+					}
+				}
+			}
+			collectImages(child, defaultTag, images)
+		}
+	case []interface{}:
+		for _, child := range value {
+			collectImages(child, defaultTag, images)
+		}
+	}
+}
+
+// imageOfFields joins the registry, repository, tag and digest fields of an image map
+func imageOfFields(fields map[interface{}]interface{}, defaultTag string) (string, bool) {
+	repository := scalarString(fields["repository"])
+	if !isImageValue(repository) {
+		return "", false
+	}
+	image := repository
+	if registry := scalarString(fields["registry"]); registry != "" {
+		image = registry + "/" + image
+	}
+	tag, digest := scalarString(fields["tag"]), scalarString(fields["digest"])
+	if tag == "" && digest == "" {
+		tag = defaultTag
+	}
+	if tag != "" {
+		image += ":" + tag
+	}
+	if digest != "" {
+		image += "@" + digest
+	}
+	return image, isImageValue(image)
+}
+
+// scalarString returns the original text of a scalar field, an unquoted tag like 1.10 is 1.10,
+// it is empty for a mapping or a sequence
+func scalarString(value interface{}) string {
+	text, _ := value.(string)
+	return text
+}
+
+// isImageValue returns false for an empty value and a value with whitespaces or template actions
+func isImageValue(value string) bool {
+	return value != "" && !strings.ContainsAny(value, " \t\n{}")
+}
+
+// chartImages returns the images of a chart directory or archive, the values of the chart are overridden
+// by valueFiles in order. The chart is not rendered, the images are extracted from the merged values,
+// the literal image fields of templates and crds, and the subcharts with their values in the parent
+func chartImages(path string, valueFiles []string) ([]string, error) {
+	var files map[string][]byte
+	if info, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if info.IsDir() {
+		if files, err = readChartDir(path); err != nil {
+			return nil, err
+		}
+	} else {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if files, err = readChartArchive(data); err != nil {
+			return nil, err
+		}
+	}
+
+	values := make(map[interface{}]interface{})
+	for _, valueFile := range valueFiles {
+		data, err := ioutil.ReadFile(valueFile)
+		if err != nil {
+			return nil, err
+		}
+		fileValues, err := unmarshalValues(data)
+		if err != nil {
+			return nil, fmt.Errorf("parse values %s error: %v", valueFile, err)
+		}
+		mergeValues(values, fileValues)
+	}
+	return chartFilesImages(path, files, values), nil
+}
+
+// chartFilesImages returns the images of the files of a chart, the paths of files are relative to the
+// chart directory
+func chartFilesImages(name string, files map[string][]byte, values map[interface{}]interface{}) []string {
+	chartValues := make(map[interface{}]interface{})
+	if data, ok := files["values.yaml"]; ok {
+		var err error
+		if chartValues, err = unmarshalValues(data); err != nil {
+			log.Warnf("Skip values.yaml of chart %s, it can not be parsed: %v", name, err)
+			chartValues = make(map[interface{}]interface{})
+		}
+	}
+	mergeValues(chartValues, values)
+
+	// the charts use appVersion as the default tag of their images by convention
+	var images []string
+	collectImages(chartValues, chartMetadataOf(files).AppVersion, &images)
+
+	subcharts := make(map[string]map[string][]byte)
+	for path, data := range files {
+		switch {
+		case strings.HasPrefix(path, "templates/") || strings.HasPrefix(path, "crds/"):
+			for _, match := range templateImagePattern.FindAllSubmatch(data, -1) {
+				images = append(images, string(match[1]))
+			}
+		case strings.HasPrefix(path, "charts/"):
+			subpath := strings.TrimPrefix(path, "charts/")
+			if parts := strings.SplitN(subpath, "/", 2); len(parts) == 2 {
+				if subcharts[parts[0]] == nil {
+					subcharts[parts[0]] = make(map[string][]byte)
+				}
+				subcharts[parts[0]][parts[1]] = data
+			} else if strings.HasSuffix(subpath, ".tgz") {
+				subfiles, err := readChartArchive(data)
+				if err != nil {
+					log.Warnf("Skip subchart %s of chart %s, it can not be read: %v", subpath, name, err)
+					continue
+				}
+				subname := chartMetadataOf(subfiles).Name
+				if subname == "" {
+					subname = strings.TrimSuffix(subpath, ".tgz")
+				}
+				subcharts[subname] = subfiles
+			}
+		}
+	}
+
+	for subname, subfiles := range subcharts {
+		// the values of a subchart are overridden by the values under its name in the parent
+		subvalues, _ := chartValues[subname].(map[interface{}]interface{})
+		images = append(images, chartFilesImages(name+"/charts/"+subname, subfiles, subvalues)...)
+	}
+	return images
+}
+
+// chartMetadata is the name and appVersion in Chart.yaml
+type chartMetadata struct {
+	Name       string `yaml:"name"`
+	AppVersion string `yaml:"appVersion"`
+}
+
+// chartMetadataOf reads Chart.yaml of the files of a chart, the fields are empty if it can not be read
+func chartMetadataOf(files map[string][]byte) *chartMetadata {
+	metadata := &chartMetadata{}
+	if err := yaml.Unmarshal(files["Chart.yaml"], metadata); err != nil {
+		return &chartMetadata{}
+	}
+	return metadata
+}
+
+// mergeValues merges src into dst, the maps are merged recursively and the other values of src
+// override the ones of dst
+func mergeValues(dst, src map[interface{}]interface{}) {
+	for key, value := range src {
+		srcMap, srcIsMap := value.(map[interface{}]interface{})
+		dstMap, dstIsMap := dst[key].(map[interface{}]interface{})
+		if srcIsMap && dstIsMap {
+			mergeValues(dstMap, srcMap)
+			continue
+		}
+		dst[key] = value
+	}
+}
+
+// readChartArchive reads the files of a chart archive, the top directory which is the chart name
+// is removed from the paths
+func readChartArchive(data []byte) (map[string][]byte, error) {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gzipReader.Close()
+
+	files := make(map[string][]byte)
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(header.Name, "./"), "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if files[parts[1]], err = ioutil.ReadAll(tarReader); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// readChartDir reads the files of a chart directory
+func readChartDir(dir string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)], err = ioutil.ReadFile(path)
+		return err
+	})
+	return files, err
+}
+
+// uniqueImages returns the sorted images without duplicates
+func uniqueImages(images []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, image := range images {
+		if !seen[image] {
+			seen[image] = true
+			unique = append(unique, image)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
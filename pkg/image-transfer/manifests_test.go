@@ -0,0 +1,121 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testDigest = "sha256:2b4e7b2ae2ee3a5e6d2d2d5b2bd6c6d3e3c5cbf0d1a9a3a9d2c0c8e4f6b8a1c3"
+
+func TestDocumentImages(t *testing.T) {
+	data := []byte(`apiVersion: apps/v1
+kind: Deployment
+spec:
+  template:
+    spec:
+      initContainers:
+      - name: init
+        image: busybox:1.10
+      containers:
+      - name: app
+        image: nginx:1.21
+---
+apiVersion: example.com/v1
+kind: Agent
+spec:
+  agentImage: example.com/agent:2.0
+  image:
+    repository: example.com/app
+    tag: 1.10
+`)
+	images := uniqueImages(documentImages("deploy.yaml", data))
+	expected := []string{"busybox:1.10", "example.com/agent:2.0", "example.com/app:1.10", "nginx:1.21"}
+	if !reflect.DeepEqual(images, expected) {
+		t.Errorf("expected %v, got %v", expected, images)
+	}
+}
+
+func TestImageOfFieldsScalarText(t *testing.T) {
+	cases := []struct {
+		values   string
+		expected []string
+	}{
+		{"image:\n  repository: nginx\n  tag: 1.10\n", []string{"nginx:1.10"}},
+		{"image:\n  repository: nginx\n  tag: 2.0\n", []string{"nginx:2.0"}},
+		{"image:\n  repository: nginx\n  tag: 3\n", []string{"nginx:3"}},
+		{"image:\n  repository: nginx\n  tag: 010\n", []string{"nginx:010"}},
+		{"image:\n  registry: example.com\n  repository: library/nginx\n  tag: 1.10\n  digest: " + testDigest + "\n",
+			[]string{"example.com/library/nginx:1.10@" + testDigest}},
+		{"image:\n  repository: nginx\n", []string{"nginx:1.20"}},
+		{"image:\n  repository: nginx\n  tag: \"{{ .Values.tag }}\"\n", nil},
+	}
+	for _, c := range cases {
+		values, err := unmarshalValues([]byte(c.values))
+		if err != nil {
+			t.Fatalf("unmarshal %q error: %v", c.values, err)
+		}
+		var images []string
+		collectImages(values, "1.20", &images)
+		if !reflect.DeepEqual(images, c.expected) {
+			t.Errorf("values %q: expected %v, got %v", c.values, c.expected, images)
+		}
+	}
+}
+
+func TestChartImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"Chart.yaml":  "apiVersion: v2\nname: app\nappVersion: 1.10\n",
+		"values.yaml": "image:\n  repository: example.com/app\nsidecar:\n  image:\n    repository: example.com/sidecar\n    tag: 0.9\n",
+		"templates/deployment.yaml": "spec:\n  containers:\n  - name: app\n    image: \"{{ .Values.image.repository }}\"\n" +
+			"  - name: proxy\n    image: example.com/proxy:1.0\n",
+		"charts/redis/Chart.yaml":  "apiVersion: v2\nname: redis\nappVersion: 6.0\n",
+		"charts/redis/values.yaml": "image:\n  repository: redis\n",
+		"override.yaml":            "sidecar:\n  image:\n    tag: 1.10\nredis:\n  image:\n    tag: 6.2.10\n",
+	}
+	for path, content := range files {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	override := filepath.Join(dir, "override.yaml")
+	images, err := chartImages(dir, []string{override})
+	if err != nil {
+		t.Fatalf("chart images error: %v", err)
+	}
+	expected := []string{"example.com/app:1.10", "example.com/proxy:1.0", "example.com/sidecar:1.10", "redis:6.2.10"}
+	if images = uniqueImages(images); !reflect.DeepEqual(images, expected) {
+		t.Errorf("expected %v, got %v", expected, images)
+	}
+}
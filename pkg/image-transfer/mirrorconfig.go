@@ -0,0 +1,217 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+const (
+	// hostsTomlFile is the containerd mirror configuration of a registry in its directory of mirrorHostsDir
+	hostsTomlFile = "hosts.toml"
+	// dockerHubServer is the upstream server of docker.io in hosts.toml
+	dockerHubServer = "https://registry-1.docker.io"
+)
+
+// registryMirror is the mirror of a source registry, the repositories of source registry are found
+// under prefix of the mirror registry
+type registryMirror struct {
+	source   string
+	registry string
+	prefix   string
+	insecure bool
+}
+
+// location returns the mirror registry followed by prefix
+func (m *registryMirror) location() string {
+	if m.prefix == "" {
+		return m.registry
+	}
+	return m.registry + "/" + m.prefix
+}
+
+// splitRuleRepo splits a source or target of a rule into the registry and the repository path without
+// the tag and digest, the path of registry/namespace/* is the namespace. ok is false for a local image
+func splitRuleRepo(url string) (registry, path string, ok bool) {
+	if registry, namespace, wildcard := utils.SplitWildcardRepo(url); wildcard {
+		return registry, namespace, true
+	}
+	repoURL, err := utils.NewRepoURL(url)
+	if err != nil || repoURL.IsLocal() {
+		return "", "", false
+	}
+	return repoURL.GetRegistry(), repoURL.GetRepoWithNamespace(), true
+}
+
+// ruleMirror returns the mirror of the source registry of a rule, ok is false if the target does not
+// keep the repository path of source under a prefix, e.g. a renamed repository
+func ruleMirror(source, target string) (*registryMirror, bool) {
+	sourceRegistry, sourcePath, ok := splitRuleRepo(source)
+	if !ok {
+		return nil, false
+	}
+	targetRegistry, targetPath, ok := splitRuleRepo(target)
+	if !ok {
+		return nil, false
+	}
+
+	mirror := &registryMirror{
+		source:   sourceRegistry,
+		registry: targetRegistry,
+	}
+	switch {
+	case sourcePath == "":
+		mirror.prefix = targetPath
+	case targetPath == sourcePath:
+	case strings.HasSuffix(targetPath, "/"+sourcePath):
+		mirror.prefix = strings.TrimSuffix(targetPath, "/"+sourcePath)
+	default:
+		return nil, false
+	}
+	return mirror, true
+}
+
+// registryMirrors returns the mirrors of the source registries of rules, sorted by source registry.
+// A source registry mirrored to different targets is warned and the target of the last rule sorted
+// by source is picked, so the result is deterministic
+func (c *Client) registryMirrors(imageList map[string]string) []*registryMirror {
+	sources := make([]string, 0, len(imageList))
+	for source := range imageList {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	mirrors := make(map[string]*registryMirror)
+	for _, source := range sources {
+		target := imageList[source]
+		mirror, ok := ruleMirror(source, target)
+		if !ok {
+			log.Warnf("Rule %s: %s does not keep the repository path under a prefix, it can not be a mirror",
+				source, target)
+			continue
+		}
+		if last, ok := mirrors[mirror.source]; ok && last.location() != mirror.location() {
+			log.Warnf("%s is mirrored to both %s and %s, %s is picked", mirror.source, last.location(),
+				mirror.location(), mirror.location())
+		}
+		mirrors[mirror.source] = mirror
+	}
+
+	result := make([]*registryMirror, 0, len(mirrors))
+	for _, mirror := range mirrors {
+		security, _ := c.config.GetSecuritySpecific(mirror.registry, mirror.prefix)
+		mirror.insecure = security.Insecure
+		result = append(result, mirror)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].source < result[j].source
+	})
+	return result
+}
+
+// hostsToml returns the containerd hosts.toml of a mirror, a prefix is the api root of the mirror by override_path
+func hostsToml(mirror *registryMirror, capabilities []string) string {
+	server := "https://" + mirror.source
+	if mirror.source == utils.DockerHubRegistry {
+		server = dockerHubServer
+	}
+	host := "https://" + mirror.registry
+	if mirror.prefix != "" {
+		host += "/v2/" + mirror.prefix
+	}
+
+	quoted := make([]string, 0, len(capabilities))
+	for _, capability := range capabilities {
+		quoted = append(quoted, fmt.Sprintf("%q", capability))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "server = %q\n\n", server)
+	fmt.Fprintf(&b, "[host.%q]\n", host)
+	fmt.Fprintf(&b, "  capabilities = [%s]\n", strings.Join(quoted, ", "))
+	if mirror.prefix != "" {
+		b.WriteString("  override_path = true\n")
+	}
+	if mirror.insecure {
+		b.WriteString("  skip_verify = true\n")
+	}
+	return b.String()
+}
+
+// registriesConf returns the registries.conf of cri-o and podman with a [[registry]] of every mirror
+func registriesConf(mirrors []*registryMirror) string {
+	var b strings.Builder
+	for i, mirror := range mirrors {
+		if i != 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString("[[registry]]\n")
+		fmt.Fprintf(&b, "prefix = %q\n", mirror.source)
+		fmt.Fprintf(&b, "location = %q\n\n", mirror.source)
+		b.WriteString("[[registry.mirror]]\n")
+		fmt.Fprintf(&b, "location = %q\n", mirror.location())
+		if mirror.insecure {
+			b.WriteString("insecure = true\n")
+		}
+	}
+	return b.String()
+}
+
+// MirrorConfig writes the containerd hosts.toml of every source registry of rules to mirrorHostsDir and
+// the registries.conf of all source registries to mirrorRegistriesConf, the targets of rules are taken
+// as the pull-through mirrors of sources. Nothing is transferred
+func (c *Client) MirrorConfig(imageList map[string]string) error {
+	config := c.config.FlagConf.Config
+	mirrors := c.registryMirrors(imageList)
+	log.Summaryf("################# %v source registries are mirrored #################", len(mirrors))
+
+	for _, mirror := range mirrors {
+		log.Summaryf("%s: %s, insecure: %v", mirror.source, mirror.location(), mirror.insecure)
+		if config.MirrorHostsDir == "" {
+			continue
+		}
+		dir := filepath.Join(config.MirrorHostsDir, mirror.source)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("create hosts directory %s error: %v", dir, err)
+		}
+		path := filepath.Join(dir, hostsTomlFile)
+		if err := ioutil.WriteFile(path, []byte(hostsToml(mirror, config.MirrorCapabilities)), 0644); err != nil {
+			return fmt.Errorf("write hosts.toml to %s error: %v", path, err)
+		}
+	}
+	if config.MirrorHostsDir != "" {
+		log.Summaryf("containerd hosts.toml files are written to %s", config.MirrorHostsDir)
+	}
+
+	if path := config.MirrorRegistriesConf; path != "" {
+		if err := ioutil.WriteFile(path, []byte(registriesConf(mirrors)), 0644); err != nil {
+			return fmt.Errorf("write registries.conf to %s error: %v", path, err)
+		}
+		log.Summaryf("registries.conf is written to %s", path)
+	}
+	return nil
+}
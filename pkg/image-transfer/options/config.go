@@ -19,13 +19,32 @@
 package options
 
 import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
 	"github.com/spf13/pflag"
+	"tkestack.io/image-transfer/pkg/transfer"
+	"tkestack.io/image-transfer/pkg/utils"
 )
 
+// tagRegexp is the naming rule of an image tag
+var tagRegexp = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+
+// sha256Regexp matches a hex encoded sha256
+var sha256Regexp = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+// IsValidTag checks if a tag matches the naming rule of an image tag
+func IsValidTag(tag string) bool {
+	return tagRegexp.MatchString(tag)
+}
+
 // ConfigOptions 基础配置信息
 type ConfigOptions struct {
 	SecurityFile string
-	RuleFile string
+	RuleFile []string
 	RoutineNums int
 	RetryNums int
 	QPS int
@@ -36,6 +55,119 @@ type ConfigOptions struct {
 	TCRRegion string
 	TCRName string
 	SecretFile string
+	SWRToTCR bool
+	SWRRegion string
+	CreateRepoIfMissing bool
+	RepoVisibility string
+	LowercaseTarget bool
+	TCRToTCR bool
+	SourceTCRRegion string
+	SourceTCRName string
+	SourceNamespaces []string
+	SkipSameDigest bool
+	TCRToCCR bool
+	VerifyAfterPush bool
+	CCRToRegistry bool
+	TargetTemplate string
+	CCRNamespaces []string
+	CCRNamespaceExclude string
+	Deterministic bool
+	CCRRepoInclude []string
+	CCRRepoExclude []string
+	CCRRepoFilterFile string
+	DefaultTag string
+	CCRMaxTagsPerRepo int
+	MaxTagsPerRepo int
+	TagSortOrder string
+	NamespaceMapping string
+	KeepNonSemverTags bool
+	TCRRouting string
+	UnroutedNsFallback bool
+	ListTimeout time.Duration
+	CopyTimeout time.Duration
+	ForcePrivate bool
+	SyncRepoMetadata bool
+	SourceRegistryMirror map[string]string
+	SourceMirrorFallback bool
+	CrossAccount bool
+	Report string
+	DockerConfig string
+	UseDockerConfig bool
+	JobBufferSize int
+	PasswordStdin string
+	StdinUsername string
+	PromptCredentials bool
+	SkipMissingTags bool
+	CheckAuth bool
+	SkipPreflight bool
+	CatalogRepoInclude []string
+	CatalogRepoExclude []string
+	MaxCatalogRepos int
+	MirrorRegistry string
+	Mode string
+	MaxFailures int
+	FailFastRate float64
+	DiffOutput string
+	DeleteExtraneous bool
+	DeleteDryRun bool
+	MaxDeletePercent int
+	ForceDelete bool
+	TargetManifestType string
+	RetainTags int
+	RetainTagRegexes []string
+	IfExists string
+	DropAnnotations []string
+	DeepVerify bool
+	RewriteMap string
+	EmitKustomize string
+	EmitHelmValues string
+	MirrorHostsDir string
+	MirrorRegistriesConf string
+	MirrorCapabilities []string
+	RuleConflict string
+	LabelFilter []string
+	FromKubeconfig string
+	KubeNamespaces []string
+	KubeRegistries []string
+	DryRun bool
+	FromManifests []string
+	FromChart string
+	ChartValues []string
+	ImageListFile []string
+	LatestOnly bool
+	RemoteConfigHeader []string
+	RemoteConfigTimeout time.Duration
+	ImageListSha256 string
+	CacheConfigDir string
+	UserAgent string
+	LayerCompression string
+	UploadChunkSizeMB int
+	RewriteRules string
+	TestRewrite []string
+	MaxIdleConnsPerHost int
+	KeepAlive time.Duration
+	DigestLock string
+	WarnMutatedTags bool
+	TargetRepoRewrite []string
+	TCRAPIEndpoint string
+	CCRAPIEndpoint string
+	APICAFile string
+	RegistryDomainOverride map[string]string
+	APIQPS int
+	APIMaxAttempts int
+	IgnoreQuota bool
+	TCRNamespaceQuota int64
+	TCRRepoQuota int64
+	TCRStorageQuotaGB int64
+	NsRoutines int
+	DefaultSourceRegistry string
+	Verify bool
+	VerifyOnly bool
+	ReportOnly bool
+	VerifyReport string
+	CCRRepoFile string
+	CopyReferrers bool
+	CopySignatures bool
 
 }
 
@@ -50,16 +182,243 @@ func NewConfigOptions() *ConfigOptions {
 func (o *ConfigOptions) Validate() []error {
 	var allErrors []error
 
+	if o.RepoVisibility != "public" && o.RepoVisibility != "private" {
+		allErrors = append(allErrors, fmt.Errorf("repoVisibility should be public or private, got %s",
+			o.RepoVisibility))
+	}
+
+	// a default tag is a single tag, multi-tags are only supported in rules
+	if o.DefaultTag != "" && !tagRegexp.MatchString(o.DefaultTag) {
+		allErrors = append(allErrors, fmt.Errorf("defaultTag %s is not a valid single tag", o.DefaultTag))
+	}
+
+	if o.CCRMaxTagsPerRepo < 0 {
+		allErrors = append(allErrors, fmt.Errorf("ccrMaxTagsPerRepo should not be negative, got %v",
+			o.CCRMaxTagsPerRepo))
+	}
+
+	if o.MaxTagsPerRepo < 0 {
+		allErrors = append(allErrors, fmt.Errorf("maxTagsPerRepo should not be negative, got %v", o.MaxTagsPerRepo))
+	}
+
+	if ext := strings.ToLower(filepath.Ext(o.Report)); o.Report != "" && ext != ".json" && ext != ".csv" {
+		allErrors = append(allErrors, fmt.Errorf("report should be a .json or .csv file, got %s", o.Report))
+	}
+
+	if ext := strings.ToLower(filepath.Ext(o.RewriteMap)); o.RewriteMap != "" && ext != ".yaml" && ext != ".yml" {
+		allErrors = append(allErrors, fmt.Errorf("rewriteMap should be a .yaml file, got %s", o.RewriteMap))
+	}
+
+	if ext := strings.ToLower(filepath.Ext(o.DigestLock)); o.DigestLock != "" && ext != ".yaml" && ext != ".yml" {
+		allErrors = append(allErrors, fmt.Errorf("digestLock should be a .yaml or .yml file, got %s", o.DigestLock))
+	}
+	if _, err := utils.ParseRepoRewrite(o.TargetRepoRewrite); err != nil {
+		allErrors = append(allErrors, fmt.Errorf("targetRepoRewrite is invalid: %v", err))
+	}
+	if ext := strings.ToLower(filepath.Ext(o.VerifyReport)); o.VerifyReport != "" && ext != ".json" && ext != ".csv" {
+		allErrors = append(allErrors, fmt.Errorf("verifyReport should be a .json or .csv file, got %s",
+			o.VerifyReport))
+	}
+
+	if o.ListTimeout < 0 || o.CopyTimeout < 0 {
+		allErrors = append(allErrors, fmt.Errorf("listTimeout and copyTimeout should not be negative, got %v and %v",
+			o.ListTimeout, o.CopyTimeout))
+	}
+
+	if o.APIQPS <= 0 || o.APIMaxAttempts <= 0 {
+		allErrors = append(allErrors, fmt.Errorf("apiQps and apiMaxAttempts should be positive, got %v and %v",
+			o.APIQPS, o.APIMaxAttempts))
+	}
+
+	if o.NsRoutines <= 0 {
+		allErrors = append(allErrors, fmt.Errorf("nsRoutines should be positive, got %v", o.NsRoutines))
+	}
+
+	// 0 means fail-fast is disabled
+	if o.MaxFailures < 0 {
+		allErrors = append(allErrors, fmt.Errorf("maxFailures should not be negative, got %v", o.MaxFailures))
+	}
+	if o.FailFastRate < 0 || o.FailFastRate > 1 {
+		allErrors = append(allErrors, fmt.Errorf("failFastRate should be in [0, 1], got %v", o.FailFastRate))
+	}
+
+	if o.Mode != "transfer" && o.Mode != "verify" && o.Mode != "diff" && o.Mode != "mirrorConfig" &&
+		o.Mode != "inventory" {
+		allErrors = append(allErrors, fmt.Errorf("mode should be transfer, verify, diff, mirrorConfig or "+
+			"inventory, got %s", o.Mode))
+	}
+	for _, label := range o.LabelFilter {
+		if strings.TrimSpace(strings.SplitN(label, "=", 2)[0]) == "" {
+			allErrors = append(allErrors, fmt.Errorf("labelFilter %q should be key=value or key", label))
+		}
+	}
+	stdinReaders := 0
+	if o.PasswordStdin != "" {
+		stdinReaders++
+	}
+	for _, imageList := range o.ImageListFile {
+		if imageList == "-" {
+			stdinReaders++
+		}
+	}
+	if stdinReaders > 1 {
+		allErrors = append(allErrors, fmt.Errorf("stdin can only be read once by imageList or passwordStdin"))
+	}
+	if o.ImageListSha256 != "" {
+		if !sha256Regexp.MatchString(o.ImageListSha256) {
+			allErrors = append(allErrors, fmt.Errorf("imageListSha256 should be 64 hex characters, got %s",
+				o.ImageListSha256))
+		}
+		if len(o.RuleFile)+len(o.ImageListFile) != 1 {
+			allErrors = append(allErrors, fmt.Errorf("imageListSha256 should be used with only one ruleFile "+
+				"or imageList"))
+		}
+	}
+	if o.RemoteConfigTimeout <= 0 {
+		allErrors = append(allErrors, fmt.Errorf("remoteConfigTimeout should be positive, got %v",
+			o.RemoteConfigTimeout))
+	}
+	if o.LatestOnly && o.DefaultTag != "" {
+		allErrors = append(allErrors, fmt.Errorf("latestOnly should not be used with defaultTag"))
+	}
+	if len(o.ChartValues) != 0 && o.FromChart == "" {
+		allErrors = append(allErrors, fmt.Errorf("chartValues should be used with fromChart"))
+	}
+	if o.RuleConflict != "override" && o.RuleConflict != "error" {
+		allErrors = append(allErrors, fmt.Errorf("ruleConflict should be override or error, got %s", o.RuleConflict))
+	}
+	for _, capability := range o.MirrorCapabilities {
+		if capability != "pull" && capability != "resolve" && capability != "push" {
+			allErrors = append(allErrors, fmt.Errorf("mirrorCapabilities should be pull, resolve or push, got %s",
+				capability))
+		}
+	}
+	if o.Mode == "diff" && !strings.HasSuffix(o.DiffOutput, ".yaml") {
+		allErrors = append(allErrors, fmt.Errorf("diffOutput should be a .yaml file, got %s", o.DiffOutput))
+	}
+	if !transfer.ValidManifestType(o.TargetManifestType) {
+		allErrors = append(allErrors, fmt.Errorf("targetManifestType should be v2s2 or oci, got %s",
+			o.TargetManifestType))
+	}
+	if o.TargetTemplate != "" {
+		if _, err := utils.ParseTargetTemplate(utils.CompleteTargetTemplate(o.TargetTemplate)); err != nil {
+			allErrors = append(allErrors, fmt.Errorf("targetTemplate is invalid: %v", err))
+		}
+	}
+	if o.MaxIdleConnsPerHost < 0 {
+		allErrors = append(allErrors, fmt.Errorf("maxIdleConnsPerHost should not be negative, got %v",
+			o.MaxIdleConnsPerHost))
+	}
+	if o.KeepAlive < 0 {
+		allErrors = append(allErrors, fmt.Errorf("keepAlive should not be negative, got %v", o.KeepAlive))
+	}
+	if o.UploadChunkSizeMB < 0 {
+		allErrors = append(allErrors, fmt.Errorf("uploadChunkSizeMB should not be negative, got %v",
+			o.UploadChunkSizeMB))
+	}
+	if !transfer.ValidLayerCompression(o.LayerCompression) {
+		allErrors = append(allErrors, fmt.Errorf("layerCompression should be gzip or zstd, got %s",
+			o.LayerCompression))
+	}
+	if o.LayerCompression == transfer.LayerCompressionZstd && o.TargetManifestType == transfer.ManifestTypeV2S2 {
+		allErrors = append(allErrors, fmt.Errorf("layerCompression zstd should not be used with " +
+			"targetManifestType v2s2, docker manifests can not have zstd layers"))
+	}
+	if !utils.IsContain(transfer.IfExistsPolicies, o.IfExists) {
+		allErrors = append(allErrors, fmt.Errorf("ifExists should be one of %v, got %s",
+			transfer.IfExistsPolicies, o.IfExists))
+	}
+	for _, pattern := range o.DropAnnotations {
+		if _, err := regexp.Compile("^(?:" + pattern + ")$"); err != nil {
+			allErrors = append(allErrors, fmt.Errorf("dropAnnotations %s is not a valid regular expression: %v",
+				pattern, err))
+		}
+	}
+	if o.RetainTags < 0 {
+		allErrors = append(allErrors, fmt.Errorf("retainTags should not be negative, got %v", o.RetainTags))
+	}
+	for _, pattern := range o.RetainTagRegexes {
+		if _, err := regexp.Compile("^(?:" + pattern + ")$"); err != nil {
+			allErrors = append(allErrors, fmt.Errorf("retainTagRegexes %s is not a valid regular expression: %v",
+				pattern, err))
+		}
+	}
+	if o.MaxDeletePercent < 0 || o.MaxDeletePercent > 100 {
+		allErrors = append(allErrors, fmt.Errorf("maxDeletePercent should be in [0, 100], got %v", o.MaxDeletePercent))
+	}
+	if o.MirrorRegistry != "" && (o.DefaultRegistry == "" || o.DefaultNamespace == "") {
+		allErrors = append(allErrors, fmt.Errorf("registry and ns should be set with mirrorRegistry"))
+	}
+	if o.MirrorRegistry != "" && (o.CCRToTCR || o.SWRToTCR || o.TCRToTCR || o.TCRToCCR || o.CCRToRegistry) {
+		allErrors = append(allErrors, fmt.Errorf("mirrorRegistry can not be used with ccrToTcr, swrToTcr, " +
+			"tcrToTcr, tcrToCcr or ccrToRegistry"))
+	}
+	// 0 means the catalog is listed without limit
+	if o.MaxCatalogRepos < 0 {
+		allErrors = append(allErrors, fmt.Errorf("maxCatalogRepos should not be negative, got %v",
+			o.MaxCatalogRepos))
+	}
+	// 0 means the job buffer is as large as routines
+	if o.JobBufferSize < 0 {
+		allErrors = append(allErrors, fmt.Errorf("jobBufferSize should not be negative, got %v", o.JobBufferSize))
+	}
+
+	if o.TCRNamespaceQuota < 0 || o.TCRRepoQuota < 0 || o.TCRStorageQuotaGB < 0 {
+		allErrors = append(allErrors, fmt.Errorf("tcrNamespaceQuota, tcrRepoQuota and tcrStorageQuotaGB " +
+			"should not be negative"))
+	}
+
+	if !utils.IsContain(transfer.TagSortOrders, o.TagSortOrder) {
+		allErrors = append(allErrors, fmt.Errorf("tagSortOrder should be one of %v, got %s",
+			transfer.TagSortOrders, o.TagSortOrder))
+	}
+
+	if o.CCRNamespaceExclude != "" {
+		if _, err := regexp.Compile(o.CCRNamespaceExclude); err != nil {
+			allErrors = append(allErrors, fmt.Errorf("ccrNamespaceExclude %s is not a valid regular expression: %v",
+				o.CCRNamespaceExclude, err))
+		}
+	}
+
 	return allErrors
 }
 
+// DropAnnotationRegexps returns the anchored regular expressions of dropAnnotations, they are
+// checked by Validate
+func (o *ConfigOptions) DropAnnotationRegexps() []*regexp.Regexp {
+	var regexps []*regexp.Regexp
+	for _, pattern := range o.DropAnnotations {
+		regexps = append(regexps, regexp.MustCompile("^(?:"+pattern+")$"))
+	}
+	return regexps
+}
+
+// LabelSelector returns the labels of labelFilter, a label without value only requires the key
+func (o *ConfigOptions) LabelSelector() map[string]string {
+	if len(o.LabelFilter) == 0 {
+		return nil
+	}
+	selector := make(map[string]string)
+	for _, label := range o.LabelFilter {
+		keyAndValue := strings.SplitN(label, "=", 2)
+		key := strings.TrimSpace(keyAndValue[0])
+		if len(keyAndValue) == 2 {
+			selector[key] = keyAndValue[1]
+		} else {
+			selector[key] = ""
+		}
+	}
+	return selector
+}
+
 // AddFlags adds flags related to authenticate for a specific APIServer to the
 // specified FlagSet
 func (o *ConfigOptions) AddFlags(fs *pflag.FlagSet) {
 	fs.StringVar(&o.SecurityFile, "securityFile", o.SecurityFile,
 		"Get registry auth config from config file path")
-	fs.StringVar(&o.RuleFile, "ruleFile", o.RuleFile,
-		"Get images rules config from config file path")
+	fs.StringSliceVar(&o.RuleFile, "ruleFile", o.RuleFile,
+		"Get images rules config from config file path, several files can be given by comma separated " +
+		"paths or repeated flags, they are merged in order, see ruleConflict")
 	fs.StringVar(&o.DefaultRegistry, "registry", o.DefaultRegistry,
 		"default destinate registry url when destinate registry is not " +
 		"given in the config file, can also be set with DEFAULT_REGISTRY environment value")
@@ -82,4 +441,345 @@ func (o *ConfigOptions) AddFlags(fs *pflag.FlagSet) {
 		"tcr name. this flag is used when flag ccrToTcr=true")
 	fs.StringVar(&o.SecretFile, "secretFile", o.SecretFile,
 		"Tencent Cloud secretId 、secretKey for access ccr and tcr. this flag is used when flag ccrToTcr=true")
+	fs.BoolVar(&o.SWRToTCR, "swrToTcr", false,
+		"mode: transfer huawei cloud swr images to tcr, default value is false")
+	fs.StringVar(&o.SWRRegion, "swrRegion", "cn-north-4",
+		"swr region, default value is cn-north-4. this flag is used when flag swrToTcr=true")
+	fs.BoolVar(&o.CreateRepoIfMissing, "createRepoIfMissing", false,
+		"create the missing target repository before pushing if the registry needs it, " +
+		"only quay with quayToken in security file is supported currently")
+	fs.StringVar(&o.RepoVisibility, "repoVisibility", "private",
+		"visibility(public or private) of the repository created by createRepoIfMissing, the visibility of " +
+		"a ghcr.io package is checked after its first push. default value is private")
+	fs.BoolVar(&o.LowercaseTarget, "lowercaseTarget", false,
+		"convert the registry, namespace and repository of target url to lower case, " +
+		"for the registries which reject upper case like ghcr.io, default value is false")
+	fs.BoolVar(&o.TCRToTCR, "tcrToTcr", false,
+		"mode: transfer images of a tcr instance to another tcr instance(tcrName), default value is false")
+	fs.StringVar(&o.SourceTCRRegion, "sourceTcrRegion", "ap-guangzhou",
+		"source tcr region, default value is ap-guangzhou. this flag is used when flag tcrToTcr=true")
+	fs.StringVar(&o.SourceTCRName, "sourceTcrName", o.SourceTCRName,
+		"source tcr name. this flag is used when flag tcrToTcr=true")
+	fs.StringSliceVar(&o.SourceNamespaces, "sourceNamespaces", o.SourceNamespaces,
+		"comma separated namespaces of source tcr to transfer, all namespaces are transferred if empty. " +
+		"this flag is used when flag tcrToTcr=true")
+	fs.BoolVar(&o.SkipSameDigest, "skipSameDigest", false,
+		"skip the image if the target tag already has the same manifest digest as source, " +
+		"useful for periodic sync, default value is false")
+	fs.BoolVar(&o.TCRToCCR, "tcrToCcr", false,
+		"mode: transfer tcr(tcrName) images back to ccr(ccrRegion), default value is false")
+	fs.BoolVar(&o.VerifyAfterPush, "verifyAfterPush", false,
+		"re-fetch the target manifest after push and fail the job if its digest differs from source, " +
+		"default value is false")
+	fs.BoolVar(&o.CCRToRegistry, "ccrToRegistry", false,
+		"mode: transfer ccr images to the registry given by targetTemplate, e.g. harbor, the target " +
+		"namespaces should exist or be created automatically by the registry, default value is false")
+	fs.StringVar(&o.TargetTemplate, "targetTemplate", o.TargetTemplate,
+		"target of ccr repositories, {namespace} and {repo} are replaced with the ccr namespace and repo, " +
+		"e.g. harbor.corp.local/ccr-{namespace}/{repo}, a base url like harbor.corp.local means " +
+		"harbor.corp.local/{namespace}/{repo}. this flag is used when flag ccrToRegistry=true, for the " +
+		"images discovered by fromKubeconfig and for the rules without target. {registry}, {path} " +
+		"(namespace/repo) and {tag} of the source, and modifiers like {path|flatten|lower} are supported " +
+		"too, flatten replaces / with -")
+	fs.StringSliceVar(&o.CCRNamespaces, "ccrNamespaces", o.CCRNamespaces,
+		"comma separated ccr namespaces to transfer, or a file with a namespace per line, all namespaces " +
+		"are transferred if empty. this flag is used when flag ccrToTcr=true or ccrToRegistry=true")
+	fs.StringVar(&o.CCRNamespaceExclude, "ccrNamespaceExclude", o.CCRNamespaceExclude,
+		"regular expression of ccr namespaces not to transfer, e.g. '^test-'. " +
+		"this flag is used when flag ccrToTcr=true or ccrToRegistry=true")
+	fs.BoolVar(&o.Deterministic, "deterministic", false,
+		"sort the rules by source then target and sort the listed tags, so that a config produces " +
+		"a stable job order, use it with routines=1 for fully reproducible runs, default value is false")
+	fs.StringSliceVar(&o.CCRRepoInclude, "ccrRepoInclude", o.CCRRepoInclude,
+		"comma separated regular expressions matched against namespace/repository of ccr, only the matched " +
+		"repositories are transferred. this flag is used when flag ccrToTcr=true or ccrToRegistry=true")
+	fs.StringSliceVar(&o.CCRRepoExclude, "ccrRepoExclude", o.CCRRepoExclude,
+		"comma separated regular expressions matched against namespace/repository of ccr, the matched " +
+		"repositories are not transferred, e.g. '-ci-cache$,-tmp$'. " +
+		"this flag is used when flag ccrToTcr=true or ccrToRegistry=true")
+	fs.StringVar(&o.CCRRepoFilterFile, "ccrRepoFilterFile", o.CCRRepoFilterFile,
+		"yaml file of include and exclude patterns, they are added to ccrRepoInclude and ccrRepoExclude. " +
+		"this flag is used when flag ccrToTcr=true or ccrToRegistry=true")
+	fs.StringVar(&o.DefaultTag, "defaultTag", o.DefaultTag,
+		"tag to transfer when neither source nor target of a rule has a tag, e.g. latest, " +
+		"all tags of the source repository are transferred if empty")
+	fs.IntVar(&o.CCRMaxTagsPerRepo, "ccrMaxTagsPerRepo", 0,
+		"only transfer the newest N tags of each ccr repository, default value is 0(unlimited). " +
+		"this flag is used when flag ccrToTcr=true or ccrToRegistry=true")
+	fs.IntVar(&o.MaxTagsPerRepo, "maxTagsPerRepo", 0,
+		"only transfer the newest N tags when all tags of a source repository are listed, " +
+		"tags are sorted by tagSortOrder, default value is 0(unlimited)")
+	fs.StringVar(&o.TagSortOrder, "tagSortOrder", transfer.TagSortLexical,
+		"order to find the newest tags for maxTagsPerRepo: lexical, semver or date, date reads the created " +
+		"time from the image config of each tag, default value is lexical")
+	fs.StringVar(&o.NamespaceMapping, "namespaceMapping", o.NamespaceMapping,
+		"yaml file which maps ccr namespaces to target namespaces, unmapped namespaces keep their names. " +
+		"this flag is used when flag ccrToTcr=true or ccrToRegistry=true")
+	fs.BoolVar(&o.KeepNonSemverTags, "keepNonSemverTags", false,
+		"keep the tags which are not semantic versions when a rule has a semver constraint, " +
+		"default value is false")
+	fs.StringVar(&o.TCRRouting, "tcrRouting", o.TCRRouting,
+		"yaml file which routes ccr namespaces to different tcr instances, " +
+		"this flag is used when flag ccrToTcr=true")
+	fs.BoolVar(&o.UnroutedNsFallback, "unroutedNsFallback", true,
+		"transfer the ccr namespaces matched by no route to the tcr given by tcrName, " +
+		"they are reported as unrouted if it is false. default value is true")
+	fs.DurationVar(&o.ListTimeout, "listTimeout", 0,
+		"timeout of listing the tags of a repository, e.g. 30s. default value is 0, means no timeout")
+	fs.DurationVar(&o.CopyTimeout, "copyTimeout", 0,
+		"timeout of transferring an image, e.g. 30m. default value is 0, means no timeout")
+	fs.BoolVar(&o.ForcePrivate, "forcePrivate", false,
+		"create all tcr namespaces private instead of keeping the visibility of ccr namespaces, " +
+		"this flag is used when flag ccrToTcr=true. default value is false")
+	fs.BoolVar(&o.SyncRepoMetadata, "syncRepoMetadata", false,
+		"create tcr repositories with the descriptions of ccr repositories before transfer, failures of it " +
+		"do not fail the transfer. this flag is used when flag ccrToTcr=true. default value is false")
+	fs.StringToStringVar(&o.SourceRegistryMirror, "sourceRegistryMirror", o.SourceRegistryMirror,
+		"pull source images from mirrors, e.g. docker.io=mirror.example.com,quay.io=quay-mirror.example.com")
+	fs.BoolVar(&o.SourceMirrorFallback, "sourceMirrorFallback", true,
+		"pull source images from the origin registry if the mirror misses, default value is true")
+	fs.BoolVar(&o.CrossAccount, "crossAccount", false,
+		"ccr and tcr belong to different tencent cloud accounts, both ccr and tcr secrets are required " +
+		"and they are not used for each other. default value is false")
+	fs.StringVar(&o.Report, "report", o.Report,
+		"write the outcome of every transfer job to a .json or .csv file, empty value disables it")
+	fs.StringVar(&o.DockerConfig, "dockerConfig", o.DockerConfig,
+		"docker config file like ~/.docker/config.json, the registries which are not in securityFile " +
+		"use the auth information in it. empty value disables it")
+	fs.StringVar(&o.TCRAPIEndpoint, "tcrApiEndpoint", "tcr.tencentcloudapi.com",
+		"domain of tencent cloud api of tcr, e.g. a private endpoint tcr.internal.tencentcloudapi.com. " +
+		"default value is tcr.tencentcloudapi.com")
+	fs.StringVar(&o.CCRAPIEndpoint, "ccrApiEndpoint", "tcr.tencentcloudapi.com",
+		"domain of tencent cloud api of ccr, e.g. a private endpoint tcr.internal.tencentcloudapi.com. " +
+		"default value is tcr.tencentcloudapi.com")
+	fs.StringVar(&o.APICAFile, "apiCaFile", o.APICAFile,
+		"ca file of the private certificate of tcrApiEndpoint and ccrApiEndpoint")
+	fs.StringToStringVar(&o.RegistryDomainOverride, "registryDomainOverride", o.RegistryDomainOverride,
+		"replace the registry domains in the generated rules of ccr and tcr, " +
+		"e.g. tcr-test.tencentcloudcr.com=tcr-test-vpc.example.internal")
+	fs.IntVar(&o.APIQPS, "apiQps", 10,
+		"max qps of the tencent cloud api calls of tcr and ccr, default value is 10")
+	fs.IntVar(&o.APIMaxAttempts, "apiMaxAttempts", 5,
+		"max attempts of a tencent cloud api call failed for throttling or server errors, " +
+		"retried with exponential backoff, default value is 5")
+	fs.BoolVar(&o.IgnoreQuota, "ignoreQuota", false,
+		"start ccrToTcr even if the quota preflight fails or the plan exceeds the tcr quotas, default value is false")
+	fs.Int64Var(&o.TCRNamespaceQuota, "tcrNamespaceQuota", 0,
+		"namespace quota of tcr instances in the quota preflight, 0 means the quota of the instance specification")
+	fs.Int64Var(&o.TCRRepoQuota, "tcrRepoQuota", 0,
+		"repository quota of tcr instances in the quota preflight, 0 means the quota of the instance specification")
+	fs.Int64Var(&o.TCRStorageQuotaGB, "tcrStorageQuotaGB", 0,
+		"storage quota in GB of tcr instances in the quota preflight, the storage of ccr repositories " +
+		"is estimated if it is set, default value is 0 (unlimited)")
+	fs.IntVar(&o.NsRoutines, "nsRoutines", 5,
+		"number of namespaces created concurrently in tcr and ccr, default value is 5")
+	fs.StringVar(&o.DefaultSourceRegistry, "sourceRegistry", o.DefaultSourceRegistry,
+		"default source registry url which is prepended to the source urls without registry host " +
+		"in the config file, e.g. library/nginx:1.25")
+	fs.BoolVar(&o.Verify, "verify", false,
+		"verify the manifest digests of all targets after transfer, default value is false")
+	fs.BoolVar(&o.VerifyOnly, "verifyOnly", false,
+		"only verify the manifest digests of all targets, no image or namespace is transferred, " +
+		"default value is false")
+	fs.BoolVar(&o.ReportOnly, "reportOnly", false,
+		"exit with zero even if some targets are missing or mismatched in verify, default value is false")
+	fs.StringVar(&o.VerifyReport, "verifyReport", o.VerifyReport,
+		"write the verify results of targets to a .json or .csv file")
+	fs.StringVar(&o.CCRRepoFile, "ccrRepoFile", o.CCRRepoFile,
+		"file with a namespace/repository of ccr per line, only these repositories and their namespaces " +
+		"are transferred. this flag is used when flag ccrToTcr=true or ccrToRegistry=true")
+	fs.BoolVar(&o.CopyReferrers, "copyReferrers", false,
+		"copy the signatures, SBOMs and attestations which refer to the images by the referrers api " +
+		"of source registries, default value is false")
+	fs.BoolVar(&o.CopySignatures, "copySignatures", false,
+		"copy the cosign signature tag sha256-<digest>.sig of the images if it exists, default value is false")
+	fs.BoolVar(&o.UseDockerConfig, "useDockerConfig", false,
+		"use the auth information in ~/.docker/config.json(or $DOCKER_CONFIG/config.json) for the registries " +
+		"which are not in securityFile when dockerConfig is not set, default value is false")
+	fs.IntVar(&o.JobBufferSize, "jobBufferSize", 0,
+		"number of generated jobs waiting for transfer, a larger buffer lets job generation run ahead " +
+		"of slow transfers, each waiting job holds an open image source and target in memory. " +
+		"default value is 0, the same as routines")
+	fs.StringVar(&o.PasswordStdin, "passwordStdin", o.PasswordStdin,
+		"registry whose password is read from stdin, the username is given by stdinUsername or the " +
+		"security file, the password is only kept in memory")
+	fs.StringVar(&o.StdinUsername, "stdinUsername", o.StdinUsername,
+		"username of the registry given by passwordStdin")
+	fs.BoolVar(&o.PromptCredentials, "promptCredentials", false,
+		"prompt the username and password on the terminal for a registry which needs auth and has no " +
+		"auth information, it fails if stdin is not a terminal. default value is false")
+	fs.BoolVar(&o.SkipMissingTags, "skipMissingTags", false,
+		"check the tags listed in a multi-tags source or the tags of a rule exist on the source, the missing " +
+		"tags are skipped with a warning instead of generating failed jobs, default value is false")
+	fs.BoolVar(&o.CheckAuth, "checkAuth", false,
+		"only check the credentials and connectivity of the registries in the rules and the security file " +
+		"and the tencent cloud credentials, print a pass/fail table and exit, default value is false")
+	fs.BoolVar(&o.SkipPreflight, "skipPreflight", false,
+		"skip the auth checks of checkAuth which run before transfer, default value is false")
+	fs.StringSliceVar(&o.CatalogRepoInclude, "catalogRepoInclude", o.CatalogRepoInclude,
+		"comma separated regular expressions matched against namespace/repository of the repositories " +
+		"listed for a rule like registry/namespace/*, only the matched repositories are transferred")
+	fs.StringSliceVar(&o.CatalogRepoExclude, "catalogRepoExclude", o.CatalogRepoExclude,
+		"comma separated regular expressions matched against namespace/repository of the repositories " +
+		"listed for a rule like registry/namespace/*, the matched repositories are not transferred")
+	fs.IntVar(&o.MaxCatalogRepos, "maxCatalogRepos", 1000,
+		"max number of repositories listed for a rule like registry/namespace/*, the rule fails if more " +
+		"repositories are listed, 0 means unlimited. default value is 1000")
+	fs.StringVar(&o.MirrorRegistry, "mirrorRegistry", o.MirrorRegistry,
+		"source registry whose repositories are all listed by the catalog api and transferred to " +
+		"registry/ns/<repository>, the rule file is optional with it. the flags registry and ns are required")
+	fs.StringVar(&o.Mode, "mode", "transfer",
+		"transfer, verify or diff, verify compares the manifest digests of sources and targets by HEAD requests " +
+		"without transferring, the same as verifyOnly=true. diff only checks which targets are missing by " +
+		"the tags of target repositories and writes them to diffOutput. mirrorConfig writes the containerd " +
+		"hosts.toml and registries.conf which take the targets of rules as the mirrors of the source " +
+		"registries, see mirrorHostsDir and mirrorRegistriesConf. inventory lists the tags of every source " +
+		"repo and prints them as json without transferring. default value is transfer")
+	fs.IntVar(&o.MaxFailures, "maxFailures", 0,
+		"abort the run and cancel the remaining jobs once this number of jobs failed, the failed attempts " +
+		"of retries are counted. default value is 0 (never abort)")
+	fs.Float64Var(&o.FailFastRate, "failFastRate", 0,
+		"abort the run and cancel the remaining jobs once the failed fraction of finished jobs reaches it, " +
+		"checked after 20 jobs finished, e.g. 0.5. default value is 0 (never abort)")
+	fs.StringVar(&o.DiffOutput, "diffOutput", "./diff_rules.yaml",
+		"rule file where the missing source and target pairs of mode=diff are written, " +
+		"default value is ./diff_rules.yaml")
+	fs.BoolVar(&o.DeleteExtraneous, "deleteExtraneous", false,
+		"delete the target tags which no longer exist at source after the tag filters, only for the rules " +
+		"transferring all tags of a repository and the repositories synced successfully. default value is false")
+	fs.BoolVar(&o.DeleteDryRun, "deleteDryRun", false,
+		"only list the tags deleted by deleteExtraneous or retention without deleting them. " +
+		"default value is false")
+	fs.IntVar(&o.MaxDeletePercent, "maxDeletePercent", 10,
+		"refuse to delete the extraneous tags of a repository if they are more than this percent of its tags, " +
+		"unless forceDelete=true. default value is 10")
+	fs.BoolVar(&o.ForceDelete, "forceDelete", false,
+		"delete the extraneous tags even if they are more than maxDeletePercent. default value is false")
+	fs.StringVar(&o.TargetManifestType, "targetManifestType", "",
+		"convert the manifests to v2s2(docker v2 schema2) or oci before pushing, for the targets which only " +
+		"accept one of them, the layer digests are kept. default value is empty (push the source type)")
+	fs.IntVar(&o.RetainTags, "retainTags", 0,
+		"after transfer, keep the newest N tags by the created time of images in every target repository " +
+		"transferred to, the other tags are deleted except the ones transferred in this run and the ones " +
+		"matched by retainTagRegexes. default value is 0 (no retention)")
+	fs.StringSliceVar(&o.RetainTagRegexes, "retainTagRegexes", o.RetainTagRegexes,
+		"comma separated regular expressions of the protected tags kept by retention, e.g. " +
+		"latest,v\\d+\\.\\d+\\.\\d+, the tags not matched are deleted if retainTags is 0")
+	fs.StringVar(&o.IfExists, "ifExists", transfer.IfExistsOverwrite,
+		"what to do when the target tag exists, checked by a HEAD request of the target manifest: " +
+		"overwrite always pushes, skip leaves it alone, fail fails the job if the digest differs from source, " +
+		"update skips the same digest and overwrites a different one. skipSameDigest=true turns overwrite " +
+		"to update. default value is overwrite")
+	fs.StringSliceVar(&o.DropAnnotations, "dropAnnotations", o.DropAnnotations,
+		"comma separated regular expressions of the oci annotation keys dropped from the manifests, configs " +
+		"and layers before pushing, e.g. org.opencontainers.image.source, the manifest digest changes if any " +
+		"annotation is dropped. default value is empty (annotations are preserved verbatim)")
+	fs.BoolVar(&o.DeepVerify, "deepVerify", false,
+		"check every layer and config blob exists on target after push besides the manifest digest, " +
+		"implies verifyAfterPush, the job is retried if a blob is missing, default value is false")
+	fs.StringVar(&o.RewriteMap, "rewriteMap", o.RewriteMap,
+		"write the old and new references of every transferred image to a .yaml file, including the " +
+		"digest-pinned forms, for updating the image references of kubernetes manifests. mode=diff writes " +
+		"the planned references without digests. empty value disables it")
+	fs.StringVar(&o.EmitKustomize, "emitKustomize", o.EmitKustomize,
+		"write a kustomization.yaml with the images (name/newName/newTag/digest) of the transferred " +
+		"source repositories to the directory, newTag and digest are set if a single tag of a repository " +
+		"is transferred. empty value disables it")
+	fs.StringVar(&o.EmitHelmValues, "emitHelmValues", o.EmitHelmValues,
+		"write a helm values file with the images (registry/repository/tag/digest) of the transferred " +
+		"source repositories keyed by source repository. empty value disables it")
+	fs.StringVar(&o.MirrorHostsDir, "mirrorHostsDir", "./certs.d",
+		"directory of the containerd hosts.toml files written by mode=mirrorConfig, a file is written to " +
+		"<dir>/<source registry>/hosts.toml. empty value disables it, default value is ./certs.d")
+	fs.StringVar(&o.MirrorRegistriesConf, "mirrorRegistriesConf", "./registries.conf",
+		"registries.conf of cri-o and podman written by mode=mirrorConfig, empty value disables it, " +
+		"default value is ./registries.conf")
+	fs.StringSliceVar(&o.MirrorCapabilities, "mirrorCapabilities", []string{"pull", "resolve"},
+		"comma separated capabilities of the mirrors in the containerd hosts.toml files, pull, resolve " +
+		"or push, default value is pull,resolve")
+	fs.StringVar(&o.RuleConflict, "ruleConflict", "override",
+		"what to do when a source is in several rule files: override uses the rule of the later file, " +
+		"error fails the run. default value is override")
+	fs.StringSliceVar(&o.LabelFilter, "labelFilter", o.LabelFilter,
+		"comma separated labels key=value or key, only the images whose config labels match all of them " +
+		"are transferred, e.g. mirror=true. the config of every image is fetched, the images which do not " +
+		"match are counted as filtered. default value is empty (no filter)")
+	fs.StringVar(&o.FromKubeconfig, "fromKubeconfig", o.FromKubeconfig,
+		"kubeconfig file of a cluster, the images of the containers, init containers and ephemeral containers " +
+		"of its pods are added to the rules, their targets are rendered by targetTemplate or the default " +
+		"registry and namespace. empty value disables it")
+	fs.StringSliceVar(&o.KubeNamespaces, "kubeNamespaces", o.KubeNamespaces,
+		"comma separated namespaces whose pods are listed by fromKubeconfig, default value is empty (all namespaces)")
+	fs.StringSliceVar(&o.KubeRegistries, "kubeRegistries", o.KubeRegistries,
+		"comma separated source registries of the images discovered by fromKubeconfig, e.g. docker.io,quay.io, " +
+		"default value is empty (all registries)")
+	fs.BoolVar(&o.DryRun, "dryRun", false,
+		"print the rules of the run, including the images discovered by fromKubeconfig, fromManifests and " +
+		"fromChart, as a rule file and " +
+		"exit without transferring, default value is false")
+	fs.StringSliceVar(&o.FromManifests, "fromManifests", o.FromManifests,
+		"comma separated directories or files of kubernetes manifests, the image fields of their yaml and json " +
+		"documents, including the image fields of custom resources, are added to the rules like fromKubeconfig. " +
+		"the documents which can not be parsed are skipped. default value is empty")
+	fs.StringVar(&o.FromChart, "fromChart", o.FromChart,
+		"helm chart archive or directory whose images are added to the rules like fromKubeconfig, the chart is " +
+		"not rendered, the images are extracted from its values, the literal image fields of its templates " +
+		"and its subcharts. empty value disables it")
+	fs.StringSliceVar(&o.ChartValues, "chartValues", o.ChartValues,
+		"comma separated values files which override the values of fromChart in order, default value is empty")
+	fs.StringSliceVar(&o.ImageListFile, "imageList", o.ImageListFile,
+		"comma separated plain image lists, every line is \"source\" or \"source target\", blank lines and " +
+		"lines starting with # are skipped, - reads the list from stdin. they are merged after ruleFile in " +
+		"order, see ruleConflict. default value is empty")
+	fs.BoolVar(&o.LatestOnly, "latestOnly", false,
+		"only transfer the latest tag when neither source nor target of a rule has a tag, instead of all tags " +
+		"of the source repository. a repository without latest tag is skipped with a warning. " +
+		"default value is false")
+	fs.StringArrayVar(&o.RemoteConfigHeader, "remoteConfigHeader", o.RemoteConfigHeader,
+		"header \"Name: value\" sent to the http(s):// urls of ruleFile, imageList and the other config files, " +
+		"the value is expanded with environment variables like ${TOKEN}, can be repeated. the s3:// and cos:// " +
+		"urls are signed with the AWS_* and TENCENTCLOUD_* environment variables. default value is empty")
+	fs.DurationVar(&o.RemoteConfigTimeout, "remoteConfigTimeout", 30*time.Second,
+		"timeout of fetching a remote config file, default value is 30s")
+	fs.StringVar(&o.ImageListSha256, "imageListSha256", o.ImageListSha256,
+		"expected sha256 of the only ruleFile or imageList, the run fails if it does not match. " +
+		"empty value disables it")
+	fs.StringVar(&o.CacheConfigDir, "cacheConfigDir", o.CacheConfigDir,
+		"directory where the fetched remote config files are written, they are only kept in memory if it " +
+		"is empty. default value is empty")
+	fs.StringVar(&o.UserAgent, "userAgent", o.UserAgent,
+		"User-Agent of the requests to registries and tencent cloud apis, default value is " +
+		"image-transfer/<version> (<os>/<arch>)")
+	fs.StringVar(&o.LayerCompression, "layerCompression", o.LayerCompression,
+		"re-compress the layers to gzip or zstd before pushing, the layers already compressed by it are " +
+		"pushed as is. it is cpu intensive, the layers are re-compressed by the routines of jobs. zstd layers " +
+		"need oci manifests, see targetManifestType. empty value pushes the layers as is")
+	fs.IntVar(&o.UploadChunkSizeMB, "uploadChunkSizeMB", 16,
+		"the blobs larger than it are uploaded to registries in chunks of this size(MB), a failed upload is " +
+		"resumed from the last acknowledged chunk when the job is retried. the registries which do not support " +
+		"chunked uploads get the whole blobs. 0 disables it, default value is 16")
+	fs.StringVar(&o.RewriteRules, "rewriteRules", o.RewriteRules,
+		"yaml file whose rewrite_rules section lists {match, replace} pairs, the targets of the rules without " +
+		"target are rewritten from the full source references by the first matched regular expression, " +
+		"the default registry and namespace are used if no pair matches. default value is empty")
+	fs.StringSliceVar(&o.TestRewrite, "testRewrite", o.TestRewrite,
+		"print the targets of these source references computed by rewriteRules and exit without " +
+		"transferring, to debug the rewrite rules. default value is empty")
+	fs.IntVar(&o.MaxIdleConnsPerHost, "maxIdleConnsPerHost", 0,
+		"max idle connections kept to a registry for reuse by the requests sent directly to registries, like " +
+		"chunked uploads, referrers, HEAD digests, catalogs, deletes and auth checks. the blob and manifest " +
+		"copies use the connections of containers/image per job. default value is 0, means the value of routines")
+	fs.DurationVar(&o.KeepAlive, "keepAlive", 90*time.Second,
+		"how long an idle connection to a registry is kept for reuse, 0 disables keep-alive and every " +
+		"request opens a new connection. default value is 90s")
+	fs.StringVar(&o.DigestLock, "digestLock", o.DigestLock,
+		"yaml file which pins the source and target digests transferred by every rule, it is read before " +
+		"transfer and written after it, the pins of the images not transferred are kept. default value is empty")
+	fs.BoolVar(&o.WarnMutatedTags, "warnMutatedTags", true,
+		"warn the source tags whose digests differ from the pins of digestLock, they are mutated upstream " +
+		"since the last run and listed in the summary. default value is true")
+	fs.StringSliceVar(&o.TargetRepoRewrite, "targetRepoRewrite", o.TargetRepoRewrite,
+		"strategies applied in order to the repositories below the target namespace of wildcard rules and " +
+		"default targets: prefix=p, suffix=s, replace=old:new, flatten[=sep] and lower, e.g. " +
+		"bitnami/* with prefix=bitnami- transfers bitnami/redis to namespace/bitnami-redis. default value is empty")
 }
@@ -0,0 +1,527 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/apis/ccrapis"
+	"tkestack.io/image-transfer/pkg/apis/tcrapis"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/transfer"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+// QuotaChecker checks the quotas of a target registry before namespaces are created
+type QuotaChecker interface {
+	// CheckQuota compares the planned namespaces, repositories and bytes with the quotas
+	CheckQuota(plan *QuotaPlan) ([]QuotaItem, error)
+	// String describes the target registry in the preflight report
+	String() string
+}
+
+// QuotaPlan is the target namespaces, repositories(namespace/repository) and the estimated bytes
+// of a destination, Bytes is only estimated when tcrStorageQuotaGB is set
+type QuotaPlan struct {
+	Namespaces   []string
+	Repositories []string
+	Bytes        int64
+}
+
+// QuotaItem is the usage of a quota, a zero Quota means unlimited or unknown
+type QuotaItem struct {
+	Name  string
+	Used  int64
+	New   int64
+	Quota int64
+}
+
+// Exceeded checks if the planned usage is larger than the quota
+func (i QuotaItem) Exceeded() bool {
+	return i.Quota > 0 && i.Used+i.New > i.Quota
+}
+
+// String formats a quota item in the preflight report
+func (i QuotaItem) String() string {
+	quota := "unlimited"
+	if i.Quota > 0 {
+		quota = fmt.Sprintf("%v", i.Quota)
+	}
+	result := "ok"
+	if i.Exceeded() {
+		result = "EXCEEDED"
+	}
+	return fmt.Sprintf("%s: %v used + %v new / %s quota, %s", i.Name, i.Used, i.New, quota, result)
+}
+
+// bytesToGB converts bytes to GB, the fraction is rounded up
+func bytesToGB(bytes int64) int64 {
+	return (bytes + 1<<30 - 1) >> 30
+}
+
+// preflightQuota prints the preflight report of the destinations which have quota checkers,
+// an error is returned if the plan exceeds the quotas unless ignoreQuota is true
+func (c *Client) preflightQuota(ccrClient *ccrapis.CCRAPIClient, destinations []*CcrDestination,
+	destinationNs map[*CcrDestination][]string) error {
+
+	var checked []*CcrDestination
+	for _, destination := range destinations {
+		if destination.QuotaChecker != nil {
+			checked = append(checked, destination)
+		}
+	}
+	if len(checked) == 0 {
+		return nil
+	}
+
+	repos, err := ccrClient.ListRepositories(c.config.Secret, c.config.FlagConf.Config.CCRRegion)
+	if err != nil {
+		return c.quotaError(fmt.Errorf("list ccr repositories for quota preflight error: %v", err))
+	}
+	nsRepos := make(map[string][]string)
+	for _, repo := range repos {
+		if !c.config.CCRRepoFilter.Match(*repo.RepoName) {
+			continue
+		}
+		nsAndRepo := strings.SplitN(*repo.RepoName, "/", 2)
+		nsRepos[nsAndRepo[0]] = append(nsRepos[nsAndRepo[0]], *repo.RepoName)
+	}
+
+	exceeded := false
+	for _, destination := range checked {
+		plan := &QuotaPlan{}
+		for _, ns := range destinationNs[destination] {
+			targetNs := ns
+			if mappedNs, ok := c.config.NamespaceMapping[ns]; ok {
+				targetNs = mappedNs
+			}
+			for _, repoName := range nsRepos[ns] {
+				nsAndRepo := strings.SplitN(repoName, "/", 2)
+				targetURL, err := utils.NewRepoURL(utils.RenderTargetTemplate(destination.TargetTemplate,
+					targetNs, nsAndRepo[len(nsAndRepo)-1]))
+				if err != nil {
+					return fmt.Errorf("target template %s renders invalid url: %v", destination.TargetTemplate, err)
+				}
+				if !utils.IsContain(plan.Namespaces, targetURL.GetNamespace()) {
+					plan.Namespaces = append(plan.Namespaces, targetURL.GetNamespace())
+				}
+				plan.Repositories = append(plan.Repositories, targetURL.GetRepoWithNamespace())
+
+				// the storage is only estimated with a storage quota, it costs a request per repository
+				if c.config.FlagConf.Config.TCRStorageQuotaGB > 0 {
+					size, err := ccrClient.GetRepoSize(c.config.Secret, c.config.FlagConf.Config.CCRRegion, repoName)
+					if err != nil {
+						return c.quotaError(fmt.Errorf("get size of ccr repository %s error: %v", repoName, err))
+					}
+					plan.Bytes += size
+				}
+			}
+		}
+
+		items, err := destination.QuotaChecker.CheckQuota(plan)
+		if err != nil {
+			return c.quotaError(fmt.Errorf("check quota of %s error: %v", destination.QuotaChecker, err))
+		}
+		log.Summaryf("Quota preflight of %s:", destination.QuotaChecker)
+		for _, item := range items {
+			log.Summaryf("  %s", item)
+			if item.Exceeded() {
+				exceeded = true
+			}
+		}
+	}
+
+	if exceeded {
+		return c.quotaError(fmt.Errorf("the transfer plan exceeds the quotas"))
+	}
+	return nil
+}
+
+// quotaError returns the error of quota preflight, it is only logged if ignoreQuota is true
+func (c *Client) quotaError(err error) error {
+	if c.config.FlagConf.Config.IgnoreQuota {
+		log.Warnf("%v, ignored by ignoreQuota", err)
+		return nil
+	}
+	return fmt.Errorf("%v, set --ignoreQuota=true to start anyway", err)
+}
+
+// TcrQuotaChecker checks the quotas of a tcr instance, the quotas of the instance specification
+// are used unless they are overridden by flags
+type TcrQuotaChecker struct {
+	client    *Client
+	tcrClient *tcrapis.TCRAPIClient
+	region    string
+	tcrName   string
+}
+
+// NewTcrQuotaChecker creates a TcrQuotaChecker for a tcr instance
+func NewTcrQuotaChecker(client *Client, tcrClient *tcrapis.TCRAPIClient, region, tcrName string) *TcrQuotaChecker {
+	return &TcrQuotaChecker{
+		client:    client,
+		tcrClient: tcrClient,
+		region:    region,
+		tcrName:   tcrName,
+	}
+}
+
+// String describes the tcr instance
+func (q *TcrQuotaChecker) String() string {
+	return fmt.Sprintf("tcr %s in %s", q.tcrName, q.region)
+}
+
+// CheckQuota compares the plan with the namespaces and repositories of the tcr instance,
+// the planned namespaces and repositories which exist already are not counted as new
+func (q *TcrQuotaChecker) CheckQuota(plan *QuotaPlan) ([]QuotaItem, error) {
+	config := q.client.config.FlagConf.Config
+
+	secretID, secretKey, err := tcrapis.GetTcrSecret(q.client.config.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces, tcrID, err := q.tcrClient.GetCachedNamespaceByName(q.client.config.Secret, q.region,
+		q.tcrName, false)
+	if err != nil {
+		return nil, err
+	}
+
+	nsQuota, repoQuota := config.TCRNamespaceQuota, config.TCRRepoQuota
+	if nsQuota == 0 || repoQuota == 0 {
+		registryType, err := q.tcrClient.GetRegistryType(q.client.config.Secret, q.region, q.tcrName)
+		if err != nil {
+			return nil, err
+		}
+		specQuota, ok := tcrapis.SpecQuotas[registryType]
+		if !ok {
+			log.Warnf("quotas of tcr %s of type %q are unknown, set tcrNamespaceQuota and tcrRepoQuota to check them",
+				q.tcrName, registryType)
+		}
+		if nsQuota == 0 {
+			nsQuota = specQuota.Namespaces
+		}
+		if repoQuota == 0 {
+			repoQuota = specQuota.Repositories
+		}
+	}
+
+	nsItem := QuotaItem{Name: "namespaces", Used: int64(len(namespaces)), Quota: nsQuota}
+	for _, ns := range plan.Namespaces {
+		if !utils.IsContain(namespaces, ns) {
+			nsItem.New++
+		}
+	}
+
+	repoItem := QuotaItem{Name: "repositories", Quota: repoQuota}
+	existingRepos := make(map[string]bool)
+	for _, ns := range namespaces {
+		// the repositories of planned namespaces are listed to find the existing ones
+		if utils.IsContain(plan.Namespaces, ns) {
+			repos, err := q.tcrClient.GetAllRepositories(secretID, secretKey, q.region, tcrID, ns)
+			if err != nil {
+				return nil, err
+			}
+			for _, repo := range repos {
+				existingRepos[repo] = true
+			}
+			repoItem.Used += int64(len(repos))
+			continue
+		}
+		count, err := q.tcrClient.CountRepositories(secretID, secretKey, q.region, tcrID, ns)
+		if err != nil {
+			return nil, err
+		}
+		repoItem.Used += count
+	}
+	for _, repo := range plan.Repositories {
+		if !existingRepos[repo] {
+			repoItem.New++
+		}
+	}
+
+	items := []QuotaItem{nsItem, repoItem}
+	if config.TCRStorageQuotaGB > 0 {
+		// the used storage is unknown by tcr api, only the estimated bytes are compared
+		items = append(items, QuotaItem{Name: "storage(GB, estimated)", New: bytesToGB(plan.Bytes),
+			Quota: config.TCRStorageQuotaGB})
+	}
+
+	return items, nil
+}
+
+// AuthCheck is a credential or connectivity check of the auth preflight
+type AuthCheck struct {
+	Name string
+	Err  error
+}
+
+// authCheckTarget is a registry to check, a repository is used for the scope of the token if known.
+// The registry is checked with the security key authProfile if a rule refers to it
+type authCheckTarget struct {
+	registry    string
+	repository  string
+	authProfile string
+	push        bool
+}
+
+// preflightAuth checks every registry referenced by the rules and the security file with a v2 ping
+// and an authenticated scope request, and the tencent cloud credentials with a describe api. a pass/fail
+// table is printed and an error is returned if any check fails
+func (c *Client) preflightAuth() error {
+	var checks []AuthCheck
+	var checksMutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, target := range c.authCheckTargets() {
+		wg.Add(1)
+		go func(target *authCheckTarget) {
+			defer wg.Done()
+			check := c.checkRegistryAuth(target)
+			checksMutex.Lock()
+			checks = append(checks, check)
+			checksMutex.Unlock()
+		}(target)
+	}
+	wg.Wait()
+	checks = append(checks, c.checkTencentCloudAuth()...)
+	sort.Slice(checks, func(i, j int) bool {
+		return checks[i].Name < checks[j].Name
+	})
+
+	failed := 0
+	failedRegistries := make(map[transfer.AuthCheckReason][]string)
+	log.Summaryf("################# auth preflight of %v checks: #################", len(checks))
+	for _, check := range checks {
+		if check.Err != nil {
+			failed++
+			if reason := transfer.AuthCheckReasonOf(check.Err); reason != "" {
+				failedRegistries[reason] = append(failedRegistries[reason], check.Name)
+				log.Summaryf("FAIL  %s [%s]: %v", check.Name, reason, check.Err)
+				continue
+			}
+			log.Summaryf("FAIL  %s: %v", check.Name, check.Err)
+		} else {
+			log.Summaryf("PASS  %s", check.Name)
+		}
+	}
+	for _, reason := range []transfer.AuthCheckReason{transfer.AuthCheckUnreachable, transfer.AuthCheckUnauthorized} {
+		if len(failedRegistries[reason]) != 0 {
+			log.Summaryf("%v %s: %s", len(failedRegistries[reason]), reason,
+				strings.Join(failedRegistries[reason], ", "))
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("%v of %v auth preflight checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+// checkRegistryAuth checks a registry with the auth information found for it, or the security key
+// referred by the rules, a registry without auth information is checked anonymously
+func (c *Client) checkRegistryAuth(target *authCheckTarget) AuthCheck {
+	name := "registry " + target.registry
+	var username, password string
+	var insecure bool
+	security, exist := c.config.GetSecuritySpecific(target.registry, target.repository)
+	if target.authProfile != "" {
+		security, exist = c.config.GetSecurityProfile(target.authProfile, target.registry)
+		name += " by " + target.authProfile
+	}
+	if exist {
+		username, password, insecure = security.Username, security.Password, security.Insecure
+		name += " (" + security.LogUsername() + ")"
+	} else {
+		name += " (anonymous)"
+	}
+	return AuthCheck{
+		Name: name,
+		Err: transfer.CheckRegistryAuth(target.registry, target.repository, username, password, insecure,
+			target.push),
+	}
+}
+
+// authCheckTargets collects the registries of the transfer mode, the rules and the security file
+func (c *Client) authCheckTargets() []*authCheckTarget {
+	config := c.config.FlagConf.Config
+	// the registries are checked once by every security key the rules refer to them with
+	targets := make(map[string]*authCheckTarget)
+	targetKey := func(registry, authProfile string) string {
+		return registry + " " + authProfile
+	}
+	addByProfile := func(registry, repository, authProfile string, push bool) {
+		key := targetKey(registry, authProfile)
+		target, ok := targets[key]
+		if !ok {
+			target = &authCheckTarget{registry: registry, authProfile: authProfile}
+			targets[key] = target
+		}
+		if target.repository == "" || (push && !target.push) {
+			target.repository = repository
+		}
+		target.push = target.push || push
+	}
+	add := func(registry, repository string, push bool) {
+		addByProfile(registry, repository, "", push)
+	}
+	addURL := func(url, authProfile string, push bool) {
+		if registry, _, ok := utils.SplitWildcardRepo(url); ok {
+			addByProfile(registry, "", authProfile, push)
+			return
+		}
+		repoURL, err := utils.NewRepoURL(url)
+		if err != nil || repoURL.IsLocal() {
+			return
+		}
+		registry := repoURL.GetRegistry()
+		if !push {
+			if mirror, ok := config.SourceRegistryMirror[registry]; ok {
+				addByProfile(mirror, repoURL.GetRepoWithNamespace(), authProfile, false)
+				if !config.SourceMirrorFallback {
+					return
+				}
+			}
+		}
+		addByProfile(registry, repoURL.GetRepoWithNamespace(), authProfile, push)
+	}
+
+	ccrDomain := ccrapis.GetRegistryDomain(config.CCRRegion)
+	switch {
+	case config.CCRToTCR:
+		add(ccrDomain, "", false)
+		if config.TCRName != "" {
+			add(config.TCRName+".tencentcloudcr.com", "", true)
+		}
+		for _, route := range c.config.TCRRoutes {
+			add(route.TCRName+".tencentcloudcr.com", "", true)
+		}
+	case config.CCRToRegistry:
+		add(ccrDomain, "", false)
+		addURL(utils.RenderTargetTemplate(config.TargetTemplate, "preflight", "preflight"), "", true)
+	case config.TCRToTCR:
+		add(config.SourceTCRName+".tencentcloudcr.com", "", false)
+		add(config.TCRName+".tencentcloudcr.com", "", true)
+	case config.TCRToCCR:
+		add(config.TCRName+".tencentcloudcr.com", "", false)
+		add(ccrDomain, "", true)
+	case config.SWRToTCR:
+		add(fmt.Sprintf("swr.%s.myhuaweicloud.com", config.SWRRegion), "", false)
+		add(config.TCRName+".tencentcloudcr.com", "", true)
+	default:
+		for source, target := range c.config.ImageList {
+			rule := c.config.Rules[source]
+			source = utils.AddDefaultRegistry(source, config.DefaultSourceRegistry)
+			addURL(source, rule.GetSourceAuth(), false)
+			if _, _, wildcard := utils.SplitWildcardRepo(source); target == "" && !wildcard {
+				target = c.rewriteTarget(source)
+			}
+			if target == "" && config.TargetTemplate != "" {
+				target = utils.CompleteTargetTemplate(config.TargetTemplate)
+			}
+			// a target template is rendered for the source, only the registry of the target is checked
+			if utils.IsTargetTemplate(target) {
+				template, err := utils.ParseTargetTemplate(target)
+				sourceURL, urlErr := utils.NewRepoURL(source)
+				if err == nil && urlErr == nil {
+					target, _ = template.RenderRepository(sourceURL)
+				}
+			}
+			if target == "" && config.DefaultRegistry != "" && config.DefaultNamespace != "" {
+				if sourceURL, err := utils.NewRepoURL(source); err == nil {
+					target = config.DefaultRegistry + "/" + config.DefaultNamespace + "/" + sourceURL.GetRepoWithTag()
+				}
+			}
+			addURL(target, rule.GetTargetAuth(), true)
+		}
+	}
+
+	// the registries of the security file, the entries with patterns are checked by their registries
+	for key := range c.config.Security {
+		registry := strings.SplitN(key, "/", 2)[0]
+		if key == configs.DefaultSecurityKey || strings.ContainsAny(registry, "*?[") {
+			continue
+		}
+		if _, ok := targets[targetKey(registry, "")]; !ok {
+			add(registry, "", false)
+		}
+	}
+
+	var result []*authCheckTarget
+	for _, target := range targets {
+		result = append(result, target)
+	}
+	return result
+}
+
+// checkTencentCloudAuth checks the tencent cloud credentials of the transfer mode with a cheap describe api
+func (c *Client) checkTencentCloudAuth() []AuthCheck {
+	config := c.config.FlagConf.Config
+	var checks []AuthCheck
+	if config.CCRToTCR || config.CCRToRegistry || config.TCRToCCR {
+		check := AuthCheck{Name: "tencent cloud api of ccr in " + config.CCRRegion}
+		secretID, secretKey, err := ccrapis.GetCcrSecret(c.config.Secret)
+		if err == nil {
+			_, err = c.newCCRAPIClient().DescribeNamespacePersonal(secretID, secretKey, config.CCRRegion, 0, 1)
+		}
+		check.Err = err
+		checks = append(checks, check)
+	}
+	if config.CCRToTCR || config.TCRToTCR || config.TCRToCCR || config.SWRToTCR {
+		tcrNames := map[string]string{}
+		if config.TCRName != "" {
+			tcrNames[config.TCRName] = config.TCRRegion
+		}
+		if config.TCRToTCR {
+			tcrNames[config.SourceTCRName] = config.SourceTCRRegion
+		}
+		for _, route := range c.config.TCRRoutes {
+			region := route.TCRRegion
+			if region == "" {
+				region = config.TCRRegion
+			}
+			tcrNames[route.TCRName] = region
+		}
+		for tcrName, region := range tcrNames {
+			checks = append(checks, AuthCheck{
+				Name: fmt.Sprintf("tencent cloud api of tcr %s in %s", tcrName, region),
+				Err:  c.checkTcrInstance(tcrName, region),
+			})
+		}
+	}
+	return checks
+}
+
+// checkTcrInstance describes a tcr instance to check the credential and that the instance exists
+func (c *Client) checkTcrInstance(tcrName, region string) error {
+	secretID, secretKey, err := tcrapis.GetTcrSecret(c.config.Secret)
+	if err != nil {
+		return err
+	}
+	resp, err := c.newTCRAPIClient().DescribeInstances(secretID, secretKey, region, 0, 1, "RegistryName",
+		[]string{tcrName})
+	if err != nil {
+		return err
+	}
+	if resp.Response == nil || resp.Response.TotalCount == nil || *resp.Response.TotalCount == 0 {
+		return fmt.Errorf("tcr instance %s is not found in %s", tcrName, region)
+	}
+	return nil
+}
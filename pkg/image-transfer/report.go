@@ -0,0 +1,209 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"tkestack.io/image-transfer/pkg/transfer"
+)
+
+// status of a record in the transfer report
+const (
+	ReportStatusSuccess = "success"
+	ReportStatusFailed  = "failed"
+	ReportStatusSkipped = "skipped"
+	// ReportStatusSkippedImmutable is a job rejected by an immutable target tag with the same digest
+	ReportStatusSkippedImmutable = "skipped-immutable"
+	// ReportStatusFiltered is a job which skipped the image as its labels do not match labelFilter
+	ReportStatusFiltered = "filtered"
+	// ReportStatusDeleted is a target tag deleted by deleteExtraneous or retention, it has no source
+	ReportStatusDeleted = "deleted"
+	// ReportStatusDeleteDryRun is a target tag which would be deleted without deleteDryRun
+	ReportStatusDeleteDryRun = "deleteDryRun"
+)
+
+// ReportRecord is the outcome of a transfer job
+type ReportRecord struct {
+	Source          string  `json:"source"`
+	Target          string  `json:"target"`
+	Status          string  `json:"status"`
+	Attempts        int     `json:"attempts"`
+	Bytes           int64   `json:"bytes"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	IfExists        string  `json:"ifExists,omitempty"`
+	TargetDigest    string  `json:"targetDigest,omitempty"`
+	VerifiedDigest  string  `json:"verifiedDigest,omitempty"`
+	// Rule is the source of the rule which generated the job
+	Rule string `json:"rule,omitempty"`
+	// SourceDigest is the source manifest digest resolved by the job, ManifestDigest is the manifest
+	// digest the target tag refers to after the job
+	SourceDigest   string `json:"sourceDigest,omitempty"`
+	ManifestDigest string `json:"manifestDigest,omitempty"`
+}
+
+// Report collects the outcomes of transfer jobs, the last outcome of a job is kept
+type Report struct {
+	records map[string]*ReportRecord
+	// keys of records in the order they are added
+	keys  []string
+	mutex sync.Mutex
+}
+
+// NewReport creates an empty Report
+func NewReport() *Report {
+	return &Report{
+		records: make(map[string]*ReportRecord),
+	}
+}
+
+// getRecord returns the record of source and target, it is created if not exist
+func (r *Report) getRecord(source, target string) *ReportRecord {
+	key := source + "|" + target
+	record, ok := r.records[key]
+	if !ok {
+		record = &ReportRecord{
+			Source: source,
+			Target: target,
+		}
+		r.records[key] = record
+		r.keys = append(r.keys, key)
+	}
+	return record
+}
+
+// RecordJob records the outcome of a run of a transfer job
+func (r *Report) RecordJob(job *transfer.Job, err error) {
+	stats := job.Stats()
+	status := ReportStatusSuccess
+	if err != nil {
+		status = ReportStatusFailed
+	} else if stats.Filtered {
+		status = ReportStatusFiltered
+	} else if stats.Immutable {
+		status = ReportStatusSkippedImmutable
+	} else if stats.Skipped {
+		status = ReportStatusSkipped
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	record := r.getRecord(job.Source.GetRegistry()+"/"+job.Source.GetRepository()+":"+job.Source.GetTag(),
+		job.Target.GetRegistry()+"/"+job.Target.GetRepository()+":"+job.Target.GetTag())
+	record.Status = status
+	record.Attempts = stats.Attempts
+	record.Bytes = stats.Bytes
+	record.DurationSeconds = stats.Duration.Seconds()
+	record.IfExists = string(stats.Exists)
+	record.TargetDigest = string(stats.PushedDigest)
+	record.VerifiedDigest = string(stats.VerifiedDigest)
+	record.Rule = job.Rule
+	record.SourceDigest = string(stats.SourceDigest)
+	record.ManifestDigest = string(stats.ManifestDigest)
+}
+
+// RecordGenerateFailure records a url pair which failed to generate transfer jobs
+func (r *Report) RecordGenerateFailure(source, target string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	record := r.getRecord(source, target)
+	record.Status = ReportStatusFailed
+	record.Attempts++
+}
+
+// RecordDeletion records a target tag which is deleted, failed to delete or would be deleted by dry run
+func (r *Report) RecordDeletion(target, status string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	record := r.getRecord("", target)
+	record.Status = status
+	record.Attempts++
+}
+
+// Records returns the records in the order they are added
+func (r *Report) Records() []*ReportRecord {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	records := make([]*ReportRecord, 0, len(r.keys))
+	for _, key := range r.keys {
+		record := *r.records[key]
+		records = append(records, &record)
+	}
+	return records
+}
+
+// Write writes the report to a json or csv file by the extension of path
+func (r *Report) Write(path string) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return r.writeJSON(path)
+	case ".csv":
+		return r.writeCSV(path)
+	default:
+		return fmt.Errorf("report file %s should be a .json or .csv file", path)
+	}
+}
+
+// writeJSON writes the report to a json file
+func (r *Report) writeJSON(path string) error {
+	data, err := json.MarshalIndent(r.Records(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// writeCSV writes the report to a csv file
+func (r *Report) writeCSV(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	if err := writer.Write([]string{"source", "target", "status", "attempts", "bytes",
+		"durationSeconds", "ifExists", "targetDigest", "verifiedDigest", "rule", "sourceDigest",
+		"manifestDigest"}); err != nil {
+		return err
+	}
+	for _, record := range r.Records() {
+		if err := writer.Write([]string{record.Source, record.Target, record.Status,
+			strconv.Itoa(record.Attempts), strconv.FormatInt(record.Bytes, 10),
+			strconv.FormatFloat(record.DurationSeconds, 'f', 3, 64), record.IfExists,
+			record.TargetDigest, record.VerifiedDigest, record.Rule, record.SourceDigest,
+			record.ManifestDigest}); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
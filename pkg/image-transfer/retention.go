@@ -0,0 +1,174 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/transfer"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+// retainedRepos are the target repositories transferred to in this run, the retention policy
+// is applied to them after transfer
+type retainedRepos struct {
+	repos map[string]*retainedRepo
+	mutex sync.Mutex
+
+	// results are the deleted and dry-run tags of every repository for the summary
+	results []string
+}
+
+// retainedRepo is a target repository with the tags transferred to it in this run, they are never deleted
+type retainedRepo struct {
+	target *utils.RepoURL
+	tags   map[string]bool
+}
+
+// newRetainedRepos creates an empty retainedRepos
+func newRetainedRepos() *retainedRepos {
+	return &retainedRepos{
+		repos: make(map[string]*retainedRepo),
+	}
+}
+
+// Record records the target tag of a job, a local target has no retention
+func (r *retainedRepos) Record(target *transfer.ImageTarget) {
+	if target.IsLocal() || target.GetTag() == "" {
+		return
+	}
+	key := target.GetRegistry() + "/" + target.GetRepository()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	repo, ok := r.repos[key]
+	if !ok {
+		targetURL, err := utils.NewRepoURL(key)
+		if err != nil {
+			log.Warnf("Parse target repository %s for retention error: %v", key, err)
+			return
+		}
+		repo = &retainedRepo{target: targetURL, tags: make(map[string]bool)}
+		r.repos[key] = repo
+	}
+	repo.tags[target.GetTag()] = true
+}
+
+// retentionEnabled checks if a retention policy is set by retainTags or retainTagRegexes
+func (c *Client) retentionEnabled() bool {
+	config := c.config.FlagConf.Config
+	return config.RetainTags > 0 || len(config.RetainTagRegexes) != 0
+}
+
+// applyRetention deletes the tags of the target repositories transferred to which are not kept by
+// the retention policy: the newest retainTags tags, the tags matched by retainTagRegexes and the
+// tags transferred in this run are kept
+func (c *Client) applyRetention() {
+	var protected []*regexp.Regexp
+	for _, pattern := range c.config.FlagConf.Config.RetainTagRegexes {
+		protected = append(protected, regexp.MustCompile("^(?:"+pattern+")$"))
+	}
+
+	var keys []string
+	for key := range c.retainedRepos.repos {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		result, err := c.retainRepoTags(c.retainedRepos.repos[key], protected)
+		if err != nil {
+			log.Errorf("Apply retention to %s error: %v", key, err)
+			result = fmt.Sprintf("%s: %v", key, err)
+		}
+		if result != "" {
+			c.retainedRepos.results = append(c.retainedRepos.results, result)
+		}
+	}
+}
+
+// retainRepoTags applies the retention policy to a repository, the result for the summary is returned
+func (c *Client) retainRepoTags(repo *retainedRepo, protected []*regexp.Regexp) (string, error) {
+	config := c.config.FlagConf.Config
+	targetURL := repo.target
+	security, _ := c.config.GetSecuritySpecific(targetURL.GetRegistry(), targetURL.GetRepoWithNamespace())
+	imageTarget, err := transfer.NewImageTarget(targetURL.GetRegistry(), targetURL.GetRepoWithNamespace(), "",
+		security.Username, security.Password, security.Insecure)
+	if err != nil {
+		return "", err
+	}
+	targetTags, err := imageTarget.GetRepoTags(config.ListTimeout)
+	if err != nil {
+		return "", fmt.Errorf("list tags error: %v", err)
+	}
+
+	kept := make(map[string]bool, len(targetTags))
+	var candidates []string
+	for _, tag := range targetTags {
+		if repo.tags[tag] || matchAny(protected, tag) {
+			kept[tag] = true
+		} else {
+			candidates = append(candidates, tag)
+		}
+	}
+
+	// the newest tags are counted among all tags of the repository
+	if config.RetainTags > 0 && len(candidates) != 0 {
+		if len(targetTags) <= config.RetainTags {
+			return "", nil
+		}
+		// the created time is read from the image config of the target
+		imageSource, err := transfer.NewImageSource(targetURL.GetRegistry(), targetURL.GetRepoWithNamespace(), "",
+			security.Username, security.Password, security.Insecure)
+		if err != nil {
+			return "", err
+		}
+		for _, tag := range imageSource.SortTags(targetTags, transfer.TagSortDate)[:config.RetainTags] {
+			kept[tag] = true
+		}
+	}
+
+	var deleting []string
+	for _, tag := range candidates {
+		if !kept[tag] {
+			deleting = append(deleting, tag)
+		}
+	}
+	if len(deleting) == 0 {
+		return "", nil
+	}
+	sort.Strings(deleting)
+	log.Infof("%v of %v tags of %s are not kept by retention: %v", len(deleting), len(targetTags),
+		targetURL.GetURLWithoutTag(), deleting)
+
+	return c.deleteTags(imageTarget, targetURL, deleting, targetTags, kept), nil
+}
+
+// matchAny checks if tag is matched by any of the regular expressions
+func matchAny(regexps []*regexp.Regexp, tag string) bool {
+	for _, r := range regexps {
+		if r.MatchString(tag) {
+			return true
+		}
+	}
+	return false
+}
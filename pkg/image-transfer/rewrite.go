@@ -0,0 +1,104 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"fmt"
+
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+// rewriteTarget rewrites a full source reference to its target by the rewrite rules, it is empty if no
+// rule matches
+func (c *Client) rewriteTarget(source string) string {
+	target, rule := c.config.RewriteTarget(source)
+	if rule == nil {
+		return ""
+	}
+	log.Debugf("source %s is rewritten to %s by rewrite rule %s", source, target, rule.Match)
+	return target
+}
+
+// repoRewrite returns the repo rewrite of the rule, the flag targetRepoRewrite is used if the rule has none
+func (c *Client) repoRewrite(rule *configs.Rule) utils.RepoRewrite {
+	if rewrite := rule.GetRepoRewrite(); rewrite != nil {
+		return rewrite
+	}
+	return c.targetRepoRewrite
+}
+
+// defaultTarget returns the target of sourceURL in the default registry and namespace, the repository
+// is rewritten by the repo rewrite of the rule
+func (c *Client) defaultTarget(sourceURL *utils.RepoURL, rule *configs.Rule) (string, error) {
+	repo, err := c.repoRewrite(rule).Apply(sourceURL.GetRepo())
+	if err != nil {
+		return "", fmt.Errorf("rewrite target of %s error: %v", sourceURL.GetURL(), err)
+	}
+	if sourceURL.GetTag() != "" {
+		repo += ":" + sourceURL.GetTag()
+	}
+	return c.config.FlagConf.Config.DefaultRegistry + "/" + c.config.FlagConf.Config.DefaultNamespace + "/" + repo,
+		nil
+}
+
+// TestRewrite prints the targets of the source references computed by the rewrite rules, the
+// default registry and namespace are used for the sources matched by no rule. Nothing is transferred,
+// the first source whose target can not be computed fails it
+func (c *Client) TestRewrite(sources []string) error {
+	for _, source := range sources {
+		source = utils.AddDefaultRegistry(source, c.config.FlagConf.Config.DefaultSourceRegistry)
+		sourceURL, err := utils.NewRepoURL(source)
+		if err != nil {
+			return fmt.Errorf("url %s format error: %v", source, err)
+		}
+
+		target, rule := c.config.RewriteTarget(source)
+		matched := "no rewrite rule matched"
+		if rule != nil {
+			matched = "rewrite rule " + rule.Match
+		} else if c.config.FlagConf.Config.DefaultRegistry != "" && c.config.FlagConf.Config.DefaultNamespace != "" {
+			if target, err = c.defaultTarget(sourceURL, nil); err != nil {
+				return err
+			}
+		} else {
+			return fmt.Errorf("no rewrite rule matches %s, the default registry and namespace should "+
+				"not be nil if you want to use them", source)
+		}
+
+		// a rewritten target template is rendered as the rules are
+		if utils.IsTargetTemplate(target) {
+			template, err := utils.ParseTargetTemplate(target)
+			if err != nil {
+				return fmt.Errorf("target template %s of %s error: %v", target, source, err)
+			}
+			render := template.Render
+			if sourceURL.GetTag() == "" {
+				render = template.RenderRepository
+			}
+			if target, err = render(sourceURL); err != nil {
+				return fmt.Errorf("target template of %s error: %v", source, err)
+			}
+		}
+
+		fmt.Printf("%s -> %s (%s)\n", source, target, matched)
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	"gopkg.in/yaml.v2"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/transfer"
+)
+
+// ImageReference is a parsed image reference of the rewrite map
+type ImageReference struct {
+	Registry   string `json:"registry" yaml:"registry"`
+	Repository string `json:"repository" yaml:"repository"`
+	Tag        string `json:"tag,omitempty" yaml:"tag,omitempty"`
+	Digest     string `json:"digest,omitempty" yaml:"digest,omitempty"`
+}
+
+// Name returns the reference by tag, or by digest if it has no tag
+func (r ImageReference) Name() string {
+	if r.Tag == "" {
+		return r.Pinned()
+	}
+	return r.Registry + "/" + r.Repository + ":" + r.Tag
+}
+
+// Pinned returns the reference by digest, it is empty if the digest is unknown
+func (r ImageReference) Pinned() string {
+	if r.Digest == "" {
+		return ""
+	}
+	return r.Registry + "/" + r.Repository + "@" + r.Digest
+}
+
+// RewriteEntry maps an old image reference to the new one, the pinned forms refer to the images by digest
+// and they are empty if the digest is unknown, e.g. by diff mode
+type RewriteEntry struct {
+	Old       string         `json:"old" yaml:"old"`
+	New       string         `json:"new" yaml:"new"`
+	OldPinned string         `json:"oldPinned,omitempty" yaml:"oldPinned,omitempty"`
+	NewPinned string         `json:"newPinned,omitempty" yaml:"newPinned,omitempty"`
+	Source    ImageReference `json:"source" yaml:"source"`
+	Target    ImageReference `json:"target" yaml:"target"`
+}
+
+// rewriteMapFile is the content of the rewrite map file
+type rewriteMapFile struct {
+	Images []*RewriteEntry `json:"images" yaml:"images"`
+}
+
+// RewriteMap collects the old and new references of the transferred images, the last outcome of a job is kept
+type RewriteMap struct {
+	entries map[string]*RewriteEntry
+	mutex   sync.Mutex
+}
+
+// NewRewriteMap creates an empty RewriteMap
+func NewRewriteMap() *RewriteMap {
+	return &RewriteMap{
+		entries: make(map[string]*RewriteEntry),
+	}
+}
+
+// RecordJob records a successful job, a planned job of diff mode is recorded whether the target exists or not,
+// a verify job is recorded only if the target matches source. A local target has no reference to rewrite to,
+// and a job filtered by labels transfers nothing
+func (m *RewriteMap) RecordJob(job *transfer.Job, planned bool) {
+	stats := job.Stats()
+	if job.Target.IsLocal() || stats.Filtered {
+		return
+	}
+
+	var sourceDigest, targetDigest digest.Digest
+	switch {
+	case planned:
+	case stats.Verify == transfer.VerifyMatched:
+		targetDigest = stats.TargetDigest
+		// a rewritten manifest has a different digest from source
+		if stats.SourceDigest == stats.TargetDigest {
+			sourceDigest = stats.SourceDigest
+		}
+	case stats.Verify != "":
+		return
+	default:
+		targetDigest = stats.ManifestDigest
+		sourceDigest = stats.SourceDigest
+	}
+
+	source := ImageReference{
+		Registry:   job.Source.GetRegistry(),
+		Repository: job.Source.GetRepository(),
+		Tag:        job.Source.GetTag(),
+		Digest:     sourceDigest.String(),
+	}
+	// a source pulled by digest has no tag
+	if d, err := digest.Parse(source.Tag); err == nil {
+		source.Tag = ""
+		source.Digest = d.String()
+	}
+	target := ImageReference{
+		Registry:   job.Target.GetRegistry(),
+		Repository: job.Target.GetRepository(),
+		Tag:        job.Target.GetTag(),
+		Digest:     targetDigest.String(),
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.entries[source.Name()+"|"+target.Name()] = &RewriteEntry{
+		Old:       source.Name(),
+		New:       target.Name(),
+		OldPinned: source.Pinned(),
+		NewPinned: target.Pinned(),
+		Source:    source,
+		Target:    target,
+	}
+}
+
+// Entries returns the entries sorted by the old and new references
+func (m *RewriteMap) Entries() []*RewriteEntry {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	entries := make([]*RewriteEntry, 0, len(m.entries))
+	for _, entry := range m.entries {
+		copied := *entry
+		entries = append(entries, &copied)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Old != entries[j].Old {
+			return entries[i].Old < entries[j].Old
+		}
+		return entries[i].New < entries[j].New
+	})
+	return entries
+}
+
+// Write writes the rewrite map to a yaml file
+func (m *RewriteMap) Write(path string) error {
+	data, err := yaml.Marshal(&rewriteMapFile{Images: m.Entries()})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("write rewrite map to %s error: %v", path, err)
+	}
+	return nil
+}
+
+// writeRewriteMap writes the rewrite map to the rewriteMap file, and the kustomization and helm values
+// of emitKustomize and emitHelmValues
+func (c *Client) writeRewriteMap() {
+	config := c.config.FlagConf.Config
+	if path := config.RewriteMap; path != "" {
+		if err := c.rewriteMap.Write(path); err != nil {
+			log.Errorf("%v", err)
+		} else {
+			log.Summaryf("Rewrite map of %v images is written to %s", len(c.rewriteMap.Entries()), path)
+		}
+	}
+
+	if config.EmitKustomize == "" && config.EmitHelmValues == "" {
+		return
+	}
+	rewrites := c.rewriteMap.repoRewrites()
+	if dir := config.EmitKustomize; dir != "" {
+		if err := writeKustomize(dir, rewrites); err != nil {
+			log.Errorf("%v", err)
+		} else {
+			log.Summaryf("Kustomize images of %v repositories are written to %s", len(rewrites),
+				filepath.Join(dir, kustomizationFile))
+		}
+	}
+	if path := config.EmitHelmValues; path != "" {
+		if err := writeHelmValues(path, rewrites); err != nil {
+			log.Errorf("%v", err)
+		} else {
+			log.Summaryf("Helm values of %v repositories are written to %s", len(rewrites), path)
+		}
+	}
+}
@@ -20,12 +20,22 @@ package imagetransfer
 
 import (
 	"container/list"
+	"errors"
 	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/apis/apicall"
 	"tkestack.io/image-transfer/pkg/apis/ccrapis"
+	"tkestack.io/image-transfer/pkg/apis/quayapis"
+	"tkestack.io/image-transfer/pkg/apis/ssmapis"
+	"tkestack.io/image-transfer/pkg/apis/swrapis"
 	"tkestack.io/image-transfer/pkg/apis/tcrapis"
 	"tkestack.io/image-transfer/pkg/image-transfer/options"
 	"tkestack.io/image-transfer/pkg/log"
@@ -33,40 +43,180 @@ import (
 	"tkestack.io/image-transfer/pkg/utils"
 )
 
-//Client is a transfer client
+//Client is a transfer client. Url pairs are expanded to jobs by the workers of rulesHandler and the
+//jobs are run by the workers of jobsHandler, they are connected by a bounded job channel, see newJobListChan.
+//Sending to a full channel blocks the generating worker, so job generation never runs far ahead of
+//transfer and the jobs waiting in memory are limited by the capacity of the channel.
 type Client struct {
-	// a Transfer.Job list
-	jobList *list.List
-
 	// a URLPair list
 	urlPairList *list.List
+	// urlPairSet dedupes the url pairs put into urlPairList
+	urlPairSet *urlPairSet
 
 	// failed list
 	failedJobList         *list.List
 	failedJobGenerateList *list.List
 
+	// jobs and url pairs failed for permanent reasons, they are not retried
+	permanentFailedList *list.List
+
 	config *configs.Configs
 
+	// target repositories which are ensured to exist
+	ensuredRepos map[string]bool
+
+	// source namespaces skipped by filters
+	skippedNs []string
+
+	// source namespaces matched by no route
+	unroutedNs []string
+
+	// target namespaces which are created public, others are created private
+	publicNs map[string]bool
+	// reasons of target namespaces whose visibility differs from source
+	nsVisibilityNotes map[string]string
+	// namespaces created with a visibility different from source
+	visibilityDiffs []string
+
+	// repositories whose metadata failed to sync, they do not fail the transfer
+	metadataFailedList []string
+
+	// the listed tags which are missing on the source and skipped, per rule source
+	missingTags []string
+
+	// report collects the outcome of every job, it is nil if no report is required
+	report *Report
+
+	// verifying is true in the verify phase, the jobs compare targets with sources instead of transferring
+	verifying bool
+	// verifyReport collects the verify results, it is nil if verify is not required
+	verifyReport *VerifyReport
+	// rewriteMap collects the old and new references of images, it is nil if neither rewrite map nor
+	// kustomize and helm values are required
+	rewriteMap *RewriteMap
+
+	// digestLock pins the digests transferred by every rule, it is nil if digestLock is not set
+	digestLock *DigestLock
+	// targetRepoRewrite rewrites the repositories of the rules without repoRewrite, see flag targetRepoRewrite
+	targetRepoRewrite utils.RepoRewrite
+
+	// apiTransport is the rate limited transport of tencent cloud api, with a custom ca of apiCaFile
+	apiTransport http.RoundTripper
+
+	// options shared by all transfer jobs of this run
+	jobOptions *transfer.JobOptions
+
+	// failFast aborts the run when the failures exceed maxFailures or failFastRate
+	failFast *failFast
+
+	// retainedRepos are the target repositories the retention policy is applied to
+	retainedRepos *retainedRepos
+
+	// ghcrPackages are the ghcr.io packages whose visibility is checked
+	ghcrPackages *ghcrPackages
+
+	// counters are the live job counts, read by Snapshot
+	counters *counters
+
+	// mirroredRepos are the target repositories whose extraneous tags are deleted by deleteExtraneous
+	mirroredRepos *mirroredRepos
+
 	// mutex
-	jobListMutex               sync.Mutex
 	urlPairListMutex           sync.Mutex
 	failedJobListMutex         sync.Mutex
 	failedJobGenerateListMutex sync.Mutex
+	permanentFailedListMutex   sync.Mutex
+	ensuredReposMutex          sync.Mutex
+	visibilityDiffsMutex       sync.Mutex
+	missingTagsMutex           sync.Mutex
 }
 
 // URLPair is a pair of source and target url
 type URLPair struct {
 	source string
 	target string
+
+	// rule is the rule which the pair is generated from, it may be nil
+	rule *configs.Rule
+}
+
+// PermanentFailure is a job or url pair which failed for a permanent reason
+type PermanentFailure struct {
+	name string
+	err  error
 }
 
 // Run is main function of a transfer client
 func (c *Client) Run() error {
 
+	// the rewrite rules are debugged without reading the rules or accessing any registry
+	if len(c.config.FlagConf.Config.TestRewrite) != 0 {
+		return c.TestRewrite(c.config.FlagConf.Config.TestRewrite)
+	}
+
+	if c.config.FlagConf.Config.FromKubeconfig != "" {
+		if err := c.discoverKubeImages(); err != nil {
+			return fmt.Errorf("discover images from kubeconfig %s error: %v", c.config.FlagConf.Config.FromKubeconfig,
+				err)
+		}
+	}
+	if err := c.discoverManifestImages(); err != nil {
+		return err
+	}
+	if c.config.FlagConf.Config.DryRun {
+		return c.printImageList()
+	}
+
+	// the mirror configuration is generated from the rules, no registry is accessed
+	if c.config.FlagConf.Config.Mode == "mirrorConfig" {
+		return c.MirrorConfig(c.config.ImageList)
+	}
+
+	// only the tags of source repos are listed, the targets are not accessed
+	if c.config.FlagConf.Config.Mode == "inventory" {
+		return c.Inventory(c.config.ImageList)
+	}
+
+	// typo'd passwords and unreachable registries fail before the rules are generated
+	if c.config.FlagConf.Config.CheckAuth || !c.config.FlagConf.Config.SkipPreflight {
+		err := c.preflightAuth()
+		if c.config.FlagConf.Config.CheckAuth {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("%v, set --skipPreflight=true to start anyway", err)
+		}
+	}
+
+	// the rewrite map is written however the run ends, it contains the images transferred so far
+	if c.rewriteMap != nil {
+		defer c.writeRewriteMap()
+	}
+	if c.digestLock != nil {
+		defer c.writeDigestLock()
+	}
+
 	if c.config.FlagConf.Config.CCRToTCR == true {
 		return c.CCRToTCRTransfer()
 	}
 
+	if c.config.FlagConf.Config.CCRToRegistry == true {
+		return c.CCRToRegistryTransfer(NewCcrRouter(c.config.FlagConf.Config.TargetTemplate, &NoopNsEnsurer{}),
+			"./ccr_to_registry_rules")
+	}
+
+	if c.config.FlagConf.Config.SWRToTCR == true {
+		return c.SWRToTCRTransfer()
+	}
+
+	if c.config.FlagConf.Config.TCRToTCR == true {
+		return c.TCRToTCRTransfer()
+	}
+
+	if c.config.FlagConf.Config.TCRToCCR == true {
+		return c.TCRToCCRTransfer()
+	}
+
 	return c.NormalTransfer(c.config.ImageList, false)
 
 }
@@ -74,52 +224,404 @@ func (c *Client) Run() error {
 //CCRToTCRTransfer transfer ccr to tcr
 func (c *Client) CCRToTCRTransfer() error {
 
-	ccrClient := ccrapis.NewCCRAPIClient()
+	tcrClient := c.newTCRAPIClient()
+	destinations := make(map[string]*CcrDestination)
+	tcrDestination := func(region, tcrName string) *CcrDestination {
+		key := region + "/" + tcrName
+		if _, ok := destinations[key]; !ok {
+			destinations[key] = &CcrDestination{
+				TargetTemplate: tcrName + ".tencentcloudcr.com/" + utils.NamespacePlaceholder + "/" +
+					utils.RepoPlaceholder,
+				Ensurer:        NewTcrNsEnsurer(c, tcrClient, region, tcrName),
+				MetadataSyncer: NewTcrRepoMetadataSyncer(c, tcrClient, region, tcrName),
+				QuotaChecker:   NewTcrQuotaChecker(c, tcrClient, region, tcrName),
+			}
+		}
+		return destinations[key]
+	}
+
+	router := func(ns string) *CcrDestination {
+		if route := c.config.GetTCRRoute(ns); route != nil {
+			return tcrDestination(route.TCRRegion, route.TCRName)
+		}
+		if len(c.config.TCRRoutes) != 0 && !c.config.FlagConf.Config.UnroutedNsFallback {
+			return nil
+		}
+		return tcrDestination(c.config.FlagConf.Config.TCRRegion, c.config.FlagConf.Config.TCRName)
+	}
+
+	if err := c.resolveNsVisibility(); err != nil {
+		return err
+	}
+
+	return c.CCRToRegistryTransfer(router, "./ccr_to_tcr_rules")
+
+}
+
+// resolveNsVisibility decides the visibility of target namespaces from ccr, a target namespace
+// is public if all repositories of its ccr namespaces are public and forcePrivate is false
+func (c *Client) resolveNsVisibility() error {
+
+	visibility, err := c.newCCRAPIClient().GetNamespaceVisibility(c.config.Secret,
+		c.config.FlagConf.Config.CCRRegion)
+	if err != nil {
+		log.Errorf("Get ccr namespace visibility returned error: %v", err)
+		return err
+	}
+
+	var ccrNs []string
+	for ns := range visibility {
+		ccrNs = append(ccrNs, ns)
+	}
+	sort.Strings(ccrNs)
+
+	c.publicNs = make(map[string]bool)
+	c.nsVisibilityNotes = make(map[string]string)
+	privateNs := make(map[string]bool)
+	for _, ns := range ccrNs {
+		targetNs := ns
+		if mappedNs, ok := c.config.NamespaceMapping[ns]; ok {
+			targetNs = mappedNs
+		}
+
+		v := visibility[ns]
+		switch {
+		case v.IsPublic() && c.config.FlagConf.Config.ForcePrivate:
+			privateNs[targetNs] = true
+			c.nsVisibilityNotes[targetNs] = fmt.Sprintf("%s is public in ccr, created private by forcePrivate", ns)
+		case v.IsPublic():
+			c.publicNs[targetNs] = true
+		default:
+			privateNs[targetNs] = true
+			if v.PublicRepos != 0 {
+				c.nsVisibilityNotes[targetNs] = fmt.Sprintf("%v of %v repositories of %s are public in ccr, "+
+					"created private", v.PublicRepos, v.PublicRepos+v.PrivateRepos, ns)
+			}
+		}
+	}
+
+	// a namespace mapped from both public and private namespaces is private
+	for targetNs := range c.publicNs {
+		if privateNs[targetNs] {
+			delete(c.publicNs, targetNs)
+			c.nsVisibilityNotes[targetNs] = fmt.Sprintf("%s is mapped from public and private ccr namespaces, "+
+				"created private", targetNs)
+		}
+	}
+
+	return nil
+
+}
+
+// CcrDestination is the target registry of ccr namespaces
+type CcrDestination struct {
+	// TargetTemplate renders the targets, see utils.RenderTargetTemplate
+	TargetTemplate string
+	// Ensurer creates the target namespaces
+	Ensurer NamespaceEnsurer
+	// MetadataSyncer sets the metadata of target repositories, it may be nil
+	MetadataSyncer RepoMetadataSyncer
+	// QuotaChecker checks the quotas before target namespaces are created, it may be nil
+	QuotaChecker QuotaChecker
+}
+
+// CcrRouter returns the destination of a ccr namespace, nil means the namespace is unrouted
+type CcrRouter func(ns string) *CcrDestination
+
+// NewCcrRouter returns a CcrRouter which routes all ccr namespaces to one destination
+func NewCcrRouter(targetTemplate string, ensurer NamespaceEnsurer) CcrRouter {
+	destination := &CcrDestination{
+		TargetTemplate: targetTemplate,
+		Ensurer:        ensurer,
+	}
+	return func(ns string) *CcrDestination {
+		return destination
+	}
+}
+
+// CCRToRegistryTransfer transfer ccr to the registries given by router, the target namespaces
+// are created by the ensurer of each destination, and the rules are saved to rulesFile
+func (c *Client) CCRToRegistryTransfer(router CcrRouter, rulesFile string) error {
+
+	ccrClient := c.newCCRAPIClient()
 	ccrNs, err := ccrClient.GetAllNamespaceByName(c.config.Secret, c.config.FlagConf.Config.CCRRegion)
 
 	if err != nil {
-		log.Errorf("Get ccr ns returned error: ", err)
+		log.Errorf("Get ccr ns returned error: %v", err)
 		return err
 	}
 
-	tcrClient := tcrapis.NewTCRAPIClient()
-	tcrNs, tcrID, err := tcrClient.GetAllNamespaceByName(c.config.Secret,
-		c.config.FlagConf.Config.TCRRegion, c.config.FlagConf.Config.TCRName)
+	ccrNs, skippedNs, err := c.FilterCcrNs(ccrNs)
+	if err != nil {
+		return err
+	}
+	c.skippedNs = skippedNs
+
+	if err := c.checkCcrRepoList(ccrClient); err != nil {
+		return err
+	}
+
+	// group ccr namespaces by destination
+	var destinations []*CcrDestination
+	destinationNs := make(map[*CcrDestination][]string)
+	nsTemplates := make(map[string]string)
+	var unroutedNs []string
+	for _, ns := range ccrNs {
+		destination := router(ns)
+		if destination == nil {
+			unroutedNs = append(unroutedNs, ns)
+			continue
+		}
+		if _, ok := destinationNs[destination]; !ok {
+			destinations = append(destinations, destination)
+		}
+		destinationNs[destination] = append(destinationNs[destination], ns)
+		nsTemplates[ns] = destination.TargetTemplate
+	}
+	if len(unroutedNs) != 0 {
+		log.Errorf("%v ccr namespaces are matched by no route: %v", len(unroutedNs), unroutedNs)
+	}
+	c.unroutedNs = unroutedNs
 
+	if !c.config.FlagConf.Config.VerifyOnly {
+		if err := c.preflightQuota(ccrClient, destinations, destinationNs); err != nil {
+			return err
+		}
+	}
+
+	var failedNsList []string
+	for _, destination := range destinations {
+		failedNs, err := c.ensureCcrTargetNs(destination, destinationNs[destination])
+		if err != nil {
+			return err
+		}
+		failedNsList = append(failedNsList, failedNs...)
+	}
+
+	//generate transfer rules, the skipped and unrouted namespaces generate no rules
+	excludedNs := append(append(failedNsList, skippedNs...), unroutedNs...)
+	rulesMap, err := c.GenerateCcrRules(excludedNs, ccrClient, c.config.Secret, c.config.FlagConf.Config.CCRRegion,
+		nsTemplates, rulesFile)
 	if err != nil {
-		log.Errorf("Get tcr ns returned error: ", err)
 		return err
 	}
 
-	//create ccr ns in tcr
-	failedNsList, err := c.CreateTcrNs(tcrClient, ccrNs, tcrNs, c.config.Secret, c.config.FlagConf.Config.TCRRegion, tcrID)
+	if c.config.FlagConf.Config.SyncRepoMetadata && !c.config.FlagConf.Config.VerifyOnly {
+		c.SyncCcrRepoMetadata(ccrClient, router, rulesMap)
+	}
+
+	return c.NormalTransfer(rulesMap, true)
+
+}
+
+// SyncCcrRepoMetadata sets the descriptions of ccr repositories on target repositories, it is
+// best-effort, the failures are recorded in metadataFailedList and never fail the transfer
+func (c *Client) SyncCcrRepoMetadata(ccrClient *ccrapis.CCRAPIClient, router CcrRouter, rulesMap map[string]string) {
+
+	descriptions, err := ccrClient.GetRepoDescriptions(c.config.Secret, c.config.FlagConf.Config.CCRRegion)
 	if err != nil {
-		log.Errorf("CreateTcrNs error: ", err)
+		log.Warnf("Get ccr repository descriptions error, repository metadata will not be synced: %v", err)
+		c.metadataFailedList = append(c.metadataFailedList, fmt.Sprintf("get ccr repository descriptions: %v", err))
+		return
+	}
+
+	var targets []string
+	for target := range rulesMap {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	synced := 0
+	for _, target := range targets {
+		sourceURL, err := utils.NewRepoURL(rulesMap[target])
+		if err != nil {
+			continue
+		}
+		description, ok := descriptions[sourceURL.GetRepoWithNamespace()]
+		if !ok {
+			continue
+		}
+		destination := router(sourceURL.GetNamespace())
+		if destination == nil || destination.MetadataSyncer == nil {
+			continue
+		}
+		targetURL, err := utils.NewRepoURL(target)
+		if err != nil {
+			continue
+		}
+
+		if err := destination.MetadataSyncer.SyncDescription(targetURL.GetNamespace(), targetURL.GetRepo(),
+			description); err != nil {
+			log.Warnf("Sync description of %s error: %v", targetURL.GetURLWithoutTag(), err)
+			c.metadataFailedList = append(c.metadataFailedList,
+				fmt.Sprintf("%s: %v", targetURL.GetURLWithoutTag(), err))
+			continue
+		}
+		synced++
+	}
+
+	log.Infof("Sync descriptions of %v repositories, %v failed", synced, len(c.metadataFailedList))
+
+}
+
+// ensureCcrTargetNs creates the target namespaces of ccr namespaces in a destination,
+// the ccr namespaces whose target namespaces failed to create are returned
+func (c *Client) ensureCcrTargetNs(destination *CcrDestination, ccrNs []string) ([]string, error) {
+
+	// map ccr namespaces to target namespaces
+	targetNsMap := make(map[string]string)
+	var targetNs []string
+	for _, ns := range ccrNs {
+		mappedNs := ns
+		if m, ok := c.config.NamespaceMapping[ns]; ok {
+			mappedNs = m
+		}
+		target := utils.RenderTargetTemplate(destination.TargetTemplate, mappedNs, "repo")
+		targetURL, err := utils.NewRepoURL(target)
+		if err != nil {
+			return nil, fmt.Errorf("target template %s renders invalid url %s: %v",
+				destination.TargetTemplate, target, err)
+		}
+		targetNsMap[ns] = targetURL.GetNamespace()
+		if !utils.IsContain(targetNs, targetURL.GetNamespace()) {
+			targetNs = append(targetNs, targetURL.GetNamespace())
+		}
+	}
+
+	//create ccr ns in target
+	failedTargetNs, err := destination.Ensurer.EnsureNamespaces(targetNs)
+	if err != nil {
+		return nil, err
+	}
+
+	var failedNsList []string
+	for _, ns := range ccrNs {
+		if utils.IsContain(failedTargetNs, targetNsMap[ns]) {
+			failedNsList = append(failedNsList, ns)
+		}
+	}
+
+	return failedNsList, nil
+
+}
+
+// SWRToTCRTransfer transfer huawei cloud swr to tcr
+func (c *Client) SWRToTCRTransfer() error {
+
+	swrClient := swrapis.NewSWRAPIClient()
+	swrNs, err := swrClient.GetAllNamespaceByName(c.config.Secret, c.config.FlagConf.Config.SWRRegion)
+	if err != nil {
+		log.Errorf("Get swr ns returned error: %v", err)
 		return err
 	}
 
-	//retry failedNsList
-	if len(failedNsList) != 0 {
-		log.Infof("some ccr namespace create failed in tcr, retry Create Tcr Ns.")
-		for times := 0; times < c.config.FlagConf.Config.RetryNums && len(failedNsList) != 0; times++ {
-			tmpFailedNsList, err := c.RetryCreateTcrNs(tcrClient, failedNsList,
-				c.config.Secret, c.config.FlagConf.Config.TCRRegion)
-			if err != nil {
+	// organizations whose names are invalid for tcr can never be created, report them up front
+	var validNs, invalidNs []string
+	for _, ns := range swrNs {
+		if err := tcrapis.ValidateNamespaceName(ns); err != nil {
+			log.Warnf("swr organization %s will not be transferred: %v", ns, err)
+			invalidNs = append(invalidNs, ns)
+			continue
+		}
+		validNs = append(validNs, ns)
+	}
+
+	if len(invalidNs) != 0 {
+		log.Warnf("%v swr organizations have invalid names for tcr namespace: %v", len(invalidNs), invalidNs)
+	}
+
+	tcrClient := c.newTCRAPIClient()
+
+	//create swr ns in tcr
+	failedNsList, err := c.EnsureTcrNs(tcrClient, c.config.FlagConf.Config.TCRRegion,
+		c.config.FlagConf.Config.TCRName, validNs)
+	if err != nil {
+		return err
+	}
+	failedNsList = append(failedNsList, invalidNs...)
+
+	//generate transfer rules
+	rulesMap, err := swrClient.GenerateAllSwrRules(c.config.Secret, c.config.FlagConf.Config.SWRRegion,
+		swrNs, failedNsList, c.config.FlagConf.Config.TCRName)
+	if err != nil {
+		log.Errorf("generate swr to tcr rules failed: %v", err)
+		return err
+	}
+
+	return c.NormalTransfer(rulesMap, true)
+
+}
+
+// TCRToTCRTransfer transfer a tcr instance to another tcr instance, e.g. across regions
+func (c *Client) TCRToTCRTransfer() error {
+
+	sourceRegion := c.config.FlagConf.Config.SourceTCRRegion
+	sourceTcrName := c.config.FlagConf.Config.SourceTCRName
+
+	tcrClient := c.newTCRAPIClient()
+	sourceNs, sourceTcrID, err := tcrClient.GetAllNamespaceByName(c.config.Secret, sourceRegion, sourceTcrName)
+	if err != nil {
+		log.Errorf("Get source tcr ns returned error: %v", err)
+		return err
+	}
+
+	// only transfer the given namespaces
+	if len(c.config.FlagConf.Config.SourceNamespaces) != 0 {
+		var filteredNs []string
+		for _, ns := range c.config.FlagConf.Config.SourceNamespaces {
+			if !utils.IsContain(sourceNs, ns) {
+				log.Warnf("namespace %s is not found in source tcr %s", ns, sourceTcrName)
 				continue
-			} else {
-				failedNsList = tmpFailedNsList
 			}
+			filteredNs = append(filteredNs, ns)
 		}
+		sourceNs = filteredNs
 	}
 
-	if len(failedNsList) != 0 {
-		log.Warnf("some ccr namespace create failed in tcr: ", failedNsList)
+	//create source tcr ns in target tcr
+	failedNsList, err := c.EnsureTcrNs(tcrClient, c.config.FlagConf.Config.TCRRegion,
+		c.config.FlagConf.Config.TCRName, sourceNs)
+	if err != nil {
+		return err
 	}
 
 	//generate transfer rules
-	rulesMap, err := c.GenerateCcrToTcrRules(failedNsList, ccrClient, c.config.Secret, c.config.FlagConf.Config.CCRRegion,
+	rulesMap, err := tcrClient.GenerateAllTcrRules(c.config.Secret, sourceRegion, sourceTcrName, sourceTcrID,
+		sourceNs, failedNsList, c.config.FlagConf.Config.TCRName+".tencentcloudcr.com", "./tcr_to_tcr_rules")
+	if err != nil {
+		log.Errorf("generate tcr to tcr rules failed: %v", err)
+		return err
+	}
+
+	return c.NormalTransfer(rulesMap, true)
+
+}
+
+// TCRToCCRTransfer transfer tcr back to ccr
+func (c *Client) TCRToCCRTransfer() error {
+
+	tcrClient := c.newTCRAPIClient()
+	tcrNs, tcrID, err := tcrClient.GetAllNamespaceByName(c.config.Secret,
 		c.config.FlagConf.Config.TCRRegion, c.config.FlagConf.Config.TCRName)
 	if err != nil {
+		log.Errorf("Get tcr ns returned error: %v", err)
+		return err
+	}
+
+	ccrClient := c.newCCRAPIClient()
+
+	//create tcr ns in ccr
+	failedNsList, err := c.EnsureCcrNs(ccrClient, tcrNs)
+	if err != nil {
+		return err
+	}
+
+	//generate transfer rules
+	rulesMap, err := tcrClient.GenerateAllTcrRules(c.config.Secret, c.config.FlagConf.Config.TCRRegion,
+		c.config.FlagConf.Config.TCRName, tcrID, tcrNs, failedNsList,
+		ccrapis.GetRegistryDomain(c.config.FlagConf.Config.CCRRegion), "./tcr_to_ccr_rules")
+	if err != nil {
+		log.Errorf("generate tcr to ccr rules failed: %v", err)
 		return err
 	}
 
@@ -127,98 +629,436 @@ func (c *Client) CCRToTCRTransfer() error {
 
 }
 
-//GenerateCcrToTcrRules generate rules of ccr transfer to tcr
-func (c *Client) GenerateCcrToTcrRules(failedNsList []string, ccrClient *ccrapis.CCRAPIClient,
-	secret map[string]configs.Secret, ccrRegion string, tcrRegion string, tcrName string) (map[string]string, error) {
+// EnsureTcrNs creates the source namespaces which are not exist in tcr, failed namespaces
+// are retried RetryNums times, and the namespaces which still failed are returned
+func (c *Client) EnsureTcrNs(tcrClient *tcrapis.TCRAPIClient, region, tcrName string,
+	sourceNs []string) ([]string, error) {
+
+	// verify only mode never changes the target
+	if c.config.FlagConf.Config.VerifyOnly {
+		return nil, nil
+	}
 
-	rulesMap, err := ccrClient.GenerateAllCcrRules(secret, ccrRegion, failedNsList, tcrRegion, tcrName)
+	tcrNs, tcrID, err := tcrClient.GetAllNamespaceByName(c.config.Secret, region, tcrName)
 
 	if err != nil {
-		log.Errorf("generate ccr to tcr rules failed: ", err)
+		log.Errorf("Get tcr ns returned error: %v", err)
 		return nil, err
 	}
 
-	return rulesMap, nil
+	failedNsList, permanentNsList, err := c.CreateTcrNs(tcrClient, sourceNs, tcrNs, c.config.Secret, region,
+		tcrName, tcrID)
+	if err != nil {
+		log.Errorf("CreateTcrNs error: %v", err)
+		return nil, err
+	}
+
+	//retry failedNsList
+	failedNsList = c.RetryFailedNs("tcr "+tcrName, failedNsList, permanentNsList,
+		func(retryList []string) ([]string, []string, error) {
+			return c.RetryCreateTcrNs(tcrClient, retryList, c.config.Secret, region, tcrName)
+		})
+
+	return failedNsList, nil
 
 }
 
-//RetryCreateTcrNs retry to create tcr namespaces
-func (c *Client) RetryCreateTcrNs(tcrClient *tcrapis.TCRAPIClient, retryList []string,
-	secret map[string]configs.Secret, region string) ([]string, error) {
-	var failedList []string
+// EnsureCcrNs creates the source namespaces which are not exist in ccr, failed namespaces
+// are retried RetryNums times, and the namespaces which still failed are returned
+func (c *Client) EnsureCcrNs(ccrClient *ccrapis.CCRAPIClient, sourceNs []string) ([]string, error) {
 
-	secretID, secretKey, err := tcrapis.GetTcrSecret(secret)
+	// verify only mode never changes the target
+	if c.config.FlagConf.Config.VerifyOnly {
+		return nil, nil
+	}
 
-	tcrNs, tcrID, err := tcrClient.GetAllNamespaceByName(c.config.Secret,
-		c.config.FlagConf.Config.TCRRegion, c.config.FlagConf.Config.TCRName)
+	region := c.config.FlagConf.Config.CCRRegion
 
+	secretID, secretKey, err := ccrapis.GetCcrSecret(c.config.Secret)
 	if err != nil {
-		log.Errorf("retry create tcr ns, get tcr ns error: ", err)
+		log.Errorf("GetCcrSecret error: %v", err)
 		return nil, err
 	}
 
-	for _, ns := range retryList {
-		if !utils.IsContain(tcrNs, ns) {
-			_, err := tcrClient.CreateNamespace(secretID, secretKey, region, tcrID, ns)
+	ccrNs, err := ccrClient.GetAllNamespaceByName(c.config.Secret, region)
+	if err != nil {
+		log.Errorf("Get ccr ns returned error: %v", err)
+		return nil, err
+	}
+
+	createNs := func(ns string) error {
+		if _, err := ccrClient.CreateNamespacePersonal(secretID, secretKey, region, ns); err != nil {
+			log.Errorf("ccr CreateNamespacePersonal error: %v", err)
+			if apicall.IsPermanentError(err) {
+				return transfer.NewPermanentError(err)
+			}
+			return err
+		}
+		ccrClient.AddCachedNamespace(region, ns)
+		return nil
+	}
+
+	failedNsList, permanentNsList := CreateMissingNs(sourceNs, ccrNs, c.config.FlagConf.Config.NsRoutines,
+		createNs)
+
+	//retry failedNsList
+	failedNsList = c.RetryFailedNs("ccr", failedNsList, permanentNsList,
+		func(retryList []string) ([]string, []string, error) {
+			// use the cached listing, it grows when a namespace is created successfully
+			ccrNs, err := ccrClient.GetCachedNamespaceByName(c.config.Secret, region, false)
 			if err != nil {
-				log.Errorf("tcr CreateNamespace error: ", err)
-				failedList = append(failedList, ns)
+				log.Errorf("retry create ccr ns, get ccr ns error: %v", err)
+				return nil, nil, err
 			}
+			failedList, permanentList := CreateMissingNs(retryList, ccrNs, c.config.FlagConf.Config.NsRoutines,
+				createNs)
+			return failedList, permanentList, nil
+		})
+
+	return failedNsList, nil
+
+}
+
+// RetryFailedNs retries to create the failed namespaces of target(tcr, ccr, ...) RetryNums times
+// by retryCreateNs with exponential backoff between rounds. The namespaces in permanentNsList failed
+// for permanent reasons like invalid names, they are never retried. The namespaces which still
+// failed are returned
+func (c *Client) RetryFailedNs(target string, failedNsList, permanentNsList []string,
+	retryCreateNs func(retryList []string) ([]string, []string, error)) []string {
+
+	retryList := retryableNs(failedNsList, permanentNsList)
+	if len(permanentNsList) != 0 {
+		log.Warnf("some source namespace create failed in %s for permanent reasons, "+
+			"they will not be retried: %v", target, permanentNsList)
+	}
+
+	if len(retryList) != 0 {
+		log.Infof("some source namespace create failed in %s, retry to create them.", target)
+		for times := 0; times < c.config.FlagConf.Config.RetryNums && len(retryList) != 0; times++ {
+			time.Sleep(nsRetryBackoff(times))
+			tmpFailedNsList, tmpPermanentNsList, err := retryCreateNs(retryList)
+			if err != nil {
+				log.Warnf("retry %v to create namespaces in %s error: %v", times+1, target, err)
+				continue
+			}
+			if len(tmpPermanentNsList) != 0 {
+				log.Warnf("some source namespace create failed in %s for permanent reasons, "+
+					"they will not be retried: %v", target, tmpPermanentNsList)
+				permanentNsList = append(permanentNsList, tmpPermanentNsList...)
+			}
+			retryList = retryableNs(tmpFailedNsList, permanentNsList)
 		}
 	}
 
-	return failedList, nil
+	failedNsList = append(append([]string{}, retryList...), permanentNsList...)
+	if len(failedNsList) != 0 {
+		log.Warnf("some source namespace create failed in %s: %v", target, failedNsList)
+	}
 
+	return failedNsList
 }
 
-//CreateTcrNs create tcr namespaces
-func (c *Client) CreateTcrNs(tcrClient *tcrapis.TCRAPIClient, ccrNs, tcrNs []string,
-	secret map[string]configs.Secret, region string, tcrID string) ([]string, error) {
+// retryableNs dedupes the failed namespaces and drops the ones in permanentNsList
+func retryableNs(failedNsList, permanentNsList []string) []string {
+	var retryList []string
+	for _, ns := range failedNsList {
+		if !utils.IsContain(permanentNsList, ns) && !utils.IsContain(retryList, ns) {
+			retryList = append(retryList, ns)
+		}
+	}
+	return retryList
+}
+
+// nsRetryBackoff returns the backoff before a retry round of namespace creation,
+// it starts from 1s and doubles every round up to 30s
+func nsRetryBackoff(times int) time.Duration {
+	backoff := time.Second << uint(times)
+	if backoff > 30*time.Second || backoff <= 0 {
+		backoff = 30 * time.Second
+	}
+	return backoff
+}
 
-	var failedList []string
+// CreateMissingNs creates the namespaces of sourceNs which are not in existNs by createNs, at most
+// routines namespaces are created concurrently. The namespaces failed to create are returned in the
+// order of sourceNs, and the ones failed for permanent reasons (createNs returns a
+// transfer.PermanentError) are returned as permanentList too
+func CreateMissingNs(sourceNs, existNs []string, routines int,
+	createNs func(ns string) error) ([]string, []string) {
+	if routines < 1 {
+		routines = 1
+	}
 
-	secretID, secretKey, err := tcrapis.GetTcrSecret(secret)
+	errs := make([]error, len(sourceNs))
+	sem := make(chan struct{}, routines)
+	wg := sync.WaitGroup{}
+	seen := make(map[string]bool)
+	for i, ns := range sourceNs {
+		if seen[ns] || utils.IsContain(existNs, ns) {
+			continue
+		}
+		seen[ns] = true
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, ns string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = createNs(ns)
+		}(i, ns)
+	}
+	wg.Wait()
+
+	var failedList, permanentList []string
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		failedList = append(failedList, sourceNs[i])
+		var permanentErr *transfer.PermanentError
+		if errors.As(err, &permanentErr) {
+			permanentList = append(permanentList, sourceNs[i])
+		}
+	}
 
+	return failedList, permanentList
+}
+
+// FilterCcrNs filters ccr namespaces by ccrNamespaces, ccrNamespaceExclude and ccrRepoFile,
+// the namespaces to transfer and the skipped namespaces are returned
+func (c *Client) FilterCcrNs(ccrNs []string) ([]string, []string, error) {
+	includeNs, err := utils.ExpandListFile(c.config.FlagConf.Config.CCRNamespaces)
 	if err != nil {
-		log.Errorf("GetTcrSecret error: ", err)
-		return failedList, err
+		return nil, nil, fmt.Errorf("read ccr namespaces file error: %v", err)
 	}
 
+	var excludeRegexp *regexp.Regexp
+	if c.config.FlagConf.Config.CCRNamespaceExclude != "" {
+		excludeRegexp, err = regexp.Compile(c.config.FlagConf.Config.CCRNamespaceExclude)
+		if err != nil {
+			return nil, nil, fmt.Errorf("compile ccrNamespaceExclude error: %v", err)
+		}
+	}
+
+	for _, ns := range includeNs {
+		if !utils.IsContain(ccrNs, ns) {
+			log.Warnf("namespace %s is not found in ccr", ns)
+		}
+	}
+
+	// only the namespaces of the repositories in ccrRepoFile are transferred
+	var repoListNs []string
+	for _, repo := range c.config.CCRRepoList {
+		repoListNs = append(repoListNs, strings.SplitN(repo, "/", 2)[0])
+	}
+
+	var filteredNs, skippedNs []string
 	for _, ns := range ccrNs {
-		if !utils.IsContain(tcrNs, ns) {
-			_, err := tcrClient.CreateNamespace(secretID, secretKey, region, tcrID, ns)
-			if err != nil {
-				log.Errorf("tcr CreateNamespace error: ", err)
-				failedList = append(failedList, ns)
-			}
+		if (len(includeNs) != 0 && !utils.IsContain(includeNs, ns)) ||
+			(excludeRegexp != nil && excludeRegexp.MatchString(ns)) ||
+			(len(repoListNs) != 0 && !utils.IsContain(repoListNs, ns)) {
+			skippedNs = append(skippedNs, ns)
+			continue
+		}
+		filteredNs = append(filteredNs, ns)
+	}
+
+	if len(skippedNs) != 0 {
+		log.Infof("%v ccr namespaces are skipped by filters: %v", len(skippedNs), skippedNs)
+	}
+
+	return filteredNs, skippedNs, nil
+}
+
+// checkCcrRepoList reports the repositories of ccrRepoFile which are not found in ccr as permanent failures
+func (c *Client) checkCcrRepoList(ccrClient *ccrapis.CCRAPIClient) error {
+	if len(c.config.CCRRepoList) == 0 {
+		return nil
+	}
+
+	repos, err := ccrClient.ListRepositories(c.config.Secret, c.config.FlagConf.Config.CCRRegion)
+	if err != nil {
+		log.Errorf("List ccr repositories returned error: %v", err)
+		return err
+	}
+	existRepos := make(map[string]bool)
+	for _, repo := range repos {
+		existRepos[*repo.RepoName] = true
+	}
+
+	for _, repo := range c.config.CCRRepoList {
+		if !existRepos[repo] {
+			// a repository listed twice is reported once
+			existRepos[repo] = true
+			log.Errorf("repository %s in ccr repo file is not found in ccr", repo)
+			c.PutAPermanentFailure(repo, fmt.Errorf("repository in %s is not found in ccr",
+				c.config.FlagConf.Config.CCRRepoFile))
 		}
 	}
 
-	return failedList, nil
+	return nil
+}
+
+// GenerateCcrRules generate rules of ccr transfer to the registries given by the target templates
+// of namespaces, the namespaces without a template generate no rules
+func (c *Client) GenerateCcrRules(failedNsList []string, ccrClient *ccrapis.CCRAPIClient,
+	secret map[string]configs.Secret, ccrRegion string, nsTemplates map[string]string,
+	rulesFile string) (map[string]string, error) {
+
+	rulesMap, err := ccrClient.GenerateAllCcrRules(secret, ccrRegion, failedNsList, &ccrapis.RulesOptions{
+		NamespaceTemplates: nsTemplates,
+		RulesFile:          rulesFile,
+		RepoFilter:         c.config.CCRRepoFilter,
+		MaxTagsPerRepo:     c.config.FlagConf.Config.CCRMaxTagsPerRepo,
+		NamespaceMapping:   c.config.NamespaceMapping,
+	})
+
+	if err != nil {
+		log.Errorf("generate ccr rules failed: %v", err)
+		return nil, err
+	}
+
+	return rulesMap, nil
+
+}
+
+//RetryCreateTcrNs retry to create tcr namespaces, the namespaces failed to create are returned,
+//with the ones failed for permanent reasons
+func (c *Client) RetryCreateTcrNs(tcrClient *tcrapis.TCRAPIClient, retryList []string,
+	secret map[string]configs.Secret, region string, tcrName string) ([]string, []string, error) {
+
+	secretID, secretKey, err := tcrapis.GetTcrSecret(secret)
+	if err != nil {
+		log.Errorf("retry create tcr ns, GetTcrSecret error: %v", err)
+		return nil, nil, err
+	}
+
+	// use the cached listing, it grows when a namespace is created successfully
+	tcrNs, tcrID, err := tcrClient.GetCachedNamespaceByName(secret, region, tcrName, false)
+	if err != nil {
+		log.Errorf("retry create tcr ns, get tcr ns error: %v", err)
+		return nil, nil, err
+	}
+
+	failedList, permanentList := CreateMissingNs(retryList, tcrNs, c.config.FlagConf.Config.NsRoutines,
+		c.createTcrNsFunc(tcrClient, secretID, secretKey, region, tcrName, tcrID))
+
+	return failedList, permanentList, nil
+
+}
+
+//CreateTcrNs create tcr namespaces, the namespaces failed to create are returned,
+//with the ones failed for permanent reasons
+func (c *Client) CreateTcrNs(tcrClient *tcrapis.TCRAPIClient, ccrNs, tcrNs []string,
+	secret map[string]configs.Secret, region string, tcrName string, tcrID string) ([]string, []string, error) {
+
+	secretID, secretKey, err := tcrapis.GetTcrSecret(secret)
+	if err != nil {
+		log.Errorf("GetTcrSecret error: %v", err)
+		return nil, nil, err
+	}
+
+	failedList, permanentList := CreateMissingNs(ccrNs, tcrNs, c.config.FlagConf.Config.NsRoutines,
+		c.createTcrNsFunc(tcrClient, secretID, secretKey, region, tcrName, tcrID))
+
+	return failedList, permanentList, nil
 
 }
 
+// createTcrNsFunc returns a function which creates a tcr namespace and adds it to the cached listing,
+// it may be called concurrently
+func (c *Client) createTcrNsFunc(tcrClient *tcrapis.TCRAPIClient, secretID, secretKey, region,
+	tcrName, tcrID string) func(ns string) error {
+
+	return func(ns string) error {
+		if err := tcrapis.ValidateNamespaceName(ns); err != nil {
+			log.Errorf("tcr CreateNamespace error: %v", err)
+			return transfer.NewPermanentError(err)
+		}
+		if _, err := tcrClient.CreateNamespace(secretID, secretKey, region, tcrID, ns, c.publicNs[ns]); err != nil {
+			log.Errorf("tcr CreateNamespace error: %v", err)
+			if apicall.IsPermanentError(err) {
+				return transfer.NewPermanentError(err)
+			}
+			return err
+		}
+		tcrClient.AddCachedNamespace(tcrName, ns)
+		if note, ok := c.nsVisibilityNotes[ns]; ok {
+			c.visibilityDiffsMutex.Lock()
+			c.visibilityDiffs = append(c.visibilityDiffs, fmt.Sprintf("%s/%s: %s", tcrName, ns, note))
+			c.visibilityDiffsMutex.Unlock()
+		}
+		return nil
+	}
+}
+
 //NormalTransfer is the normal mode of transfer
 func (c *Client) NormalTransfer(imageList map[string]string, isCCRToTCR bool) error {
 
+	var urlPairs []*URLPair
 	for source, target := range imageList {
 		// ccr to tcr will use target for map key
 		if isCCRToTCR {
-			c.urlPairList.PushBack(&URLPair{
-				source: target,
-				target: source,
+			urlPairs = append(urlPairs, &URLPair{
+				source: utils.ReplaceRegistry(target, c.config.FlagConf.Config.RegistryDomainOverride),
+				target: utils.ReplaceRegistry(source, c.config.FlagConf.Config.RegistryDomainOverride),
 			})
 		} else {
-			c.urlPairList.PushBack(&URLPair{
+			urlPairs = append(urlPairs, &URLPair{
 				source: source,
 				target: target,
+				rule:   c.config.Rules[source],
 			})
 		}
 	}
 
-	jobListChan := make(chan *transfer.Job, c.config.FlagConf.Config.RoutineNums)
+	// a map has no stable order, sort the url pairs to produce a stable job order
+	if c.config.FlagConf.Config.Deterministic {
+		sort.Slice(urlPairs, func(i, j int) bool {
+			if urlPairs[i].source != urlPairs[j].source {
+				return urlPairs[i].source < urlPairs[j].source
+			}
+			return urlPairs[i].target < urlPairs[j].target
+		})
+	}
 
-	fmt.Println("Start to handle transfer jobs, please wait ...")
+	if c.config.FlagConf.Config.Mode == "diff" {
+		return c.Diff(urlPairs)
+	}
+
+	if !c.config.FlagConf.Config.VerifyOnly {
+		if !log.Quiet() {
+			fmt.Println("Start to handle transfer jobs, please wait ...")
+		}
+		c.runURLPairs(urlPairs)
+		if c.config.FlagConf.Config.DeleteExtraneous && c.failFast.Err() == nil {
+			c.deleteExtraneousTags()
+		}
+		if c.retentionEnabled() && c.failFast.Err() == nil {
+			c.applyRetention()
+		}
+		c.transferSummary()
+		if err := c.failFast.Err(); err != nil {
+			return err
+		}
+	}
+
+	if c.config.FlagConf.Config.Verify || c.config.FlagConf.Config.VerifyOnly {
+		return c.Verify(urlPairs)
+	}
+
+	return nil
+
+}
+
+// runURLPairs generates and runs the jobs of url pairs with the worker pool,
+// the failed jobs are retried RetryNums times
+func (c *Client) runURLPairs(urlPairs []*URLPair) {
+	c.urlPairListMutex.Lock()
+	c.urlPairSet = newURLPairSet(c.config.FlagConf.Config.DefaultSourceRegistry)
+	c.urlPairListMutex.Unlock()
+	c.PutURLPairs(urlPairs)
+
+	jobListChan := c.newJobListChan()
 
 	wg := sync.WaitGroup{}
 
@@ -236,92 +1076,303 @@ func (c *Client) NormalTransfer(imageList map[string]string, isCCRToTCR bool) er
 
 	log.Infof("Start to retry failed jobs...")
 
-	for times := 0; times < c.config.FlagConf.Config.RetryNums; times++ {
+	for times := 0; times < c.config.FlagConf.Config.RetryNums && c.failFast.Err() == nil; times++ {
 		c.Retry()
 	}
+}
+
+// transferSummary logs the failed jobs and the other results of transfer, and writes the report
+func (c *Client) transferSummary() {
 
 	if c.failedJobList.Len() != 0 {
-		log.Infof("################# %v failed transfer jobs: #################", c.failedJobList.Len())
+		log.Summaryf("################# %v failed transfer jobs after retries: #################", c.failedJobList.Len())
 		for e := c.failedJobList.Front(); e != nil; e = e.Next() {
-			log.Infof(e.Value.(*transfer.Job).Source.GetRegistry() + "/" +
-				e.Value.(*transfer.Job).Source.GetRepository() + ":" + e.Value.(*transfer.Job).Source.GetTag())
+			log.Summaryf("%s/%s:%s", e.Value.(*transfer.Job).Source.GetRegistry(),
+				e.Value.(*transfer.Job).Source.GetRepository(), e.Value.(*transfer.Job).Source.GetTag())
 
 		}
 	}
 
 	if c.failedJobGenerateList.Len() != 0 {
-		log.Infof("################# %v failed generate jobs: #################", c.failedJobGenerateList.Len())
+		log.Summaryf("################# %v failed generate jobs after retries: #################",
+			c.failedJobGenerateList.Len())
 		for e := c.failedJobGenerateList.Front(); e != nil; e = e.Next() {
-			log.Infof(e.Value.(*URLPair).source + ": " + e.Value.(*URLPair).target)
+			log.Summaryf("%s: %s", e.Value.(*URLPair).source, e.Value.(*URLPair).target)
 
 		}
 	}
 
-	log.Infof("################# Finished, %v transfer jobs failed, %v jobs generate failed #################",
-		c.failedJobList.Len(), c.failedJobGenerateList.Len())
+	if c.permanentFailedList.Len() != 0 {
+		log.Summaryf("################# %v permanently failed jobs, not retried: #################",
+			c.permanentFailedList.Len())
+		for e := c.permanentFailedList.Front(); e != nil; e = e.Next() {
+			log.Summaryf("%s: %v", e.Value.(*PermanentFailure).name, e.Value.(*PermanentFailure).err)
+		}
+	}
 
-	return nil
+	if len(c.skippedNs) != 0 {
+		log.Summaryf("################# %v namespaces are skipped by filters: %v #################",
+			len(c.skippedNs), c.skippedNs)
+	}
 
-}
+	if len(c.visibilityDiffs) != 0 {
+		// namespaces are created concurrently, sort them for a stable summary
+		sort.Strings(c.visibilityDiffs)
+		log.Summaryf("################# %v namespaces are created with a visibility different from source: "+
+			"#################", len(c.visibilityDiffs))
+		for _, diff := range c.visibilityDiffs {
+			log.Summaryf("%s", diff)
+		}
+	}
 
-//Retry is retry the failed job
-func (c *Client) Retry() {
-	retryJobListChan := make(chan *transfer.Job, c.config.FlagConf.Config.RoutineNums)
+	if len(c.ghcrPackages.diffs) != 0 {
+		sort.Strings(c.ghcrPackages.diffs)
+		log.Summaryf("################# %v ghcr packages have a visibility different from repoVisibility, "+
+			"change them in the package settings of github: #################", len(c.ghcrPackages.diffs))
+		for _, diff := range c.ghcrPackages.diffs {
+			log.Summaryf("%s", diff)
+		}
+	}
 
-	wg1 := sync.WaitGroup{}
-	wg1.Add(1)
-	go func() {
-		defer func() {
-			wg1.Done()
-		}()
-		c.jobsHandler(retryJobListChan)
-	}()
+	if len(c.missingTags) != 0 {
+		// rules are generated concurrently, sort them for a stable summary
+		sort.Strings(c.missingTags)
+		log.Summaryf("################# %v rules have listed tags missing on the source: #################",
+			len(c.missingTags))
+		for _, missing := range c.missingTags {
+			log.Summaryf("%s", missing)
+		}
+	}
 
-	if c.failedJobList.Len() != 0 {
-		for {
-			failedJob := c.failedJobList.Front()
-			if failedJob == nil {
-				break
-			}
-			retryJobListChan <- failedJob.Value.(*transfer.Job)
-			c.failedJobList.Remove(failedJob)
+	if len(c.mirroredRepos.results) != 0 {
+		log.Summaryf("################# %v repositories have extraneous tags: #################",
+			len(c.mirroredRepos.results))
+		for _, result := range c.mirroredRepos.results {
+			log.Summaryf("%s", result)
 		}
+	}
 
+	if len(c.retainedRepos.results) != 0 {
+		log.Summaryf("################# %v repositories have tags not kept by retention: #################",
+			len(c.retainedRepos.results))
+		for _, result := range c.retainedRepos.results {
+			log.Summaryf("%s", result)
+		}
 	}
 
-	if c.failedJobGenerateList.Len() != 0 {
-		c.urlPairList.PushBackList(c.failedJobGenerateList)
-		c.failedJobGenerateList.Init()
-		c.rulesHandler(retryJobListChan)
-	} else {
+	if len(c.metadataFailedList) != 0 {
+		log.Summaryf("################# %v repositories failed to sync metadata: #################",
+			len(c.metadataFailedList))
+		for _, failure := range c.metadataFailedList {
+			log.Summaryf("%s", failure)
+		}
+	}
+
+	if len(c.unroutedNs) != 0 {
+		log.Summaryf("################# %v namespaces are matched by no route: %v #################",
+			len(c.unroutedNs), c.unroutedNs)
+	}
+
+	if c.urlPairSet != nil && (c.urlPairSet.duplicates != 0 || c.urlPairSet.noops != 0) {
+		log.Summaryf("################# %v duplicate url pairs and %v url pairs whose source and target are "+
+			"the same image are skipped #################", c.urlPairSet.duplicates, c.urlPairSet.noops)
+	}
+
+	if filtered := c.Snapshot().Filtered; filtered != 0 {
+		log.Summaryf("################# %v images are filtered out by labelFilter #################", filtered)
+	}
+
+	if immutable := c.Snapshot().SkippedImmutable; immutable != 0 {
+		log.Summaryf("################# %v jobs are skipped as their immutable target tags have the same "+
+			"digest #################", immutable)
+	}
+
+	c.failFast.Summary()
+
+	log.Summaryf("################# Finished, %v transfer jobs failed after retries, %v jobs generate failed "+
+		"after retries, %v jobs failed permanently #################",
+		c.failedJobList.Len(), c.failedJobGenerateList.Len(), c.permanentFailedList.Len())
+
+	if c.report != nil {
+		if err := c.report.Write(c.config.FlagConf.Config.Report); err != nil {
+			log.Errorf("Write report to %s error: %v", c.config.FlagConf.Config.Report, err)
+		} else {
+			log.Summaryf("Report is written to %s", c.config.FlagConf.Config.Report)
+		}
+	}
+
+}
+
+//Retry is retry the failed job. The jobs failed in the last round are run first, then the url pairs
+// failed to generate jobs are generated again. The repos whose tags were listed successfully are not
+// listed again, only their failed tags are in the lists. The jobs which fail again are retried by the
+// next round
+func (c *Client) Retry() {
+	c.failedJobListMutex.Lock()
+	failedJobs := list.New()
+	failedJobs.PushBackList(c.failedJobList)
+	c.failedJobList.Init()
+	c.failedJobListMutex.Unlock()
+
+	if failedJobs.Len() != 0 {
+		retryJobListChan := c.newJobListChan()
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.jobsHandler(retryJobListChan)
+		}()
+		for e := failedJobs.Front(); e != nil; e = e.Next() {
+			atomic.AddInt64(&c.counters.retried, 1)
+			retryJobListChan <- e.Value.(*transfer.Job)
+		}
 		close(retryJobListChan)
+		wg.Wait()
+	}
+
+	c.failedJobGenerateListMutex.Lock()
+	failedURLPairs := list.New()
+	failedURLPairs.PushBackList(c.failedJobGenerateList)
+	c.failedJobGenerateList.Init()
+	c.failedJobGenerateListMutex.Unlock()
+
+	if failedURLPairs.Len() != 0 && c.failFast.Err() == nil {
+		atomic.AddInt64(&c.counters.retried, int64(failedURLPairs.Len()))
+		retryJobListChan := c.newJobListChan()
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.jobsHandler(retryJobListChan)
+		}()
+		c.urlPairListMutex.Lock()
+		c.urlPairList.PushBackList(failedURLPairs)
+		c.urlPairListMutex.Unlock()
+		c.rulesHandler(retryJobListChan)
+		wg.Wait()
+	} else if failedURLPairs.Len() != 0 {
+		// the url pairs are kept as failed after an abort
+		c.failedJobGenerateListMutex.Lock()
+		c.failedJobGenerateList.PushBackList(failedURLPairs)
+		c.failedJobGenerateListMutex.Unlock()
+	}
+}
+
+// NewTransferClient creates a transfer client
+func NewTransferClient(opts *options.ClientOptions) (*Client, error) {
+
+	configs.RegisterSecretProvider(configs.SecretSourceSSM, ssmapis.SecretProvider{})
+	clientConfig, err := configs.InitConfigs(opts)
+
+	if err != nil {
+		return nil, err
 	}
 
-	wg1.Wait()
-}
+	var report *Report
+	if clientConfig.FlagConf.Config.Report != "" {
+		report = NewReport()
+	}
 
-// NewTransferClient creates a transfer client
-func NewTransferClient(opts *options.ClientOptions) (*Client, error) {
+	var verifyReport *VerifyReport
+	if clientConfig.FlagConf.Config.Verify || clientConfig.FlagConf.Config.VerifyOnly {
+		verifyReport = NewVerifyReport()
+	}
 
-	clientConfig, err := configs.InitConfigs(opts)
+	var rewriteMap *RewriteMap
+	if clientConfig.FlagConf.Config.RewriteMap != "" || clientConfig.FlagConf.Config.EmitKustomize != "" ||
+		clientConfig.FlagConf.Config.EmitHelmValues != "" {
+		rewriteMap = NewRewriteMap()
+	}
 
+	var digestLock *DigestLock
+	if path := clientConfig.FlagConf.Config.DigestLock; path != "" {
+		if digestLock, err = LoadDigestLock(path, clientConfig.FlagConf.Config.WarnMutatedTags); err != nil {
+			return nil, err
+		}
+	}
+
+	targetRepoRewrite, err := utils.ParseRepoRewrite(clientConfig.FlagConf.Config.TargetRepoRewrite)
 	if err != nil {
 		return nil, err
 	}
 
+	var apiTransport http.RoundTripper = http.DefaultTransport
+	if clientConfig.FlagConf.Config.APICAFile != "" {
+		if apiTransport, err = utils.NewTransportWithCA(clientConfig.FlagConf.Config.APICAFile); err != nil {
+			return nil, err
+		}
+	}
+	userAgent := clientConfig.FlagConf.Config.UserAgent
+	if userAgent == "" {
+		userAgent = utils.DefaultUserAgent()
+	}
+	transfer.UserAgent = userAgent
+	// the connection pool is shared by all jobs, a routine keeps its connection to a registry between jobs
+	transfer.MaxIdleConnsPerHost = clientConfig.FlagConf.Config.MaxIdleConnsPerHost
+	if transfer.MaxIdleConnsPerHost == 0 {
+		transfer.MaxIdleConnsPerHost = clientConfig.FlagConf.Config.RoutineNums
+	}
+	transfer.KeepAlive = clientConfig.FlagConf.Config.KeepAlive
+	apiTransport = utils.NewUserAgentTransport(userAgent, apiTransport)
+	apiTransport = utils.NewAPIRateLimitedTransport(clientConfig.FlagConf.Config.APIQPS, apiTransport)
+	apicall.MaxAttempts = clientConfig.FlagConf.Config.APIMaxAttempts
+
+	failFast := newFailFast(clientConfig.FlagConf.Config.MaxFailures, clientConfig.FlagConf.Config.FailFastRate)
 	return &Client{
-		jobList:                    list.New(),
 		urlPairList:                list.New(),
 		failedJobList:              list.New(),
 		failedJobGenerateList:      list.New(),
+		permanentFailedList:        list.New(),
 		config:                     clientConfig,
-		jobListMutex:               sync.Mutex{},
+		ensuredRepos:               make(map[string]bool),
+		jobOptions: &transfer.JobOptions{
+			KnownBlobs:         transfer.NewBlobSet(),
+			SkipSameDigest:     clientConfig.FlagConf.Config.SkipSameDigest,
+			IfExists:           clientConfig.FlagConf.Config.IfExists,
+			VerifyAfterPush:    clientConfig.FlagConf.Config.VerifyAfterPush,
+			DeepVerify:         clientConfig.FlagConf.Config.DeepVerify,
+			CopyTimeout:        clientConfig.FlagConf.Config.CopyTimeout,
+			CopyReferrers:      clientConfig.FlagConf.Config.CopyReferrers,
+			CopySignatures:     clientConfig.FlagConf.Config.CopySignatures,
+			TargetManifestType: clientConfig.FlagConf.Config.TargetManifestType,
+			DropAnnotations:    clientConfig.FlagConf.Config.DropAnnotationRegexps(),
+			RefreshAuth:        refreshAuth(clientConfig),
+			LabelSelector:      clientConfig.FlagConf.Config.LabelSelector(),
+			LayerCompression:   clientConfig.FlagConf.Config.LayerCompression,
+			RecompressedLayers: transfer.NewRecompressedLayers(),
+			UploadChunkSize:    int64(clientConfig.FlagConf.Config.UploadChunkSizeMB) << 20,
+			Context:            failFast.ctx,
+		},
+		failFast:                   failFast,
+		mirroredRepos:              newMirroredRepos(),
+		counters:                   &counters{},
+		retainedRepos:              newRetainedRepos(),
+		ghcrPackages:               newGHCRPackages(),
+		report:                     report,
+		verifyReport:               verifyReport,
+		rewriteMap:                 rewriteMap,
+		digestLock:                 digestLock,
+		targetRepoRewrite:          targetRepoRewrite,
+		apiTransport:               apiTransport,
 		urlPairListMutex:           sync.Mutex{},
 		failedJobListMutex:         sync.Mutex{},
 		failedJobGenerateListMutex: sync.Mutex{},
+		permanentFailedListMutex:   sync.Mutex{},
+		ensuredReposMutex:          sync.Mutex{},
 	}, nil
 }
 
+// newJobListChan creates the bounded channel between rulesHandler and jobsHandler, generating
+// workers block on it when jobsHandler falls behind. Its capacity is jobBufferSize(routines by default),
+// every buffered job holds an open image source and target.
+func (c *Client) newJobListChan() chan *transfer.Job {
+	size := c.config.FlagConf.Config.JobBufferSize
+	if size == 0 {
+		size = c.config.FlagConf.Config.RoutineNums
+	}
+	return make(chan *transfer.Job, size)
+}
+
 func (c *Client) rulesHandler(jobListChan chan *transfer.Job) {
 	defer func() {
 		close(jobListChan)
@@ -339,11 +1390,27 @@ func (c *Client) rulesHandler(jobListChan chan *transfer.Job) {
 				if empty {
 					break
 				}
-				moreURLPairs, err := c.GenerateTransferJob(jobListChan, urlPair.source, urlPair.target)
+				// the url pairs left after an abort are dropped
+				if c.failFast.Aborted() {
+					continue
+				}
+				moreURLPairs, err := c.GenerateTransferJob(jobListChan, urlPair.source, urlPair.target, urlPair.rule)
+				c.failFast.Record(err)
 				if err != nil {
+					atomic.AddInt64(&c.counters.failed, 1)
 					log.Errorf("Generate transfer job %s to %s error: %v", urlPair.source, urlPair.target, err)
-					// put to failedJobGenerateList
-					c.PutAFailedURLPair(urlPair)
+					if c.report != nil && !c.verifying {
+						c.report.RecordGenerateFailure(urlPair.source, urlPair.target)
+					}
+					if transfer.IsRetryableError(err) {
+						// put to failedJobGenerateList
+						c.PutAFailedURLPair(urlPair)
+					} else {
+						c.PutAPermanentFailure(urlPair.source+": "+urlPair.target, err)
+						if targetURL, err := utils.NewRepoURL(urlPair.target); err == nil {
+							c.mirroredRepos.MarkFailed(targetURL.GetURLWithoutTag())
+						}
+					}
 				}
 				if moreURLPairs != nil {
 					c.PutURLPairs(moreURLPairs)
@@ -367,8 +1434,39 @@ func (c *Client) jobsHandler(jobListChan chan *transfer.Job) {
 				if !ok {
 					break
 				}
-				if err := job.Run(); err != nil {
-					c.PutAFailedJob(job)
+				// the jobs are still received after an abort to unblock rulesHandler, but they are not run
+				if c.failFast.Aborted() {
+					continue
+				}
+				c.counters.jobStarted()
+				err := job.Run()
+				c.counters.jobFinished(err, job.Stats())
+				c.failFast.Record(err)
+				if !c.verifying && c.retentionEnabled() {
+					c.retainedRepos.Record(job.Target)
+				}
+				if !c.verifying && err == nil && !job.Stats().Skipped {
+					c.checkGHCRVisibility(job.Target)
+				}
+				if err == nil && c.rewriteMap != nil {
+					c.rewriteMap.RecordJob(job, c.jobOptions.DiffOnly)
+				}
+				if err == nil && c.digestLock != nil && !c.verifying {
+					c.digestLock.RecordJob(job)
+				}
+				if c.verifying {
+					c.verifyReport.RecordJob(job)
+				} else if c.report != nil {
+					c.report.RecordJob(job, err)
+				}
+				if err != nil {
+					if transfer.IsRetryableError(err) {
+						c.PutAFailedJob(job)
+					} else {
+						c.PutAPermanentFailure(job.Source.GetRegistry()+"/"+job.Source.GetRepository()+":"+
+							job.Source.GetTag(), err)
+						c.mirroredRepos.MarkFailed(job.Target.GetRegistry() + "/" + job.Target.GetRepository())
+					}
 				}
 			}
 		}()
@@ -403,73 +1501,143 @@ func (c *Client) PutURLPairs(urlPairs []*URLPair) {
 
 	if c.urlPairList != nil {
 		for _, urlPair := range urlPairs {
+			// the duplicate pairs and the pairs from an image to itself are skipped
+			if c.urlPairSet != nil && !c.urlPairSet.add(urlPair) {
+				continue
+			}
 			c.urlPairList.PushBack(urlPair)
 		}
 	}
 
 }
 
-// GetJob return a transfer.Job struct if the job list is not empty
-func (c *Client) GetJob() (*transfer.Job, bool) {
-	c.jobListMutex.Lock()
-	defer func() {
-		c.jobListMutex.Unlock()
-	}()
-
-	job := c.jobList.Front()
-	if job == nil {
-		return nil, true
-	}
-	c.jobList.Remove(job)
-
-	return job.Value.(*transfer.Job), false
-}
-
-// PutJob puts a transfer.Job struct to job list
-func (c *Client) PutJob(job *transfer.Job) {
-	c.jobListMutex.Lock()
-	defer func() {
-		c.jobListMutex.Unlock()
-	}()
-
-	if c.jobList != nil {
-		c.jobList.PushBack(job)
-	}
-}
-
 // GenerateTransferJob creates transfer jobs from source and target url,
 // return URLPair array if there are more than one tags
-func (c *Client) GenerateTransferJob(jobListChan chan *transfer.Job, source string, target string) ([]*URLPair, error) {
+func (c *Client) GenerateTransferJob(jobListChan chan *transfer.Job, source string, target string,
+	rule *configs.Rule) ([]*URLPair, error) {
 	if source == "" {
-		return nil, fmt.Errorf("source url should not be empty")
+		return nil, transfer.NewPermanentError(fmt.Errorf("source url should not be empty"))
 	}
 
+	// a source without registry host is pulled from the default source registry
+	source = utils.AddDefaultRegistry(source, c.config.FlagConf.Config.DefaultSourceRegistry)
+	if registry, namespace, ok := utils.SplitWildcardRepo(source); ok {
+		return c.expandWildcardRepo(registry, namespace, target, rule)
+	}
 	sourceURL, err := utils.NewRepoURL(source)
 	if err != nil {
-		return nil, fmt.Errorf("url %s format error: %v", source, err)
+		return nil, transfer.NewPermanentError(fmt.Errorf("url %s format error: %v", source, err))
+	}
+
+	// the rewrite rules map the full source references to the targets which are not specific, the first
+	// matched rule wins
+	if target == "" {
+		target = c.rewriteTarget(source)
+	}
+
+	// targetTemplate renders the targets which are not specific before the default registry and namespace
+	if target == "" && c.config.FlagConf.Config.TargetTemplate != "" {
+		target = utils.CompleteTargetTemplate(c.config.FlagConf.Config.TargetTemplate)
+	}
+	if utils.IsTargetTemplate(target) {
+		urlPairs, rendered, err := c.renderTargetTemplate(jobListChan, source, target, sourceURL, rule)
+		if err != nil || rendered == "" {
+			return urlPairs, err
+		}
+		target = rendered
 	}
 
 	// if dest is not specific, use default registry and namespace
 	if target == "" {
 		if c.config.FlagConf.Config.DefaultRegistry != "" && c.config.FlagConf.Config.DefaultNamespace != "" {
-			target = c.config.FlagConf.Config.DefaultRegistry + "/" +
-				c.config.FlagConf.Config.DefaultNamespace + "/" + sourceURL.GetRepoWithTag()
+			if target, err = c.defaultTarget(sourceURL, rule); err != nil {
+				return nil, transfer.NewPermanentError(err)
+			}
 		} else {
-			return nil, fmt.Errorf("the default registry and namespace should not be nil if you want to use them")
+			return nil, transfer.NewPermanentError(
+				fmt.Errorf("the default registry and namespace should not be nil if you want to use them"))
 		}
 	}
 
 	targetURL, err := utils.NewRepoURL(target)
 	if err != nil {
-		return nil, fmt.Errorf("url %s format error: %v", target, err)
+		return nil, transfer.NewPermanentError(fmt.Errorf("url %s format error: %v", target, err))
+	}
+
+	if c.config.FlagConf.Config.LowercaseTarget {
+		targetURL = targetURL.ToLower()
+	}
+
+	// use the tags listed in the rule instead of listing all tags of the source
+	if ruleTags := rule.GetTags(); len(ruleTags) > 0 && sourceURL.GetReference() == "" && !sourceURL.IsArchive() {
+		if targetURL.GetTag() != "" {
+			return nil, transfer.NewPermanentError(fmt.Errorf("tags of the rule should not be used with "+
+				"a tag in the target url: %s:%s", sourceURL.GetURL(), targetURL.GetURL()))
+		}
+		if targetURL.IsArchive() && len(ruleTags) > 1 {
+			return nil, transfer.NewPermanentError(fmt.Errorf("archive target %s can only hold one image, "+
+				"a single tag should be listed in the rule: %v", targetURL.GetURL(), ruleTags))
+		}
+
+		if c.config.FlagConf.Config.SkipMissingTags {
+			ruleTags = c.existingTags(sourceURL, ruleTags)
+		}
+
+		// the tags mapped by the rule are renamed at the target
+		var urlPairs = []*URLPair{}
+		for _, tag := range ruleTags {
+			urlPairs = append(urlPairs, &URLPair{
+				source: sourceURL.GetURL() + ":" + tag,
+				target: targetURL.GetURL() + ":" + rule.TargetTag(tag),
+				rule:   rule,
+			})
+		}
+
+		return urlPairs, nil
+	}
+
+	// an archive holds only one image, multi-tags or all tags of a repo can not be written to it
+	if targetURL.IsArchive() {
+		if strings.Contains(sourceURL.GetTag(), ",") || (sourceURL.GetReference() == "" && !sourceURL.IsArchive()) {
+			return nil, transfer.NewPermanentError(fmt.Errorf("archive target %s can only hold one image, "+
+				"a single source tag should be specified: %s", targetURL.GetURL(), sourceURL.GetURL()))
+		}
+	}
+
+	// only the latest tag of a repo is transferred, the repo is skipped with a warning if it has no latest tag
+	if c.config.FlagConf.Config.LatestOnly && sourceURL.GetReference() == "" && targetURL.GetTag() == "" &&
+		!sourceURL.IsArchive() {
+		var urlPairs = []*URLPair{}
+		for _, tag := range c.existingTags(sourceURL, []string{latestTag}) {
+			urlPairs = append(urlPairs, &URLPair{
+				source: sourceURL.GetURL() + ":" + tag,
+				target: targetURL.GetURL() + ":" + tag,
+				rule:   rule,
+			})
+		}
+		return urlPairs, nil
+	}
+
+	// use the default tag instead of listing all tags if neither side has a tag
+	defaultTag := c.config.FlagConf.Config.DefaultTag
+	if defaultTag != "" && sourceURL.GetReference() == "" && targetURL.GetTag() == "" && !sourceURL.IsArchive() {
+		return []*URLPair{{
+			source: sourceURL.GetURL() + ":" + defaultTag,
+			target: targetURL.GetURL() + ":" + defaultTag,
+			rule:   rule,
+		}}, nil
 	}
 
 	// multi-tags config
 	tags := sourceURL.GetTag()
 	if moreTag := strings.Split(tags, ","); len(moreTag) > 1 {
 		if targetURL.GetTag() != "" && targetURL.GetTag() != sourceURL.GetTag() {
-			return nil, fmt.Errorf("multi-tags source should not correspond to a target with tag: %s:%s",
-				sourceURL.GetURL(), targetURL.GetURL())
+			return nil, transfer.NewPermanentError(fmt.Errorf("multi-tags source should not correspond "+
+				"to a target with tag: %s:%s", sourceURL.GetURL(), targetURL.GetURL()))
+		}
+
+		if c.config.FlagConf.Config.SkipMissingTags {
+			moreTag = c.existingTags(sourceURL, moreTag)
 		}
 
 		// contains more than one tag
@@ -478,6 +1646,7 @@ func (c *Client) GenerateTransferJob(jobListChan chan *transfer.Job, source stri
 			urlPairs = append(urlPairs, &URLPair{
 				source: sourceURL.GetURLWithoutTag() + ":" + t,
 				target: targetURL.GetURLWithoutTag() + ":" + t,
+				rule:   rule,
 			})
 		}
 
@@ -487,35 +1656,50 @@ func (c *Client) GenerateTransferJob(jobListChan chan *transfer.Job, source stri
 	var imageSource *transfer.ImageSource
 	var imageTarget *transfer.ImageTarget
 
-	if security, exist := c.config.GetSecuritySpecific(sourceURL.GetRegistry(), sourceURL.GetNamespace()); exist {
-		log.Infof("Find auth information for %v, username: %v", sourceURL.GetURL(), security.Username)
-		imageSource, err = transfer.NewImageSource(sourceURL.GetRegistry(), sourceURL.GetRepoWithNamespace(),
-			sourceURL.GetTag(), security.Username, security.Password, security.Insecure)
-		if err != nil {
-			return nil, fmt.Errorf("generate %s image source error: %v", sourceURL.GetURL(), err)
-		}
-	} else {
-		log.Infof("Cannot find auth information for %v, pull actions will be anonymous", sourceURL.GetURL())
-		imageSource, err = transfer.NewImageSource(sourceURL.GetRegistry(), sourceURL.GetRepoWithNamespace(),
-			sourceURL.GetTag(), "", "", false)
-		if err != nil {
-			return nil, fmt.Errorf("generate %s image source error: %v", sourceURL.GetURL(), err)
-		}
+	imageSource, err = c.newImageSource(sourceURL, rule.GetSourceAuth())
+	if err != nil {
+		return nil, err
 	}
 
-	// if tag is not specific, return tags
-	if sourceURL.GetTag() == "" {
+	// if tag is not specific, return tags, an archive holds only one image and has no tags
+	if sourceURL.GetReference() == "" && !sourceURL.IsArchive() {
 		if targetURL.GetTag() != "" {
-			return nil, fmt.Errorf("tag should be included both side of the config: %s:%s",
-				sourceURL.GetURL(), targetURL.GetURL())
+			return nil, transfer.NewPermanentError(fmt.Errorf("tag should be included both side of the config: %s:%s",
+				sourceURL.GetURL(), targetURL.GetURL()))
 		}
 
 		// get all tags of this source repo
-		tags, err := imageSource.GetSourceRepoTags()
+		var tags []string
+		imageSource, tags, err = c.getSourceRepoTags(sourceURL, imageSource, rule.GetSourceAuth())
 		if err != nil {
 			return nil, fmt.Errorf("get tags failed from %s error: %v", sourceURL.GetURL(), err)
 		}
-		log.Infof("Get tags of %s successfully: %v", sourceURL.GetURL(), tags)
+		if c.config.FlagConf.Config.Deterministic {
+			sort.Strings(tags)
+		}
+		log.Debugf("Get tags of %s successfully: %v", sourceURL.GetURL(), tags)
+
+		if constraint := rule.SemverConstraint(); constraint != nil {
+			tags = c.FilterSemverTags(tags, constraint)
+			log.Infof("Tags of %s matched by semver %s: %v", sourceURL.GetURL(), constraint, tags)
+		}
+
+		if filtered := rule.FilterTags(tags); len(filtered) != len(tags) {
+			tags = filtered
+			log.Infof("Tags of %s matched by includeTags and excludeTags of the rule: %v", sourceURL.GetURL(), tags)
+		}
+
+		// only keep the newest tags
+		if maxTags := c.config.FlagConf.Config.MaxTagsPerRepo; maxTags > 0 && len(tags) > maxTags {
+			tags = imageSource.SortTags(tags, c.config.FlagConf.Config.TagSortOrder)[:maxTags]
+			log.Infof("Keep the newest %v tags of %s by %s order: %v", maxTags, sourceURL.GetURL(),
+				c.config.FlagConf.Config.TagSortOrder, tags)
+		}
+
+		// the target tags which are not in tags are deleted after all of them are synced
+		if c.config.FlagConf.Config.DeleteExtraneous && !c.verifying && !targetURL.IsLocal() {
+			c.mirroredRepos.Record(targetURL, tags)
+		}
 
 		// generate url pairs for tags
 		var urlPairs = []*URLPair{}
@@ -523,6 +1707,7 @@ func (c *Client) GenerateTransferJob(jobListChan chan *transfer.Job, source stri
 			urlPairs = append(urlPairs, &URLPair{
 				source: sourceURL.GetURL() + ":" + tag,
 				target: targetURL.GetURL() + ":" + tag,
+				rule:   rule,
 			})
 		}
 		return urlPairs, nil
@@ -534,13 +1719,44 @@ func (c *Client) GenerateTransferJob(jobListChan chan *transfer.Job, source stri
 		destTag = sourceURL.GetTag()
 	}
 
-	if security, exist := c.config.GetSecuritySpecific(targetURL.GetRegistry(), targetURL.GetNamespace()); exist {
-		log.Infof("Find auth information for %v, username: %v", targetURL.GetURL(), security.Username)
+	if destTag == "" && sourceURL.GetDigest() != "" && !targetURL.IsArchive() {
+		return nil, transfer.NewPermanentError(fmt.Errorf("tag should be included in the target "+
+			"when source is pulled by digest: %s:%s", sourceURL.GetURL(), targetURL.GetURL()))
+	}
+
+	if destTag == "" && sourceURL.IsArchive() && !targetURL.IsLocal() {
+		return nil, transfer.NewPermanentError(fmt.Errorf("tag should be included in the target "+
+			"when source is an archive: %s:%s", sourceURL.GetURL(), targetURL.GetURL()))
+	}
+
+	if targetURL.IsLocal() {
+		// local image needs no auth information
+		// a docker archive saves the name of source image
+		var image string
+		if !sourceURL.IsLocal() && sourceURL.GetTag() != "" {
+			image = sourceURL.GetURLWithoutTag() + ":" + sourceURL.GetTag()
+		}
+		imageTarget, err = transfer.NewLocalImageTarget(targetURL.GetTransport(), targetURL.GetPath(), destTag, image)
+		if err != nil {
+			return nil, fmt.Errorf("generate %s image target error: %v", targetURL.GetURL(), err)
+		}
+	} else if security, exist := c.targetSecurity(targetURL, rule.GetTargetAuth()); exist {
+		log.Infof("Find auth information for %v, username: %v", targetURL.GetURL(), security.LogUsername())
 		imageTarget, err = transfer.NewImageTarget(targetURL.GetRegistry(), targetURL.GetRepoWithNamespace(),
 			destTag, security.Username, security.Password, security.Insecure)
 		if err != nil {
 			return nil, fmt.Errorf("generate %s image target error: %v", sourceURL.GetURL(), err)
 		}
+	} else if security, exist, err := c.config.PromptSecurity(targetURL.GetRegistry()); err != nil {
+		return nil, transfer.NewPermanentError(err)
+	} else if exist {
+		log.Infof("Use the prompted auth information for %v, username: %v", targetURL.GetURL(),
+			security.LogUsername())
+		imageTarget, err = transfer.NewImageTarget(targetURL.GetRegistry(), targetURL.GetRepoWithNamespace(),
+			destTag, security.Username, security.Password, false)
+		if err != nil {
+			return nil, fmt.Errorf("generate %s image target error: %v", targetURL.GetURL(), err)
+		}
 	} else {
 		log.Infof("Cannot find auth information for %v, push actions will be anonymous", targetURL.GetURL())
 		imageTarget, err = transfer.NewImageTarget(targetURL.GetRegistry(),
@@ -550,12 +1766,422 @@ func (c *Client) GenerateTransferJob(jobListChan chan *transfer.Job, source stri
 		}
 	}
 
-	jobListChan <- transfer.NewJob(imageSource, imageTarget)
+	if err := c.EnsureTargetRepo(targetURL); err != nil {
+		return nil, fmt.Errorf("ensure target repository %s error: %v", targetURL.GetURLWithoutTag(), err)
+	}
+
+	job := transfer.NewJob(imageSource, imageTarget, c.ruleJobOptions(rule))
+	job.Rule = rule.GetSource()
+	jobListChan <- job
+	atomic.AddInt64(&c.counters.generated, 1)
 
-	log.Infof("Generate a job for %s to %s", sourceURL.GetURL(), targetURL.GetURL())
+	log.Debugf("Generate a job for %s to %s", sourceURL.GetURL(), targetURL.GetURL())
 	return nil, nil
 }
 
+// renderTargetTemplate renders the target template of the rule of source for sourceURL. A template whose
+// tag part is not the source tag as is can only be rendered for a single tag, the source without a single
+// tag is expanded to the url pairs of its tags which are rendered and returned instead of the target
+func (c *Client) renderTargetTemplate(jobListChan chan *transfer.Job, source, target string,
+	sourceURL *utils.RepoURL, rule *configs.Rule) ([]*URLPair, string, error) {
+	template, err := utils.ParseTargetTemplate(target)
+	if err != nil {
+		return nil, "", transfer.NewPermanentError(fmt.Errorf("target template of rule %s error: %v", source, err))
+	}
+
+	tag := sourceURL.GetTag()
+	if (tag != "" && !strings.Contains(tag, ",")) || !template.HasTag() || template.HasSourceTag() {
+		// the tags are appended to the rendered repository like a target without tag
+		render := template.Render
+		if tag == "" || strings.Contains(tag, ",") {
+			render = template.RenderRepository
+		}
+		rendered, err := render(sourceURL)
+		if err != nil {
+			return nil, "", transfer.NewPermanentError(fmt.Errorf("target template of rule %s error: %v",
+				source, err))
+		}
+		return nil, rendered, nil
+	}
+	if sourceURL.IsLocal() || sourceURL.GetDigest() != "" {
+		return nil, "", transfer.NewPermanentError(fmt.Errorf("target template %s of rule %s has a tag part, "+
+			"the source should have a tag", template, source))
+	}
+	// the target tags differ from the source tags which deleteExtraneous compares with
+	if c.config.FlagConf.Config.DeleteExtraneous {
+		return nil, "", transfer.NewPermanentError(fmt.Errorf("target template %s of rule %s renders the tags, "+
+			"it should not be used with deleteExtraneous", template, source))
+	}
+
+	repository, err := template.RenderRepository(sourceURL)
+	if err != nil {
+		return nil, "", transfer.NewPermanentError(fmt.Errorf("target template of rule %s error: %v", source, err))
+	}
+	urlPairs, err := c.GenerateTransferJob(jobListChan, source, repository, rule)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, urlPair := range urlPairs {
+		tagURL, err := utils.NewRepoURL(urlPair.source)
+		if err != nil {
+			return nil, "", transfer.NewPermanentError(fmt.Errorf("url %s format error: %v", urlPair.source, err))
+		}
+		if urlPair.target, err = template.Render(tagURL); err != nil {
+			return nil, "", transfer.NewPermanentError(fmt.Errorf("target template of rule %s error: %v",
+				source, err))
+		}
+	}
+	return urlPairs, "", nil
+}
+
+// ruleJobOptions returns the job options of a rule, the platforms and ifExists of the rule
+// override the flags. The ifExists of the rule is ignored by verify and diff
+func (c *Client) ruleJobOptions(rule *configs.Rule) *transfer.JobOptions {
+	platforms, ifExists := rule.GetPlatforms(), rule.GetIfExists()
+	if c.verifying || c.jobOptions.DiffOnly {
+		ifExists = ""
+	}
+	if len(platforms) == 0 && ifExists == "" {
+		return c.jobOptions
+	}
+
+	jobOptions := *c.jobOptions
+	if len(platforms) > 0 {
+		jobOptions.Platforms = platforms
+	}
+	if ifExists != "" {
+		jobOptions.IfExists = ifExists
+	}
+	return &jobOptions
+}
+
+// targetSecurity returns the auth information of the target, the security key of the rule is used
+// if authProfile is set, otherwise it is matched by registry and repository
+func (c *Client) targetSecurity(targetURL *utils.RepoURL, authProfile string) (configs.Security, bool) {
+	if authProfile != "" {
+		return c.config.GetSecurityProfile(authProfile, targetURL.GetRegistry())
+	}
+	return c.config.GetSecuritySpecific(targetURL.GetRegistry(), targetURL.GetRepoWithNamespace())
+}
+
+// newTCRAPIClient creates a tcr api client with the endpoint given by flags
+func (c *Client) newTCRAPIClient() *tcrapis.TCRAPIClient {
+	return tcrapis.NewTCRAPIClient().WithEndpoint(c.config.FlagConf.Config.TCRAPIEndpoint, c.apiTransport)
+}
+
+// newCCRAPIClient creates a ccr api client with the endpoint given by flags
+func (c *Client) newCCRAPIClient() *ccrapis.CCRAPIClient {
+	return ccrapis.NewCCRAPIClient().WithEndpoint(c.config.FlagConf.Config.CCRAPIEndpoint, c.apiTransport)
+}
+
+// NewImageSource creates the image source of a url, the images of a registry are pulled from
+// its mirror in sourceRegistryMirror, and from the registry if the mirror misses and fallback is enabled
+func (c *Client) NewImageSource(sourceURL *utils.RepoURL) (*transfer.ImageSource, error) {
+	return c.newImageSource(sourceURL, "")
+}
+
+// newImageSource creates the image source of a url like NewImageSource, the security key authProfile
+// of a rule is used if it is set
+func (c *Client) newImageSource(sourceURL *utils.RepoURL, authProfile string) (*transfer.ImageSource, error) {
+	if sourceURL.IsLocal() {
+		// local image needs no auth information
+		imageSource, err := transfer.NewLocalImageSource(sourceURL.GetTransport(), sourceURL.GetPath(), sourceURL.GetTag())
+		if err != nil {
+			return nil, fmt.Errorf("generate %s image source error: %v", sourceURL.GetURL(), err)
+		}
+		return imageSource, nil
+	}
+
+	mirror, ok := c.config.FlagConf.Config.SourceRegistryMirror[sourceURL.GetRegistry()]
+	if !ok {
+		return c.newRegistryImageSource(sourceURL, sourceURL.GetRegistry(), authProfile)
+	}
+
+	imageSource, err := c.newRegistryImageSource(sourceURL, mirror, authProfile)
+	if err != nil && c.config.FlagConf.Config.SourceMirrorFallback {
+		log.Warnf("Pull %s from mirror %s error, fall back to origin: %v", sourceURL.GetURL(), mirror, err)
+		return c.newRegistryImageSource(sourceURL, sourceURL.GetRegistry(), authProfile)
+	}
+	return imageSource, err
+}
+
+// newRegistryImageSource creates the image source of a registry url which pulls images from mirror,
+// the auth information of mirror is used, or the security key authProfile if it is set
+func (c *Client) newRegistryImageSource(sourceURL *utils.RepoURL, mirror,
+	authProfile string) (*transfer.ImageSource, error) {
+	var imageSource *transfer.ImageSource
+	var err error
+
+	security, exist := c.config.GetSecuritySpecific(mirror, sourceURL.GetRepoWithNamespace())
+	if authProfile != "" {
+		security, exist = c.config.GetSecurityProfile(authProfile, mirror)
+	}
+	if exist {
+		log.Infof("Find auth information for %v, username: %v", sourceURL.GetURL(), security.LogUsername())
+		imageSource, err = transfer.NewMirroredImageSource(sourceURL.GetRegistry(), mirror,
+			sourceURL.GetRepoWithNamespace(), sourceURL.GetReference(), security.Username, security.Password, security.Insecure)
+		if transfer.IsUnauthorizedError(err) {
+			// the credential in a secret backend may have rotated, query it again and retry once
+			if refreshed, changed, refreshErr := c.config.RefreshSecurity(security); refreshErr != nil {
+				log.Warnf("Refresh auth information for %v error: %v", sourceURL.GetURL(), refreshErr)
+			} else if changed {
+				imageSource, err = transfer.NewMirroredImageSource(sourceURL.GetRegistry(), mirror,
+					sourceURL.GetRepoWithNamespace(), sourceURL.GetReference(), refreshed.Username,
+					refreshed.Password, refreshed.Insecure)
+			}
+		}
+	} else {
+		log.Infof("Cannot find auth information for %v, pull actions will be anonymous", sourceURL.GetURL())
+		imageSource, err = transfer.NewMirroredImageSource(sourceURL.GetRegistry(), mirror,
+			sourceURL.GetRepoWithNamespace(), sourceURL.GetReference(), "", "", false)
+		if transfer.IsUnauthorizedError(err) {
+			imageSource, err = c.newDefaultAuthImageSource(sourceURL, mirror, err)
+		} else if err == nil && sourceURL.GetReference() != "" {
+			log.Infof("Pull %s anonymously", sourceURL.GetURL())
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("generate %s image source error: %v", sourceURL.GetURL(), err)
+	}
+
+	if mirror != sourceURL.GetRegistry() {
+		log.Debugf("Pull %s from mirror %s", sourceURL.GetURL(), mirror)
+	}
+	return imageSource, nil
+}
+
+// refreshAuth returns the AuthRefresher of jobs which queries the auth information of the security
+// file or the docker config file again
+func refreshAuth(clientConfig *configs.Configs) transfer.AuthRefresher {
+	return func(registry, repository string) (string, string, error) {
+		security, err := clientConfig.RefreshAuth(registry, repository)
+		if err != nil {
+			return "", "", err
+		}
+		return security.Username, security.Password, nil
+	}
+}
+
+// newDefaultAuthImageSource creates the image source of a registry url with the default auth information
+// after an anonymous pull is unauthorized, the auth information is prompted if there is no default one
+// and promptCredentials is true, otherwise anonymousErr is returned
+func (c *Client) newDefaultAuthImageSource(sourceURL *utils.RepoURL, mirror string,
+	anonymousErr error) (*transfer.ImageSource, error) {
+	authName := "the default auth information"
+	security, exist := c.config.GetDefaultSecurity()
+	if !exist {
+		var err error
+		if security, exist, err = c.config.PromptSecurity(mirror); err != nil {
+			return nil, transfer.NewPermanentError(fmt.Errorf("anonymous pull error: %v, %v", anonymousErr, err))
+		} else if !exist {
+			return nil, anonymousErr
+		}
+		authName = "the prompted auth information"
+	}
+
+	log.Infof("Anonymous pull of %s is unauthorized, retry with %s, username: %v: %v",
+		sourceURL.GetURL(), authName, security.LogUsername(), anonymousErr)
+	imageSource, err := transfer.NewMirroredImageSource(sourceURL.GetRegistry(), mirror,
+		sourceURL.GetRepoWithNamespace(), sourceURL.GetReference(), security.Username, security.Password, security.Insecure)
+	if err != nil {
+		return nil, fmt.Errorf("anonymous pull error: %v, pull with %s error: %v",
+			anonymousErr, authName, err)
+	}
+	if sourceURL.GetReference() != "" {
+		log.Infof("Pull %s with %s", sourceURL.GetURL(), authName)
+	}
+	return imageSource, nil
+}
+
+// getSourceRepoTags lists all tags of the source repo, the origin registry is tried if the mirror fails
+// with sourceMirrorFallback, and the default auth information is tried if the anonymous access is denied.
+// The image source which listed the tags is returned, authProfile is the security key of the rule
+func (c *Client) getSourceRepoTags(sourceURL *utils.RepoURL, imageSource *transfer.ImageSource,
+	authProfile string) (*transfer.ImageSource, []string, error) {
+	tags, err := imageSource.GetSourceRepoTags(c.config.FlagConf.Config.ListTimeout)
+	if err != nil && imageSource.IsMirrored() && c.config.FlagConf.Config.SourceMirrorFallback {
+		log.Warnf("Get tags from mirror of %s error, fall back to origin: %v", sourceURL.GetURL(), err)
+		if imageSource, err = c.newRegistryImageSource(sourceURL, sourceURL.GetRegistry(), authProfile); err == nil {
+			tags, err = imageSource.GetSourceRepoTags(c.config.FlagConf.Config.ListTimeout)
+		}
+	}
+	if err != nil && imageSource.IsAnonymous() && transfer.IsUnauthorizedError(err) {
+		if imageSource, err = c.newDefaultAuthImageSource(sourceURL, imageSource.GetMirror(), err); err == nil {
+			tags, err = imageSource.GetSourceRepoTags(c.config.FlagConf.Config.ListTimeout)
+			if err == nil {
+				log.Infof("Get tags of %s with the default auth information", sourceURL.GetURL())
+			}
+		}
+	}
+	return imageSource, tags, err
+}
+
+// expandWildcardRepo lists the repositories under a namespace of the source registry by the catalog api
+// for a rule like registry/namespace/*, or all repositories for registry/*, and generates a url pair for
+// every repository which passes the catalog filters, the repositories are mapped under the namespace of
+// the target like registry/namespace/*
+func (c *Client) expandWildcardRepo(registry, namespace, target string, rule *configs.Rule) ([]*URLPair, error) {
+	// a registry/* rule lists the full catalog of the registry
+	source, prefix := registry+"/*", ""
+	if namespace != "" {
+		source, prefix = registry+"/"+namespace+"/*", namespace+"/"
+	}
+	// a target template is rendered for every listed repository
+	var targetRegistry, targetNamespace string
+	var wildcardRewrite utils.RepoRewrite
+	if target != "" && !utils.IsTargetTemplate(target) {
+		var ok bool
+		if targetRegistry, targetNamespace, wildcardRewrite, ok = utils.SplitWildcardTarget(target); !ok {
+			return nil, transfer.NewPermanentError(fmt.Errorf("target of %s should be like registry/namespace/* "+
+				"or registry/namespace/prefix-*, got %s", source, target))
+		}
+	}
+	// the prefix and suffix around the * of the target are added after the repo rewrite
+	rewrite := append(append(utils.RepoRewrite{}, c.repoRewrite(rule)...), wildcardRewrite...)
+
+	security, _ := c.config.GetSecuritySpecific(registry, namespace)
+	repositories, err := transfer.ListCatalog(registry, prefix, security.Username, security.Password,
+		security.Insecure, c.config.FlagConf.Config.MaxCatalogRepos)
+	if err == transfer.ErrCatalogUnsupported {
+		return nil, transfer.NewPermanentError(fmt.Errorf("%s does not expose the _catalog api to the auth "+
+			"information, list the repositories of %s in rules instead", registry, source))
+	} else if err == transfer.ErrCatalogLimitExceeded {
+		return nil, transfer.NewPermanentError(fmt.Errorf("more than %v repositories are listed for %s, "+
+			"narrow it with catalogRepoInclude or raise maxCatalogRepos", c.config.FlagConf.Config.MaxCatalogRepos,
+			source))
+	} else if err != nil {
+		return nil, fmt.Errorf("list repositories of %s error: %v", source, err)
+	}
+
+	var urlPairs = []*URLPair{}
+	filtered := 0
+	for _, repository := range repositories {
+		if !c.config.CatalogRepoFilter.Match(repository) {
+			filtered++
+			continue
+		}
+		// the default registry and namespace are used if target is empty
+		repoTarget := target
+		if target != "" && !utils.IsTargetTemplate(target) {
+			repo, err := rewrite.Apply(strings.TrimPrefix(repository, prefix))
+			if err != nil {
+				log.Errorf("Rewrite target of %s/%s error: %v", registry, repository, err)
+				c.PutAPermanentFailure(registry+"/"+repository+": "+target, err)
+				continue
+			}
+			repoTarget = targetRegistry + "/" + strings.TrimPrefix(targetNamespace+"/", "/") + repo
+		}
+		urlPairs = append(urlPairs, &URLPair{
+			source: registry + "/" + repository,
+			target: repoTarget,
+			rule:   rule,
+		})
+	}
+	log.Infof("%v repositories of %s are listed, %v are skipped by filters", len(repositories), source, filtered)
+	return urlPairs, nil
+}
+
+// existingTags keeps the listed tags which exist on the source repository, the missing tags are skipped
+// with a warning. all tags are kept if the tags of the source can not be listed, they fail in their jobs
+func (c *Client) existingTags(sourceURL *utils.RepoURL, tags []string) []string {
+	repoURL, err := utils.NewRepoURL(sourceURL.GetURLWithoutTag())
+	if err != nil {
+		log.Warnf("Check tags of %s error, all listed tags are kept: %v", sourceURL.GetURLWithoutTag(), err)
+		return tags
+	}
+	imageSource, err := c.NewImageSource(repoURL)
+	if err != nil {
+		log.Warnf("Check tags of %s error, all listed tags are kept: %v", repoURL.GetURL(), err)
+		return tags
+	}
+	sourceTags, err := imageSource.GetSourceRepoTags(c.config.FlagConf.Config.ListTimeout)
+	if err != nil {
+		log.Warnf("Check tags of %s error, all listed tags are kept: %v", repoURL.GetURL(), err)
+		return tags
+	}
+
+	exist := make(map[string]bool, len(sourceTags))
+	for _, tag := range sourceTags {
+		exist[tag] = true
+	}
+	var existing, missing []string
+	for _, tag := range tags {
+		if exist[tag] {
+			existing = append(existing, tag)
+		} else {
+			missing = append(missing, tag)
+		}
+	}
+
+	if len(missing) != 0 {
+		log.Warnf("%v listed tags of %s are missing on the source and skipped: %v", len(missing),
+			repoURL.GetURL(), missing)
+		c.missingTagsMutex.Lock()
+		c.missingTags = append(c.missingTags, fmt.Sprintf("%s: %v tags skipped %v", repoURL.GetURL(),
+			len(missing), missing))
+		c.missingTagsMutex.Unlock()
+	}
+	return existing
+}
+
+// FilterSemverTags keeps the tags which satisfy a semver constraint, the tags which are not
+// semantic versions are kept only if keepNonSemverTags is true
+func (c *Client) FilterSemverTags(tags []string, constraint *utils.SemverConstraint) []string {
+	var result []string
+	for _, tag := range tags {
+		v, ok := utils.ParseSemver(tag)
+		if !ok {
+			if c.config.FlagConf.Config.KeepNonSemverTags {
+				result = append(result, tag)
+			}
+			continue
+		}
+		if constraint.Check(v) {
+			result = append(result, tag)
+		}
+	}
+	return result
+}
+
+// EnsureTargetRepo creates the missing target repository before its jobs run, it only works for
+// the registries which need repositories to be created by api, e.g. quay with quayToken configured.
+// An existing repository is left untouched.
+func (c *Client) EnsureTargetRepo(targetURL *utils.RepoURL) error {
+	if !c.config.FlagConf.Config.CreateRepoIfMissing || targetURL.IsLocal() || c.verifying {
+		return nil
+	}
+
+	security, exist := c.config.GetSecuritySpecific(targetURL.GetRegistry(), targetURL.GetRepoWithNamespace())
+	if !exist || security.QuayToken == "" {
+		return nil
+	}
+
+	repo := targetURL.GetURLWithoutTag()
+
+	c.ensuredReposMutex.Lock()
+	ensured := c.ensuredRepos[repo]
+	c.ensuredReposMutex.Unlock()
+	if ensured {
+		return nil
+	}
+
+	quayClient := quayapis.NewQuayAPIClient(targetURL.GetRegistry(), security.QuayToken, security.Insecure)
+	created, err := quayClient.EnsureRepository(targetURL.GetNamespace(), targetURL.GetRepo(),
+		c.config.FlagConf.Config.RepoVisibility)
+	if err != nil {
+		return err
+	}
+	if created {
+		log.Infof("Create quay repository %s with visibility %s", repo, c.config.FlagConf.Config.RepoVisibility)
+	}
+
+	c.ensuredReposMutex.Lock()
+	c.ensuredRepos[repo] = true
+	c.ensuredReposMutex.Unlock()
+
+	return nil
+}
+
 // GetFailedJob gets a failed job from failedJobList
 func (c *Client) GetFailedJob() (*transfer.Job, bool) {
 	c.failedJobListMutex.Lock()
@@ -613,3 +2239,19 @@ func (c *Client) PutAFailedURLPair(failedURLPair *URLPair) {
 	}
 
 }
+
+// PutAPermanentFailure puts a job or url pair which failed for a permanent reason to permanentFailedList
+func (c *Client) PutAPermanentFailure(name string, err error) {
+	c.permanentFailedListMutex.Lock()
+	defer func() {
+		c.permanentFailedListMutex.Unlock()
+	}()
+
+	if c.permanentFailedList != nil {
+		c.permanentFailedList.PushBack(&PermanentFailure{
+			name: name,
+			err:  err,
+		})
+	}
+
+}
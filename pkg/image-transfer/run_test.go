@@ -0,0 +1,455 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/apis/apicall"
+	"tkestack.io/image-transfer/pkg/apis/apitest"
+	"tkestack.io/image-transfer/pkg/image-transfer/options"
+	"tkestack.io/image-transfer/pkg/transfer"
+)
+
+// newTestClient creates a client of the options without starting anything
+func newTestClient(config *options.ConfigOptions) *Client {
+	return &Client{
+		config: &configs.Configs{
+			FlagConf: &options.ClientOptions{Config: config},
+			Secret:   map[string]configs.Secret{"tcr": {SecretID: "id", SecretKey: "key"}},
+		},
+	}
+}
+
+// newPipelineTestClient creates a client of the options which can run rulesHandler, jobsHandler and Retry
+func newPipelineTestClient(config *options.ConfigOptions) *Client {
+	c := newTestClient(config)
+	c.urlPairList = list.New()
+	c.failedJobList = list.New()
+	c.failedJobGenerateList = list.New()
+	c.permanentFailedList = list.New()
+	c.failFast = newFailFast(0, 0)
+	c.jobOptions = &transfer.JobOptions{KnownBlobs: transfer.NewBlobSet(), Context: c.failFast.ctx}
+	c.mirroredRepos = newMirroredRepos()
+	c.counters = &counters{}
+	c.retainedRepos = newRetainedRepos()
+	c.ghcrPackages = newGHCRPackages()
+	return c
+}
+
+// writeOCILayout writes an oci layout directory holding an image of one layer tagged by tags,
+// the digest of the layer is returned
+func writeOCILayout(t *testing.T, tags ...string) (string, digest.Digest) {
+	dir, err := ioutil.TempDir("", "image-transfer-oci")
+	if err != nil {
+		t.Fatalf("create oci layout directory error: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	writeBlob := func(content []byte) imgspecv1.Descriptor {
+		d := digest.FromBytes(content)
+		if err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755); err != nil {
+			t.Fatalf("create blobs directory error: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "blobs", "sha256", d.Hex()), content, 0644); err != nil {
+			t.Fatalf("write blob %s error: %v", d, err)
+		}
+		return imgspecv1.Descriptor{Digest: d, Size: int64(len(content))}
+	}
+	writeJSON := func(v interface{}) []byte {
+		content, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("marshal %T error: %v", v, err)
+		}
+		return content
+	}
+
+	var layer, diff bytes.Buffer
+	tw := tar.NewWriter(&diff)
+	tw.WriteHeader(&tar.Header{Name: "hello", Mode: 0644, Size: 5, ModTime: time.Unix(0, 0)})
+	tw.Write([]byte("hello"))
+	tw.Close()
+	gw := gzip.NewWriter(&layer)
+	gw.Write(diff.Bytes())
+	gw.Close()
+
+	layerDesc := writeBlob(layer.Bytes())
+	layerDesc.MediaType = imgspecv1.MediaTypeImageLayerGzip
+	configDesc := writeBlob(writeJSON(imgspecv1.Image{
+		Architecture: "amd64",
+		OS:           "linux",
+		RootFS:       imgspecv1.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromBytes(diff.Bytes())}},
+	}))
+	configDesc.MediaType = imgspecv1.MediaTypeImageConfig
+	manifest := map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     imgspecv1.MediaTypeImageManifest,
+		"config":        configDesc,
+		"layers":        []imgspecv1.Descriptor{layerDesc},
+	}
+	manifestDesc := writeBlob(writeJSON(manifest))
+	manifestDesc.MediaType = imgspecv1.MediaTypeImageManifest
+
+	var manifests []imgspecv1.Descriptor
+	for _, tag := range tags {
+		desc := manifestDesc
+		desc.Annotations = map[string]string{imgspecv1.AnnotationRefName: tag}
+		manifests = append(manifests, desc)
+	}
+	index := map[string]interface{}{"schemaVersion": 2, "manifests": manifests}
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.json"), writeJSON(index), 0644); err != nil {
+		t.Fatalf("write index.json error: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, imgspecv1.ImageLayoutFile),
+		writeJSON(imgspecv1.ImageLayout{Version: imgspecv1.ImageLayoutVersion}), 0644); err != nil {
+		t.Fatalf("write oci-layout error: %v", err)
+	}
+	return dir, layerDesc.Digest
+}
+
+// fakeTCR is a fake tcr api of the instance test, CreateNamespace answers a namespace by the error
+// codes scripted for its calls in order, the calls after the script succeed
+type fakeTCR struct {
+	namespaces []string
+	mutex      sync.Mutex
+	scripts    map[string][]string
+	creates    map[string]int
+}
+
+// handlers returns the handlers of the actions of the fake tcr api
+func (f *fakeTCR) handlers() map[string]apitest.Handler {
+	return map[string]apitest.Handler{
+		"DescribeInstances": func(map[string]interface{}) interface{} {
+			return map[string]interface{}{
+				"Registries": []map[string]interface{}{{"RegistryId": "tcr-test", "RegistryName": "test"}},
+				"TotalCount": 1,
+			}
+		},
+		"DescribeNamespaces": func(map[string]interface{}) interface{} {
+			var list []map[string]interface{}
+			for _, ns := range f.namespaces {
+				list = append(list, map[string]interface{}{"Name": ns})
+			}
+			return map[string]interface{}{"NamespaceList": list, "TotalCount": len(list)}
+		},
+		"CreateNamespace": func(params map[string]interface{}) interface{} {
+			ns := params["NamespaceName"].(string)
+			f.mutex.Lock()
+			defer f.mutex.Unlock()
+			call := f.creates[ns]
+			f.creates[ns]++
+			if script := f.scripts[ns]; call < len(script) {
+				return apitest.Error(script[call], "scripted failure of "+ns)
+			}
+			return map[string]interface{}{"RequestId": "test"}
+		},
+	}
+}
+
+// newFakeTCRClient starts a fake tcr api with the scripts and creates a client calling it
+func newFakeTCRClient(retryNums int, scripts map[string][]string) (*Client, *fakeTCR, *apitest.FakeAPI) {
+	tcr := &fakeTCR{namespaces: []string{"ns-exist"}, scripts: scripts, creates: make(map[string]int)}
+	api := apitest.NewFakeAPI(tcr.handlers())
+	c := newTestClient(&options.ConfigOptions{TCRAPIEndpoint: api.Endpoint(), RetryNums: retryNums, NsRoutines: 2})
+	c.apiTransport = api.Transport()
+	return c, tcr, api
+}
+
+// withMaxAttempts sets the attempts of an api call so that the namespaces are retried by rounds
+func withMaxAttempts(t *testing.T, attempts int) {
+	maxAttempts := apicall.MaxAttempts
+	apicall.MaxAttempts = attempts
+	t.Cleanup(func() { apicall.MaxAttempts = maxAttempts })
+}
+
+func TestEnsureTcrNsRetry(t *testing.T) {
+	withMaxAttempts(t, 1)
+	c, tcr, api := newFakeTCRClient(3, map[string][]string{
+		"ns-flaky": {"InternalError"},
+		"ns-quota": {"LimitExceeded.NamespaceMaxLimit"},
+	})
+	defer api.Close()
+
+	failed, err := c.EnsureTcrNs(c.newTCRAPIClient(), "ap-guangzhou", "test",
+		[]string{"ns-exist", "ns-ok", "ns-flaky", "Bad_NS", "ns-quota", "ns-flaky"})
+	if err != nil {
+		t.Fatalf("EnsureTcrNs error: %v", err)
+	}
+	// the namespaces failed for permanent reasons are not retried
+	if expected := []string{"Bad_NS", "ns-quota"}; !reflect.DeepEqual(failed, expected) {
+		t.Errorf("EnsureTcrNs failed %v, expected %v", failed, expected)
+	}
+	expected := map[string]int{"ns-ok": 1, "ns-flaky": 2, "ns-quota": 1}
+	if !reflect.DeepEqual(tcr.creates, expected) {
+		t.Errorf("EnsureTcrNs created %v, expected %v", tcr.creates, expected)
+	}
+	// the retry rounds use the cached namespaces instead of listing them again
+	if calls := api.Calls("DescribeNamespaces"); calls != 1 {
+		t.Errorf("EnsureTcrNs listed the namespaces %v times, expected 1", calls)
+	}
+}
+
+func TestEnsureTcrNsThrottled(t *testing.T) {
+	withMaxAttempts(t, 1)
+	c, tcr, api := newFakeTCRClient(1, map[string][]string{
+		"ns-throttled": {"RequestLimitExceeded", "RequestLimitExceeded"},
+	})
+	defer api.Close()
+
+	failed, err := c.EnsureTcrNs(c.newTCRAPIClient(), "ap-guangzhou", "test", []string{"ns-throttled"})
+	if err != nil {
+		t.Fatalf("EnsureTcrNs error: %v", err)
+	}
+	// the throttled namespace is retried retryNums times and still fails
+	if !reflect.DeepEqual(failed, []string{"ns-throttled"}) || tcr.creates["ns-throttled"] != 2 {
+		t.Errorf("EnsureTcrNs failed %v after %v calls, expected ns-throttled after 2", failed,
+			tcr.creates["ns-throttled"])
+	}
+}
+
+func TestEnsureTcrNsThrottledCall(t *testing.T) {
+	// a throttled call is retried by the api call before the retry rounds
+	withMaxAttempts(t, 2)
+	c, tcr, api := newFakeTCRClient(0, map[string][]string{"ns-throttled": {"RequestLimitExceeded"}})
+	defer api.Close()
+
+	failed, err := c.EnsureTcrNs(c.newTCRAPIClient(), "ap-guangzhou", "test", []string{"ns-throttled"})
+	if err != nil || len(failed) != 0 || tcr.creates["ns-throttled"] != 2 {
+		t.Errorf("EnsureTcrNs = %v, %v after %v calls, expected ns-throttled created by the second call",
+			failed, err, tcr.creates["ns-throttled"])
+	}
+}
+
+func TestRetryCreateTcrNsSecretError(t *testing.T) {
+	c, _, api := newFakeTCRClient(1, nil)
+	defer api.Close()
+
+	if _, _, err := c.RetryCreateTcrNs(c.newTCRAPIClient(), []string{"ns-ok"}, nil, "ap-guangzhou",
+		"test"); err == nil {
+		t.Errorf("RetryCreateTcrNs without tcr secret should fail")
+	}
+	if calls := api.Calls("CreateNamespace"); calls != 0 {
+		t.Errorf("RetryCreateTcrNs without tcr secret called CreateNamespace %v times", calls)
+	}
+}
+
+func TestRetryableNs(t *testing.T) {
+	retryList := retryableNs([]string{"a", "b", "a", "c", "b"}, []string{"c"})
+	if expected := []string{"a", "b"}; !reflect.DeepEqual(retryList, expected) {
+		t.Errorf("retryableNs = %v, expected %v", retryList, expected)
+	}
+}
+
+func TestNewJobListChan(t *testing.T) {
+	cases := []struct {
+		routines int
+		size     int
+		capacity int
+	}{
+		{routines: 5, size: 0, capacity: 5},
+		{routines: 5, size: 2, capacity: 2},
+		{routines: 1, size: 50, capacity: 50},
+	}
+	for _, tc := range cases {
+		c := newTestClient(&options.ConfigOptions{RoutineNums: tc.routines, JobBufferSize: tc.size})
+		if capacity := cap(c.newJobListChan()); capacity != tc.capacity {
+			t.Errorf("capacity with routines %d and jobBufferSize %d = %d, expected %d", tc.routines, tc.size,
+				capacity, tc.capacity)
+		}
+	}
+}
+
+func TestRulesHandlerBackpressure(t *testing.T) {
+	tags := []string{"v1", "v2", "v3", "v4", "v5", "v6", "v7", "v8"}
+	source, _ := writeOCILayout(t, tags...)
+	target, err := ioutil.TempDir("", "image-transfer-oci")
+	if err != nil {
+		t.Fatalf("create target directory error: %v", err)
+	}
+	defer os.RemoveAll(target)
+
+	c := newPipelineTestClient(&options.ConfigOptions{RoutineNums: 2, JobBufferSize: 3})
+	for _, tag := range tags {
+		c.PutURLPairs([]*URLPair{{source: "oci:" + source + ":" + tag, target: "oci:" + target + ":" + tag}})
+	}
+	jobListChan := c.newJobListChan()
+	done := make(chan struct{})
+	go func() {
+		c.rulesHandler(jobListChan)
+		close(done)
+	}()
+
+	// nothing receives the jobs, so the generators fill the buffer and block on it
+	for deadline := time.Now().Add(10 * time.Second); len(jobListChan) < cap(jobListChan); {
+		if time.Now().After(deadline) {
+			t.Fatalf("the job buffer is not filled: %d jobs", len(jobListChan))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatalf("rulesHandler returned while the job buffer is full")
+	case <-time.After(200 * time.Millisecond):
+	}
+	// each of the 2 blocked generators holds a job besides the 3 buffered ones
+	c.urlPairListMutex.Lock()
+	left := c.urlPairList.Len()
+	c.urlPairListMutex.Unlock()
+	if len(jobListChan) != 3 || left != len(tags)-3-2 {
+		t.Errorf("%d jobs are buffered and %d url pairs are left, expected 3 and %d", len(jobListChan), left,
+			len(tags)-5)
+	}
+
+	// the generation goes on as the jobs are received
+	var received []string
+	for job := range jobListChan {
+		received = append(received, job.Source.GetTag())
+		job.Source.Close()
+		job.Target.Close()
+	}
+	<-done
+	if len(received) != len(tags) || c.Snapshot().Generated != int64(len(tags)) {
+		t.Errorf("received jobs %v, generated %d, expected all of %v", received, c.Snapshot().Generated, tags)
+	}
+}
+
+// runPipeline generates and runs the jobs of the url pairs put to the client once
+func runPipeline(c *Client) {
+	jobListChan := c.newJobListChan()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.jobsHandler(jobListChan)
+	}()
+	c.rulesHandler(jobListChan)
+	wg.Wait()
+}
+
+// blobPath returns the path of a blob in an oci layout directory
+func blobPath(dir string, d digest.Digest) string {
+	return filepath.Join(dir, "blobs", d.Algorithm().String(), d.Hex())
+}
+
+func TestRetryFlakyJob(t *testing.T) {
+	source, layer := writeOCILayout(t, "v1")
+	target, err := ioutil.TempDir("", "image-transfer-oci")
+	if err != nil {
+		t.Fatalf("create target directory error: %v", err)
+	}
+	defer os.RemoveAll(target)
+
+	// the jobs fail in the first round as the layer can not be read
+	if err := os.Rename(blobPath(source, layer), blobPath(source, layer)+".bak"); err != nil {
+		t.Fatalf("move layer error: %v", err)
+	}
+	c := newPipelineTestClient(&options.ConfigOptions{RoutineNums: 2})
+	c.PutURLPairs([]*URLPair{{source: "oci:" + source, target: "oci:" + target}})
+	runPipeline(c)
+	if c.failedJobList.Len() != 1 || c.failedJobGenerateList.Len() != 0 || c.permanentFailedList.Len() != 0 {
+		t.Fatalf("first round: %d failed jobs, %d failed url pairs, %d permanent failures, expected 1, 0, 0",
+			c.failedJobList.Len(), c.failedJobGenerateList.Len(), c.permanentFailedList.Len())
+	}
+
+	// the job fails again in the first retry
+	c.Retry()
+	if c.failedJobList.Len() != 1 || c.failedJobGenerateList.Len() != 0 {
+		t.Fatalf("first retry: %d failed jobs, %d failed url pairs, expected 1, 0", c.failedJobList.Len(),
+			c.failedJobGenerateList.Len())
+	}
+
+	// the tags can not be listed any more, the failed job is retried without listing them again
+	if err := os.Rename(blobPath(source, layer)+".bak", blobPath(source, layer)); err != nil {
+		t.Fatalf("restore layer error: %v", err)
+	}
+	if err := os.Remove(filepath.Join(source, "index.json")); err != nil {
+		t.Fatalf("remove index.json error: %v", err)
+	}
+	c.Retry()
+
+	if c.failedJobList.Len() != 0 || c.failedJobGenerateList.Len() != 0 || c.permanentFailedList.Len() != 0 {
+		t.Errorf("second retry: %d failed jobs, %d failed url pairs, %d permanent failures, expected none",
+			c.failedJobList.Len(), c.failedJobGenerateList.Len(), c.permanentFailedList.Len())
+	}
+	expected := Counters{Generated: 1, Succeeded: 1, Failed: 2, Retried: 2}
+	if snapshot := c.Snapshot(); snapshot != expected {
+		t.Errorf("Snapshot() = %+v, expected %+v", snapshot, expected)
+	}
+	targetSource, err := transfer.NewLocalImageSource("oci", target, "")
+	if err != nil {
+		t.Fatalf("open target error: %v", err)
+	}
+	if tags, err := targetSource.GetSourceRepoTags(0); err != nil || !reflect.DeepEqual(tags, []string{"v1"}) {
+		t.Errorf("tags of target = %v, %v, expected v1", tags, err)
+	}
+}
+
+func TestRetryPermanentFailure(t *testing.T) {
+	source, _ := writeOCILayout(t, "v1")
+	target, _ := writeOCILayout(t, "v1")
+
+	// the manifest of the source is changed, so its digest is different from the target by ifExists=fail
+	index, err := ioutil.ReadFile(filepath.Join(source, "index.json"))
+	if err != nil {
+		t.Fatalf("read index.json error: %v", err)
+	}
+	var layout imgspecv1.Index
+	if err := json.Unmarshal(index, &layout); err != nil {
+		t.Fatalf("decode index.json error: %v", err)
+	}
+	if err := ioutil.WriteFile(blobPath(source, layout.Manifests[0].Digest),
+		[]byte(`{"schemaVersion": 2, "mediaType": "application/vnd.example.changed"}`), 0644); err != nil {
+		t.Fatalf("write manifest error: %v", err)
+	}
+
+	c := newPipelineTestClient(&options.ConfigOptions{RoutineNums: 2})
+	c.jobOptions.IfExists = transfer.IfExistsFail
+	c.PutURLPairs([]*URLPair{
+		{source: "oci:" + source + ":v1", target: "oci:" + target + ":v1"},
+		{source: "registry.example.com/ns:v1/app", target: "oci:" + target},
+	})
+	runPipeline(c)
+	if c.failedJobList.Len() != 0 || c.failedJobGenerateList.Len() != 0 || c.permanentFailedList.Len() != 2 {
+		t.Fatalf("%d failed jobs, %d failed url pairs, %d permanent failures, expected 0, 0, 2",
+			c.failedJobList.Len(), c.failedJobGenerateList.Len(), c.permanentFailedList.Len())
+	}
+
+	// the permanent failures are not retried
+	c.Retry()
+	expected := Counters{Generated: 1, Failed: 2}
+	if snapshot := c.Snapshot(); snapshot != expected || c.permanentFailedList.Len() != 2 {
+		t.Errorf("Snapshot() = %+v with %d permanent failures after retry, expected %+v with 2", snapshot,
+			c.permanentFailedList.Len(), expected)
+	}
+}
@@ -0,0 +1,248 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/transfer"
+)
+
+// VerifyRecord is the verify result of a target tag
+type VerifyRecord struct {
+	Namespace    string `json:"namespace"`
+	Source       string `json:"source"`
+	Target       string `json:"target"`
+	Status       string `json:"status"`
+	SourceDigest string `json:"sourceDigest"`
+	TargetDigest string `json:"targetDigest"`
+}
+
+// VerifyReport collects the verify results of jobs, the records are grouped by source namespace
+type VerifyReport struct {
+	records map[string]*VerifyRecord
+	mutex   sync.Mutex
+}
+
+// NewVerifyReport creates an empty VerifyReport
+func NewVerifyReport() *VerifyReport {
+	return &VerifyReport{
+		records: make(map[string]*VerifyRecord),
+	}
+}
+
+// RecordJob records the result of a verify job, the jobs which are not verified are ignored
+func (r *VerifyReport) RecordJob(job *transfer.Job) {
+	stats := job.Stats()
+	if stats.Verify == "" {
+		return
+	}
+
+	// a source pulled by digest is registry/repository@sha256:...
+	separator := ":"
+	if _, err := digest.Parse(job.Source.GetTag()); err == nil {
+		separator = "@"
+	}
+	source := job.Source.GetRegistry() + "/" + job.Source.GetRepository() + separator + job.Source.GetTag()
+	target := job.Target.GetRegistry() + "/" + job.Target.GetRepository() + ":" + job.Target.GetTag()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.records[source+"|"+target] = &VerifyRecord{
+		Namespace:    strings.SplitN(job.Source.GetRepository(), "/", 2)[0],
+		Source:       source,
+		Target:       target,
+		Status:       string(stats.Verify),
+		SourceDigest: stats.SourceDigest.String(),
+		TargetDigest: stats.TargetDigest.String(),
+	}
+}
+
+// Records returns the records sorted by namespace and source
+func (r *VerifyReport) Records() []*VerifyRecord {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	records := make([]*VerifyRecord, 0, len(r.records))
+	for _, record := range r.records {
+		copied := *record
+		records = append(records, &copied)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Namespace != records[j].Namespace {
+			return records[i].Namespace < records[j].Namespace
+		}
+		if records[i].Source != records[j].Source {
+			return records[i].Source < records[j].Source
+		}
+		return records[i].Target < records[j].Target
+	})
+	return records
+}
+
+// Summary logs the matched, missing and mismatched counts of every namespace and the targets
+// which are not matched, the number of targets which are not matched is returned
+func (r *VerifyReport) Summary() int {
+	type counts struct {
+		matched, missing, mismatched int
+	}
+
+	var namespaces []string
+	nsCounts := make(map[string]*counts)
+	var unmatched []*VerifyRecord
+	for _, record := range r.Records() {
+		c, ok := nsCounts[record.Namespace]
+		if !ok {
+			c = &counts{}
+			nsCounts[record.Namespace] = c
+			namespaces = append(namespaces, record.Namespace)
+		}
+		switch transfer.VerifyResult(record.Status) {
+		case transfer.VerifyMatched:
+			c.matched++
+		case transfer.VerifyMissing:
+			c.missing++
+			unmatched = append(unmatched, record)
+		case transfer.VerifyMismatched:
+			c.mismatched++
+			unmatched = append(unmatched, record)
+		}
+	}
+
+	log.Summaryf("################# verify results of %v namespaces: #################", len(namespaces))
+	for _, ns := range namespaces {
+		c := nsCounts[ns]
+		log.Summaryf("%s: %v matched, %v missing, %v mismatched", ns, c.matched, c.missing, c.mismatched)
+	}
+	if len(unmatched) != 0 {
+		log.Summaryf("################# %v targets are missing or mismatched: #################", len(unmatched))
+		for _, record := range unmatched {
+			log.Summaryf("%s: %s %s", record.Status, record.Source, record.Target)
+		}
+	}
+
+	return len(unmatched)
+}
+
+// Write writes the report to a json or csv file by the extension of path
+func (r *VerifyReport) Write(path string) error {
+	records := r.Records()
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		data, err := json.MarshalIndent(records, "", "  ")
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(path, data, 0644)
+	case ".csv":
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		writer := csv.NewWriter(file)
+		if err := writer.Write([]string{"namespace", "source", "target", "status", "sourceDigest",
+			"targetDigest"}); err != nil {
+			return err
+		}
+		for _, record := range records {
+			if err := writer.Write([]string{record.Namespace, record.Source, record.Target, record.Status,
+				record.SourceDigest, record.TargetDigest}); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	default:
+		return fmt.Errorf("verify report file %s should be a .json or .csv file", path)
+	}
+}
+
+// Verify compares the targets of url pairs with their sources by manifest digests, the tags of
+// sources are listed as transfer does and the jobs run in the same worker pool. An error is
+// returned if any target is missing or mismatched, or any job failed, unless reportOnly is true
+func (c *Client) Verify(urlPairs []*URLPair) error {
+	// the failures of transfer are not failures of verify
+	c.failedJobList.Init()
+	c.failedJobGenerateList.Init()
+	c.permanentFailedList.Init()
+
+	c.verifying = true
+	c.jobOptions = &transfer.JobOptions{
+		VerifyOnly:         true,
+		CopyTimeout:        c.config.FlagConf.Config.CopyTimeout,
+		TargetManifestType: c.config.FlagConf.Config.TargetManifestType,
+		DropAnnotations:    c.config.FlagConf.Config.DropAnnotationRegexps(),
+		LayerCompression:   c.config.FlagConf.Config.LayerCompression,
+		RecompressedLayers: transfer.NewRecompressedLayers(),
+		Context:            c.failFast.ctx,
+	}
+
+	if !log.Quiet() {
+		fmt.Println("Start to verify targets, please wait ...")
+	}
+	c.runURLPairs(urlPairs)
+
+	c.failFast.Summary()
+	if err := c.failFast.Err(); err != nil {
+		return err
+	}
+
+	unmatched := c.verifyReport.Summary()
+	failed := c.failedJobList.Len() + c.failedJobGenerateList.Len() + c.permanentFailedList.Len()
+	if failed != 0 {
+		log.Summaryf("################# %v targets failed to verify: #################", failed)
+		for e := c.failedJobList.Front(); e != nil; e = e.Next() {
+			job := e.Value.(*transfer.Job)
+			log.Summaryf("%s/%s:%s", job.Source.GetRegistry(), job.Source.GetRepository(), job.Source.GetTag())
+		}
+		for e := c.failedJobGenerateList.Front(); e != nil; e = e.Next() {
+			log.Summaryf("%s: %s", e.Value.(*URLPair).source, e.Value.(*URLPair).target)
+		}
+		for e := c.permanentFailedList.Front(); e != nil; e = e.Next() {
+			log.Summaryf("%s: %v", e.Value.(*PermanentFailure).name, e.Value.(*PermanentFailure).err)
+		}
+	}
+
+	if path := c.config.FlagConf.Config.VerifyReport; path != "" {
+		if err := c.verifyReport.Write(path); err != nil {
+			log.Errorf("Write verify report to %s error: %v", path, err)
+		} else {
+			log.Summaryf("Verify report is written to %s", path)
+		}
+	}
+
+	if (unmatched != 0 || failed != 0) && !c.config.FlagConf.Config.ReportOnly {
+		return fmt.Errorf("verify failed, %v targets are missing or mismatched, %v targets failed to verify",
+			unmatched, failed)
+	}
+	return nil
+}
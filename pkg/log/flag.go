@@ -40,6 +40,10 @@ const (
 	IgnoreCallerFlagName = "log-ignore-caller"
 	// OutputPathsName path name
 	OutputPathsName = "log-output-paths"
+	// QuietFlagName flag name
+	QuietFlagName = "quiet"
+	// LogCredentialsFlagName flag name
+	LogCredentialsFlagName = "log-credentials"
 )
 
 var (
@@ -50,6 +54,9 @@ var (
 	logWithColor    = pflag.Bool(WithColorFlagName, false, "Whether to output colored log")
 	logIgnoreCaller = pflag.Bool(IgnoreCallerFlagName, false, "Ignore the output of caller information in the log")
 	logOutputPaths  = pflag.StringSlice(OutputPathsName, []string{}, "Log output paths, comma separated.")
+	logQuiet        = pflag.Bool(QuietFlagName, false, "Only output warnings, errors and the final summary")
+	logCredentials  = pflag.Bool(LogCredentialsFlagName, false,
+		"Output credentials in plain text for debugging, they are masked by default")
 )
 
 // AddFlags registers this package's flags on arbitrary FlagSets, such that they
@@ -61,19 +68,37 @@ func AddFlags(fs *pflag.FlagSet) {
 	fs.AddFlag(pflag.Lookup(IgnoreCallerFlagName))
 	fs.AddFlag(pflag.Lookup(SamplingFreqFlagName))
 	fs.AddFlag(pflag.Lookup(OutputPathsName))
+	fs.AddFlag(pflag.Lookup(QuietFlagName))
+	fs.AddFlag(pflag.Lookup(LogCredentialsFlagName))
 }
 
-// SetLevel to change the log level flag
+// SetLevel to change the log level flag, Reset should be called to apply it
 func SetLevel(level string) error {
 	lock.Lock()
 	defer lock.Unlock()
+	oldLevel := logLevel
+	logLevel = &level
 	if _, err := parseLevel(); err != nil {
+		logLevel = oldLevel
 		return err
 	}
-	logLevel = &level
 	return nil
 }
 
+// Quiet returns if only warnings, errors and the summary are output
+func Quiet() bool {
+	lock.RLock()
+	defer lock.RUnlock()
+	return *logQuiet
+}
+
+// LogCredentials returns if credentials are output in plain text
+func LogCredentials() bool {
+	lock.RLock()
+	defer lock.RUnlock()
+	return *logCredentials
+}
+
 // Level returns the current log level
 func Level() string {
 	lock.RLock()
@@ -100,7 +125,17 @@ func Format() string {
 }
 
 func mustLevel() zapcore.Level {
-	level := MustParseLevel()
+	// quiet mode raises the level to warn, a higher level is kept
+	if *logQuiet {
+		if lvl := MustParseLevel(); lvl != "DEBUG" && lvl != "INFO" {
+			return levelOf(lvl)
+		}
+		return zapcore.WarnLevel
+	}
+	return levelOf(MustParseLevel())
+}
+
+func levelOf(level string) zapcore.Level {
 	zapLevel := zapcore.InfoLevel
 	if err := zapLevel.UnmarshalText([]byte(level)); err != nil {
 		panic(err)
@@ -131,6 +166,8 @@ func parseLevel() (string, error) {
 	switch *logLevel {
 	case "DEBUG", "debug", "dbg", "DBG":
 		return "DEBUG", nil
+	case "INFO", "info":
+		return "INFO", nil
 	case "WARN", "warn", "warning", "WARNING":
 		return "WARN", nil
 	case "ERROR", "error", "ERR", "err":
@@ -34,6 +34,9 @@ import (
 var (
 	logger *zap.Logger
 	once   sync.Once
+
+	// summaryLogger outputs the summary at info level whatever the log level is
+	summaryLogger *zap.Logger
 )
 
 // InitLogger initializes logger the way we want for tke.
@@ -98,32 +101,32 @@ func StdInfoLogger() *log.Logger {
 
 // Debug method output debug level log.
 func Debug(msg string, fields ...Field) {
-	getLogger().Debug(msg, fields...)
+	getLogger().Debug(redactSecrets(msg), fields...)
 }
 
 // Info method output info level log.
 func Info(msg string, fields ...Field) {
-	getLogger().Info(msg, fields...)
+	getLogger().Info(redactSecrets(msg), fields...)
 }
 
 // Warn method output warning level log.
 func Warn(msg string, fields ...Field) {
-	getLogger().Warn(msg, fields...)
+	getLogger().Warn(redactSecrets(msg), fields...)
 }
 
 // Error method output error level log.
 func Error(msg string, fields ...Field) {
-	getLogger().Error(msg, fields...)
+	getLogger().Error(redactSecrets(msg), fields...)
 }
 
 // Panic method output panic level log and shutdown application.
 func Panic(msg string, fields ...Field) {
-	getLogger().Panic(msg, fields...)
+	getLogger().Panic(redactSecrets(msg), fields...)
 }
 
 // Fatal method output fatal level log.
 func Fatal(msg string, fields ...Field) {
-	getLogger().Fatal(msg, fields...)
+	getLogger().Fatal(redactSecrets(msg), fields...)
 }
 
 // Debugf uses fmt.Sprintf to log a templated message.
@@ -146,6 +149,13 @@ func Errorf(template string, args ...interface{}) {
 	Error(fmt.Sprintf(template, args...))
 }
 
+// Summaryf uses fmt.Sprintf to log a templated message of the summary, it is output
+// even if the log level is higher than info, e.g. in quiet mode.
+func Summaryf(template string, args ...interface{}) {
+	getLogger()
+	summaryLogger.Info(redactSecrets(fmt.Sprintf(template, args...)))
+}
+
 // Panicf uses fmt.Sprintf to log a templated message, then panics.
 func Panicf(template string, args ...interface{}) {
 	Panic(fmt.Sprintf(template, args...))
@@ -206,16 +216,24 @@ func newLogger() *zap.Logger {
 		MaxBackups: 3,
 		MaxAge:     30, // days
 	})
+	writer := zapcore.NewMultiWriteSyncer(zapcore.AddSync(os.Stdout),
+		w)
 	core := zapcore.NewCore(
 		zapcore.NewConsoleEncoder(encoderConfig),
-		zapcore.NewMultiWriteSyncer(zapcore.AddSync(os.Stdout),
-			w),
+		writer,
 		zap.NewAtomicLevelAt(mustLevel()),
 	)
 
 	l := zap.New(core, zap.AddStacktrace(zapcore.PanicLevel),
 		zap.AddCaller(), zap.Development(), zap.AddCallerSkip(2))
 
+	summaryCore := zapcore.NewCore(
+		zapcore.NewConsoleEncoder(encoderConfig),
+		writer,
+		zap.NewAtomicLevelAt(zapcore.InfoLevel),
+	)
+	summaryLogger = zap.New(summaryCore, zap.AddCaller(), zap.AddCallerSkip(1))
+
 	/*l, err := loggerConfig.Build(zap.AddStacktrace(zapcore.PanicLevel),
 		zap.AddCallerSkip(1))
 	if err != nil {
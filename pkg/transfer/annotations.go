@@ -0,0 +1,82 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// DropAnnotations drops the annotations whose keys match any of patterns from an oci manifest or
+// index m of type t, including the annotations of the config, layers and index entries. The instances
+// of an index are got by getInstance, the rewritten instances are returned by their new digests.
+// m is returned as is if no annotation is dropped, so the digest is kept
+func DropAnnotations(m []byte, t string, patterns []*regexp.Regexp,
+	getInstance func(d digest.Digest) ([]byte, string, error)) ([]byte, string, map[digest.Digest][]byte, error) {
+	return rewriteManifest(m, t, getInstance, func(image []byte, imageType string) ([]byte, string, error) {
+		// docker manifests have no annotations
+		if imageType != imgspecv1.MediaTypeImageManifest {
+			return image, imageType, nil
+		}
+
+		var parsed convertImage
+		if err := json.Unmarshal(image, &parsed); err != nil {
+			return nil, "", fmt.Errorf("parse manifest error: %v", err)
+		}
+		dropped := dropMatchedKeys(parsed.Annotations, patterns)
+		dropped = dropMatchedKeys(parsed.Config.Annotations, patterns) || dropped
+		for _, layer := range parsed.Layers {
+			dropped = dropMatchedKeys(layer.Annotations, patterns) || dropped
+		}
+		if !dropped {
+			return image, imageType, nil
+		}
+		rewritten, err := json.Marshal(parsed)
+		if err != nil {
+			return nil, "", err
+		}
+		return rewritten, imageType, nil
+	}, func(index *convertIndex, indexType string) (string, bool, error) {
+		dropped := dropMatchedKeys(index.Annotations, patterns)
+		for _, entry := range index.Manifests {
+			dropped = dropMatchedKeys(entry.Annotations, patterns) || dropped
+		}
+		return indexType, dropped, nil
+	})
+}
+
+// dropMatchedKeys deletes the keys of annotations which match any of patterns, true is returned
+// if any key is deleted
+func dropMatchedKeys(annotations map[string]string, patterns []*regexp.Regexp) bool {
+	dropped := false
+	for key := range annotations {
+		for _, pattern := range patterns {
+			if pattern.MatchString(key) {
+				delete(annotations, key)
+				dropped = true
+				break
+			}
+		}
+	}
+	return dropped
+}
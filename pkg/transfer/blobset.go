@@ -0,0 +1,115 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// BlobSet is a concurrency-safe set of blobs which are known to be present on targets, blobs are keyed
+// by registry and digest with the repositories holding them. A blob of another repository is not present
+// in a repository, but it can be mounted from there by a cross-repository blob mount instead of a push
+type BlobSet struct {
+	// blobs are the repositories holding a blob in the order they are added
+	blobs map[string][]string
+	mutex sync.RWMutex
+}
+
+// NewBlobSet creates an empty BlobSet
+func NewBlobSet() *BlobSet {
+	return &BlobSet{
+		blobs: make(map[string][]string),
+	}
+}
+
+// Contains checks if a blob is known to be present in the target repository
+func (s *BlobSet) Contains(registry, repository string, d digest.Digest) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return indexOf(s.blobs[blobKey(registry, d)], repository) >= 0
+}
+
+// Repository returns a repository of registry which the blob is known to be present in, the repository
+// added first is returned. It is empty if the blob is not known in any repository of registry
+func (s *BlobSet) Repository(registry string, d digest.Digest) string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if repositories := s.blobs[blobKey(registry, d)]; len(repositories) != 0 {
+		return repositories[0]
+	}
+	return ""
+}
+
+// Add records a blob which is present in the target repository
+func (s *BlobSet) Add(registry, repository string, d digest.Digest) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := blobKey(registry, d)
+	if indexOf(s.blobs[key], repository) < 0 {
+		s.blobs[key] = append(s.blobs[key], repository)
+	}
+}
+
+// Remove forgets a blob which is found missing in the target repository
+func (s *BlobSet) Remove(registry, repository string, d digest.Digest) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := blobKey(registry, d)
+	repositories := s.blobs[key]
+	if i := indexOf(repositories, repository); i >= 0 {
+		repositories = append(repositories[:i:i], repositories[i+1:]...)
+	}
+	if len(repositories) == 0 {
+		delete(s.blobs, key)
+	} else {
+		s.blobs[key] = repositories
+	}
+}
+
+// Len returns the number of known blobs of all repositories, a blob in two repositories is counted twice
+func (s *BlobSet) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	count := 0
+	for _, repositories := range s.blobs {
+		count += len(repositories)
+	}
+	return count
+}
+
+func blobKey(registry string, d digest.Digest) string {
+	return registry + "@" + d.String()
+}
+
+// indexOf returns the index of repository in repositories, -1 if it is missing
+func indexOf(repositories []string, repository string) int {
+	for i, r := range repositories {
+		if r == repository {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,57 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestBlobSetRepository(t *testing.T) {
+	s := NewBlobSet()
+	d := digest.FromString("base layer")
+	s.Add("registry", "team/base", d)
+	s.Add("registry", "team/app", d)
+	s.Add("registry", "team/app", d)
+	s.Add("other", "team/other", d)
+
+	if !s.Contains("registry", "team/app", d) || s.Contains("registry", "team/new", d) {
+		t.Errorf("the blob should be contained by team/base and team/app of registry only")
+	}
+	if s.Len() != 3 {
+		t.Errorf("expected 3 known blobs, got %v", s.Len())
+	}
+	// a blob is mounted from the repository added first
+	if repository := s.Repository("registry", d); repository != "team/base" {
+		t.Errorf("expected team/base to mount from, got %q", repository)
+	}
+
+	s.Remove("registry", "team/base", d)
+	if repository := s.Repository("registry", d); repository != "team/app" {
+		t.Errorf("expected team/app to mount from after team/base is removed, got %q", repository)
+	}
+	s.Remove("registry", "team/app", d)
+	if repository := s.Repository("registry", d); repository != "" {
+		t.Errorf("expected no repository to mount from, got %q", repository)
+	}
+	if repository := s.Repository("other", d); repository != "team/other" {
+		t.Errorf("the blobs of other registries should be kept, got %q", repository)
+	}
+}
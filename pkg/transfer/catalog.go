@@ -0,0 +1,133 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/containers/image/v5/types"
+)
+
+// ErrCatalogUnsupported means the registry does not expose the _catalog API to the auth information
+var ErrCatalogUnsupported = errors.New("catalog api is not supported")
+
+// ErrCatalogLimitExceeded means more repositories than the limit are listed from the catalog
+var ErrCatalogLimitExceeded = errors.New("catalog limit is exceeded")
+
+// catalogPageSize is the number of repositories requested per page of the catalog
+const catalogPageSize = 100
+
+// ListCatalog lists the repositories of a registry by the _catalog API page by page, only the
+// repositories under prefix (like team-a/) are returned. the listing stops with ErrCatalogLimitExceeded
+// once more than limit repositories are matched if limit is positive, ErrCatalogUnsupported is returned
+// if the registry does not expose the catalog
+func ListCatalog(registry, prefix, username, password string, insecure bool, limit int) ([]string, error) {
+	sysctx := &types.SystemContext{DockerRegistryUserAgent: UserAgent}
+	if insecure {
+		sysctx.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
+	}
+	setAuth(sysctx, username, password)
+	i := &ImageSource{
+		registry: registry,
+		ctx:      context.Background(),
+		sysctx:   sysctx,
+		mirror:   registry,
+	}
+
+	base, err := i.apiBase(registry)
+	if err != nil {
+		return nil, err
+	}
+	next := fmt.Sprintf("%s/v2/_catalog?n=%d", base, catalogPageSize)
+	var repositories []string
+	for next != "" {
+		page, link, err := i.getCatalogPage(next)
+		if err != nil {
+			return nil, err
+		}
+		for _, repository := range page {
+			if strings.HasPrefix(repository, prefix) {
+				repositories = append(repositories, repository)
+			}
+		}
+		if limit > 0 && len(repositories) > limit {
+			return nil, ErrCatalogLimitExceeded
+		}
+
+		current := next
+		next = ""
+		if link != "" {
+			linkURL, err := url.Parse(link)
+			if err != nil {
+				return nil, fmt.Errorf("invalid catalog link %s: %v", link, err)
+			}
+			next = base + linkURL.RequestURI()
+		}
+		if next == current {
+			return nil, fmt.Errorf("catalog of %s links to the same page %s", registry, next)
+		}
+	}
+	return repositories, nil
+}
+
+// getCatalogPage gets a page of the catalog, the next page in the Link header is returned
+func (i *ImageSource) getCatalogPage(pageURL string) ([]string, string, error) {
+	resp, err := i.registryGet(pageURL, "application/json")
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusUnauthorized, http.StatusForbidden:
+		return nil, "", ErrCatalogUnsupported
+	default:
+		return nil, "", fmt.Errorf("list catalog of %s error: status %s", i.registry, resp.Status)
+	}
+
+	var catalog struct {
+		Repositories []string `json:"repositories"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&catalog); err != nil {
+		return nil, "", fmt.Errorf("decode catalog of %s error: %v", i.registry, err)
+	}
+	return catalog.Repositories, parseNextLink(resp.Header.Get("Link")), nil
+}
+
+// parseNextLink gets the url of a Link header like </v2/_catalog?last=b&n=100>; rel="next"
+func parseNextLink(link string) string {
+	for _, part := range strings.Split(link, ",") {
+		fields := strings.Split(part, ";")
+		if len(fields) < 2 || !strings.Contains(strings.Join(fields[1:], ";"), `rel="next"`) {
+			continue
+		}
+		target := strings.TrimSpace(fields[0])
+		if strings.HasPrefix(target, "<") && strings.HasSuffix(target, ">") {
+			return target[1 : len(target)-1]
+		}
+	}
+	return ""
+}
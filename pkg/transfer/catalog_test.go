@@ -0,0 +1,187 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// catalogServer serves the repositories of a catalog in pages of the requested size with Link headers,
+// the requested pages are recorded
+type catalogServer struct {
+	repositories []string
+	mutex        sync.Mutex
+	pages        []string
+}
+
+func (s *catalogServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v2/_catalog" {
+		http.NotFound(w, r)
+		return
+	}
+	s.mutex.Lock()
+	s.pages = append(s.pages, r.URL.RawQuery)
+	s.mutex.Unlock()
+
+	n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+	start := 0
+	if last := r.URL.Query().Get("last"); last != "" {
+		for start < len(s.repositories) && s.repositories[start] <= last {
+			start++
+		}
+	}
+	end := start + n
+	if end >= len(s.repositories) {
+		end = len(s.repositories)
+	} else {
+		w.Header().Set("Link", fmt.Sprintf(`</v2/_catalog?last=%s&n=%d>; rel="next"`, s.repositories[end-1], n))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"repositories": s.repositories[start:end]})
+}
+
+// newCatalogServer starts a registry whose catalog holds count repositories of team-a and team-b
+func newCatalogServer(count int) (*catalogServer, *httptest.Server) {
+	catalog := &catalogServer{}
+	for i := 0; i < count; i++ {
+		catalog.repositories = append(catalog.repositories, fmt.Sprintf("team-a/app%04d", i),
+			fmt.Sprintf("team-b/app%04d", i))
+	}
+	// the Link headers page the catalog in order
+	sort.Strings(catalog.repositories)
+	return catalog, httptest.NewTLSServer(catalog)
+}
+
+func TestListCatalogPages(t *testing.T) {
+	catalog, server := newCatalogServer(150)
+	defer server.Close()
+	defer forgetRegistryBases()
+	registry := strings.TrimPrefix(server.URL, "https://")
+
+	repositories, err := ListCatalog(registry, "", "", "", true, 0)
+	if err != nil {
+		t.Fatalf("ListCatalog error: %v", err)
+	}
+	if len(repositories) != 300 {
+		t.Errorf("ListCatalog listed %v repositories, expected 300", len(repositories))
+	}
+	if len(catalog.pages) != 3 {
+		t.Errorf("ListCatalog fetched %v pages, expected 3: %v", len(catalog.pages), catalog.pages)
+	}
+	seen := make(map[string]bool)
+	for _, repository := range repositories {
+		if seen[repository] {
+			t.Errorf("repository %s is listed twice", repository)
+		}
+		seen[repository] = true
+	}
+
+	repositories, err = ListCatalog(registry, "team-b/", "", "", true, 0)
+	if err != nil {
+		t.Fatalf("ListCatalog of team-b/ error: %v", err)
+	}
+	if len(repositories) != 150 || !strings.HasPrefix(repositories[0], "team-b/") {
+		t.Errorf("ListCatalog of team-b/ listed %v repositories like %v, expected 150", len(repositories),
+			repositories[:1])
+	}
+}
+
+func TestListCatalogPlainHTTP(t *testing.T) {
+	catalog := &catalogServer{repositories: []string{"team-a/app", "team-b/app"}}
+	server := httptest.NewServer(catalog)
+	defer server.Close()
+	defer forgetRegistryBases()
+	registry := strings.TrimPrefix(server.URL, "http://")
+
+	repositories, err := ListCatalog(registry, "team-a/", "", "", true, 0)
+	if err != nil || len(repositories) != 1 || repositories[0] != "team-a/app" {
+		t.Errorf("ListCatalog of an insecure plain http registry = %v, %v", repositories, err)
+	}
+	if _, err := ListCatalog(registry, "", "", "", false, 0); err == nil {
+		t.Errorf("ListCatalog of a secure registry should not fall back to http")
+	}
+}
+
+func TestListCatalogLimit(t *testing.T) {
+	catalog, server := newCatalogServer(150)
+	defer server.Close()
+	defer forgetRegistryBases()
+	registry := strings.TrimPrefix(server.URL, "https://")
+
+	if _, err := ListCatalog(registry, "", "", "", true, 120); err != ErrCatalogLimitExceeded {
+		t.Fatalf("ListCatalog with limit 120 should fail with ErrCatalogLimitExceeded, got %v", err)
+	}
+	// the listing stops at the page which exceeds the limit
+	if len(catalog.pages) != 2 {
+		t.Errorf("ListCatalog with limit 120 fetched %v pages, expected 2", len(catalog.pages))
+	}
+
+	// the limit counts the repositories under the prefix only
+	if repositories, err := ListCatalog(registry, "team-a/", "", "", true, 150); err != nil ||
+		len(repositories) != 150 {
+		t.Errorf("ListCatalog of team-a/ with limit 150 = %v repositories, %v", len(repositories), err)
+	}
+}
+
+func TestListCatalogUnsupported(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	defer forgetRegistryBases()
+	registry := strings.TrimPrefix(server.URL, "https://")
+
+	if _, err := ListCatalog(registry, "", "", "", true, 0); err != ErrCatalogUnsupported {
+		t.Errorf("ListCatalog of a registry without catalog should fail with ErrCatalogUnsupported, got %v", err)
+	}
+}
+
+func TestListCatalogSamePage(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", fmt.Sprintf(`</v2/_catalog?n=%d>; rel="next"`, catalogPageSize))
+		w.Write([]byte(`{"repositories":["a/b"]}`))
+	}))
+	defer server.Close()
+	defer forgetRegistryBases()
+	registry := strings.TrimPrefix(server.URL, "https://")
+
+	if _, err := ListCatalog(registry, "", "", "", true, 0); err == nil {
+		t.Errorf("ListCatalog of a catalog linking to the same page should fail")
+	}
+}
+
+func TestParseNextLink(t *testing.T) {
+	cases := map[string]string{
+		"": "",
+		`</v2/_catalog?last=b&n=100>; rel="next"`:                              "/v2/_catalog?last=b&n=100",
+		`</v2/_catalog?last=a>; rel="prev", </v2/_catalog?last=c>; rel="next"`: "/v2/_catalog?last=c",
+		`</v2/_catalog?last=a>; rel="prev"`:                                    "",
+	}
+	for link, expected := range cases {
+		if next := parseNextLink(link); next != expected {
+			t.Errorf("parseNextLink(%q) = %q, expected %q", link, next, expected)
+		}
+	}
+}
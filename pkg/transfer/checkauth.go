@@ -0,0 +1,139 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/containers/image/v5/types"
+)
+
+// AuthCheckReason is the reason of a failed registry auth check
+type AuthCheckReason string
+
+const (
+	// AuthCheckUnreachable means the v2 api of the registry or its token service can not be requested
+	AuthCheckUnreachable AuthCheckReason = "unreachable"
+	// AuthCheckUnauthorized means the auth information is missing or rejected
+	AuthCheckUnauthorized AuthCheckReason = "unauthorized"
+)
+
+// AuthCheckError is the error of a failed registry auth check with its reason
+type AuthCheckError struct {
+	Reason AuthCheckReason
+	err    error
+}
+
+// Error returns the message of the wrapped error
+func (e *AuthCheckError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the wrapped error
+func (e *AuthCheckError) Unwrap() error {
+	return e.err
+}
+
+// AuthCheckReasonOf returns the reason of a failed registry auth check, it is empty for other errors
+func AuthCheckReasonOf(err error) AuthCheckReason {
+	var checkErr *AuthCheckError
+	if errors.As(err, &checkErr) {
+		return checkErr.Reason
+	}
+	return ""
+}
+
+// unreachable marks the error of a registry auth check as unreachable
+func unreachable(err error) error {
+	return &AuthCheckError{Reason: AuthCheckUnreachable, err: err}
+}
+
+// unauthorized marks the error of a registry auth check as unauthorized
+func unauthorized(err error) error {
+	return &AuthCheckError{Reason: AuthCheckUnauthorized, err: err}
+}
+
+// CheckRegistryAuth pings the v2 api of a registry and answers its auth challenge with username
+// and password, the token is requested for the pull scope of repository, or push,pull if push is
+// true, the scope is omitted if repository is empty. The error is an AuthCheckError which tells
+// whether the registry is unreachable or the auth information is rejected
+func CheckRegistryAuth(registry, repository, username, password string, insecure, push bool) error {
+	sysctx := &types.SystemContext{DockerRegistryUserAgent: UserAgent}
+	if insecure {
+		sysctx.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
+	}
+	setAuth(sysctx, username, password)
+	i := &ImageSource{
+		registry:   registry,
+		repository: repository,
+		ctx:        context.Background(),
+		sysctx:     sysctx,
+		mirror:     registry,
+	}
+
+	base, err := i.apiBase(registry)
+	if err != nil {
+		return unreachable(err)
+	}
+	client := i.httpClient()
+	pingURL := base + "/v2/"
+	resp, err := i.doGet(client, pingURL, "", "")
+	if err != nil {
+		return unreachable(fmt.Errorf("ping error: %v", err))
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized:
+	default:
+		return unreachable(fmt.Errorf("ping error: status %s", resp.Status))
+	}
+
+	actions := "pull"
+	if push {
+		actions = "push,pull"
+	}
+	authorization, err := i.authorize(client, resp.Header.Get("WWW-Authenticate"), actions)
+	if err != nil {
+		// the token service which can not be requested is unreachable, a rejected token request is unauthorized
+		var netErr net.Error
+		if errors.As(err, &netErr) {
+			return unreachable(err)
+		}
+		return unauthorized(err)
+	}
+	resp, err = i.doGet(client, pingURL, "", authorization)
+	if err != nil {
+		return unreachable(fmt.Errorf("ping with auth information error: %v", err))
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return unauthorized(fmt.Errorf("auth information is rejected: status %s", resp.Status))
+	default:
+		return unreachable(fmt.Errorf("ping with auth information error: status %s", resp.Status))
+	}
+}
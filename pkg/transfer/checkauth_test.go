@@ -0,0 +1,82 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// forgetRegistryBases drops the cached api base urls of the test servers, a server of a later test
+// may listen on the same port by another scheme
+func forgetRegistryBases() {
+	registryBases.Range(func(key, _ interface{}) bool {
+		registryBases.Delete(key)
+		return true
+	})
+}
+
+// basicAuthRegistry is a registry whose v2 api requires the basic auth of admin:secret
+var basicAuthRegistry = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if username, password, ok := r.BasicAuth(); !ok || username != "admin" || password != "secret" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+})
+
+func TestCheckRegistryAuthPlainHTTP(t *testing.T) {
+	server := httptest.NewServer(basicAuthRegistry)
+	defer server.Close()
+	defer forgetRegistryBases()
+	registry := strings.TrimPrefix(server.URL, "http://")
+
+	cases := []struct {
+		name     string
+		password string
+		insecure bool
+		reason   AuthCheckReason
+	}{
+		{"insecure", "secret", true, ""},
+		{"wrong password", "wrong", true, AuthCheckUnauthorized},
+		// a secure registry is only requested by https
+		{"secure", "secret", false, AuthCheckUnreachable},
+	}
+	for _, c := range cases {
+		err := CheckRegistryAuth(registry, "team/app", "admin", c.password, c.insecure, true)
+		if reason := AuthCheckReasonOf(err); reason != c.reason || (c.reason == "") != (err == nil) {
+			t.Errorf("%s: expected reason %q, got %v", c.name, c.reason, err)
+		}
+	}
+}
+
+func TestCheckRegistryAuthHTTPS(t *testing.T) {
+	server := httptest.NewTLSServer(basicAuthRegistry)
+	defer server.Close()
+	defer forgetRegistryBases()
+	registry := strings.TrimPrefix(server.URL, "https://")
+
+	if err := CheckRegistryAuth(registry, "", "admin", "secret", true, false); err != nil {
+		t.Errorf("CheckRegistryAuth of an insecure https registry error: %v", err)
+	}
+	if base, _ := registryBases.Load(registryBaseKey{host: registry, insecure: true}); base != server.URL {
+		t.Errorf("expected the api of %s at %s, got %v", registry, server.URL, base)
+	}
+}
@@ -0,0 +1,322 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package transfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+const (
+	// LayerCompressionGzip re-compresses the layers with gzip
+	LayerCompressionGzip = "gzip"
+	// LayerCompressionZstd re-compresses the layers with zstd, only oci manifests have zstd layers
+	LayerCompressionZstd = "zstd"
+
+	// ociLayerZstdMediaType is the media type of a zstd compressed oci layer
+	ociLayerZstdMediaType = "application/vnd.oci.image.layer.v1.tar+zstd"
+)
+
+// recompressedMediaTypes maps the layer media types to the ones of each LayerCompression, the layers of
+// other media types like foreign layers or those already compressed by it are pushed as is
+var recompressedMediaTypes = map[string]map[string]string{
+	LayerCompressionGzip: {
+		imgspecv1.MediaTypeImageLayer:                     imgspecv1.MediaTypeImageLayerGzip,
+		ociLayerZstdMediaType:                             imgspecv1.MediaTypeImageLayerGzip,
+		manifest.DockerV2SchemaLayerMediaTypeUncompressed: manifest.DockerV2Schema2LayerMediaType,
+	},
+	LayerCompressionZstd: {
+		imgspecv1.MediaTypeImageLayer:     ociLayerZstdMediaType,
+		imgspecv1.MediaTypeImageLayerGzip: ociLayerZstdMediaType,
+	},
+}
+
+// ValidLayerCompression checks if c is a supported LayerCompression, an empty c pushes the layers as is
+func ValidLayerCompression(c string) bool {
+	_, ok := recompressedMediaTypes[c]
+	return c == "" || ok
+}
+
+// RecompressLayers rewrites the layers of a manifest or manifest list m of type t to the media types of
+// layerCompression, the layers are re-compressed by recompress which returns their new digests and sizes.
+// The instances of a manifest list are got by getInstance, the rewritten instances are returned by their
+// new digests. A docker manifest can not have zstd layers, it returns a PermanentError
+func RecompressLayers(m []byte, t, layerCompression string, getInstance func(d digest.Digest) ([]byte, string, error),
+	recompress func(layer types.BlobInfo) (types.BlobInfo, error)) ([]byte, string, map[digest.Digest][]byte, error) {
+	mediaTypes := recompressedMediaTypes[layerCompression]
+
+	return rewriteManifest(m, t, getInstance, func(image []byte, imageType string) ([]byte, string, error) {
+		if imageType != manifest.DockerV2Schema2MediaType && imageType != imgspecv1.MediaTypeImageManifest {
+			return nil, "", NewPermanentError(fmt.Errorf("layers of %s manifest can not be re-compressed",
+				imageType))
+		}
+		if imageType == manifest.DockerV2Schema2MediaType && layerCompression == LayerCompressionZstd {
+			return nil, "", NewPermanentError(fmt.Errorf("docker v2 schema2 manifest can not have zstd layers, " +
+				"convert it to oci by targetManifestType"))
+		}
+
+		var parsed convertImage
+		if err := json.Unmarshal(image, &parsed); err != nil {
+			return nil, "", fmt.Errorf("parse manifest error: %v", err)
+		}
+		changed := false
+		for i := range parsed.Layers {
+			layer := &parsed.Layers[i]
+			mediaType, ok := mediaTypes[layer.MediaType]
+			if !ok {
+				continue
+			}
+			recompressed, err := recompress(types.BlobInfo{Digest: layer.Digest, Size: layer.Size,
+				MediaType: layer.MediaType})
+			if err != nil {
+				return nil, "", err
+			}
+			layer.MediaType = mediaType
+			layer.Digest = recompressed.Digest
+			layer.Size = recompressed.Size
+			changed = true
+		}
+		if !changed {
+			return image, imageType, nil
+		}
+
+		rewritten, err := json.Marshal(parsed)
+		if err != nil {
+			return nil, "", err
+		}
+		return rewritten, imageType, nil
+	}, func(index *convertIndex, indexType string) (string, bool, error) {
+		return indexType, false, nil
+	})
+}
+
+// RecompressedLayers is a concurrency-safe cache of the layers re-compressed in a run by their source
+// digests, a later job reuses the digest and size and only re-compresses a layer which its target misses
+type RecompressedLayers struct {
+	layers map[string]types.BlobInfo
+	mutex  sync.RWMutex
+}
+
+// NewRecompressedLayers creates an empty RecompressedLayers
+func NewRecompressedLayers() *RecompressedLayers {
+	return &RecompressedLayers{
+		layers: make(map[string]types.BlobInfo),
+	}
+}
+
+// Get returns the re-compressed layer of a source layer
+func (s *RecompressedLayers) Get(source digest.Digest, layerCompression string) (types.BlobInfo, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	layer, ok := s.layers[layerCompression+"@"+source.String()]
+	return layer, ok
+}
+
+// Add records the re-compressed layer of a source layer
+func (s *RecompressedLayers) Add(source digest.Digest, layerCompression string, layer types.BlobInfo) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.layers[layerCompression+"@"+source.String()] = layer
+}
+
+// Remove forgets the re-compressed layer of a source layer which is re-compressed to another digest
+func (s *RecompressedLayers) Remove(source digest.Digest, layerCompression string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.layers, layerCompression+"@"+source.String())
+}
+
+// recompressedLayer is a layer re-compressed by a job, it is kept in a temporary file until the job ends.
+// path is empty if the layer was re-compressed by an earlier job and is not written yet
+type recompressedLayer struct {
+	source digest.Digest
+	info   types.BlobInfo
+	path   string
+}
+
+// recompressLayer re-compresses a source layer by LayerCompression and returns its digest and size
+func (j *Job) recompressLayer(layer types.BlobInfo) (types.BlobInfo, error) {
+	if j.recompressed == nil {
+		j.recompressed = make(map[digest.Digest]*recompressedLayer)
+	}
+	if j.options.RecompressedLayers != nil {
+		if info, ok := j.options.RecompressedLayers.Get(layer.Digest, j.options.LayerCompression); ok {
+			j.recompressed[info.Digest] = &recompressedLayer{source: layer.Digest, info: info}
+			return info, nil
+		}
+	}
+
+	recompressed, err := j.compressLayer(layer.Digest)
+	if err != nil {
+		return types.BlobInfo{}, err
+	}
+	j.recompressed[recompressed.info.Digest] = recompressed
+	if j.options.RecompressedLayers != nil {
+		j.options.RecompressedLayers.Add(layer.Digest, j.options.LayerCompression, recompressed.info)
+	}
+	log.Infof("Re-compress layer %s(%v) of %s/%s:%s by %s to %s(%v)", layer.Digest, layer.Size,
+		j.Source.GetRegistry(), j.Source.GetRepository(), j.Source.GetTag(), j.options.LayerCompression,
+		recompressed.info.Digest, recompressed.info.Size)
+	return recompressed.info, nil
+}
+
+// compressLayer pulls a source layer, decompresses it and writes it compressed by LayerCompression to
+// a temporary file
+func (j *Job) compressLayer(source digest.Digest) (*recompressedLayer, error) {
+	algorithm, err := compression.AlgorithmByName(j.options.LayerCompression)
+	if err != nil {
+		return nil, NewPermanentError(err)
+	}
+
+	blob, _, err := j.Source.GetABlob(types.BlobInfo{Digest: source})
+	if err != nil {
+		return nil, fmt.Errorf("get layer %s error: %v", source, err)
+	}
+	defer blob.Close()
+
+	_, decompressor, reader, err := compression.DetectCompressionFormat(blob)
+	if err != nil {
+		return nil, fmt.Errorf("detect compression of layer %s error: %v", source, err)
+	}
+	if decompressor != nil {
+		decompressed, err := decompressor(reader)
+		if err != nil {
+			return nil, fmt.Errorf("decompress layer %s error: %v", source, err)
+		}
+		defer decompressed.Close()
+		reader = decompressed
+	}
+
+	file, err := ioutil.TempFile("", "image-transfer-layer-")
+	if err != nil {
+		return nil, fmt.Errorf("create temporary file of layer %s error: %v", source, err)
+	}
+	written := false
+	defer func() {
+		if !written {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+
+	digester := digest.Canonical.Digester()
+	compressor, err := compression.CompressStream(io.MultiWriter(file, digester.Hash()), algorithm, nil)
+	if err != nil {
+		return nil, fmt.Errorf("compress layer %s error: %v", source, err)
+	}
+	if _, err := io.Copy(compressor, reader); err != nil {
+		compressor.Close()
+		return nil, fmt.Errorf("re-compress layer %s error: %v", source, err)
+	}
+	if err := compressor.Close(); err != nil {
+		return nil, fmt.Errorf("re-compress layer %s error: %v", source, err)
+	}
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, fmt.Errorf("write layer %s error: %v", source, err)
+	}
+	if err := file.Close(); err != nil {
+		return nil, fmt.Errorf("write layer %s error: %v", source, err)
+	}
+
+	written = true
+	return &recompressedLayer{
+		source: source,
+		info:   types.BlobInfo{Digest: digester.Digest(), Size: size},
+		path:   file.Name(),
+	}, nil
+}
+
+// pushedBlobInfos replaces the source layers in blobInfos with the layers re-compressed by the job
+func (j *Job) pushedBlobInfos(blobInfos []types.BlobInfo) []types.BlobInfo {
+	if len(j.recompressed) == 0 {
+		return blobInfos
+	}
+	sources := make(map[digest.Digest]types.BlobInfo)
+	for _, layer := range j.recompressed {
+		sources[layer.source] = layer.info
+	}
+
+	pushed := make([]types.BlobInfo, 0, len(blobInfos))
+	for _, blobinfo := range blobInfos {
+		if info, ok := sources[blobinfo.Digest]; ok {
+			blobinfo = info
+		}
+		pushed = append(pushed, blobinfo)
+	}
+	return pushed
+}
+
+// openBlob opens a blob to push, a re-compressed layer is read from its temporary file which is written
+// again if the layer was re-compressed by an earlier job
+func (j *Job) openBlob(blobinfo types.BlobInfo) (io.ReadCloser, int64, error) {
+	layer, ok := j.recompressed[blobinfo.Digest]
+	if !ok {
+		return j.Source.GetABlob(blobinfo)
+	}
+
+	if layer.path == "" {
+		compressed, err := j.compressLayer(layer.source)
+		if err != nil {
+			return nil, 0, err
+		}
+		if compressed.info.Digest != layer.info.Digest {
+			os.Remove(compressed.path)
+			// the layer is re-compressed again when the job is retried
+			if j.options.RecompressedLayers != nil {
+				j.options.RecompressedLayers.Remove(layer.source, j.options.LayerCompression)
+			}
+			return nil, 0, fmt.Errorf("layer %s is re-compressed to %s, mismatches %s of an earlier job",
+				layer.source, compressed.info.Digest, layer.info.Digest)
+		}
+		layer.path = compressed.path
+	}
+
+	file, err := os.Open(layer.path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("open re-compressed layer %s error: %v", layer.info.Digest, err)
+	}
+	return file, layer.info.Size, nil
+}
+
+// removeRecompressedLayers removes the temporary files of the layers re-compressed by the job
+func (j *Job) removeRecompressedLayers() {
+	for _, layer := range j.recompressed {
+		if layer.path == "" {
+			continue
+		}
+		if err := os.Remove(layer.path); err != nil && !os.IsNotExist(err) {
+			log.Warnf("Remove re-compressed layer %s error: %v", layer.path, err)
+		}
+	}
+	j.recompressed = nil
+}
@@ -0,0 +1,257 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// ManifestTypeV2S2 converts the manifests to docker v2 schema2 manifests and manifest lists
+	ManifestTypeV2S2 = "v2s2"
+	// ManifestTypeOCI converts the manifests to oci manifests and indexes
+	ManifestTypeOCI = "oci"
+
+	// dockerForeignLayerGzipMediaType is the media type of a compressed docker foreign layer
+	dockerForeignLayerGzipMediaType = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+)
+
+// ociToDockerMediaTypes maps the config and layer media types of oci to docker v2 schema2,
+// the blobs are not changed so the digests are preserved
+var ociToDockerMediaTypes = map[string]string{
+	imgspecv1.MediaTypeImageConfig:                    manifest.DockerV2Schema2ConfigMediaType,
+	imgspecv1.MediaTypeImageLayerGzip:                 manifest.DockerV2Schema2LayerMediaType,
+	imgspecv1.MediaTypeImageLayerNonDistributableGzip: dockerForeignLayerGzipMediaType,
+	imgspecv1.MediaTypeImageLayerNonDistributable:     manifest.DockerV2Schema2ForeignLayerMediaType,
+}
+
+// dockerToOCIMediaTypes maps the config and layer media types of docker v2 schema2 to oci
+var dockerToOCIMediaTypes = map[string]string{
+	manifest.DockerV2Schema2ConfigMediaType:       imgspecv1.MediaTypeImageConfig,
+	manifest.DockerV2Schema2LayerMediaType:        imgspecv1.MediaTypeImageLayerGzip,
+	dockerForeignLayerGzipMediaType:               imgspecv1.MediaTypeImageLayerNonDistributableGzip,
+	manifest.DockerV2Schema2ForeignLayerMediaType: imgspecv1.MediaTypeImageLayerNonDistributable,
+}
+
+// convertDescriptor is a descriptor of a docker v2 schema2 or oci manifest, the fields docker
+// does not support are dropped when converted to docker
+type convertDescriptor struct {
+	MediaType   string            `json:"mediaType,omitempty"`
+	Size        int64             `json:"size"`
+	Digest      digest.Digest     `json:"digest"`
+	URLs        []string          `json:"urls,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *convertPlatform  `json:"platform,omitempty"`
+}
+
+// convertPlatform is the platform of a manifest list entry, features is docker only
+type convertPlatform struct {
+	Architecture string   `json:"architecture"`
+	OS           string   `json:"os"`
+	OSVersion    string   `json:"os.version,omitempty"`
+	OSFeatures   []string `json:"os.features,omitempty"`
+	Variant      string   `json:"variant,omitempty"`
+	Features     []string `json:"features,omitempty"`
+}
+
+// convertImage is a docker v2 schema2 or oci image manifest, subject and artifactType are oci only
+type convertImage struct {
+	SchemaVersion int                 `json:"schemaVersion"`
+	MediaType     string              `json:"mediaType,omitempty"`
+	ArtifactType  string              `json:"artifactType,omitempty"`
+	Config        convertDescriptor   `json:"config"`
+	Layers        []convertDescriptor `json:"layers"`
+	Subject       *convertDescriptor  `json:"subject,omitempty"`
+	Annotations   map[string]string   `json:"annotations,omitempty"`
+}
+
+// convertIndex is a docker manifest list or an oci index
+type convertIndex struct {
+	SchemaVersion int                 `json:"schemaVersion"`
+	MediaType     string              `json:"mediaType,omitempty"`
+	ArtifactType  string              `json:"artifactType,omitempty"`
+	Manifests     []convertDescriptor `json:"manifests"`
+	Subject       *convertDescriptor  `json:"subject,omitempty"`
+	Annotations   map[string]string   `json:"annotations,omitempty"`
+}
+
+// ValidManifestType checks if t is a supported TargetManifestType, an empty t keeps the source type
+func ValidManifestType(t string) bool {
+	return t == "" || t == ManifestTypeV2S2 || t == ManifestTypeOCI
+}
+
+// ConvertManifest converts a manifest or manifest list m of type t to targetType(v2s2 or oci), the layer
+// and config digests are preserved. The instances of a manifest list are got by getInstance and converted
+// too, the converted instances are returned by their new digests. m is returned as is if it is of targetType.
+// A manifest which can not be converted, like a schema1 manifest or a zstd layer, returns a PermanentError
+func ConvertManifest(m []byte, t, targetType string,
+	getInstance func(d digest.Digest) ([]byte, string, error)) ([]byte, string, map[digest.Digest][]byte, error) {
+	listType := manifest.DockerV2ListMediaType
+	if targetType == ManifestTypeOCI {
+		listType = imgspecv1.MediaTypeImageIndex
+	}
+
+	return rewriteManifest(m, t, getInstance, func(image []byte, imageType string) ([]byte, string, error) {
+		return convertImageManifest(image, imageType, targetType)
+	}, func(index *convertIndex, indexType string) (string, bool, error) {
+		for i := range index.Manifests {
+			entry := &index.Manifests[i]
+			if targetType == ManifestTypeOCI {
+				if entry.Platform != nil {
+					entry.Platform.Features = nil
+				}
+				continue
+			}
+			if entry.Platform == nil {
+				return "", false, NewPermanentError(fmt.Errorf("manifest %s of index has no platform, "+
+					"it can not be converted to a docker manifest list", entry.Digest))
+			}
+			entry.Annotations = nil
+		}
+		if targetType == ManifestTypeV2S2 {
+			index.Annotations = nil
+			index.Subject = nil
+			index.ArtifactType = ""
+		}
+		return listType, false, nil
+	})
+}
+
+// rewriteManifest rewrites a manifest or manifest list m of type t. An image manifest is rewritten by
+// rewriteImage, the instances of a manifest list are got by getInstance and rewritten by rewriteImage,
+// then the list is rewritten by rewriteIndex which returns the new list type and whether it changes the
+// list. The rewritten instances are returned by their new digests, m is returned as is if nothing changes
+func rewriteManifest(m []byte, t string, getInstance func(d digest.Digest) ([]byte, string, error),
+	rewriteImage func(image []byte, imageType string) ([]byte, string, error),
+	rewriteIndex func(index *convertIndex, indexType string) (string, bool, error)) ([]byte, string,
+	map[digest.Digest][]byte, error) {
+	if t == "" {
+		t = manifest.GuessMIMEType(m)
+	}
+	if !IsManifestList(t) {
+		rewritten, rewrittenType, err := rewriteImage(m, t)
+		return rewritten, rewrittenType, nil, err
+	}
+
+	var index convertIndex
+	if err := json.Unmarshal(m, &index); err != nil {
+		return nil, "", nil, fmt.Errorf("parse manifest list error: %v", err)
+	}
+	instances := make(map[digest.Digest][]byte)
+	for i := range index.Manifests {
+		entry := &index.Manifests[i]
+		instance, instanceType, err := getInstance(entry.Digest)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("get manifest %s of manifest list error: %v", entry.Digest, err)
+		}
+		if instanceType == "" {
+			instanceType = manifest.GuessMIMEType(instance)
+		}
+		if IsManifestList(instanceType) {
+			return nil, "", nil, NewPermanentError(fmt.Errorf("nested manifest list %s can not be rewritten",
+				entry.Digest))
+		}
+		rewritten, rewrittenType, err := rewriteImage(instance, instanceType)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		rewrittenDigest := digest.FromBytes(rewritten)
+		if rewrittenDigest != entry.Digest {
+			instances[rewrittenDigest] = rewritten
+		}
+		entry.MediaType = rewrittenType
+		entry.Digest = rewrittenDigest
+		entry.Size = int64(len(rewritten))
+	}
+	listType, changed, err := rewriteIndex(&index, t)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if t == listType && len(instances) == 0 && !changed {
+		return m, t, nil, nil
+	}
+
+	index.SchemaVersion = 2
+	index.MediaType = listType
+	rewritten, err := json.Marshal(index)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return rewritten, listType, instances, nil
+}
+
+// convertImageManifest converts an image manifest m of type t to targetType
+func convertImageManifest(m []byte, t, targetType string) ([]byte, string, error) {
+	wanted, mediaTypes := manifest.DockerV2Schema2MediaType, ociToDockerMediaTypes
+	if targetType == ManifestTypeOCI {
+		wanted, mediaTypes = imgspecv1.MediaTypeImageManifest, dockerToOCIMediaTypes
+	}
+	if t == wanted {
+		return m, t, nil
+	}
+	if t != manifest.DockerV2Schema2MediaType && t != imgspecv1.MediaTypeImageManifest {
+		return nil, "", NewPermanentError(fmt.Errorf("%s manifest can not be converted to %s", t, wanted))
+	}
+
+	var image convertImage
+	if err := json.Unmarshal(m, &image); err != nil {
+		return nil, "", fmt.Errorf("parse manifest error: %v", err)
+	}
+	convertType := func(descriptor *convertDescriptor) error {
+		convertedType, ok := mediaTypes[descriptor.MediaType]
+		if !ok {
+			return NewPermanentError(fmt.Errorf("blob %s of media type %s can not be converted to %s",
+				descriptor.Digest, descriptor.MediaType, wanted))
+		}
+		descriptor.MediaType = convertedType
+		if targetType == ManifestTypeV2S2 {
+			descriptor.Annotations = nil
+		}
+		return nil
+	}
+	if err := convertType(&image.Config); err != nil {
+		return nil, "", err
+	}
+	for i := range image.Layers {
+		if err := convertType(&image.Layers[i]); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if image.Layers == nil {
+		image.Layers = []convertDescriptor{}
+	}
+	image.SchemaVersion = 2
+	image.MediaType = wanted
+	if targetType == ManifestTypeV2S2 {
+		image.Annotations = nil
+		image.Subject = nil
+		image.ArtifactType = ""
+	}
+	converted, err := json.Marshal(image)
+	if err != nil {
+		return nil, "", err
+	}
+	return converted, wanted, nil
+}
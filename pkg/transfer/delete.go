@@ -0,0 +1,89 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// DeleteTag deletes a tag of the target repository by the registry api. The tag is deleted by
+// reference if the registry supports it, otherwise its manifest is deleted by digest, which removes
+// every tag of the manifest, so it is refused if shared reports that a kept tag has the digest
+func (i *ImageTarget) DeleteTag(tag string, shared func(d digest.Digest) (bool, error)) error {
+	if i.local {
+		return fmt.Errorf("can not delete tags of local target %s", i.repository)
+	}
+
+	registry := &ImageSource{registry: i.registry, repository: i.repository, ctx: i.ctx, sysctx: i.sysctx,
+		mirror: i.registry}
+	status, err := registry.deleteManifest(tag)
+	if err != nil {
+		return err
+	}
+	switch status {
+	case http.StatusAccepted, http.StatusOK, http.StatusNotFound:
+		return nil
+	case http.StatusBadRequest, http.StatusMethodNotAllowed:
+	default:
+		return fmt.Errorf("delete tag %s error: status %v", tag, status)
+	}
+
+	// the registry deletes manifests by digest only
+	d, err := registry.headManifestDigest(i.registry, tag)
+	if err != nil {
+		if IsNotFoundError(err) {
+			return nil
+		}
+		return err
+	}
+	if isShared, err := shared(d); err != nil {
+		return err
+	} else if isShared {
+		return fmt.Errorf("manifest %s of tag %s is shared with a kept tag, the registry can only delete "+
+			"it by digest", d, tag)
+	}
+	status, err = registry.deleteManifest(d.String())
+	if err != nil {
+		return err
+	}
+	switch status {
+	case http.StatusAccepted, http.StatusOK, http.StatusNotFound:
+		return nil
+	default:
+		return fmt.Errorf("delete manifest %s of tag %s error: status %v", d, tag, status)
+	}
+}
+
+// deleteManifest deletes a manifest by tag or digest, the status code is returned
+func (i *ImageSource) deleteManifest(reference string) (int, error) {
+	base, err := i.apiBase(i.registry)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := i.registryRequestFor(http.MethodDelete, base+"/v2/"+i.repository+"/manifests/"+reference, "",
+		"delete,pull")
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,140 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// ErrorClass is the class of a transfer error, it decides whether a failed job is retried
+type ErrorClass string
+
+const (
+	// ErrorClassRetryable errors are temporary, e.g. network errors, 5xx and 429 responses
+	ErrorClassRetryable ErrorClass = "retryable"
+	// ErrorClassPermanent errors fail again if retried, e.g. 401, 403, 404 responses and invalid configs
+	ErrorClassPermanent ErrorClass = "permanent"
+)
+
+var (
+	// retryableErrorRegexp matches the messages of temporary registry and network errors
+	retryableErrorRegexp = regexp.MustCompile(`(?i)(\b429\b|too ?many ?requests|\b5[0-9]{2} [a-z]|` +
+		`status(code)?:? 5[0-9]{2}\b|internal server error|bad gateway|service unavailable|gateway timeout|` +
+		`timeout|timed out|connection reset|connection refused|broken pipe|unexpected eof|\beof\b|` +
+		`temporary failure|no such host)`)
+
+	// permanentErrorRegexp matches the messages of registry errors which fail again if retried. Only the
+	// invalid errors of the registry error codes like MANIFEST_INVALID are permanent, a bare invalid like
+	// invalid character of a truncated response is retried
+	permanentErrorRegexp = regexp.MustCompile(`(?i)(unauthorized|authentication required|denied|forbidden|` +
+		`manifest unknown|name unknown|blob unknown|not found|unsupported|invalid reference format|` +
+		`\b(manifest|name|digest|tag|size|range|blob upload|pagination number)[ _]invalid\b|` +
+		`\b40[134] [a-z]|status(code)?:? 40[134]\b)`)
+
+	// notFoundErrorRegexp matches the messages of registry errors of missing manifests and repositories
+	notFoundErrorRegexp = regexp.MustCompile(`(?i)(manifest unknown|name unknown|not found|` +
+		`\b404 [a-z]|status(code)?:? 404\b)`)
+
+	// immutableTagErrorRegexp matches the messages of pushing to an immutable tag of tcr or harbor
+	immutableTagErrorRegexp = regexp.MustCompile(`(?i)(configured as immutable|tag is immutable|` +
+		`immutable tag|tag immutability)`)
+
+	// unauthorizedErrorRegexp matches the messages of 401 and 403 registry errors
+	unauthorizedErrorRegexp = regexp.MustCompile(`(?i)(unauthorized|authentication required|denied|forbidden|` +
+		`\b40[13] [a-z]|status(code)?:? 40[13]\b)`)
+)
+
+// PermanentError is an error which should not be retried, e.g. an invalid config
+type PermanentError struct {
+	err error
+}
+
+// NewPermanentError marks an error as permanent
+func NewPermanentError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{err: err}
+}
+
+// Error returns the message of the wrapped error
+func (e *PermanentError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the wrapped error
+func (e *PermanentError) Unwrap() error {
+	return e.err
+}
+
+// ClassifyError classifies a transfer error, the errors which can not be classified are
+// taken as retryable so that they are retried as before
+func ClassifyError(err error) ErrorClass {
+	if err == nil {
+		return ErrorClassRetryable
+	}
+
+	var permanentErr *PermanentError
+	if errors.As(err, &permanentErr) {
+		return ErrorClassPermanent
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorClassRetryable
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrorClassRetryable
+	}
+
+	msg := strings.TrimSpace(err.Error())
+	if retryableErrorRegexp.MatchString(msg) {
+		return ErrorClassRetryable
+	}
+	if permanentErrorRegexp.MatchString(msg) {
+		return ErrorClassPermanent
+	}
+
+	return ErrorClassRetryable
+}
+
+// IsRetryableError checks if a failed job should be retried
+func IsRetryableError(err error) bool {
+	return ClassifyError(err) == ErrorClassRetryable
+}
+
+// IsUnauthorizedError checks if a registry error is a 401 or 403 response
+func IsUnauthorizedError(err error) bool {
+	return err != nil && unauthorizedErrorRegexp.MatchString(err.Error())
+}
+
+// IsImmutableTagError checks if a registry error means the target tag is immutable and can not be overwritten
+func IsImmutableTagError(err error) bool {
+	return err != nil && immutableTagErrorRegexp.MatchString(err.Error())
+}
+
+// IsNotFoundError checks if a registry error means the manifest or repository does not exist
+func IsNotFoundError(err error) bool {
+	return err != nil && notFoundErrorRegexp.MatchString(err.Error())
+}
@@ -0,0 +1,93 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// timeoutError is a net.Error which timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o operation" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyError(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected ErrorClass
+	}{
+		{err: errors.New("received unexpected HTTP status: 500 Internal Server Error"), expected: ErrorClassRetryable},
+		{err: errors.New("received unexpected HTTP status: 503 Service Unavailable"), expected: ErrorClassRetryable},
+		{err: errors.New("toomanyrequests: Too Many Requests"), expected: ErrorClassRetryable},
+		{err: errors.New("read tcp 10.0.0.1:443: connection reset by peer"), expected: ErrorClassRetryable},
+		{err: errors.New("dial tcp: lookup registry.example.com: no such host"), expected: ErrorClassRetryable},
+		{err: errors.New("unexpected EOF"), expected: ErrorClassRetryable},
+		{err: errors.New("invalid character '<' looking for beginning of value"), expected: ErrorClassRetryable},
+		{err: errors.New("decode response error: invalid character 'x' in string literal"),
+			expected: ErrorClassRetryable},
+		{err: errors.New("something unexpected happened"), expected: ErrorClassRetryable},
+		{err: context.DeadlineExceeded, expected: ErrorClassRetryable},
+		{err: fmt.Errorf("copy error: %w", timeoutError{}), expected: ErrorClassRetryable},
+		{err: errors.New("unauthorized: authentication required"), expected: ErrorClassPermanent},
+		{err: errors.New("denied: requested access to the resource is denied"), expected: ErrorClassPermanent},
+		{err: errors.New("manifest unknown: manifest unknown"), expected: ErrorClassPermanent},
+		{err: errors.New("name unknown: repository name not known to registry"), expected: ErrorClassPermanent},
+		{err: errors.New("manifest invalid: manifest invalid"), expected: ErrorClassPermanent},
+		{err: errors.New("errors: MANIFEST_INVALID"), expected: ErrorClassPermanent},
+		{err: errors.New("name invalid: invalid repository name"), expected: ErrorClassPermanent},
+		{err: errors.New("digest invalid: provided digest did not match uploaded content"),
+			expected: ErrorClassPermanent},
+		{err: errors.New("DIGEST_INVALID"), expected: ErrorClassPermanent},
+		{err: errors.New("invalid reference format"), expected: ErrorClassPermanent},
+		{err: errors.New("received unexpected HTTP status: 404 Not Found"), expected: ErrorClassPermanent},
+		{err: NewPermanentError(errors.New("connection reset")), expected: ErrorClassPermanent},
+		{err: fmt.Errorf("job error: %w", NewPermanentError(errors.New("bad rule"))), expected: ErrorClassPermanent},
+	}
+	for _, c := range cases {
+		if class := ClassifyError(c.err); class != c.expected {
+			t.Errorf("ClassifyError(%q) = %s, expected %s", c.err, class, c.expected)
+		}
+		if retryable := IsRetryableError(c.err); retryable != (c.expected == ErrorClassRetryable) {
+			t.Errorf("IsRetryableError(%q) = %v", c.err, retryable)
+		}
+	}
+}
+
+func TestRegistryErrorKinds(t *testing.T) {
+	unauthorized := errors.New("received unexpected HTTP status: 401 Unauthorized")
+	if !IsUnauthorizedError(unauthorized) || IsNotFoundError(unauthorized) {
+		t.Errorf("%q should be unauthorized only", unauthorized)
+	}
+	notFound := errors.New("manifest unknown: manifest unknown")
+	if !IsNotFoundError(notFound) || IsUnauthorizedError(notFound) {
+		t.Errorf("%q should be not found only", notFound)
+	}
+	immutable := errors.New("denied: The tag 1.0 is configured as immutable")
+	if !IsImmutableTagError(immutable) {
+		t.Errorf("%q should be an immutable tag error", immutable)
+	}
+	if IsUnauthorizedError(nil) || IsNotFoundError(nil) || IsImmutableTagError(nil) {
+		t.Errorf("nil should not be a registry error")
+	}
+}
@@ -0,0 +1,91 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+// errNoDigestHeader means the registry answers a HEAD request without the digest of the manifest
+var errNoDigestHeader = errors.New("no Docker-Content-Digest header in response")
+
+// manifestAccept is the Accept header of HEAD requests, the digest of an image index or manifest
+// list is returned rather than the digest of a converted manifest
+var manifestAccept = strings.Join([]string{
+	imgspecv1.MediaTypeImageIndex,
+	manifest.DockerV2ListMediaType,
+	imgspecv1.MediaTypeImageManifest,
+	manifest.DockerV2Schema2MediaType,
+	manifest.DockerV2Schema1SignedMediaType,
+	manifest.DockerV2Schema1MediaType,
+}, ", ")
+
+// headManifestDigest gets the digest of a manifest in the repository by a HEAD request, which
+// costs no manifest download, a missing manifest returns an error matched by IsNotFoundError
+func (i *ImageSource) headManifestDigest(host, reference string) (digest.Digest, error) {
+	base, err := i.apiBase(host)
+	if err != nil {
+		return "", err
+	}
+	resp, err := i.registryRequest(http.MethodHead, base+"/v2/"+i.repository+"/manifests/"+reference,
+		manifestAccept)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", fmt.Errorf("manifest unknown: status %s", resp.Status)
+	default:
+		return "", fmt.Errorf("head manifest %s error: status %s", reference, resp.Status)
+	}
+	header := resp.Header.Get("Docker-Content-Digest")
+	if header == "" {
+		return "", errNoDigestHeader
+	}
+	return digest.Parse(header)
+}
+
+// GetManifestDigest gets the manifest digest of source by a HEAD request, the manifest is
+// downloaded to compute the digest if the HEAD request fails or a local image is the source
+func (i *ImageSource) GetManifestDigest() (digest.Digest, error) {
+	if i.transport == "" && i.tag != "" {
+		d, err := i.headManifestDigest(i.mirror, i.tag)
+		if err == nil || IsNotFoundError(err) {
+			return d, err
+		}
+		log.Debugf("Head manifest of %s/%s:%s error, get it instead: %v", i.mirror, i.repository, i.tag, err)
+	}
+
+	manifestByte, _, err := i.GetManifest()
+	if err != nil {
+		return "", err
+	}
+	return manifest.Digest(manifestByte)
+}
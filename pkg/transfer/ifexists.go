@@ -0,0 +1,124 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"fmt"
+
+	"github.com/containers/image/v5/manifest"
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+const (
+	// IfExistsOverwrite always pushes the image even if the target tag exists
+	IfExistsOverwrite = "overwrite"
+	// IfExistsSkip leaves an existing target tag alone whatever its digest is
+	IfExistsSkip = "skip"
+	// IfExistsFail fails the job permanently if the target tag exists with a different digest
+	IfExistsFail = "fail"
+	// IfExistsUpdate skips the job if the target tag has the same digest, and overwrites it otherwise
+	IfExistsUpdate = "update"
+)
+
+// IfExistsPolicies are the supported policies of JobOptions.IfExists
+var IfExistsPolicies = []string{IfExistsOverwrite, IfExistsSkip, IfExistsFail, IfExistsUpdate}
+
+// ExistsOutcome is what a job did with the target tag by the IfExists policy
+type ExistsOutcome string
+
+const (
+	// ExistsCreated means the target tag did not exist and is pushed
+	ExistsCreated ExistsOutcome = "created"
+	// ExistsOverwritten means the target tag existed and is pushed again
+	ExistsOverwritten ExistsOutcome = "overwritten"
+	// ExistsUnchanged means the target tag has the same digest as source, it is not pushed
+	ExistsUnchanged ExistsOutcome = "unchanged"
+	// ExistsKept means the target tag has a different digest and is kept by the skip policy
+	ExistsKept ExistsOutcome = "kept"
+	// ExistsRefused means the target tag has a different digest and the job fails by the fail policy
+	ExistsRefused ExistsOutcome = "refused"
+)
+
+// ifExistsPolicy returns the IfExists policy of the job, SkipSameDigest turns the default
+// overwrite policy to update
+func (j *Job) ifExistsPolicy() string {
+	policy := j.options.IfExists
+	if policy == "" {
+		policy = IfExistsOverwrite
+	}
+	if policy == IfExistsOverwrite && j.options.SkipSameDigest {
+		policy = IfExistsUpdate
+	}
+	return policy
+}
+
+// checkExisting heads the target manifest and decides by the IfExists policy if the manifest
+// should be pushed, the outcome is recorded in the stats of the job. true is returned if the job
+// is done without pushing
+func (j *Job) checkExisting(manifestByte []byte) (bool, error) {
+	policy := j.ifExistsPolicy()
+	sourceDigest, err := manifest.Digest(manifestByte)
+	if err != nil {
+		log.Errorf("Compute manifest digest of %s/%s:%s error: %v",
+			j.Source.GetRegistry(), j.Source.GetRepository(), j.Source.GetTag(), err)
+		return false, err
+	}
+
+	targetDigest, err := j.Target.GetManifestDigest()
+	switch {
+	case err != nil && IsNotFoundError(err):
+		j.stats.Exists = ExistsCreated
+		return false, nil
+	case err != nil && (policy == IfExistsOverwrite || policy == IfExistsUpdate):
+		// an unreadable target manifest means the tag needs to be pushed
+		log.Warnf("Get manifest digest of %s/%s:%s error, push it: %v", j.Target.GetRegistry(),
+			j.Target.GetRepository(), j.Target.GetTag(), err)
+		return false, nil
+	case err != nil:
+		// the target is not clobbered if it can not be checked
+		return false, fmt.Errorf("get manifest digest of %s/%s:%s for ifExists=%s error: %v",
+			j.Target.GetRegistry(), j.Target.GetRepository(), j.Target.GetTag(), policy, err)
+	case policy == IfExistsOverwrite:
+		j.stats.Exists = ExistsOverwritten
+		return false, nil
+	case targetDigest == sourceDigest:
+		log.Infof("%s/%s:%s has the same digest %s as source, skip it", j.Target.GetRegistry(),
+			j.Target.GetRepository(), j.Target.GetTag(), sourceDigest)
+		j.stats.Exists = ExistsUnchanged
+		j.stats.Skipped = true
+		return true, nil
+	case policy == IfExistsSkip:
+		log.Infof("%s/%s:%s exists with digest %s, source digest is %s, keep it by ifExists=skip",
+			j.Target.GetRegistry(), j.Target.GetRepository(), j.Target.GetTag(), targetDigest, sourceDigest)
+		j.stats.Exists = ExistsKept
+		j.stats.ManifestDigest = targetDigest
+		j.stats.Skipped = true
+		return true, nil
+	case policy == IfExistsFail:
+		j.stats.Exists = ExistsRefused
+		return false, NewPermanentError(fmt.Errorf("%s/%s:%s exists with digest %s different from source "+
+			"digest %s, it is not overwritten by ifExists=fail", j.Target.GetRegistry(),
+			j.Target.GetRepository(), j.Target.GetTag(), targetDigest, sourceDigest))
+	default:
+		log.Infof("%s/%s:%s has digest %s, update it to source digest %s", j.Target.GetRegistry(),
+			j.Target.GetRepository(), j.Target.GetTag(), targetDigest, sourceDigest)
+		j.stats.Exists = ExistsOverwritten
+		return false, nil
+	}
+}
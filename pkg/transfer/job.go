@@ -19,33 +19,271 @@
 package transfer
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
 	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
 	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/utils"
 )
 
 var (
 	// NoCache used to disable a blobinfocache
 	NoCache = none.NoCache
+	// UserAgent is the User-Agent of the requests to registries, it is set by the userAgent flag
+	UserAgent = utils.DefaultUserAgent()
 )
 
 // Job act as a sync action, it will pull a images from source to target
 type Job struct {
 	Source *ImageSource
 	Target *ImageTarget
+	// Rule is the source of the rule which generated the job, it is empty if the job has no rule
+	Rule string
+
+	options *JobOptions
+	stats   JobStats
+	// recompressed are the layers re-compressed by the last copy by their pushed digests
+	recompressed map[digest.Digest]*recompressedLayer
+	// uploads are the chunked uploads which failed, they are resumed by the next run
+	uploads map[digest.Digest]*blobUpload
+}
+
+// JobStats are the statistics of a job
+type JobStats struct {
+	// Attempts is the number of runs of the job
+	Attempts int
+	// Bytes is the size of blobs transferred by the last run
+	Bytes int64
+	// Duration is the total duration of all runs
+	Duration time.Duration
+	// Skipped is true if the last run found the same digest on target and skipped the job
+	Skipped bool
+	// Verify is the result of the last run of a verify job, it is empty for a transfer job
+	Verify VerifyResult
+	// SourceDigest and TargetDigest are the manifest digests compared by a verify job, SourceDigest of a
+	// transfer job is the digest of the source manifest resolved by the last run before it is rewritten
+	SourceDigest digest.Digest
+	TargetDigest digest.Digest
+	// Referrers is the number of referrers copied by the last run
+	Referrers int
+	// SignatureCopied is true if the last run copied the cosign signature of the image
+	SignatureCopied bool
+	// PushedDigest is the manifest digest pushed by the last run if the manifest is rewritten by
+	// TargetManifestType or DropAnnotations, it is empty if the source manifest is pushed as is
+	PushedDigest digest.Digest
+	// Immutable is true if the last run was rejected by the immutable target tag which already
+	// has the same digest, the job is skipped
+	Immutable bool
+	// Exists is what the last run did with the target tag by the IfExists policy, it is empty
+	// if the target is not checked
+	Exists ExistsOutcome
+	// VerifiedDigest is the target manifest digest confirmed by VerifyAfterPush or DeepVerify,
+	// it is empty if the last run did not verify the target
+	VerifiedDigest digest.Digest
+	// ManifestDigest is the manifest digest which the target tag refers to after a successful run,
+	// it is the pushed digest or the digest of the existing target tag kept by IfExists
+	ManifestDigest digest.Digest
+	// Filtered is true if the last run skipped the image as its labels do not match LabelSelector,
+	// Skipped is true too
+	Filtered bool
+}
+
+// VerifyResult is the result of comparing a target tag with its source
+type VerifyResult string
+
+const (
+	// VerifyMatched means the target tag has the same manifest digest as source
+	VerifyMatched VerifyResult = "matched"
+	// VerifyMissing means the target tag does not exist
+	VerifyMissing VerifyResult = "missing"
+	// VerifyMismatched means the target tag has a manifest digest different from source
+	VerifyMismatched VerifyResult = "mismatched"
+	// VerifyPresent means the target tag exists, the digests are not compared by a diff job
+	VerifyPresent VerifyResult = "present"
+)
+
+// AuthRefresher queries the auth information of a registry repository again after it is rejected,
+// the credential providers are invoked again, e.g. a short-lived token is renewed
+type AuthRefresher func(registry, repository string) (username, password string, err error)
+
+// JobOptions are the options shared by the transfer jobs of a run
+type JobOptions struct {
+	// KnownBlobs are the blobs pushed or found on targets earlier in this run, they will not be checked
+	// or pushed again. A blob known in another repository of the target registry is mounted from there
+	// instead of pushed. It may be nil.
+	KnownBlobs *BlobSet
+
+	// SkipSameDigest skips the job if the target tag already has the same manifest digest as source,
+	// it turns the overwrite policy of IfExists to update
+	SkipSameDigest bool
+
+	// IfExists is the policy when the target tag exists, one of IfExistsPolicies, it is checked by
+	// a HEAD request of the target manifest. The target is not checked if it is empty
+	IfExists string
+
+	// VerifyAfterPush re-fetches the target manifest after push, the job fails
+	// if its digest differs from source
+	VerifyAfterPush bool
+
+	// DeepVerify checks every blob of the image exists on target after push besides the manifest
+	// digest, it implies VerifyAfterPush
+	DeepVerify bool
+
+	// CopyTimeout is the max duration of a job, 0 means no timeout
+	CopyTimeout time.Duration
+
+	// Context cancels the jobs in progress when it is done, e.g. the run is aborted, it may be nil
+	Context context.Context
+
+	// VerifyOnly compares the manifest digests of source and target instead of transferring the image
+	VerifyOnly bool
+
+	// DiffOnly only checks if the target tag exists by the tags of the target repository in TargetTags,
+	// neither the source nor the target manifest is fetched
+	DiffOnly bool
+	// TargetTags caches the tags of target repositories for DiffOnly
+	TargetTags *TagListCache
+
+	// CopyReferrers copies the artifacts which refer to the image like signatures and SBOMs,
+	// they are discovered by the referrers API of the source registry
+	CopyReferrers bool
+
+	// CopySignatures copies the cosign signature tag sha256-<digest>.sig of the image if it exists
+	CopySignatures bool
+
+	// TargetManifestType converts the manifests to v2s2 or oci before pushing, the source type is
+	// pushed if it is empty
+	TargetManifestType string
+
+	// DropAnnotations drops the oci annotations whose keys match any of them before pushing,
+	// the annotations are preserved verbatim if it is empty
+	DropAnnotations []*regexp.Regexp
+
+	// LabelSelector transfers only the images whose config labels match all of it, a label with an
+	// empty value only requires the key. The images are not filtered if it is empty
+	LabelSelector map[string]string
+
+	// Platforms like linux/arm64 keeps only these instances of manifest lists, the other instances and
+	// their blobs are not transferred. An image manifest is transferred as is. All instances are kept if
+	// it is empty
+	Platforms []string
+
+	// LayerCompression re-compresses the layers to gzip or zstd before pushing, the manifests refer to the
+	// re-compressed layers. The layers already compressed by it are pushed as is. It is empty if the
+	// layers are pushed as is
+	LayerCompression string
+	// RecompressedLayers caches the digests of the layers re-compressed in this run, it may be nil
+	RecompressedLayers *RecompressedLayers
+
+	// UploadChunkSize uploads the blobs larger than it to registries in chunks of it, a failed upload is
+	// resumed from the offset acknowledged by the registry when the job is retried. The blobs are uploaded
+	// as a whole if it is 0 or the registry does not support chunked uploads
+	UploadChunkSize int64
+
+	// RefreshAuth refreshes the auth information of source and target after a 401 or 403 during
+	// a copy, the copy is tried again in the same run if any of them changes. It may be nil
+	RefreshAuth AuthRefresher
 }
 
 // NewJob creates a transfer job
-func NewJob(source *ImageSource, target *ImageTarget) *Job {
+func NewJob(source *ImageSource, target *ImageTarget, options *JobOptions) *Job {
+	if options == nil {
+		options = &JobOptions{}
+	}
 
 	return &Job{
-		Source: source,
-		Target: target,
+		Source:  source,
+		Target:  target,
+		options: options,
 	}
 }
 
 // Run is the main function of a transfer job
-func (j *Job) Run() error {
+func (j *Job) Run() (err error) {
+	start := time.Now()
+	j.stats.Attempts++
+	j.stats.Bytes = 0
+	j.stats.Skipped = false
+	j.stats.Verify = ""
+	j.stats.Referrers = 0
+	j.stats.SignatureCopied = false
+	j.stats.Exists = ""
+	j.stats.PushedDigest = ""
+	j.stats.Immutable = false
+	j.stats.VerifiedDigest = ""
+	j.stats.ManifestDigest = ""
+	j.stats.SourceDigest = ""
+	j.stats.TargetDigest = ""
+	j.stats.Filtered = false
+	defer func() {
+		j.stats.Duration += time.Since(start)
+	}()
+
+	if parent := j.options.Context; parent != nil {
+		if parent.Err() != nil {
+			return NewPermanentError(fmt.Errorf("job is cancelled: %v", parent.Err()))
+		}
+		defer j.withCancel(parent)()
+	}
+
+	if j.options.CopyTimeout > 0 {
+		ctx, restore := j.withTimeout(j.options.CopyTimeout)
+		defer func() {
+			if err != nil && ctx.Err() == context.DeadlineExceeded {
+				err = fmt.Errorf("copy timed out after %v: %v", j.options.CopyTimeout, err)
+			}
+			restore()
+		}()
+	}
+
+	if j.options.DiffOnly {
+		return j.diff()
+	}
+	if j.options.VerifyOnly {
+		return j.verify()
+	}
+
+	err = j.copyImage()
+	// a short-lived token may expire during a long copy, a plain retry would reuse it
+	if IsUnauthorizedError(err) && j.refreshAuth() {
+		log.Infof("Auth information of %s/%s:%s is refreshed, copy it again: %v", j.Source.GetRegistry(),
+			j.Source.GetRepository(), j.Source.GetTag(), err)
+		err = j.copyImage()
+	}
+	return err
+}
+
+// copyImage copies the image from source to target, the target is reopened if closed by the last copy
+func (j *Job) copyImage() (err error) {
+	if err := j.Target.reopen(); err != nil {
+		log.Errorf("Reopen %s/%s:%s error: %v", j.Target.GetRegistry(),
+			j.Target.GetRepository(), j.Target.GetTag(), err)
+		return err
+	}
+
+	// an archive target is written when closed
+	if j.Target.closeAfterRun {
+		defer func() {
+			if closeErr := j.Target.Close(); closeErr != nil {
+				log.Errorf("Close %s/%s:%s error: %v", j.Target.GetRegistry(),
+					j.Target.GetRepository(), j.Target.GetTag(), closeErr)
+				if err == nil {
+					err = closeErr
+				}
+			}
+		}()
+	}
+
+	// the re-compressed layers are kept in temporary files until pushed
+	defer j.removeRecompressedLayers()
+
 	// get manifest from source
 	manifestByte, manifestType, err := j.Source.GetManifest()
 	if err != nil {
@@ -54,16 +292,360 @@ func (j *Job) Run() error {
 		return err
 	}
 	log.Infof("Get manifest from %s/%s:%s", j.Source.GetRegistry(), j.Source.GetRepository(), j.Source.GetTag())
+	if j.stats.SourceDigest, err = manifest.Digest(manifestByte); err != nil {
+		return err
+	}
+
+	// the labels are read after the manifest which the copy needs anyway is fetched
+	if len(j.options.LabelSelector) != 0 {
+		labels, err := j.Source.GetConfigLabels(manifestByte, manifestType)
+		if err != nil {
+			log.Errorf("Get labels of %s/%s:%s error: %v", j.Source.GetRegistry(),
+				j.Source.GetRepository(), j.Source.GetTag(), err)
+			return err
+		}
+		if !MatchLabels(labels, j.options.LabelSelector) {
+			log.Infof("Labels of %s/%s:%s do not match %v, skip it", j.Source.GetRegistry(),
+				j.Source.GetRepository(), j.Source.GetTag(), j.options.LabelSelector)
+			j.stats.Skipped = true
+			j.stats.Filtered = true
+			return nil
+		}
+	}
+
+	// the instances of other platforms are dropped before the blobs are listed
+	originManifestByte := manifestByte
+	if manifestByte, err = j.filterPlatforms(manifestByte, manifestType); err != nil {
+		log.Errorf("Filter platforms of %s/%s:%s error: %v", j.Source.GetRegistry(),
+			j.Source.GetRepository(), j.Source.GetTag(), err)
+		return err
+	}
 
-	blobInfos, err := j.Source.GetBlobInfos(manifestByte, manifestType)
+	// the blobs are listed by the source manifest, the converted instances of a manifest list
+	// do not exist on source
+	sourceManifestByte, sourceManifestType := manifestByte, manifestType
+	manifestByte, manifestType, rewrittenInstances, err := j.rewriteManifest(manifestByte, manifestType)
+	if err != nil {
+		log.Errorf("Rewrite manifest of %s/%s:%s error: %v", j.Source.GetRegistry(),
+			j.Source.GetRepository(), j.Source.GetTag(), err)
+		return err
+	}
+	if j.stats.ManifestDigest, err = manifest.Digest(manifestByte); err != nil {
+		return err
+	}
+	rewritten := !bytes.Equal(manifestByte, originManifestByte)
+	if rewritten {
+		j.stats.PushedDigest = j.stats.ManifestDigest
+		log.Infof("The manifest of %s/%s:%s is rewritten, the digest pushed is %s", j.Source.GetRegistry(),
+			j.Source.GetRepository(), j.Source.GetTag(), j.stats.PushedDigest)
+	}
+
+	// an archive target is rewritten as a whole, it is always written
+	if !j.Target.closeAfterRun && (j.options.IfExists != "" || j.options.SkipSameDigest) {
+		if done, err := j.checkExisting(manifestByte); done || err != nil {
+			return err
+		}
+	}
+
+	blobInfos, err := j.Source.GetBlobInfos(sourceManifestByte, sourceManifestType)
 	if err != nil {
 		log.Errorf("Get blob info from %s/%s:%s error: %v",
 			j.Source.GetRegistry(), j.Source.GetRepository(), j.Source.GetTag(), err)
 		return err
 	}
+	blobInfos = j.pushedBlobInfos(blobInfos)
+
+	if err := j.transferBlobs(blobInfos); err != nil {
+		return err
+	}
+
+	//Push manifest list
+	if IsManifestList(manifestType) {
+		instances, err := GetManifestListInstances(manifestByte, manifestType)
+		if err != nil {
+			return err
+		}
+
+		var subManifestByte []byte
+
+		// push manifest to target
+		for _, instance := range instances {
+
+			log.Infof("handle manifest OS:%s Architecture:%s ", instance.OS, instance.Architecture)
+
+			subManifestByte, err = j.getPushedInstance(instance.Digest, rewrittenInstances)
+			if err != nil {
+				log.Errorf("Get manifest %v of OS:%s Architecture:%s for manifest list error: %v",
+					instance.Digest, instance.OS, instance.Architecture, err)
+				return err
+			}
+
+			if err := j.Target.PushManifest(subManifestByte); err != nil {
+				if IsImmutableTagError(err) {
+					return j.immutableTag(manifestByte, err)
+				}
+				log.Errorf("Put manifest to %s/%s:%s error: %v", j.Target.GetRegistry(),
+					j.Target.GetRepository(), j.Target.GetTag(), err)
+				return err
+			}
+
+			log.Infof("Put manifest to %s/%s:%s os:%s arch:%s", j.Target.GetRegistry(), j.Target.GetRepository(),
+				j.Target.GetTag(), instance.OS, instance.Architecture)
+
+		}
+
+		// push manifest list to target
+		if err := j.Target.PushManifest(manifestByte); err != nil {
+			if IsImmutableTagError(err) {
+				return j.immutableTag(manifestByte, err)
+			}
+			log.Errorf("Put manifestList to %s/%s:%s error: %v", j.Target.GetRegistry(),
+				j.Target.GetRepository(), j.Target.GetTag(), err)
+			return err
+		}
+
+		log.Infof("Put manifestList to %s/%s:%s", j.Target.GetRegistry(), j.Target.GetRepository(), j.Target.GetTag())
+
+	} else {
+
+		// push manifest to target
+		if err := j.Target.PushManifest(manifestByte); err != nil {
+			if IsImmutableTagError(err) {
+				return j.immutableTag(manifestByte, err)
+			}
+			log.Errorf("Put manifest to %s/%s:%s error: %v", j.Target.GetRegistry(),
+				j.Target.GetRepository(), j.Target.GetTag(), err)
+			return err
+		}
+
+		log.Infof("Put manifest to %s/%s:%s", j.Target.GetRegistry(), j.Target.GetRepository(), j.Target.GetTag())
+	}
+
+	// a local target like oci layout is written when committed
+	if err := j.Target.Commit(); err != nil {
+		log.Errorf("Commit %s/%s:%s error: %v", j.Target.GetRegistry(),
+			j.Target.GetRepository(), j.Target.GetTag(), err)
+		return err
+	}
+
+	// an archive target is not readable until closed, it is not verified
+	if (j.options.VerifyAfterPush || j.options.DeepVerify) && !j.Target.closeAfterRun {
+		if err := j.verifyPushedDigest(manifestByte, blobInfos); err != nil {
+			log.Errorf("Verify %s/%s:%s error: %v", j.Target.GetRegistry(),
+				j.Target.GetRepository(), j.Target.GetTag(), err)
+			return err
+		}
+	}
+
+	// the referrers and signatures refer to the source digest, they do not apply to a rewritten manifest
+	if rewritten && (j.options.CopyReferrers || j.options.CopySignatures) {
+		log.Warnf("The manifest of %s/%s:%s is rewritten, its referrers and signature are not copied",
+			j.Source.GetRegistry(), j.Source.GetRepository(), j.Source.GetTag())
+	}
+
+	// referrers are pushed by digest, they can not be written to a local target
+	if j.options.CopyReferrers && !j.Target.local && !rewritten {
+		if err := j.copyReferrers(manifestByte); err != nil {
+			log.Errorf("Copy referrers of %s/%s:%s error: %v", j.Source.GetRegistry(),
+				j.Source.GetRepository(), j.Source.GetTag(), err)
+			return err
+		}
+	}
+
+	// a local target holds the tag of the image only
+	if j.options.CopySignatures && !j.Target.local && !rewritten {
+		if err := j.copySignature(manifestByte); err != nil {
+			log.Errorf("Copy signature of %s/%s:%s error: %v", j.Source.GetRegistry(),
+				j.Source.GetRepository(), j.Source.GetTag(), err)
+			return err
+		}
+	}
+
+	log.Infof("Synchronization successfully from %s/%s:%s to %s/%s:%s", j.Source.GetRegistry(), j.Source.GetRepository(),
+		j.Source.GetTag(), j.Target.GetRegistry(), j.Target.GetRepository(), j.Target.GetTag())
+
+	return nil
+}
+
+// refreshAuth queries the auth information of the registry source and target again, the source and
+// target are recreated with the changed auth information, it returns true if any of them changes
+func (j *Job) refreshAuth() bool {
+	if j.options.RefreshAuth == nil {
+		return false
+	}
+
+	refreshed := false
+	if j.Source.transport == "" {
+		username, password, err := j.options.RefreshAuth(j.Source.GetMirror(), j.Source.GetRepository())
+		if err == nil {
+			var changed bool
+			changed, err = j.Source.resetAuth(username, password)
+			refreshed = refreshed || changed
+		}
+		if err != nil {
+			log.Warnf("Refresh auth information of %s/%s error: %v", j.Source.GetMirror(),
+				j.Source.GetRepository(), err)
+		}
+	}
+	if !j.Target.local {
+		username, password, err := j.options.RefreshAuth(j.Target.GetRegistry(), j.Target.GetRepository())
+		if err == nil {
+			var changed bool
+			changed, err = j.Target.resetAuth(username, password)
+			refreshed = refreshed || changed
+		}
+		if err != nil {
+			log.Warnf("Refresh auth information of %s/%s error: %v", j.Target.GetRegistry(),
+				j.Target.GetRepository(), err)
+		}
+	}
+	return refreshed
+}
+
+// immutableTag handles the rejection of an immutable target tag, the job is skipped if the target tag
+// already has the digest of manifestByte, otherwise a PermanentError is returned as retries fail again
+func (j *Job) immutableTag(manifestByte []byte, pushErr error) error {
+	sourceDigest, err := manifest.Digest(manifestByte)
+	if err != nil {
+		return err
+	}
+	targetDigest, err := j.Target.GetManifestDigest()
+	if err != nil {
+		return NewPermanentError(fmt.Errorf("tag is immutable, get its digest error: %v: %v", err, pushErr))
+	}
+	if targetDigest != sourceDigest {
+		log.Errorf("%s/%s:%s is immutable with digest %s, mismatches source digest %s", j.Target.GetRegistry(),
+			j.Target.GetRepository(), j.Target.GetTag(), targetDigest, sourceDigest)
+		return NewPermanentError(fmt.Errorf("tag is immutable with digest %s different from source digest %s: %v",
+			targetDigest, sourceDigest, pushErr))
+	}
+
+	log.Infof("%s/%s:%s is immutable and has the same digest %s as source, skip it", j.Target.GetRegistry(),
+		j.Target.GetRepository(), j.Target.GetTag(), sourceDigest)
+	j.stats.Skipped = true
+	j.stats.Immutable = true
+	return nil
+}
+
+// getInstanceManifest gets an instance of the source manifest list by digest
+func (j *Job) getInstanceManifest(d digest.Digest) ([]byte, string, error) {
+	return j.Source.source.GetManifest(j.Source.ctx, &d)
+}
+
+// getPushedInstance gets an instance of the pushed manifest list, a rewritten instance
+// is in rewrittenInstances and the others are got from source
+func (j *Job) getPushedInstance(d digest.Digest, rewrittenInstances map[digest.Digest][]byte) ([]byte, error) {
+	if instance, ok := rewrittenInstances[d]; ok {
+		return instance, nil
+	}
+	instance, _, err := j.getInstanceManifest(d)
+	return instance, err
+}
+
+// rewritesManifest checks if the manifest pushed may differ from source by TargetManifestType,
+// DropAnnotations, Platforms or LayerCompression
+func (j *Job) rewritesManifest() bool {
+	return j.options.TargetManifestType != "" || len(j.options.DropAnnotations) != 0 ||
+		len(j.options.Platforms) != 0 || j.options.LayerCompression != ""
+}
 
-	// blob transformation
+// filterPlatforms keeps the instances of Platforms of a manifest list m of type t
+func (j *Job) filterPlatforms(m []byte, t string) ([]byte, error) {
+	if len(j.options.Platforms) == 0 || !IsManifestList(t) {
+		return m, nil
+	}
+	return FilterPlatforms(m, t, j.options.Platforms)
+}
+
+// rewriteManifest converts the source manifest to TargetManifestType, drops the annotations matched by
+// DropAnnotations and re-compresses the layers by LayerCompression, the rewritten instances of a manifest
+// list are returned by their digests
+func (j *Job) rewriteManifest(m []byte, t string) ([]byte, string, map[digest.Digest][]byte, error) {
+	instances := make(map[digest.Digest][]byte)
+	getInstance := func(d digest.Digest) ([]byte, string, error) {
+		if instance, ok := instances[d]; ok {
+			return instance, "", nil
+		}
+		return j.getInstanceManifest(d)
+	}
+
+	if j.options.TargetManifestType != "" {
+		converted, convertedType, convertedInstances, err := ConvertManifest(m, t, j.options.TargetManifestType,
+			getInstance)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("convert to %s error: %v", j.options.TargetManifestType, err)
+		}
+		m, t = converted, convertedType
+		for d, instance := range convertedInstances {
+			instances[d] = instance
+		}
+	}
+	if len(j.options.DropAnnotations) != 0 {
+		stripped, strippedType, strippedInstances, err := DropAnnotations(m, t, j.options.DropAnnotations,
+			getInstance)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("drop annotations error: %v", err)
+		}
+		m, t = stripped, strippedType
+		for d, instance := range strippedInstances {
+			instances[d] = instance
+		}
+	}
+	if j.options.LayerCompression != "" {
+		recompressed, recompressedType, recompressedInstances, err := RecompressLayers(m, t,
+			j.options.LayerCompression, getInstance, j.recompressLayer)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("re-compress layers by %s error: %v", j.options.LayerCompression, err)
+		}
+		m, t = recompressed, recompressedType
+		for d, instance := range recompressedInstances {
+			instances[d] = instance
+		}
+	}
+	return m, t, instances, nil
+}
+
+// rewrittenSourceDigest returns the digest of the source manifest rewritten by rewriteManifest
+func (j *Job) rewrittenSourceDigest() (digest.Digest, error) {
+	defer j.removeRecompressedLayers()
+
+	manifestByte, manifestType, err := j.Source.GetManifest()
+	if err != nil {
+		return "", err
+	}
+	if manifestByte, err = j.filterPlatforms(manifestByte, manifestType); err != nil {
+		return "", err
+	}
+	rewritten, _, _, err := j.rewriteManifest(manifestByte, manifestType)
+	if err != nil {
+		return "", err
+	}
+	return manifest.Digest(rewritten)
+}
+
+// transferBlobs pushes the blobs which are missing on target from source
+func (j *Job) transferBlobs(blobInfos []types.BlobInfo) error {
 	for _, blobinfo := range blobInfos {
+		if j.isKnownBlob(blobinfo) {
+			log.Infof("Blob %s(%v) has been pushed to %s in this run, will not be pulled", blobinfo.Digest,
+				blobinfo.Size, j.Target.GetRegistry()+"/"+j.Target.GetRepository())
+			continue
+		}
+
+		// a blob pushed to another repository of the registry is mounted from there
+		if from := j.knownBlobRepository(blobinfo); from != "" {
+			mounted, err := j.Target.mountBlob(from, blobinfo)
+			if err != nil {
+				log.Warnf("Mount blob %s(%v) from %s to %s/%s error, will push it: %v", blobinfo.Digest,
+					blobinfo.Size, from, j.Target.GetRegistry(), j.Target.GetRepository(), err)
+			} else if mounted {
+				log.Infof("Mount blob %s(%v) from %s to %s/%s success, will not be pulled", blobinfo.Digest,
+					blobinfo.Size, from, j.Target.GetRegistry(), j.Target.GetRepository())
+				j.addKnownBlob(blobinfo)
+				continue
+			}
+		}
+
 		blobExist, err := j.Target.CheckBlobExist(blobinfo)
 		if err != nil {
 			log.Errorf("Check blob %s(%v) to %s/%s:%s exist error: %v",
@@ -72,9 +654,22 @@ func (j *Job) Run() error {
 		}
 
 		if !blobExist {
+			// a large blob is uploaded in chunks which are resumed after a failure
+			if pushed, err := j.putBlobInChunks(blobinfo); err != nil {
+				log.Errorf("Put blob %s(%v) to %s/%s:%s in chunks failed: %v", blobinfo.Digest, blobinfo.Size,
+					j.Target.GetRegistry(), j.Target.GetRepository(), j.Target.GetTag(), err)
+				return err
+			} else if pushed {
+				log.Infof("Put blob %s(%v) to %s/%s:%s in chunks success", blobinfo.Digest, blobinfo.Size,
+					j.Target.GetRegistry(), j.Target.GetRepository(), j.Target.GetTag())
+				j.stats.Bytes += blobinfo.Size
+				j.addKnownBlob(blobinfo)
+				continue
+			}
+
 			// pull a blob from source
 			log.Infof("Getting blob from %s/%s:%s ing...", j.Source.GetRegistry(), j.Source.GetRepository(), j.Source.GetTag())
-			blob, size, err := j.Source.GetABlob(blobinfo)
+			blob, size, err := j.openBlob(blobinfo)
 			if err != nil {
 				log.Errorf("Get blob %s(%v) from %s/%s:%s failed: %v", blobinfo.Digest,
 					size, j.Source.GetRegistry(), j.Source.GetRepository(), j.Source.GetTag(), err)
@@ -95,70 +690,243 @@ func (j *Job) Run() error {
 
 			log.Infof("Put blob %s(%v) to %s/%s:%s success", blobinfo.Digest, blobinfo.Size,
 				j.Target.GetRegistry(), j.Target.GetRepository(), j.Target.GetTag())
+			j.stats.Bytes += blobinfo.Size
 		} else {
 			// print the log of ignored blob
 			log.Infof("Blob %s(%v) has been pushed to %s, will not be pulled", blobinfo.Digest,
 				blobinfo.Size, j.Target.GetRegistry()+"/"+j.Target.GetRepository())
 		}
+
+		j.addKnownBlob(blobinfo)
+	}
+	return nil
+}
+
+// copyReferrers copies the referrers of the manifest from source to target, the referrer manifests
+// are pushed by digest. A source registry without the referrers API is skipped with a warning.
+func (j *Job) copyReferrers(manifestByte []byte) error {
+	subject, err := manifest.Digest(manifestByte)
+	if err != nil {
+		return fmt.Errorf("compute manifest digest error: %v", err)
 	}
 
-	//Push manifest list
-	if manifestType == manifest.DockerV2ListMediaType {
-		manifestSchemaListInfo, err := manifest.Schema2ListFromManifest(manifestByte)
+	referrers, err := j.Source.GetReferrers(subject)
+	if err == ErrReferrersUnsupported {
+		log.Warnf("%s/%s does not support the referrers api, referrers of %s are not copied",
+			j.Source.GetRegistry(), j.Source.GetRepository(), subject)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, referrer := range referrers {
+		referrerByte, referrerType, err := j.Source.GetManifestByDigest(referrer.Digest)
 		if err != nil {
+			return fmt.Errorf("get referrer %s error: %v", referrer.Digest, err)
+		}
+		if IsManifestList(referrerType) {
+			log.Warnf("Referrer %s of %s is an image index, it is not copied", referrer.Digest, subject)
+			continue
+		}
+
+		blobInfos, err := artifactBlobInfos(referrerByte, referrerType)
+		if err != nil {
+			return fmt.Errorf("parse referrer %s error: %v", referrer.Digest, err)
+		}
+		if err := j.transferBlobs(blobInfos); err != nil {
 			return err
 		}
+		if err := j.Target.PushManifestByDigest(referrerByte, referrer.Digest); err != nil {
+			return fmt.Errorf("put referrer %s error: %v", referrer.Digest, err)
+		}
 
-		var subManifestByte []byte
+		log.Infof("Copy referrer %s(%s) of %s to %s/%s", referrer.Digest, referrer.ArtifactType, subject,
+			j.Target.GetRegistry(), j.Target.GetRepository())
+		j.stats.Referrers++
+	}
 
-		// push manifest to target
-		for _, manifestDescriptorElem := range manifestSchemaListInfo.Manifests {
+	return nil
+}
 
-			log.Infof("handle manifest OS:%s Architecture:%s ", manifestDescriptorElem.Platform.OS,
-				manifestDescriptorElem.Platform.Architecture)
+// Stats returns the statistics of the job
+func (j *Job) Stats() JobStats {
+	return j.stats
+}
 
-			subManifestByte, _, err = j.Source.source.GetManifest(j.Source.ctx, &manifestDescriptorElem.Digest)
-			if err != nil {
-				log.Errorf("Get manifest %v of OS:%s Architecture:%s for manifest list error: %v",
-					manifestDescriptorElem.Digest, manifestDescriptorElem.Platform.OS,
-					manifestDescriptorElem.Platform.Architecture, err)
-				return err
-			}
+// withTimeout makes the source and target of the job use a context with timeout, the returned
+// function cancels the context and restores the original contexts for the next run of the job
+func (j *Job) withTimeout(timeout time.Duration) (context.Context, func()) {
+	sourceCtx, targetCtx := j.Source.ctx, j.Target.ctx
 
-			if err := j.Target.PushManifest(subManifestByte); err != nil {
-				log.Errorf("Put manifest to %s/%s:%s error: %v", j.Target.GetRegistry(),
-					j.Target.GetRepository(), j.Target.GetTag(), err)
-				return err
-			}
+	// source and target share the same deadline
+	deadline := time.Now().Add(timeout)
+	var cancelSource, cancelTarget context.CancelFunc
+	j.Source.ctx, cancelSource = context.WithDeadline(sourceCtx, deadline)
+	j.Target.ctx, cancelTarget = context.WithDeadline(targetCtx, deadline)
+	ctx := j.Source.ctx
 
-			log.Infof("Put manifest to %s/%s:%s os:%s arch:%s", j.Target.GetRegistry(), j.Target.GetRepository(),
-				j.Target.GetTag(), manifestDescriptorElem.Platform.OS, manifestDescriptorElem.Platform.Architecture)
+	return ctx, func() {
+		cancelSource()
+		cancelTarget()
+		j.Source.ctx, j.Target.ctx = sourceCtx, targetCtx
+	}
+}
 
-		}
+// withCancel makes the source and target of the job use contexts which are cancelled with parent,
+// the returned function restores the original contexts for the next run of the job
+func (j *Job) withCancel(parent context.Context) func() {
+	sourceCtx, targetCtx := j.Source.ctx, j.Target.ctx
 
-		// push manifest list to target
-		if err := j.Target.PushManifest(manifestByte); err != nil {
-			log.Errorf("Put manifestList to %s/%s:%s error: %v", j.Target.GetRegistry(),
-				j.Target.GetRepository(), j.Target.GetTag(), err)
-			return err
+	var cancelSource, cancelTarget context.CancelFunc
+	j.Source.ctx, cancelSource = context.WithCancel(sourceCtx)
+	j.Target.ctx, cancelTarget = context.WithCancel(targetCtx)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-parent.Done():
+			cancelSource()
+			cancelTarget()
+		case <-done:
 		}
+	}()
 
-		log.Infof("Put manifestList to %s/%s:%s", j.Target.GetRegistry(), j.Target.GetRepository(), j.Target.GetTag())
+	return func() {
+		close(done)
+		cancelSource()
+		cancelTarget()
+		j.Source.ctx, j.Target.ctx = sourceCtx, targetCtx
+	}
+}
 
-	} else {
+// isKnownBlob checks if a blob is known to be present on target in this run
+func (j *Job) isKnownBlob(blobinfo types.BlobInfo) bool {
+	// an archive is rewritten by every job, all blobs need to be written
+	if j.options.KnownBlobs == nil || j.Target.closeAfterRun {
+		return false
+	}
+	return j.options.KnownBlobs.Contains(j.Target.GetRegistry(), j.Target.GetRepository(), blobinfo.Digest)
+}
 
-		// push manifest to target
-		if err := j.Target.PushManifest(manifestByte); err != nil {
-			log.Errorf("Put manifest to %s/%s:%s error: %v", j.Target.GetRegistry(),
-				j.Target.GetRepository(), j.Target.GetTag(), err)
-			return err
+// knownBlobRepository returns another repository of the target registry which a blob is known to be
+// present in this run, it is empty if there is none or target is local
+func (j *Job) knownBlobRepository(blobinfo types.BlobInfo) string {
+	if j.options.KnownBlobs == nil || j.Target.local {
+		return ""
+	}
+	return j.options.KnownBlobs.Repository(j.Target.GetRegistry(), blobinfo.Digest)
+}
+
+// addKnownBlob records a blob which is present on target
+func (j *Job) addKnownBlob(blobinfo types.BlobInfo) {
+	if j.options.KnownBlobs == nil || j.Target.closeAfterRun {
+		return
+	}
+	j.options.KnownBlobs.Add(j.Target.GetRegistry(), j.Target.GetRepository(), blobinfo.Digest)
+}
+
+// verifyPushedDigest checks if the manifest digest of target is the same as source
+// the mismatch errors are not permanent, the job is retried
+func (j *Job) verifyPushedDigest(manifestByte []byte, blobInfos []types.BlobInfo) error {
+	sourceDigest, err := manifest.Digest(manifestByte)
+	if err != nil {
+		return fmt.Errorf("compute source manifest digest error: %v", err)
+	}
+
+	targetDigest, err := j.Target.GetManifestDigest()
+	if err != nil {
+		return fmt.Errorf("get target manifest digest error: %v", err)
+	}
+
+	if targetDigest != sourceDigest {
+		return fmt.Errorf("target manifest digest %s mismatches source manifest digest %s",
+			targetDigest, sourceDigest)
+	}
+
+	if j.options.DeepVerify {
+		for _, blobInfo := range blobInfos {
+			exist, err := j.Target.CheckBlobExist(blobInfo)
+			if err != nil {
+				return fmt.Errorf("check blob %s on target error: %v", blobInfo.Digest, err)
+			}
+			if !exist {
+				// the blob is pushed again when the job is retried
+				if j.options.KnownBlobs != nil {
+					j.options.KnownBlobs.Remove(j.Target.GetRegistry(), j.Target.GetRepository(), blobInfo.Digest)
+				}
+				return fmt.Errorf("blob %s is missing on target", blobInfo.Digest)
+			}
 		}
+	}
 
-		log.Infof("Put manifest to %s/%s:%s", j.Target.GetRegistry(), j.Target.GetRepository(), j.Target.GetTag())
+	j.stats.VerifiedDigest = targetDigest
+	log.Infof("Verify %s/%s:%s success, digest: %s", j.Target.GetRegistry(),
+		j.Target.GetRepository(), j.Target.GetTag(), targetDigest)
+	return nil
+}
+
+// verify compares the manifest digest of target with source, a missing or mismatched target
+// is recorded in the stats of the job rather than returned as an error
+func (j *Job) verify() error {
+	// an archive target is rewritten when closed, it can not be verified
+	if j.Target.closeAfterRun {
+		return NewPermanentError(fmt.Errorf("archive %s can not be verified", j.Target.GetRepository()))
 	}
 
-	log.Infof("Synchronization successfully from %s/%s:%s to %s/%s:%s", j.Source.GetRegistry(), j.Source.GetRepository(),
-		j.Source.GetTag(), j.Target.GetRegistry(), j.Target.GetRepository(), j.Target.GetTag())
+	var err error
+	j.stats.SourceDigest, err = j.Source.GetManifestDigest()
+	if err != nil {
+		log.Errorf("Failed to get manifest digest from %s/%s:%s error: %v",
+			j.Source.GetRegistry(), j.Source.GetRepository(), j.Source.GetTag(), err)
+		return err
+	}
 
+	j.stats.TargetDigest, err = j.Target.GetManifestDigest()
+	// a rewritten target is compared with the rewritten source manifest
+	if err == nil && j.stats.TargetDigest != j.stats.SourceDigest && j.rewritesManifest() {
+		if rewrittenDigest, rewriteErr := j.rewrittenSourceDigest(); rewriteErr != nil {
+			log.Warnf("Rewrite manifest of %s/%s:%s error: %v", j.Source.GetRegistry(),
+				j.Source.GetRepository(), j.Source.GetTag(), rewriteErr)
+		} else {
+			j.stats.SourceDigest = rewrittenDigest
+		}
+	}
+	switch {
+	case err != nil && IsNotFoundError(err):
+		j.stats.Verify = VerifyMissing
+		log.Warnf("%s/%s:%s is missing", j.Target.GetRegistry(), j.Target.GetRepository(), j.Target.GetTag())
+	case err != nil:
+		log.Errorf("Get manifest digest of %s/%s:%s error: %v", j.Target.GetRegistry(),
+			j.Target.GetRepository(), j.Target.GetTag(), err)
+		return err
+	case j.stats.TargetDigest != j.stats.SourceDigest:
+		j.stats.Verify = VerifyMismatched
+		log.Warnf("%s/%s:%s has digest %s, mismatches source digest %s", j.Target.GetRegistry(),
+			j.Target.GetRepository(), j.Target.GetTag(), j.stats.TargetDigest, j.stats.SourceDigest)
+	default:
+		j.stats.Verify = VerifyMatched
+		log.Infof("%s/%s:%s matches source, digest: %s", j.Target.GetRegistry(),
+			j.Target.GetRepository(), j.Target.GetTag(), j.stats.TargetDigest)
+	}
+	return nil
+}
+
+// diff checks if the target tag exists, a missing target is recorded in the stats of the job
+func (j *Job) diff() error {
+	if j.Target.local || j.options.TargetTags == nil {
+		return NewPermanentError(fmt.Errorf("%s can not be diffed", j.Target.GetRepository()))
+	}
+
+	exist, err := j.options.TargetTags.HasTag(j.Target)
+	if err != nil {
+		log.Errorf("List tags of %s/%s error: %v", j.Target.GetRegistry(), j.Target.GetRepository(), err)
+		return err
+	}
+	if exist {
+		j.stats.Verify = VerifyPresent
+		log.Debugf("%s/%s:%s exists", j.Target.GetRegistry(), j.Target.GetRepository(), j.Target.GetTag())
+	} else {
+		j.stats.Verify = VerifyMissing
+		log.Infof("%s/%s:%s is missing", j.Target.GetRegistry(), j.Target.GetRepository(), j.Target.GetTag())
+	}
 	return nil
 }
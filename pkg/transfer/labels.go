@@ -0,0 +1,74 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+)
+
+// GetConfigLabels reads the labels of the image config of a manifest, the labels of the first image are
+// read for a manifest list as the images of all platforms are built from the same source normally
+func (i *ImageSource) GetConfigLabels(manifestByte []byte, manifestType string) (map[string]string, error) {
+	if IsManifestList(manifestType) {
+		instances, err := GetManifestListInstances(manifestByte, manifestType)
+		if err != nil {
+			return nil, err
+		}
+		if len(instances) == 0 {
+			return nil, fmt.Errorf("manifest list has no image")
+		}
+		manifestByte, manifestType, err = i.source.GetManifest(i.ctx, &instances[0].Digest)
+		if err != nil {
+			return nil, fmt.Errorf("get manifest %s of manifest list error: %v", instances[0].Digest, err)
+		}
+	}
+
+	m, err := manifest.FromBlob(manifestByte, manifestType)
+	if err != nil {
+		return nil, err
+	}
+	info, err := m.Inspect(func(blobInfo types.BlobInfo) ([]byte, error) {
+		blob, _, err := i.GetABlob(blobInfo)
+		if err != nil {
+			return nil, err
+		}
+		defer blob.Close()
+		return ioutil.ReadAll(blob)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read image config error: %v", err)
+	}
+	return info.Labels, nil
+}
+
+// MatchLabels checks if labels have all the labels of selector, a label of selector with an empty value
+// only requires the key
+func MatchLabels(labels, selector map[string]string) bool {
+	for key, value := range selector {
+		actual, ok := labels[key]
+		if !ok || (value != "" && actual != value) {
+			return false
+		}
+	}
+	return true
+}
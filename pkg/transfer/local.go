@@ -0,0 +1,55 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"fmt"
+
+	dockerarchive "github.com/containers/image/v5/docker/archive"
+	ociarchive "github.com/containers/image/v5/oci/archive"
+	"github.com/containers/image/v5/oci/layout"
+	"github.com/containers/image/v5/types"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+// parseLocalReference parses the reference of a local image, image is the tag of an oci layout,
+// or the name:tag saved in an archive, it may be empty
+func parseLocalReference(transport, path, image string) (types.ImageReference, error) {
+	// image may be empty
+	imageWithColon := ""
+	if image != "" {
+		imageWithColon = ":" + image
+	}
+
+	switch transport {
+	case utils.OCILayoutTransport:
+		return layout.ParseReference(path + imageWithColon)
+	case utils.DockerArchiveTransport:
+		return dockerarchive.ParseReference(path + imageWithColon)
+	case utils.OCIArchiveTransport:
+		return ociarchive.ParseReference(path + imageWithColon)
+	default:
+		return nil, fmt.Errorf("unsupported local transport: %s", transport)
+	}
+}
+
+// isArchiveTransport checks if a transport is an archive file which is written when closed
+func isArchiveTransport(transport string) bool {
+	return transport == utils.DockerArchiveTransport || transport == utils.OCIArchiveTransport
+}
@@ -22,6 +22,8 @@ import (
 	"fmt"
 
 	"github.com/containers/image/v5/manifest"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 // ManifestSchemaV2List describes a schema V2 manifest list
@@ -53,16 +55,23 @@ func ManifestHandler(m []byte, t string, i *ImageSource) ([]manifest.Manifest, e
 		}
 		manifestInfoSlice = append(manifestInfoSlice, manifestInfo)
 		return manifestInfoSlice, nil
-	} else if t == manifest.DockerV2ListMediaType {
+	} else if t == imgspecv1.MediaTypeImageManifest {
+		manifestInfo, err := manifest.OCI1FromManifest(m)
+		if err != nil {
+			return nil, err
+		}
+		manifestInfoSlice = append(manifestInfoSlice, manifestInfo)
+		return manifestInfoSlice, nil
+	} else if IsManifestList(t) {
 
-		manifestSchemaListInfo, err := manifest.Schema2ListFromManifest(m)
+		instances, err := GetManifestListInstances(m, t)
 		if err != nil {
 			return nil, err
 		}
 
-		for _, manifestDescriptorElem := range manifestSchemaListInfo.Manifests {
+		for _, instance := range instances {
 
-			manifestByte, manifestType, err := i.source.GetManifest(i.ctx, &manifestDescriptorElem.Digest)
+			manifestByte, manifestType, err := i.source.GetManifest(i.ctx, &instance.Digest)
 			if err != nil {
 				return nil, err
 			}
@@ -78,3 +87,52 @@ func ManifestHandler(m []byte, t string, i *ImageSource) ([]manifest.Manifest, e
 	}
 	return nil, fmt.Errorf("unsupported manifest type: %v", t)
 }
+
+// ManifestListInstance is a platform specific manifest of a manifest list
+type ManifestListInstance struct {
+	Digest       digest.Digest
+	OS           string
+	Architecture string
+}
+
+// IsManifestList checks if the manifest type is a docker manifest list or an oci index
+func IsManifestList(t string) bool {
+	return t == manifest.DockerV2ListMediaType || t == imgspecv1.MediaTypeImageIndex
+}
+
+// GetManifestListInstances returns the platform specific manifests of a docker manifest list or an oci index
+func GetManifestListInstances(m []byte, t string) ([]ManifestListInstance, error) {
+	var instances []ManifestListInstance
+
+	switch t {
+	case manifest.DockerV2ListMediaType:
+		manifestSchemaListInfo, err := manifest.Schema2ListFromManifest(m)
+		if err != nil {
+			return nil, err
+		}
+		for _, elem := range manifestSchemaListInfo.Manifests {
+			instances = append(instances, ManifestListInstance{
+				Digest:       elem.Digest,
+				OS:           elem.Platform.OS,
+				Architecture: elem.Platform.Architecture,
+			})
+		}
+	case imgspecv1.MediaTypeImageIndex:
+		index, err := manifest.OCI1IndexFromManifest(m)
+		if err != nil {
+			return nil, err
+		}
+		for _, elem := range index.Manifests {
+			instance := ManifestListInstance{Digest: elem.Digest}
+			if elem.Platform != nil {
+				instance.OS = elem.Platform.OS
+				instance.Architecture = elem.Platform.Architecture
+			}
+			instances = append(instances, instance)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported manifest list type: %v", t)
+	}
+
+	return instances, nil
+}
@@ -0,0 +1,87 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ValidPlatform checks if a platform is like os/arch or os/arch/variant
+func ValidPlatform(platform string) bool {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return false
+	}
+	for _, part := range parts {
+		if part == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// matchPlatform checks if the platform of a manifest list entry is one of platforms, a platform
+// without variant matches all variants of the architecture
+func matchPlatform(platform *convertPlatform, platforms []string) bool {
+	if platform == nil {
+		return false
+	}
+	for _, p := range platforms {
+		parts := strings.Split(p, "/")
+		if parts[0] != platform.OS || parts[1] != platform.Architecture {
+			continue
+		}
+		if len(parts) == 2 || parts[2] == platform.Variant {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterPlatforms keeps the entries of a manifest list or an oci index m of type t whose platforms
+// are in platforms like linux/arm64 or linux/arm/v7, the entries without platform are dropped too.
+// m is returned as is if all entries are kept, a PermanentError is returned if no entry is kept
+func FilterPlatforms(m []byte, t string, platforms []string) ([]byte, error) {
+	var index convertIndex
+	if err := json.Unmarshal(m, &index); err != nil {
+		return nil, fmt.Errorf("parse manifest list error: %v", err)
+	}
+
+	kept := make([]convertDescriptor, 0, len(index.Manifests))
+	for _, entry := range index.Manifests {
+		if matchPlatform(entry.Platform, platforms) {
+			kept = append(kept, entry)
+		}
+	}
+	if len(kept) == 0 {
+		return nil, NewPermanentError(fmt.Errorf("no manifest of the manifest list matches platforms %v",
+			platforms))
+	}
+	if len(kept) == len(index.Manifests) {
+		return m, nil
+	}
+
+	index.Manifests = kept
+	if index.MediaType == "" {
+		index.MediaType = t
+	}
+	return json.Marshal(index)
+}
@@ -0,0 +1,318 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+// ErrReferrersUnsupported means the registry does not support the referrers API
+var ErrReferrersUnsupported = errors.New("referrers api is not supported")
+
+// referrersTimeout is the timeout of a request to the referrers API
+const referrersTimeout = 60 * time.Second
+
+// Referrer is a manifest which refers to another manifest by its subject, e.g. a signature
+type Referrer struct {
+	MediaType    string        `json:"mediaType"`
+	ArtifactType string        `json:"artifactType"`
+	Digest       digest.Digest `json:"digest"`
+	Size         int64         `json:"size"`
+}
+
+// referrersIndex is the response of the referrers API, an image index of the referrers
+type referrersIndex struct {
+	Manifests []Referrer `json:"manifests"`
+}
+
+// GetReferrers lists the artifacts like signatures and SBOMs which refer to the manifest d
+// by the referrers API of the registry, ErrReferrersUnsupported is returned if the registry
+// does not support it
+func (i *ImageSource) GetReferrers(d digest.Digest) ([]Referrer, error) {
+	if i.transport != "" {
+		return nil, ErrReferrersUnsupported
+	}
+
+	base, err := i.apiBase(i.mirror)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := i.registryGet(base+"/v2/"+i.repository+"/referrers/"+d.String(), imgspecv1.MediaTypeImageIndex)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusBadRequest, http.StatusMethodNotAllowed:
+		return nil, ErrReferrersUnsupported
+	default:
+		return nil, fmt.Errorf("list referrers of %s error: status %s", d, resp.Status)
+	}
+
+	// a registry without the referrers API may answer with something else than an image index
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" &&
+		!strings.HasPrefix(contentType, imgspecv1.MediaTypeImageIndex) &&
+		!strings.HasPrefix(contentType, "application/json") {
+		return nil, ErrReferrersUnsupported
+	}
+
+	var index referrersIndex
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		return nil, fmt.Errorf("decode referrers of %s error: %v", d, err)
+	}
+	return index.Manifests, nil
+}
+
+// GetManifestByDigest gets a manifest in the repository of source by digest
+func (i *ImageSource) GetManifestByDigest(d digest.Digest) ([]byte, string, error) {
+	if i.source == nil {
+		return nil, "", fmt.Errorf("can not get manifest file without specfied a tag")
+	}
+	return i.source.GetManifest(i.ctx, &d)
+}
+
+// apiHost returns the host of the registry api, docker.io is served by registry-1.docker.io
+func apiHost(registry string) string {
+	if registry == "docker.io" {
+		return "registry-1.docker.io"
+	}
+	return registry
+}
+
+// httpClient creates the http client of the registry api requests on the shared transport, tls verify
+// is skipped for an insecure registry
+func (i *ImageSource) httpClient() *http.Client {
+	transport := sharedTransport(i.sysctx.DockerInsecureSkipTLSVerify == types.OptionalBoolTrue)
+	return &http.Client{Transport: utils.NewUserAgentTransport(UserAgent, transport), Timeout: referrersTimeout}
+}
+
+// registryGet sends a GET request to the registry, the token or basic auth challenged
+// by the registry is answered with the auth information of source
+func (i *ImageSource) registryGet(requestURL, accept string) (*http.Response, error) {
+	return i.registryRequest(http.MethodGet, requestURL, accept)
+}
+
+// registryRequest sends a GET or HEAD request to the registry, the token or basic auth challenged
+// by the registry is answered with the auth information of source
+func (i *ImageSource) registryRequest(method, requestURL, accept string) (*http.Response, error) {
+	return i.registryRequestFor(method, requestURL, accept, "pull")
+}
+
+// registryRequestFor sends a request to the registry, the token is requested for the actions
+// like pull or delete on the repository if the registry challenges for a token
+func (i *ImageSource) registryRequestFor(method, requestURL, accept, actions string) (*http.Response, error) {
+	resp, _, err := i.authorizedRequest(i.httpClient(), method, requestURL, accept, actions)
+	return resp, err
+}
+
+// authorizedRequest sends a request without body by client, the challenge of the registry is answered
+// for the actions on the repository and the Authorization header is returned for the following requests,
+// it is empty if the registry does not challenge
+func (i *ImageSource) authorizedRequest(client *http.Client, method, requestURL, accept,
+	actions string) (*http.Response, string, error) {
+	resp, err := i.doRequest(client, method, requestURL, accept, "")
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, "", err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+
+	authorization, err := i.authorize(client, challenge, actions)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err = i.doRequest(client, method, requestURL, accept, authorization)
+	return resp, authorization, err
+}
+
+// doGet sends a GET request with an optional Authorization header
+func (i *ImageSource) doGet(client *http.Client, requestURL, accept, authorization string) (*http.Response, error) {
+	return i.doRequest(client, http.MethodGet, requestURL, accept, authorization)
+}
+
+// doRequest sends a request without body with an optional Authorization header
+func (i *ImageSource) doRequest(client *http.Client, method, requestURL, accept,
+	authorization string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(i.ctx, method, requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	return client.Do(req)
+}
+
+// authorize answers a WWW-Authenticate challenge, a bearer token is requested from the realm
+// of the challenge for the actions like pull or push,pull on the repository if the challenge
+// has no scope, the Authorization header value is returned. A bearer token of the auth information
+// is returned as is
+func (i *ImageSource) authorize(client *http.Client, challenge, actions string) (string, error) {
+	return i.authorizeScopes(client, challenge, actions)
+}
+
+// authorizeScopes answers a WWW-Authenticate challenge like authorize, the token is requested for
+// the extra scopes like repository:team/base:pull as well
+func (i *ImageSource) authorizeScopes(client *http.Client, challenge, actions string,
+	scopes ...string) (string, error) {
+	if token := i.sysctx.DockerBearerRegistryToken; token != "" {
+		return "Bearer " + token, nil
+	}
+	var username, password string
+	if i.sysctx.DockerAuthConfig != nil {
+		username, password = i.sysctx.DockerAuthConfig.Username, i.sysctx.DockerAuthConfig.Password
+	}
+
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if username == "" {
+			return "", fmt.Errorf("registry requires basic auth but no auth information is provided")
+		}
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(username, password)
+		return req.Header.Get("Authorization"), nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("unsupported auth challenge: %s", challenge)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("invalid realm in auth challenge: %s", challenge)
+	}
+	query := realm.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	scope := params["scope"]
+	if scope == "" && i.repository != "" {
+		scope = "repository:" + i.repository + ":" + actions
+	}
+	if scope != "" {
+		query.Set("scope", scope)
+	}
+	for _, extra := range scopes {
+		query.Add("scope", extra)
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(i.ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("get token from %s error: status %s: %s", realm.Host, resp.Status,
+			strings.TrimSpace(string(body)))
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("decode token from %s error: %v", realm.Host, err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	return "Bearer " + token.Token, nil
+}
+
+// parseChallenge parses a WWW-Authenticate header like Bearer realm="...",service="...",scope="..."
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := make(map[string]string)
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) != 2 {
+		return parts[0], params
+	}
+
+	rest := parts[1]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = strings.TrimSpace(rest[eq+1:])
+
+		var value string
+		if strings.HasPrefix(rest, "\"") {
+			end := strings.Index(rest[1:], "\"")
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if comma := strings.Index(rest, ","); comma >= 0 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+		params[key] = value
+		rest = strings.TrimPrefix(strings.TrimSpace(rest), ",")
+	}
+	return parts[0], params
+}
+
+// artifactBlobInfos returns the blobs of an artifact manifest like a referrer or a signature,
+// the config is included
+func artifactBlobInfos(manifestByte []byte, manifestType string) ([]types.BlobInfo, error) {
+	m, err := manifest.FromBlob(manifestByte, manifestType)
+	if err != nil {
+		return nil, err
+	}
+
+	var blobInfos []types.BlobInfo
+	for _, layer := range m.LayerInfos() {
+		blobInfos = append(blobInfos, layer.BlobInfo)
+	}
+	if config := m.ConfigInfo(); config.Digest != "" {
+		blobInfos = append(blobInfos, config)
+	}
+	return blobInfos, nil
+}
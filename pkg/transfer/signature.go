@@ -0,0 +1,68 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/opencontainers/go-digest"
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+// CosignSignatureTag returns the tag where cosign stores the signatures of a manifest,
+// e.g. sha256-<hex>.sig
+func CosignSignatureTag(d digest.Digest) string {
+	return strings.Replace(d.String(), ":", "-", 1) + ".sig"
+}
+
+// copySignature copies the cosign signature tag of the manifest from source to target,
+// the manifest without a signature is skipped silently
+func (j *Job) copySignature(manifestByte []byte) error {
+	d, err := manifest.Digest(manifestByte)
+	if err != nil {
+		return fmt.Errorf("compute manifest digest error: %v", err)
+	}
+	sigTag := CosignSignatureTag(d)
+
+	sigByte, sigType, err := j.Source.GetTagManifest(sigTag)
+	if err != nil && IsNotFoundError(err) {
+		log.Debugf("%s/%s:%s has no cosign signature", j.Source.GetRegistry(), j.Source.GetRepository(),
+			j.Source.GetTag())
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("get signature %s error: %v", sigTag, err)
+	}
+
+	blobInfos, err := artifactBlobInfos(sigByte, sigType)
+	if err != nil {
+		return fmt.Errorf("parse signature %s error: %v", sigTag, err)
+	}
+	if err := j.transferBlobs(blobInfos); err != nil {
+		return err
+	}
+	if err := j.Target.PushManifestToTag(sigByte, sigTag); err != nil {
+		return fmt.Errorf("put signature %s error: %v", sigTag, err)
+	}
+
+	log.Infof("Copy signature %s to %s/%s", sigTag, j.Target.GetRegistry(), j.Target.GetRepository())
+	j.stats.SignatureCopied = true
+	return nil
+}
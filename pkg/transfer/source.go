@@ -20,11 +20,18 @@ package transfer
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"path/filepath"
+	"time"
 
 	"github.com/containers/image/v5/docker"
 	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"tkestack.io/image-transfer/pkg/log"
 	"tkestack.io/image-transfer/pkg/utils"
 )
 
@@ -37,23 +44,38 @@ type ImageSource struct {
 	source     types.ImageSource
 	ctx        context.Context
 	sysctx     *types.SystemContext
+
+	// transport of a local image source, empty for a registry
+	transport string
+
+	// mirror is the registry which images are actually pulled from, it is the same as registry without a mirror
+	mirror string
 }
 
 // NewImageSource generates a PullJob by repository, the repository string must include "tag",
 // if username or password is empty, access to repository will be anonymous.
 // a repository string is the rest part of the images url except "tag" and "registry"
 func NewImageSource(registry, repository, tag, username, password string, insecure bool) (*ImageSource, error) {
+	return NewMirroredImageSource(registry, registry, repository, tag, username, password, insecure)
+}
+
+// NewMirroredImageSource generates an ImageSource which pulls images from mirror instead of registry,
+// the registry is still returned by GetRegistry, the auth information is used for mirror
+func NewMirroredImageSource(registry, mirror, repository, tag, username, password string,
+	insecure bool) (*ImageSource, error) {
 	if utils.CheckIfIncludeTag(repository) {
 		return nil, fmt.Errorf("repository string should not include tag")
 	}
 
-	// tag may be empty
+	// tag may be empty, or a digest like sha256:... to pull the image by digest
 	tagWithColon := ""
-	if tag != "" {
+	if _, err := digest.Parse(tag); err == nil {
+		tagWithColon = "@" + tag
+	} else if tag != "" {
 		tagWithColon = ":" + tag
 	}
 
-	srcRef, err := docker.ParseReference("//" + registry + "/" + repository + tagWithColon)
+	srcRef, err := docker.ParseReference("//" + mirror + "/" + repository + tagWithColon)
 	if err != nil {
 		return nil, err
 	}
@@ -67,14 +89,10 @@ func NewImageSource(registry, repository, tag, username, password string, insecu
 	} else {
 		sysctx = &types.SystemContext{}
 	}
+	sysctx.DockerRegistryUserAgent = UserAgent
 
 	ctx := context.WithValue(context.Background(), interface{}("ImageSource"), repository)
-	if username != "" && password != "" {
-		sysctx.DockerAuthConfig = &types.DockerAuthConfig{
-			Username: username,
-			Password: password,
-		}
-	}
+	setAuth(sysctx, username, password)
 
 	var rawSource types.ImageSource
 	if tag != "" {
@@ -93,6 +111,44 @@ func NewImageSource(registry, repository, tag, username, password string, insecu
 		registry:   registry,
 		repository: repository,
 		tag:        tag,
+		mirror:     mirror,
+	}, nil
+}
+
+// NewLocalImageSource generates an ImageSource from a local oci layout directory or an archive file,
+// the tag is the "org.opencontainers.image.ref.name" of an image in an oci layout, and it is ignored
+// for an archive which holds only one image
+func NewLocalImageSource(transport, path, tag string) (*ImageSource, error) {
+	image := tag
+	if isArchiveTransport(transport) {
+		image = ""
+	}
+
+	srcRef, err := parseLocalReference(transport, path, image)
+	if err != nil {
+		return nil, err
+	}
+
+	sysctx := &types.SystemContext{}
+	ctx := context.WithValue(context.Background(), interface{}("ImageSource"), path)
+
+	var rawSource types.ImageSource
+	if tag != "" || isArchiveTransport(transport) {
+		rawSource, err = srcRef.NewImageSource(ctx, sysctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &ImageSource{
+		sourceRef:  srcRef,
+		source:     rawSource,
+		ctx:        ctx,
+		sysctx:     sysctx,
+		registry:   transport + ":",
+		repository: path,
+		tag:        tag,
+		transport:  transport,
 	}, nil
 }
 
@@ -104,6 +160,21 @@ func (i *ImageSource) GetManifest() ([]byte, string, error) {
 	return i.source.GetManifest(i.ctx, nil)
 }
 
+// GetTagManifest gets the manifest of another tag in the repository of source
+func (i *ImageSource) GetTagManifest(tag string) ([]byte, string, error) {
+	ref, err := i.tagReference(tag)
+	if err != nil {
+		return nil, "", err
+	}
+	rawSource, err := ref.NewImageSource(i.ctx, i.sysctx)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rawSource.Close()
+
+	return rawSource.GetManifest(i.ctx, nil)
+}
+
 // GetBlobInfos get blobs from source image.
 func (i *ImageSource) GetBlobInfos(manifestByte []byte, manifestType string) ([]types.BlobInfo, error) {
 	if i.source == nil {
@@ -159,7 +230,138 @@ func (i *ImageSource) GetTag() string {
 	return i.tag
 }
 
-// GetSourceRepoTags gets all the tags of a repository which ImageSource belongs to
-func (i *ImageSource) GetSourceRepoTags() ([]string, error) {
-	return docker.GetRepositoryTags(i.ctx, i.sysctx, i.sourceRef)
+// IsMirrored returns true if the images are pulled from a mirror of the registry
+func (i *ImageSource) IsMirrored() bool {
+	return i.transport == "" && i.mirror != i.registry
+}
+
+// GetMirror returns the registry which images are actually pulled from
+func (i *ImageSource) GetMirror() string {
+	return i.mirror
+}
+
+// IsAnonymous checks if images are pulled without auth information
+func (i *ImageSource) IsAnonymous() bool {
+	return i.transport == "" && i.sysctx.DockerAuthConfig == nil && i.sysctx.DockerBearerRegistryToken == ""
+}
+
+// setAuth sets the auth information of sysctx, a password with the username utils.BearerTokenUsername
+// is a bearer token which is sent to the registry directly without login
+func setAuth(sysctx *types.SystemContext, username, password string) {
+	if username == "" || password == "" {
+		return
+	}
+	if username == utils.BearerTokenUsername {
+		sysctx.DockerBearerRegistryToken = password
+		return
+	}
+	sysctx.DockerAuthConfig = &types.DockerAuthConfig{
+		Username: username,
+		Password: password,
+	}
+}
+
+// sameAuth checks if sysctx already has the auth information of username and password
+func sameAuth(sysctx *types.SystemContext, username, password string) bool {
+	updated := &types.SystemContext{}
+	setAuth(updated, username, password)
+	if updated.DockerBearerRegistryToken != sysctx.DockerBearerRegistryToken {
+		return false
+	}
+	if updated.DockerAuthConfig == nil || sysctx.DockerAuthConfig == nil {
+		return updated.DockerAuthConfig == nil && sysctx.DockerAuthConfig == nil
+	}
+	return *updated.DockerAuthConfig == *sysctx.DockerAuthConfig
+}
+
+// replaceAuth replaces the auth information of sysctx, it returns false if the auth information
+// is empty or not changed
+func replaceAuth(sysctx *types.SystemContext, username, password string) bool {
+	if username == "" || password == "" || sameAuth(sysctx, username, password) {
+		return false
+	}
+	sysctx.DockerAuthConfig = nil
+	sysctx.DockerBearerRegistryToken = ""
+	setAuth(sysctx, username, password)
+	return true
+}
+
+// resetAuth recreates the ImageSource with the auth information of username and password, the client of
+// an image source keeps the auth information it is created with. It returns false if it is not changed
+func (i *ImageSource) resetAuth(username, password string) (bool, error) {
+	if !replaceAuth(i.sysctx, username, password) {
+		return false, nil
+	}
+	if i.source == nil {
+		return true, nil
+	}
+
+	rawSource, err := i.sourceRef.NewImageSource(i.ctx, i.sysctx)
+	if err != nil {
+		return true, err
+	}
+	if err := i.source.Close(); err != nil {
+		log.Debugf("Close image source of %s/%s error: %v", i.registry, i.repository, err)
+	}
+	i.source = rawSource
+	return true, nil
+}
+
+// GetSourceRepoTags gets all the tags of a repository which ImageSource belongs to,
+// the listing fails if it takes longer than timeout, 0 means no timeout
+func (i *ImageSource) GetSourceRepoTags(timeout time.Duration) ([]string, error) {
+	if i.transport == utils.OCILayoutTransport {
+		return getOCILayoutTags(i.repository)
+	}
+	if isArchiveTransport(i.transport) {
+		return nil, fmt.Errorf("can not list tags of archive %s, it holds only one image", i.repository)
+	}
+
+	ctx := i.ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	tags, err := docker.GetRepositoryTags(ctx, i.sysctx, i.sourceRef)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("listing tags timed out after %v: %v", timeout, err)
+	}
+	return tags, err
+}
+
+// tagReference returns the reference of another tag in the repository of ImageSource
+func (i *ImageSource) tagReference(tag string) (types.ImageReference, error) {
+	if i.transport != "" {
+		if isArchiveTransport(i.transport) {
+			return nil, fmt.Errorf("archive %s holds only one image, it has no tags", i.repository)
+		}
+		return parseLocalReference(i.transport, i.repository, tag)
+	}
+	return docker.ParseReference("//" + i.mirror + "/" + i.repository + ":" + tag)
+}
+
+// getOCILayoutTags reads the ref names of images from index.json of an oci layout directory
+func getOCILayoutTags(path string) ([]string, error) {
+	indexByte, err := ioutil.ReadFile(filepath.Join(path, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var index imgspecv1.Index
+	if err := json.Unmarshal(indexByte, &index); err != nil {
+		return nil, fmt.Errorf("decode index.json of %s error: %v", path, err)
+	}
+
+	var tags []string
+	for _, m := range index.Manifests {
+		if refName, ok := m.Annotations[imgspecv1.AnnotationRefName]; ok && refName != "" {
+			if !utils.IsContain(tags, refName) {
+				tags = append(tags, refName)
+			}
+		}
+	}
+
+	return tags, nil
 }
@@ -0,0 +1,107 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/docker"
+)
+
+// TagListCache caches the tags of target repositories, every repository is listed once
+// for all the tags checked in it
+type TagListCache struct {
+	timeout time.Duration
+
+	mutex   sync.Mutex
+	entries map[string]*tagListEntry
+}
+
+// tagListEntry is the tags of a repository, it is listed by the first check
+type tagListEntry struct {
+	once sync.Once
+	tags map[string]bool
+	err  error
+}
+
+// NewTagListCache creates a TagListCache, a listing is limited by timeout if it is positive
+func NewTagListCache(timeout time.Duration) *TagListCache {
+	return &TagListCache{
+		timeout: timeout,
+		entries: make(map[string]*tagListEntry),
+	}
+}
+
+// HasTag checks if the tag of target exists by the cached tags of its repository,
+// a repository which does not exist has no tags
+func (c *TagListCache) HasTag(target *ImageTarget) (bool, error) {
+	key := target.GetRegistry() + "/" + target.GetRepository()
+	c.mutex.Lock()
+	entry, ok := c.entries[key]
+	if !ok {
+		entry = &tagListEntry{}
+		c.entries[key] = entry
+	}
+	c.mutex.Unlock()
+
+	entry.once.Do(func() {
+		var tags []string
+		tags, entry.err = target.GetRepoTags(c.timeout)
+		if IsNotFoundError(entry.err) {
+			entry.err = nil
+		}
+		entry.tags = make(map[string]bool, len(tags))
+		for _, tag := range tags {
+			entry.tags[tag] = true
+		}
+	})
+	if entry.err != nil {
+		// the repository is listed again when the job is retried
+		c.mutex.Lock()
+		if c.entries[key] == entry {
+			delete(c.entries, key)
+		}
+		c.mutex.Unlock()
+		return false, entry.err
+	}
+	return entry.tags[target.GetTag()], nil
+}
+
+// GetRepoTags lists the tags of the target repository
+func (i *ImageTarget) GetRepoTags(timeout time.Duration) ([]string, error) {
+	if i.local {
+		return nil, fmt.Errorf("can not list tags of local target %s", i.repository)
+	}
+
+	ctx := i.ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	tags, err := docker.GetRepositoryTags(ctx, i.sysctx, i.targetRef)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("listing tags timed out after %v: %v", timeout, err)
+	}
+	return tags, err
+}
@@ -0,0 +1,109 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"sort"
+	"time"
+
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+const (
+	// TagSortLexical sorts tags in reverse lexical order
+	TagSortLexical = "lexical"
+	// TagSortSemver sorts semantic version tags from the highest version, other tags are sorted
+	// in reverse lexical order after them
+	TagSortSemver = "semver"
+	// TagSortDate sorts tags from the newest created image, the created time is read
+	// from the image config, so it needs a request for each tag
+	TagSortDate = "date"
+)
+
+// TagSortOrders are the supported orders of SortTags
+var TagSortOrders = []string{TagSortLexical, TagSortSemver, TagSortDate}
+
+// SortTags sorts tags of the source repository from the newest, order is one of TagSortOrders
+func (i *ImageSource) SortTags(tags []string, order string) []string {
+	sorted := append([]string{}, tags...)
+
+	switch order {
+	case TagSortSemver:
+		sort.SliceStable(sorted, func(a, b int) bool {
+			va, aOK := utils.ParseSemver(sorted[a])
+			vb, bOK := utils.ParseSemver(sorted[b])
+			if aOK && bOK {
+				if c := va.Compare(vb); c != 0 {
+					return c > 0
+				}
+				return sorted[a] > sorted[b]
+			}
+			if aOK != bOK {
+				return aOK
+			}
+			return sorted[a] > sorted[b]
+		})
+	case TagSortDate:
+		created := make(map[string]time.Time)
+		for _, tag := range sorted {
+			t, err := i.GetTagCreatedTime(tag)
+			if err != nil {
+				// the tag is taken as the oldest one
+				log.Warnf("Get created time of %s/%s:%s error: %v", i.registry, i.repository, tag, err)
+				continue
+			}
+			created[tag] = t
+		}
+		sort.SliceStable(sorted, func(a, b int) bool {
+			ta, tb := created[sorted[a]], created[sorted[b]]
+			if !ta.Equal(tb) {
+				return ta.After(tb)
+			}
+			return sorted[a] > sorted[b]
+		})
+	default:
+		sort.Sort(sort.Reverse(sort.StringSlice(sorted)))
+	}
+
+	return sorted
+}
+
+// GetTagCreatedTime reads the created time of an image from its config
+func (i *ImageSource) GetTagCreatedTime(tag string) (time.Time, error) {
+	ref, err := i.tagReference(tag)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	img, err := ref.NewImage(i.ctx, i.sysctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer img.Close()
+
+	info, err := img.Inspect(i.ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if info.Created == nil {
+		return time.Time{}, nil
+	}
+	return *info.Created, nil
+}
@@ -24,7 +24,10 @@ import (
 	"io"
 
 	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"tkestack.io/image-transfer/pkg/log"
 	"tkestack.io/image-transfer/pkg/utils"
 )
 
@@ -36,6 +39,15 @@ type ImageTarget struct {
 	targetRef  types.ImageReference
 	target     types.ImageDestination
 	ctx        context.Context
+	sysctx     *types.SystemContext
+
+	// an archive target is written when closed, it is closed after each run
+	// and reopened when the job is retried
+	closeAfterRun bool
+	closed        bool
+
+	// local is true for an oci layout or an archive target
+	local bool
 }
 
 // NewImageTarget generates a ImageTarget by repository, the repository string must include "tag".
@@ -66,14 +78,10 @@ func NewImageTarget(registry, repository, tag, username, password string, insecu
 	} else {
 		sysctx = &types.SystemContext{}
 	}
+	sysctx.DockerRegistryUserAgent = UserAgent
 
 	ctx := context.WithValue(context.Background(), interface{}("ImageTarget"), repository)
-	if username != "" && password != "" {
-		sysctx.DockerAuthConfig = &types.DockerAuthConfig{
-			Username: username,
-			Password: password,
-		}
-	}
+	setAuth(sysctx, username, password)
 
 	rawtarget, err := destRef.NewImageDestination(ctx, sysctx)
 	if err != nil {
@@ -84,6 +92,7 @@ func NewImageTarget(registry, repository, tag, username, password string, insecu
 		targetRef: destRef,
 		target:    rawtarget,
 		ctx:       ctx,
+		sysctx:    sysctx,
 
 		registry:   registry,
 		repository: repository,
@@ -91,11 +100,75 @@ func NewImageTarget(registry, repository, tag, username, password string, insecu
 	}, nil
 }
 
+// NewLocalImageTarget generates a ImageTarget of a local oci layout directory or an archive file.
+// For an oci layout, the tag is saved as the "org.opencontainers.image.ref.name" of the image,
+// for an archive, image is the name:tag saved in the archive and it may be empty.
+func NewLocalImageTarget(transport, path, tag, image string) (*ImageTarget, error) {
+	if transport != utils.DockerArchiveTransport {
+		image = tag
+	}
+
+	destRef, err := parseLocalReference(transport, path, image)
+	if err != nil && transport == utils.DockerArchiveTransport && image != "" {
+		// the name of source may be invalid for docker, save the image without name
+		log.Warnf("Can not save %s as the name of image in %s, the image will be saved without name: %v",
+			image, path, err)
+		destRef, err = parseLocalReference(transport, path, "")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sysctx := &types.SystemContext{}
+	ctx := context.WithValue(context.Background(), interface{}("ImageTarget"), path)
+	rawtarget, err := destRef.NewImageDestination(ctx, sysctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ImageTarget{
+		targetRef: destRef,
+		target:    rawtarget,
+		ctx:       ctx,
+		sysctx:    sysctx,
+
+		registry:   transport + ":",
+		repository: path,
+		tag:        tag,
+
+		closeAfterRun: isArchiveTransport(transport),
+		local:         true,
+	}, nil
+}
+
 // PushManifest push a manifest file to target image
 func (i *ImageTarget) PushManifest(manifestByte []byte) error {
 	return i.target.PutManifest(i.ctx, manifestByte, nil)
 }
 
+// PushManifestByDigest push a manifest file to the repository of target by digest, the tag is not changed
+func (i *ImageTarget) PushManifestByDigest(manifestByte []byte, d digest.Digest) error {
+	return i.target.PutManifest(i.ctx, manifestByte, &d)
+}
+
+// PushManifestToTag push a manifest file to another tag in the repository of target
+func (i *ImageTarget) PushManifestToTag(manifestByte []byte, tag string) error {
+	ref, err := docker.ParseReference("//" + i.registry + "/" + i.repository + ":" + tag)
+	if err != nil {
+		return err
+	}
+	rawtarget, err := ref.NewImageDestination(i.ctx, i.sysctx)
+	if err != nil {
+		return err
+	}
+	defer rawtarget.Close()
+
+	if err := rawtarget.PutManifest(i.ctx, manifestByte, nil); err != nil {
+		return err
+	}
+	return rawtarget.Commit(i.ctx, nil)
+}
+
 // PutABlob push a blob to target image
 func (i *ImageTarget) PutABlob(blob io.ReadCloser, blobInfo types.BlobInfo) error {
 	_, err := i.target.PutBlob(i.ctx, blob, types.BlobInfo{
@@ -109,6 +182,11 @@ func (i *ImageTarget) PutABlob(blob io.ReadCloser, blobInfo types.BlobInfo) erro
 	return err
 }
 
+// Commit marks the pushed image as complete, a local target like oci layout writes its index here
+func (i *ImageTarget) Commit() error {
+	return i.target.Commit(i.ctx, nil)
+}
+
 // CheckBlobExist checks if a blob exist for target and reuse exist blobs
 func (i *ImageTarget) CheckBlobExist(blobInfo types.BlobInfo) (bool, error) {
 	exist, _, err := i.target.TryReusingBlob(i.ctx, types.BlobInfo{
@@ -119,11 +197,69 @@ func (i *ImageTarget) CheckBlobExist(blobInfo types.BlobInfo) (bool, error) {
 	return exist, err
 }
 
+// GetManifestDigest returns the manifest digest which the tag of target refers to
+func (i *ImageTarget) GetManifestDigest() (digest.Digest, error) {
+	// a HEAD request is cheaper than downloading the manifest
+	if !i.local && i.tag != "" {
+		head := &ImageSource{registry: i.registry, repository: i.repository, ctx: i.ctx, sysctx: i.sysctx,
+			mirror: i.registry}
+		d, err := head.headManifestDigest(i.registry, i.tag)
+		if err == nil || IsNotFoundError(err) {
+			return d, err
+		}
+		log.Debugf("Head manifest of %s/%s:%s error, get it instead: %v", i.registry, i.repository, i.tag, err)
+	}
+
+	rawsource, err := i.targetRef.NewImageSource(i.ctx, i.sysctx)
+	if err != nil {
+		return "", err
+	}
+	defer rawsource.Close()
+
+	manifestByte, _, err := rawsource.GetManifest(i.ctx, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return manifest.Digest(manifestByte)
+}
+
 // Close a ImageTarget
 func (i *ImageTarget) Close() error {
+	i.closed = true
 	return i.target.Close()
 }
 
+// reopen creates the image destination again if the ImageTarget is closed
+func (i *ImageTarget) reopen() error {
+	if !i.closed {
+		return nil
+	}
+
+	rawtarget, err := i.targetRef.NewImageDestination(i.ctx, i.sysctx)
+	if err != nil {
+		return err
+	}
+	i.target = rawtarget
+	i.closed = false
+
+	return nil
+}
+
+// resetAuth recreates the image destination with the auth information of username and password,
+// it returns false if it is not changed
+func (i *ImageTarget) resetAuth(username, password string) (bool, error) {
+	if !replaceAuth(i.sysctx, username, password) {
+		return false, nil
+	}
+	if !i.closed {
+		if err := i.Close(); err != nil {
+			log.Debugf("Close image target of %s/%s error: %v", i.registry, i.repository, err)
+		}
+	}
+	return true, i.reopen()
+}
+
 // GetRegistry returns the registry of a ImageTarget
 func (i *ImageTarget) GetRegistry() string {
 	return i.registry
@@ -138,3 +274,8 @@ func (i *ImageTarget) GetRepository() string {
 func (i *ImageTarget) GetTag() string {
 	return i.tag
 }
+
+// IsLocal returns true if the ImageTarget is a local directory or archive
+func (i *ImageTarget) IsLocal() bool {
+	return i.local
+}
@@ -0,0 +1,58 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package transfer
+
+import (
+	"testing"
+
+	"github.com/containers/image/v5/docker/reference"
+)
+
+func TestNewImageTargetNestedPath(t *testing.T) {
+	cases := []struct {
+		repository string
+		tag        string
+		name       string
+	}{
+		{repository: "my-org/app", tag: "1.2", name: "ghcr.io/my-org/app"},
+		{repository: "my-org/platform/base", tag: "1.2", name: "ghcr.io/my-org/platform/base"},
+		{repository: "my-org/platform/images/base/alpine", name: "ghcr.io/my-org/platform/images/base/alpine"},
+	}
+	for _, c := range cases {
+		target, err := NewImageTarget("ghcr.io", c.repository, c.tag, "github", "token", false)
+		if err != nil {
+			t.Errorf("NewImageTarget(%q) error: %v", c.repository, err)
+			continue
+		}
+		// the token scope of the push is requested for the path of the docker reference
+		named := target.targetRef.DockerReference()
+		if named.Name() != c.name || reference.Path(named) != c.repository {
+			t.Errorf("reference of %q = %s, %s, expected %s", c.repository, named.Name(), reference.Path(named),
+				c.name)
+		}
+		if target.GetRegistry() != "ghcr.io" || target.GetRepository() != c.repository || target.GetTag() != c.tag {
+			t.Errorf("NewImageTarget(%q) = %s %s %s", c.repository, target.GetRegistry(), target.GetRepository(),
+				target.GetTag())
+		}
+		target.Close()
+	}
+
+	if _, err := NewImageTarget("ghcr.io", "my-org/platform/base:1.2", "", "", "", false); err == nil {
+		t.Errorf("NewImageTarget with a tag in repository should fail")
+	}
+}
@@ -0,0 +1,127 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/types"
+)
+
+var (
+	// MaxIdleConnsPerHost is the number of idle connections kept to a registry for reuse, it is set by the
+	// maxIdleConnsPerHost flag. 0 means the default of net/http
+	MaxIdleConnsPerHost = 0
+	// KeepAlive is how long an idle connection to a registry is kept for reuse, it is set by the keepAlive
+	// flag. 0 disables keep-alive, every request opens a new connection
+	KeepAlive = 90 * time.Second
+
+	// transports are the shared transports of the registry requests, they are created on first use
+	transports     map[bool]*http.Transport
+	transportsOnce sync.Once
+
+	// registryBases caches the base urls of the registry api by apiHost and insecure
+	registryBases sync.Map
+)
+
+// registryBaseKey is the key of registryBases, an insecure registry may be requested by http
+type registryBaseKey struct {
+	host     string
+	insecure bool
+}
+
+// sharedTransport returns the transport shared by the registry requests sent by this package, like
+// chunked uploads, referrers and HEAD digests, their connections to a registry are reused across jobs.
+// The blob and manifest copies go through containers/image, which creates the transport of each image
+// source and destination, so they are not pooled here. tls verify is skipped by the transport of insecure
+// registries
+func sharedTransport(insecure bool) *http.Transport {
+	transportsOnce.Do(func() {
+		transports = map[bool]*http.Transport{
+			false: newTransport(false),
+			true:  newTransport(true),
+		}
+	})
+	return transports[insecure]
+}
+
+// newTransport creates a transport with the connection pool of MaxIdleConnsPerHost and KeepAlive
+func newTransport(insecure bool) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	if KeepAlive > 0 {
+		transport.IdleConnTimeout = KeepAlive
+	} else {
+		transport.DisableKeepAlives = true
+	}
+	if MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = MaxIdleConnsPerHost
+		// the total limit should not evict the idle connections of a busy registry
+		if transport.MaxIdleConns < MaxIdleConnsPerHost {
+			transport.MaxIdleConns = MaxIdleConnsPerHost
+		}
+	}
+	if insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return transport
+}
+
+// apiBase returns the base url like https://registry-1.docker.io of the registry api of host. The v2 api
+// is pinged by https, and by http if an insecure registry can not be requested by https, as containers/image
+// does for the copies. The url is cached for the run once the registry answers
+func (i *ImageSource) apiBase(host string) (string, error) {
+	insecure := i.sysctx.DockerInsecureSkipTLSVerify == types.OptionalBoolTrue
+	key := registryBaseKey{host: apiHost(host), insecure: insecure}
+	if base, ok := registryBases.Load(key); ok {
+		return base.(string), nil
+	}
+
+	client := i.httpClient()
+	ping := func(scheme string) (string, error) {
+		base := scheme + "://" + key.host
+		resp, err := i.doGet(client, base+"/v2/", "", "")
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		return base, nil
+	}
+	base, err := ping("https")
+	if err != nil && insecure {
+		var httpErr error
+		if base, httpErr = ping("http"); httpErr != nil {
+			return "", fmt.Errorf("ping %s error: %v, ping by http error: %v", key.host, err, httpErr)
+		}
+		err = nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("ping %s error: %v", key.host, err)
+	}
+	registryBases.Store(key, base)
+	return base, nil
+}
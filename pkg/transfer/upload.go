@@ -0,0 +1,407 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package transfer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+const (
+	// uploadChunkTimeout is the timeout of a request of a chunked upload
+	uploadChunkTimeout = 10 * time.Minute
+	// uploadChunkAttempts is the max attempts to upload a chunk, then the job fails and the upload
+	// is resumed when the job is retried
+	uploadChunkAttempts = 3
+)
+
+// errChunkedUploadUnsupported means the registry rejects chunked uploads, blobs are uploaded as a whole
+var errChunkedUploadUnsupported = errors.New("chunked upload is not supported")
+
+// chunkedUploadUnsupported are the registries which reject chunked uploads in this run
+var chunkedUploadUnsupported sync.Map
+
+// blobUpload is the session of a chunked upload, it is kept by the job until the blob is pushed so that
+// a failed upload resumes from the offset acknowledged by the registry when the job is retried
+type blobUpload struct {
+	location      string
+	authorization string
+	offset        int64
+}
+
+// putBlobInChunks uploads a blob larger than UploadChunkSize to a registry target in chunks, a failed upload
+// is resumed by the next run of the job. It returns false if the blob should be uploaded as a whole, e.g.
+// the registry does not support chunked uploads
+func (j *Job) putBlobInChunks(blobinfo types.BlobInfo) (bool, error) {
+	chunkSize := j.options.UploadChunkSize
+	if chunkSize <= 0 || blobinfo.Size <= chunkSize || j.Target.local {
+		return false, nil
+	}
+	if _, unsupported := chunkedUploadUnsupported.Load(j.Target.GetRegistry()); unsupported {
+		return false, nil
+	}
+
+	if j.uploads == nil {
+		j.uploads = make(map[digest.Digest]*blobUpload)
+	}
+	upload, ok := j.uploads[blobinfo.Digest]
+	if !ok {
+		upload = &blobUpload{}
+		j.uploads[blobinfo.Digest] = upload
+	}
+
+	open := func(offset int64) (io.ReadCloser, error) {
+		blob, _, err := j.openBlob(blobinfo)
+		if err != nil || offset == 0 {
+			return blob, err
+		}
+		// a re-compressed layer is read from a file, a registry blob is read again to the offset
+		if seeker, ok := blob.(io.Seeker); ok {
+			_, err = seeker.Seek(offset, io.SeekStart)
+		} else {
+			_, err = io.CopyN(ioutil.Discard, blob, offset)
+		}
+		if err != nil {
+			blob.Close()
+			return nil, fmt.Errorf("skip %v bytes of blob %s error: %v", offset, blobinfo.Digest, err)
+		}
+		return blob, nil
+	}
+
+	err := j.Target.putBlobChunked(open, blobinfo, chunkSize, upload)
+	if err == errChunkedUploadUnsupported {
+		log.Infof("%s does not support chunked uploads, blobs are uploaded as a whole", j.Target.GetRegistry())
+		chunkedUploadUnsupported.Store(j.Target.GetRegistry(), true)
+		delete(j.uploads, blobinfo.Digest)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	delete(j.uploads, blobinfo.Digest)
+	return true, nil
+}
+
+// putBlobChunked uploads a blob of a known size in chunks of chunkSize by PATCH requests. The upload is
+// resumed from the offset the registry acknowledged if upload has a session, open opens the blob from an
+// offset. errChunkedUploadUnsupported is returned if the registry rejects the first chunk
+func (i *ImageTarget) putBlobChunked(open func(offset int64) (io.ReadCloser, error), blobInfo types.BlobInfo,
+	chunkSize int64, upload *blobUpload) error {
+	api := &ImageSource{registry: i.registry, repository: i.repository, ctx: i.ctx, sysctx: i.sysctx,
+		mirror: i.registry}
+	client := api.httpClient()
+	client.Timeout = uploadChunkTimeout
+
+	if upload.location != "" {
+		offset, err := i.uploadOffset(api, client, upload)
+		if err != nil {
+			log.Warnf("Resume upload of blob %s to %s/%s error, upload it again: %v", blobInfo.Digest,
+				i.registry, i.repository, err)
+			*upload = blobUpload{}
+		} else {
+			upload.offset = offset
+			log.Infof("Resume upload of blob %s(%v) to %s/%s at offset %v", blobInfo.Digest, blobInfo.Size,
+				i.registry, i.repository, offset)
+		}
+	}
+	if upload.location == "" {
+		if err := i.startUpload(api, client, upload); err != nil {
+			return err
+		}
+	}
+
+	blob, err := open(upload.offset)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	buffer := make([]byte, chunkSize)
+	for upload.offset < blobInfo.Size {
+		size := chunkSize
+		if rest := blobInfo.Size - upload.offset; rest < size {
+			size = rest
+		}
+		chunk := buffer[:size]
+		if _, err := io.ReadFull(blob, chunk); err != nil {
+			return fmt.Errorf("read blob %s at offset %v error: %v", blobInfo.Digest, upload.offset, err)
+		}
+		if err := i.patchChunk(api, client, upload, chunk); err != nil {
+			return err
+		}
+		log.Debugf("Upload %v/%v bytes of blob %s to %s/%s", upload.offset, blobInfo.Size, blobInfo.Digest,
+			i.registry, i.repository)
+	}
+
+	return i.finishUpload(api, client, upload, blobInfo)
+}
+
+// startUpload starts an upload session of the repository, errChunkedUploadUnsupported is returned if the
+// registry can not be requested so that the blob is uploaded as a whole by containers/image
+func (i *ImageTarget) startUpload(api *ImageSource, client *http.Client, upload *blobUpload) error {
+	base, err := api.apiBase(i.registry)
+	if err != nil {
+		log.Warnf("Start chunked upload to %s/%s error: %v", i.registry, i.repository, err)
+		return errChunkedUploadUnsupported
+	}
+	requestURL := base + "/v2/" + i.repository + "/blobs/uploads/"
+	resp, authorization, err := api.authorizedRequest(client, http.MethodPost, requestURL, "", "push,pull")
+	if err != nil {
+		log.Warnf("Start chunked upload to %s/%s error: %v", i.registry, i.repository, err)
+		return errChunkedUploadUnsupported
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusAccepted:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("start upload error: status %s", resp.Status)
+	default:
+		return errChunkedUploadUnsupported
+	}
+	location, err := resolveLocation(requestURL, resp.Header.Get("Location"))
+	if err != nil {
+		return fmt.Errorf("start upload error: %v", err)
+	}
+	*upload = blobUpload{location: location, authorization: authorization}
+	return nil
+}
+
+// patchChunk uploads a chunk at the offset of upload, a failed request is retried from the offset the
+// registry acknowledged. The offset of upload is moved to the end of the chunk
+func (i *ImageTarget) patchChunk(api *ImageSource, client *http.Client, upload *blobUpload, chunk []byte) error {
+	start, sent := upload.offset, int64(0)
+	for attempt := 1; ; attempt++ {
+		resp, err := i.uploadRequest(api, client, http.MethodPatch, upload, chunk[sent:], start+sent)
+		if err == nil {
+			resp.Body.Close()
+			switch {
+			case resp.StatusCode == http.StatusAccepted:
+				if location := resp.Header.Get("Location"); location != "" {
+					if upload.location, err = resolveLocation(upload.location, location); err != nil {
+						return fmt.Errorf("upload chunk error: %v", err)
+					}
+				}
+				upload.offset = start + int64(len(chunk))
+				return nil
+			case start == 0 && (resp.StatusCode == http.StatusBadRequest ||
+				resp.StatusCode == http.StatusMethodNotAllowed ||
+				resp.StatusCode == http.StatusRequestedRangeNotSatisfiable ||
+				resp.StatusCode == http.StatusNotImplemented):
+				return errChunkedUploadUnsupported
+			default:
+				err = fmt.Errorf("status %s", resp.Status)
+			}
+		}
+
+		end := start + int64(len(chunk)) - 1
+		if attempt >= uploadChunkAttempts {
+			return fmt.Errorf("upload bytes %v-%v error: %v", start, end, err)
+		}
+		// the registry may have acknowledged a part of the chunk before the failure
+		offset, statusErr := i.uploadOffset(api, client, upload)
+		if statusErr != nil {
+			return fmt.Errorf("upload bytes %v-%v error: %v, get upload status error: %v", start, end, err,
+				statusErr)
+		}
+		if offset < start || offset > end+1 {
+			*upload = blobUpload{}
+			return fmt.Errorf("upload bytes %v-%v error: %v, the registry acknowledges offset %v", start, end,
+				err, offset)
+		}
+		if sent = offset - start; offset == end+1 {
+			upload.offset = offset
+			return nil
+		}
+		log.Warnf("Upload bytes %v-%v to %s/%s error, resume at offset %v: %v", start, end, i.registry,
+			i.repository, offset, err)
+	}
+}
+
+// finishUpload completes the upload with the digest of the blob, the session is dropped if the registry
+// rejects the blob
+func (i *ImageTarget) finishUpload(api *ImageSource, client *http.Client, upload *blobUpload,
+	blobInfo types.BlobInfo) error {
+	location, err := url.Parse(upload.location)
+	if err != nil {
+		return fmt.Errorf("finish upload error: %v", err)
+	}
+	query := location.Query()
+	query.Set("digest", blobInfo.Digest.String())
+	location.RawQuery = query.Encode()
+
+	finished := *upload
+	finished.location = location.String()
+	resp, err := i.uploadRequest(api, client, http.MethodPut, &finished, nil, 0)
+	if err != nil {
+		return fmt.Errorf("finish upload error: %v", err)
+	}
+	resp.Body.Close()
+	upload.authorization = finished.authorization
+
+	if resp.StatusCode != http.StatusCreated {
+		if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusNotFound {
+			*upload = blobUpload{}
+		}
+		return fmt.Errorf("finish upload of blob %s error: status %s", blobInfo.Digest, resp.Status)
+	}
+	return nil
+}
+
+// uploadOffset gets the offset acknowledged by the registry from the status of the upload session
+func (i *ImageTarget) uploadOffset(api *ImageSource, client *http.Client, upload *blobUpload) (int64, error) {
+	resp, err := i.uploadRequest(api, client, http.MethodGet, upload, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("get upload status error: status %s", resp.Status)
+	}
+	if location := resp.Header.Get("Location"); location != "" {
+		if upload.location, err = resolveLocation(upload.location, location); err != nil {
+			return 0, err
+		}
+	}
+
+	// Range is 0-<last byte>, 0-0 is taken as nothing uploaded
+	ranges := strings.SplitN(strings.TrimPrefix(resp.Header.Get("Range"), "bytes="), "-", 2)
+	if len(ranges) != 2 {
+		return 0, nil
+	}
+	last, err := strconv.ParseInt(ranges[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid range %q of upload status", resp.Header.Get("Range"))
+	}
+	if last == 0 {
+		return 0, nil
+	}
+	return last + 1, nil
+}
+
+// uploadRequest sends a request of the upload session, a PATCH request sends body at offset. The challenge
+// of an expired token is answered and the request is sent again
+func (i *ImageTarget) uploadRequest(api *ImageSource, client *http.Client, method string, upload *blobUpload,
+	body []byte, offset int64) (*http.Response, error) {
+	send := func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(i.ctx, method, upload.location, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if method != http.MethodGet {
+			req.Header.Set("Content-Type", "application/octet-stream")
+		}
+		if method == http.MethodPatch {
+			req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+int64(len(body))-1))
+		}
+		if upload.authorization != "" {
+			req.Header.Set("Authorization", upload.authorization)
+		}
+		return client.Do(req)
+	}
+
+	resp, err := send()
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	if upload.authorization, err = api.authorize(client, challenge, "push,pull"); err != nil {
+		return nil, err
+	}
+	return send()
+}
+
+// mountBlob mounts a blob from the repository from of the target registry by a cross-repository blob mount
+// instead of uploading it. false is returned if the registry refuses the mount, e.g. the auth information
+// can not pull from the repository, then the blob should be uploaded
+func (i *ImageTarget) mountBlob(from string, blobInfo types.BlobInfo) (bool, error) {
+	api := &ImageSource{registry: i.registry, repository: i.repository, ctx: i.ctx, sysctx: i.sysctx,
+		mirror: i.registry}
+	client := api.httpClient()
+	base, err := api.apiBase(i.registry)
+	if err != nil {
+		return false, err
+	}
+
+	query := url.Values{}
+	query.Set("mount", blobInfo.Digest.String())
+	query.Set("from", from)
+	requestURL := base + "/v2/" + i.repository + "/blobs/uploads/?" + query.Encode()
+	resp, err := api.doRequest(client, http.MethodPost, requestURL, "", "")
+	if err != nil {
+		return false, err
+	}
+	authorization := ""
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		authorization, err = api.authorizeScopes(client, challenge, "push,pull", "repository:"+from+":pull")
+		if err != nil {
+			return false, err
+		}
+		if resp, err = api.doRequest(client, http.MethodPost, requestURL, "", authorization); err != nil {
+			return false, err
+		}
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return true, nil
+	case http.StatusAccepted:
+		// the registry starts an upload session instead of the mount, it is cancelled for a normal upload
+		if location, err := resolveLocation(requestURL, resp.Header.Get("Location")); err == nil {
+			if resp, err := api.doRequest(client, http.MethodDelete, location, "", authorization); err == nil {
+				resp.Body.Close()
+			}
+		}
+		return false, nil
+	default:
+		return false, fmt.Errorf("status %s", resp.Status)
+	}
+}
+
+// resolveLocation resolves the Location header of an upload response against the request url
+func resolveLocation(requestURL, location string) (string, error) {
+	if location == "" {
+		return "", fmt.Errorf("no Location header in response")
+	}
+	base, err := url.Parse(requestURL)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := base.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("invalid Location header %q: %v", location, err)
+	}
+	return resolved.String(), nil
+}
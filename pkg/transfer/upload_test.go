@@ -0,0 +1,272 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+)
+
+// uploadServer is a plain http registry which accepts chunked and monolithic blob uploads and cross-repository
+// blob mounts unless refuseMount is set, the blobs are kept by repository@digest. The requests other than the
+// pings are recorded as the method, a mount request is recorded as MOUNT
+type uploadServer struct {
+	refuseMount bool
+
+	mutex    sync.Mutex
+	uploads  map[string]*bytes.Buffer
+	blobs    map[string][]byte
+	requests []string
+}
+
+func newUploadServer() *uploadServer {
+	return &uploadServer{uploads: make(map[string]*bytes.Buffer), blobs: make(map[string][]byte)}
+}
+
+func (s *uploadServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if r.URL.Path == "/v2/" {
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	parts := strings.SplitN(path, "/blobs/", 2)
+	if len(parts) != 2 {
+		// a manifest of the sources
+		w.Header().Set("Content-Type", manifest.DockerV2Schema2MediaType)
+		w.Write(testManifest)
+		return
+	}
+	repository, rest := parts[0], parts[1]
+
+	mount := r.Method == http.MethodPost && r.URL.Query().Get("mount") != ""
+	if mount {
+		s.requests = append(s.requests, "MOUNT")
+	} else {
+		s.requests = append(s.requests, r.Method)
+	}
+
+	switch {
+	case mount && !s.refuseMount:
+		blob, ok := s.blobs[r.URL.Query().Get("from")+"@"+r.URL.Query().Get("mount")]
+		if ok {
+			s.blobs[repository+"@"+r.URL.Query().Get("mount")] = blob
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		fallthrough
+	case r.Method == http.MethodPost && rest == "uploads/":
+		location := fmt.Sprintf("%supload-%d", r.URL.Path, len(s.uploads))
+		s.uploads[location] = &bytes.Buffer{}
+		w.Header().Set("Location", location)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	case !strings.HasPrefix(rest, "uploads/"):
+		blob, ok := s.blobs[repository+"@"+rest]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(blob)))
+		if r.Method == http.MethodGet {
+			w.Write(blob)
+		}
+		return
+	}
+
+	upload, ok := s.uploads[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodPatch:
+		// containers/image sends the whole blob in a PATCH request without Content-Range
+		var start, end int
+		if contentRange := r.Header.Get("Content-Range"); contentRange != "" {
+			if _, err := fmt.Sscanf(contentRange, "%d-%d", &start, &end); err != nil || start != upload.Len() {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+		}
+		io.Copy(upload, r.Body)
+		w.Header().Set("Location", r.URL.Path)
+		w.Header().Set("Range", fmt.Sprintf("0-%d", upload.Len()-1))
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		io.Copy(upload, r.Body)
+		d := digest.Digest(r.URL.Query().Get("digest"))
+		if d != digest.FromBytes(upload.Bytes()) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.blobs[repository+"@"+d.String()] = upload.Bytes()
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		delete(s.uploads, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// testLayer is the layer of testManifest
+var testLayer = bytes.Repeat([]byte("layer"), 2000)
+
+var testManifest = []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,`+
+	`"config":{"mediaType":"application/vnd.docker.container.image.v1+json","size":2,"digest":%q},`+
+	`"layers":[{"mediaType":"application/vnd.docker.image.rootfs.diff.tar.gzip","size":%d,"digest":%q}]}`,
+	manifest.DockerV2Schema2MediaType, digest.FromString("{}"), len(testLayer), digest.FromBytes(testLayer)))
+
+// putTestBlob uploads data in chunks of 4 KiB to the repository team/app of registry
+func putTestBlob(t *testing.T, registry string, insecure bool, data []byte) error {
+	target, err := NewImageTarget(registry, "team/app", "v1", "", "", insecure)
+	if err != nil {
+		t.Fatalf("NewImageTarget error: %v", err)
+	}
+	defer target.Close()
+
+	open := func(offset int64) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data[offset:])), nil
+	}
+	blobInfo := types.BlobInfo{Digest: digest.FromBytes(data), Size: int64(len(data))}
+	return target.putBlobChunked(open, blobInfo, 4096, &blobUpload{})
+}
+
+func TestPutBlobChunkedPlainHTTP(t *testing.T) {
+	registry := newUploadServer()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	defer forgetRegistryBases()
+
+	if err := putTestBlob(t, strings.TrimPrefix(server.URL, "http://"), true, testLayer); err != nil {
+		t.Fatalf("putBlobChunked to an insecure plain http registry error: %v", err)
+	}
+	if blob := registry.blobs["team/app@"+digest.FromBytes(testLayer).String()]; !bytes.Equal(blob, testLayer) {
+		t.Errorf("the registry holds %v bytes of the blob, expected %v", len(blob), len(testLayer))
+	}
+	expected := []string{"POST", "PATCH", "PATCH", "PATCH", "PUT"}
+	if strings.Join(registry.requests, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected requests %v, got %v", expected, registry.requests)
+	}
+}
+
+func TestPutBlobChunkedUnreachable(t *testing.T) {
+	registry := newUploadServer()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	defer forgetRegistryBases()
+
+	// a secure registry is only requested by https, the blob is uploaded as a whole instead
+	err := putTestBlob(t, strings.TrimPrefix(server.URL, "http://"), false, testLayer)
+	if err != errChunkedUploadUnsupported {
+		t.Errorf("putBlobChunked to an unreachable registry should return errChunkedUploadUnsupported, got %v", err)
+	}
+	if len(registry.requests) != 0 {
+		t.Errorf("expected no upload request, got %v", registry.requests)
+	}
+}
+
+// newMountJob creates a job from team/src to team/app of registry, the layer of testManifest is known in
+// team/base of registry and present in team/src
+func newMountJob(t *testing.T, server *uploadServer, registry string) *Job {
+	layer := digest.FromBytes(testLayer)
+	server.blobs["team/base@"+layer.String()] = testLayer
+	server.blobs["team/src@"+layer.String()] = testLayer
+
+	source, err := NewImageSource(registry, "team/src", "v1", "", "", true)
+	if err != nil {
+		t.Fatalf("NewImageSource error: %v", err)
+	}
+	target, err := NewImageTarget(registry, "team/app", "v1", "", "", true)
+	if err != nil {
+		t.Fatalf("NewImageTarget error: %v", err)
+	}
+	t.Cleanup(func() {
+		source.Close()
+		target.Close()
+	})
+	knownBlobs := NewBlobSet()
+	knownBlobs.Add(registry, "team/base", layer)
+	server.requests = nil
+	return NewJob(source, target, &JobOptions{KnownBlobs: knownBlobs})
+}
+
+func TestTransferBlobsMount(t *testing.T) {
+	registry := newUploadServer()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	defer forgetRegistryBases()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	j := newMountJob(t, registry, host)
+	layer := types.BlobInfo{Digest: digest.FromBytes(testLayer), Size: int64(len(testLayer))}
+	if err := j.transferBlobs([]types.BlobInfo{layer}); err != nil {
+		t.Fatalf("transferBlobs error: %v", err)
+	}
+	// the shared layer is mounted from team/base without a HEAD request or an upload
+	if strings.Join(registry.requests, ",") != "MOUNT" {
+		t.Errorf("expected a mount request only, got %v", registry.requests)
+	}
+	if !bytes.Equal(registry.blobs["team/app@"+layer.Digest.String()], testLayer) {
+		t.Errorf("the layer is not mounted to team/app")
+	}
+	if j.stats.Bytes != 0 {
+		t.Errorf("expected no bytes pushed, got %v", j.stats.Bytes)
+	}
+	if !j.options.KnownBlobs.Contains(host, "team/app", layer.Digest) {
+		t.Errorf("the mounted layer should be known in team/app")
+	}
+}
+
+func TestTransferBlobsMountRefused(t *testing.T) {
+	registry := newUploadServer()
+	registry.refuseMount = true
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	defer forgetRegistryBases()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	j := newMountJob(t, registry, host)
+	layer := types.BlobInfo{Digest: digest.FromBytes(testLayer), Size: int64(len(testLayer))}
+	if err := j.transferBlobs([]types.BlobInfo{layer}); err != nil {
+		t.Fatalf("transferBlobs error: %v", err)
+	}
+	// the upload session started instead of the mount is cancelled, then the layer is pushed
+	if len(registry.requests) < 2 || registry.requests[0] != "MOUNT" || registry.requests[1] != "DELETE" {
+		t.Errorf("expected a refused mount cancelled by DELETE, got %v", registry.requests)
+	}
+	if !bytes.Equal(registry.blobs["team/app@"+layer.Digest.String()], testLayer) {
+		t.Errorf("the layer is not pushed to team/app")
+	}
+	if j.stats.Bytes != int64(len(testLayer)) {
+		t.Errorf("expected %v bytes pushed, got %v", len(testLayer), j.stats.Bytes)
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package utils
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// RepoFilter filters repositories by regular expressions matched against namespace/repository,
+// a repository matches if it matches any include pattern(or there is no include pattern)
+// and matches no exclude pattern, the filter can be limited to a list of repositories further
+type RepoFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+
+	// repositories limits the matched repositories if it is not empty
+	repositories map[string]bool
+}
+
+// NewRepoFilter creates a RepoFilter from include and exclude patterns
+func NewRepoFilter(include, exclude []string) (*RepoFilter, error) {
+	f := &RepoFilter{}
+
+	for _, pattern := range include {
+		r, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("include pattern %s is invalid: %v", pattern, err)
+		}
+		f.include = append(f.include, r)
+	}
+
+	for _, pattern := range exclude {
+		r, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("exclude pattern %s is invalid: %v", pattern, err)
+		}
+		f.exclude = append(f.exclude, r)
+	}
+
+	return f, nil
+}
+
+// Match checks if a repository(namespace/repository) passes the filter, a nil filter matches all
+func (f *RepoFilter) Match(repository string) bool {
+	if f == nil {
+		return true
+	}
+
+	if len(f.repositories) != 0 && !f.repositories[repository] {
+		return false
+	}
+
+	for _, r := range f.exclude {
+		if r.MatchString(repository) {
+			return false
+		}
+	}
+
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, r := range f.include {
+		if r.MatchString(repository) {
+			return true
+		}
+	}
+	return false
+}
+
+// LimitTo limits the matched repositories to a list of namespace/repository
+func (f *RepoFilter) LimitTo(repositories []string) {
+	f.repositories = make(map[string]bool)
+	for _, repository := range repositories {
+		f.repositories[repository] = true
+	}
+}
+
+// IsEmpty checks if the filter has no pattern and no repository list
+func (f *RepoFilter) IsEmpty() bool {
+	return f == nil || (len(f.include) == 0 && len(f.exclude) == 0 && len(f.repositories) == 0)
+}
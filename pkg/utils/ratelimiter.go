@@ -74,3 +74,22 @@ func NewListRateLimitedTransport(rate int, transport http.RoundTripper) http.Rou
 		limiter:      NewListLimiter(rate),
 	}
 }
+
+var apiLimiterOnce sync.Once
+var apiLimiter ratelimit.Limiter
+
+// NewAPILimiter generates a new limiter of tencent cloud api calls.
+func NewAPILimiter(rate int) ratelimit.Limiter {
+	apiLimiterOnce.Do(func() {
+		apiLimiter = ratelimit.New(rate)
+	})
+	return apiLimiter
+}
+
+// NewAPIRateLimitedTransport generates a new transport of tencent cloud api with rateLimit.
+func NewAPIRateLimitedTransport(rate int, transport http.RoundTripper) http.RoundTripper {
+	return &limitTransport{
+		RoundTripper: transport,
+		limiter:      NewAPILimiter(rate),
+	}
+}
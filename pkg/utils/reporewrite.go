@@ -0,0 +1,149 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// the strategies of a repository rewrite, e.g. prefix=bitnami-, replace=charts:helm, flatten or flatten=_
+const (
+	RepoRewritePrefix  = "prefix"
+	RepoRewriteSuffix  = "suffix"
+	RepoRewriteReplace = "replace"
+	RepoRewriteFlatten = "flatten"
+	RepoRewriteLower   = "lower"
+)
+
+// repositoryRegexp matches a valid repository path of the distribution spec
+var repositoryRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*` +
+	`(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+
+// repoRewriteCharsRegexp matches the strings added by a repository rewrite, they hold the characters
+// of a repository path only
+var repoRewriteCharsRegexp = regexp.MustCompile(`^[a-z0-9._/-]*$`)
+
+// RepoRewrite is an ordered list of rewrites of the repository path below the target namespace
+type RepoRewrite []repoRewriteStep
+
+// repoRewriteStep is a strategy of RepoRewrite with its argument
+type repoRewriteStep struct {
+	strategy string
+	from     string
+	to       string
+}
+
+// ParseRepoRewrite parses the strategies of a repository rewrite, they are applied in order:
+// prefix=<string> and suffix=<string> add a string, replace=<old>:<new> replaces a substring, flatten
+// replaces the / of nested paths with - or the separator of flatten=<separator>, lower converts to lower case
+func ParseRepoRewrite(strategies []string) (RepoRewrite, error) {
+	var rewrite RepoRewrite
+	for _, strategy := range strategies {
+		nameAndArg := strings.SplitN(strategy, "=", 2)
+		step := repoRewriteStep{strategy: nameAndArg[0]}
+		hasArg := len(nameAndArg) == 2
+		switch step.strategy {
+		case RepoRewritePrefix, RepoRewriteSuffix:
+			if !hasArg || nameAndArg[1] == "" {
+				return nil, fmt.Errorf("repo rewrite %s should be like %s=<string>", strategy, step.strategy)
+			}
+			step.to = nameAndArg[1]
+		case RepoRewriteReplace:
+			var oldAndNew []string
+			if hasArg {
+				oldAndNew = strings.SplitN(nameAndArg[1], ":", 2)
+			}
+			if len(oldAndNew) != 2 || oldAndNew[0] == "" {
+				return nil, fmt.Errorf("repo rewrite %s should be like replace=<old>:<new>", strategy)
+			}
+			step.from, step.to = oldAndNew[0], oldAndNew[1]
+		case RepoRewriteFlatten:
+			step.from, step.to = "/", "-"
+			if hasArg {
+				if separator := nameAndArg[1]; separator != "-" && separator != "_" && separator != "." &&
+					separator != "__" {
+					return nil, fmt.Errorf("separator of repo rewrite %s should be -, _, . or __", strategy)
+				}
+				step.to = nameAndArg[1]
+			}
+		case RepoRewriteLower:
+			if hasArg {
+				return nil, fmt.Errorf("repo rewrite %s has no argument", strategy)
+			}
+		default:
+			return nil, fmt.Errorf("repo rewrite %s should be one of prefix=, suffix=, replace=, flatten or lower",
+				strategy)
+		}
+		if !repoRewriteCharsRegexp.MatchString(step.to) {
+			return nil, fmt.Errorf("repo rewrite %s should only add lower case letters, digits, ., _, - and /",
+				strategy)
+		}
+		rewrite = append(rewrite, step)
+	}
+	return rewrite, nil
+}
+
+// Apply rewrites a repository path, an error is returned if the rewritten path is not a valid repository.
+// An empty rewrite keeps the repository as it is
+func (r RepoRewrite) Apply(repository string) (string, error) {
+	if len(r) == 0 {
+		return repository, nil
+	}
+	rewritten := repository
+	for _, step := range r {
+		switch step.strategy {
+		case RepoRewritePrefix:
+			rewritten = step.to + rewritten
+		case RepoRewriteSuffix:
+			rewritten = rewritten + step.to
+		case RepoRewriteReplace, RepoRewriteFlatten:
+			rewritten = strings.Replace(rewritten, step.from, step.to, -1)
+		case RepoRewriteLower:
+			rewritten = strings.ToLower(rewritten)
+		}
+	}
+	if !repositoryRegexp.MatchString(rewritten) {
+		return "", fmt.Errorf("repository %s is rewritten to %s which is not a valid repository", repository,
+			rewritten)
+	}
+	return rewritten, nil
+}
+
+// SplitWildcardTarget splits a wildcard target like registry/namespace/prefix-*-suffix whose last component
+// holds a * into the registry, the namespace and a repo rewrite which adds the prefix and the suffix around
+// the listed repositories, ok is false if the url is not a wildcard target
+func SplitWildcardTarget(url string) (registry, namespace string, rewrite RepoRewrite, ok bool) {
+	i := strings.LastIndex(url, "/")
+	if i < 0 || strings.Count(url[i+1:], "*") != 1 || strings.Contains(url[:i], "*") {
+		return "", "", nil, false
+	}
+	if registry, namespace, ok = SplitWildcardRepo(url[:i] + "/*"); !ok {
+		return "", "", nil, false
+	}
+	parts := strings.SplitN(url[i+1:], "*", 2)
+	if parts[0] != "" {
+		rewrite = append(rewrite, repoRewriteStep{strategy: RepoRewritePrefix, to: parts[0]})
+	}
+	if parts[1] != "" {
+		rewrite = append(rewrite, repoRewriteStep{strategy: RepoRewriteSuffix, to: parts[1]})
+	}
+	return registry, namespace, rewrite, true
+}
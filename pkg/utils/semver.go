@@ -0,0 +1,206 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// semverRegexp matches a semantic version tag like 1.2.3, v1.2 or 1.2.3-rc.1,
+// a missing minor or patch version is taken as 0
+var semverRegexp = regexp.MustCompile(`^v?(0|[1-9][0-9]*)(?:\.(0|[1-9][0-9]*))?(?:\.(0|[1-9][0-9]*))?` +
+	`(?:-([0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*))?$`)
+
+// Semver is a semantic version parsed from a tag
+type Semver struct {
+	Major      int64
+	Minor      int64
+	Patch      int64
+	PreRelease []string
+}
+
+// ParseSemver parses a tag as a semantic version, false is returned if the tag is not a semantic version
+func ParseSemver(tag string) (*Semver, bool) {
+	m := semverRegexp.FindStringSubmatch(tag)
+	if m == nil {
+		return nil, false
+	}
+
+	v := &Semver{}
+	var err error
+	for i, field := range []*int64{&v.Major, &v.Minor, &v.Patch} {
+		if m[i+1] == "" {
+			continue
+		}
+		if *field, err = strconv.ParseInt(m[i+1], 10, 64); err != nil {
+			return nil, false
+		}
+	}
+	if m[4] != "" {
+		v.PreRelease = strings.Split(m[4], ".")
+	}
+
+	return v, true
+}
+
+// Compare returns -1, 0 or 1 if v is lower than, equal to or higher than o,
+// following the precedence rules of semantic versioning
+func (v *Semver) Compare(o *Semver) int {
+	if c := compareInt(v.Major, o.Major); c != 0 {
+		return c
+	}
+	if c := compareInt(v.Minor, o.Minor); c != 0 {
+		return c
+	}
+	if c := compareInt(v.Patch, o.Patch); c != 0 {
+		return c
+	}
+
+	// a pre-release version has lower precedence than the normal version
+	if len(v.PreRelease) == 0 || len(o.PreRelease) == 0 {
+		return compareInt(int64(len(o.PreRelease)), int64(len(v.PreRelease)))
+	}
+
+	for i := 0; i < len(v.PreRelease) && i < len(o.PreRelease); i++ {
+		if c := comparePreRelease(v.PreRelease[i], o.PreRelease[i]); c != 0 {
+			return c
+		}
+	}
+	return compareInt(int64(len(v.PreRelease)), int64(len(o.PreRelease)))
+}
+
+// comparePreRelease compares pre-release identifiers, numeric identifiers have
+// lower precedence than alphanumeric identifiers
+func comparePreRelease(a, b string) int {
+	aNum, aErr := strconv.ParseInt(a, 10, 64)
+	bNum, bErr := strconv.ParseInt(b, 10, 64)
+	switch {
+	case aErr == nil && bErr == nil:
+		return compareInt(aNum, bNum)
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	default:
+		return strings.Compare(a, b)
+	}
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// SemverConstraint is a constraint of semantic versions like ">=1.20,<2.0", conditions separated by
+// commas must all be satisfied, and groups separated by "||" are alternatives
+type SemverConstraint struct {
+	origin string
+	groups [][]semverCondition
+}
+
+// semverCondition is a single condition like ">=1.20"
+type semverCondition struct {
+	op      string
+	version *Semver
+}
+
+// semverOps are the supported operators, longer operators are matched first
+var semverOps = []string{">=", "<=", "!=", ">", "<", "="}
+
+// ParseSemverConstraint parses a constraint like ">=1.20,<2.0" or "1.2.3 || >=2.0"
+func ParseSemverConstraint(constraint string) (*SemverConstraint, error) {
+	c := &SemverConstraint{origin: constraint}
+
+	for _, group := range strings.Split(constraint, "||") {
+		var conditions []semverCondition
+		for _, cond := range strings.Split(group, ",") {
+			cond = strings.TrimSpace(cond)
+			if cond == "" {
+				return nil, fmt.Errorf("semver constraint %s has an empty condition", constraint)
+			}
+
+			op := "="
+			for _, o := range semverOps {
+				if strings.HasPrefix(cond, o) {
+					op = o
+					cond = strings.TrimSpace(strings.TrimPrefix(cond, o))
+					break
+				}
+			}
+
+			v, ok := ParseSemver(cond)
+			if !ok {
+				return nil, fmt.Errorf("semver constraint %s has an invalid version %s", constraint, cond)
+			}
+			conditions = append(conditions, semverCondition{op: op, version: v})
+		}
+		c.groups = append(c.groups, conditions)
+	}
+
+	return c, nil
+}
+
+// Check checks if a version satisfies the constraint
+func (c *SemverConstraint) Check(v *Semver) bool {
+	for _, group := range c.groups {
+		matched := true
+		for _, cond := range group {
+			if !cond.check(v) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the origin constraint
+func (c *SemverConstraint) String() string {
+	return c.origin
+}
+
+func (cond semverCondition) check(v *Semver) bool {
+	r := v.Compare(cond.version)
+	switch cond.op {
+	case ">=":
+		return r >= 0
+	case "<=":
+		return r <= 0
+	case "!=":
+		return r != 0
+	case ">":
+		return r > 0
+	case "<":
+		return r < 0
+	default:
+		return r == 0
+	}
+}
@@ -0,0 +1,169 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// templatePlaceholderRegexp matches the placeholders of a target template like {repo} or {path|flatten|lower}
+var templatePlaceholderRegexp = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// templatePlaceholders are the placeholders of a target template, they are replaced with the parts of a
+// source url: {registry}, {namespace}, {repo}(without namespace), {path}(namespace/repo) and {tag}
+var templatePlaceholders = map[string]func(sourceURL *RepoURL) string{
+	"registry":  (*RepoURL).GetRegistry,
+	"namespace": (*RepoURL).GetNamespace,
+	"repo":      (*RepoURL).GetRepo,
+	"path":      (*RepoURL).GetRepoWithNamespace,
+	"tag":       (*RepoURL).GetTag,
+}
+
+// templateModifiers are the modifiers of a placeholder, flatten replaces "/" with "-" and lower lowercases it
+var templateModifiers = map[string]func(value string) string{
+	"flatten": func(value string) string {
+		return strings.Replace(value, "/", "-", -1)
+	},
+	"lower": strings.ToLower,
+}
+
+// TargetTemplate is a target url like tcr.example.com/mirror/{path|flatten}:{tag}-amd64 which is rendered
+// for every source url, a placeholder may have modifiers applied in order like {path|flatten|lower}.
+// {tag} can only be in the tag part after the last ":", the tag of the source is used if there is no tag part
+type TargetTemplate struct {
+	template   string
+	repository string
+	tag        string
+}
+
+// IsTargetTemplate checks if a target url has placeholders
+func IsTargetTemplate(target string) bool {
+	return strings.Contains(target, "{")
+}
+
+// CompleteTargetTemplate appends "/{namespace}/{repo}" to a template without {repo} or {path},
+// a base url like harbor.corp.local is the same as harbor.corp.local/{namespace}/{repo}
+func CompleteTargetTemplate(template string) string {
+	for _, match := range templatePlaceholderRegexp.FindAllStringSubmatch(template, -1) {
+		if name := strings.SplitN(match[1], "|", 2)[0]; name == "repo" || name == "path" {
+			return template
+		}
+	}
+	return strings.TrimSuffix(template, "/") + "/" + NamespacePlaceholder + "/" + RepoPlaceholder
+}
+
+// ParseTargetTemplate parses a target template, an unknown placeholder or modifier, an unclosed brace
+// or {tag} out of the tag part returns an error
+func ParseTargetTemplate(template string) (*TargetTemplate, error) {
+	if strings.ContainsAny(templatePlaceholderRegexp.ReplaceAllString(template, ""), "{}") {
+		return nil, fmt.Errorf("template %s has unmatched braces", template)
+	}
+
+	// the tag part follows the last ":" after the last "/", a ":" before it is the port of the registry
+	t := &TargetTemplate{template: template, repository: template}
+	if i := strings.LastIndex(template, ":"); i > strings.LastIndex(template, "/") {
+		t.repository, t.tag = template[:i], template[i+1:]
+		if t.tag == "" {
+			return nil, fmt.Errorf("template %s has an empty tag", template)
+		}
+	}
+
+	for _, match := range templatePlaceholderRegexp.FindAllStringSubmatch(template, -1) {
+		fields := strings.Split(match[1], "|")
+		if _, ok := templatePlaceholders[fields[0]]; !ok {
+			return nil, fmt.Errorf("unknown placeholder %s in template %s, it should be one of "+
+				"{registry}, {namespace}, {repo}, {path} and {tag}", match[0], template)
+		}
+		for _, modifier := range fields[1:] {
+			if _, ok := templateModifiers[modifier]; !ok {
+				return nil, fmt.Errorf("unknown modifier %s of %s in template %s, it should be flatten or lower",
+					modifier, match[0], template)
+			}
+		}
+		if fields[0] == "tag" && !strings.Contains(t.tag, match[0]) {
+			return nil, fmt.Errorf("%s should be in the tag part after the last \":\" of template %s",
+				match[0], template)
+		}
+	}
+	return t, nil
+}
+
+// String returns the template
+func (t *TargetTemplate) String() string {
+	return t.template
+}
+
+// HasTag checks if the template has a tag part
+func (t *TargetTemplate) HasTag() bool {
+	return t.tag != ""
+}
+
+// HasSourceTag checks if the tag part of the template is the tag of the source as is, i.e. {tag}
+func (t *TargetTemplate) HasSourceTag() bool {
+	return t.tag == "{tag}"
+}
+
+// Render renders the template for a source url, the url has no tag if the template has no tag part.
+// An empty component of the rendered url returns an error
+func (t *TargetTemplate) Render(sourceURL *RepoURL) (string, error) {
+	repository, err := t.RenderRepository(sourceURL)
+	if err != nil || t.tag == "" {
+		return repository, err
+	}
+
+	tag := renderTemplate(t.tag, sourceURL)
+	if tag == "" {
+		return "", fmt.Errorf("template %s renders an empty tag for %s", t.template, sourceURL.GetURL())
+	}
+	return repository + ":" + tag, nil
+}
+
+// RenderRepository renders the repository part of the template without the tag for a source url
+func (t *TargetTemplate) RenderRepository(sourceURL *RepoURL) (string, error) {
+	repository := renderTemplate(t.repository, sourceURL)
+	for _, component := range strings.Split(repository, "/") {
+		if component == "" {
+			return "", fmt.Errorf("template %s renders %q with an empty component for %s", t.template,
+				repository, sourceURL.GetURL())
+		}
+	}
+	return repository, nil
+}
+
+// renderTemplate replaces the placeholders of template with the parts of sourceURL, an unknown
+// placeholder or modifier is left as is
+func renderTemplate(template string, sourceURL *RepoURL) string {
+	return templatePlaceholderRegexp.ReplaceAllStringFunc(template, func(placeholder string) string {
+		fields := strings.Split(placeholder[1:len(placeholder)-1], "|")
+		part, ok := templatePlaceholders[fields[0]]
+		if !ok {
+			return placeholder
+		}
+		value := part(sourceURL)
+		for _, name := range fields[1:] {
+			modifier, ok := templateModifiers[name]
+			if !ok {
+				return placeholder
+			}
+			value = modifier(value)
+		}
+		return value
+	})
+}
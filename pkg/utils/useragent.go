@@ -0,0 +1,53 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package utils
+
+import (
+	"net/http"
+	"runtime"
+
+	"tkestack.io/image-transfer/pkg/version"
+)
+
+// DefaultUserAgent returns the user agent of the requests to registries and apis, with the version
+// and platform of the binary
+func DefaultUserAgent() string {
+	return "image-transfer/" + version.Version().Version + " (" + runtime.GOOS + "/" + runtime.GOARCH + ")"
+}
+
+// userAgentTransport sets the User-Agent header of every request
+type userAgentTransport struct {
+	http.RoundTripper
+	userAgent string
+}
+
+// RoundTrip sends a copy of the request with the user agent
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// NewUserAgentTransport generates a new transport which sets the User-Agent header of requests
+func NewUserAgentTransport(userAgent string, transport http.RoundTripper) http.RoundTripper {
+	return &userAgentTransport{
+		RoundTripper: transport,
+		userAgent:    userAgent,
+	}
+}
@@ -19,11 +19,65 @@
 package utils
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// OCILayoutTransport is the transport of a local oci layout directory, e.g. oci:/path/to/layout:tag
+	OCILayoutTransport = "oci"
+	// DockerArchiveTransport is the transport of a docker-archive tar file, e.g. docker-archive:/path/image.tar
+	DockerArchiveTransport = "docker-archive"
+	// OCIArchiveTransport is the transport of an oci-archive tar file, e.g. oci-archive:/path/image.tar
+	OCIArchiveTransport = "oci-archive"
+
+	// DockerHubRegistry is the registry of docker hub short names like nginx or user/app
+	DockerHubRegistry = "docker.io"
+	// DockerHubOfficialNamespace is the namespace of docker official images like nginx
+	DockerHubOfficialNamespace = "library"
+	// DockerHubLegacyRegistry is the legacy domain of docker hub, it is the same registry as docker.io
+	DockerHubLegacyRegistry = "index.docker.io"
+
+	// NamespacePlaceholder is replaced with the source namespace in a target template
+	NamespacePlaceholder = "{namespace}"
+	// RepoPlaceholder is replaced with the source repo(without namespace) in a target template
+	RepoPlaceholder = "{repo}"
+
+	// BearerTokenUsername is the username of the auth information whose password is a bearer token
+	// sent to the registry directly, like the token of a security file entry
+	BearerTokenUsername = "<token>"
+
+	// GHCRRegistry is the registry of github container registry
+	GHCRRegistry = "ghcr.io"
+	// GHCRUsername is the username sent to ghcr.io if it is not configured, ghcr.io only checks the
+	// personal access token in the password
+	GHCRUsername = "github"
 )
 
-// The RepoURL will divide a images url to <registry>/<namespace>/<repo>:<tag>
+// DockerHubAliases are the other domains of docker hub, the auth information of them is used for docker.io
+var DockerHubAliases = []string{"registry.hub.docker.com", "index.docker.io", "registry-1.docker.io"}
+
+// localTransports are the transports of local images, an archive holds only one image
+var localTransports = []string{DockerArchiveTransport, OCIArchiveTransport, OCILayoutTransport}
+
+// The RepoURL will divide a images url to <registry>/<namespace>/<repo>:<tag>@<digest>,
+// or <transport>:<path>:<tag> for a local image. The tag and the digest are both optional,
+// a colon in the registry like myregistry:5000 is the port of a host instead of a tag, only the
+// last colon after the last slash separates the tag and a colon elsewhere in the path is invalid.
+// A repository with more than two path components keeps the first component as namespace
+// and the rest as repo, e.g. ghcr.io/my-org/platform/base:1.2 is divided to ghcr.io, my-org,
+// platform/base and 1.2, so GetRepoWithNamespace always returns the full repository path.
+// The namespace is not everything up to the last component on purpose: it is the tcr, ccr and
+// quay namespace which EnsureTcrNs creates, the quota plan counts and the repositories are
+// grouped by, and those registries have single level namespaces with nested repository names.
 type RepoURL struct {
 	// origin url
 	url string
@@ -32,62 +86,149 @@ type RepoURL struct {
 	namespace string
 	repo      string
 	tag       string
+	digest    string
+
+	// transport and path of a local image, transport is empty for a registry image
+	transport string
+	path      string
 }
 
 // NewRepoURL creates a RepoURL
 func NewRepoURL(url string) (*RepoURL, error) {
-	// split to registry/namespace/repoAndTag
-	slice := strings.SplitN(url, "/", 3)
+	for _, transport := range localTransports {
+		if strings.HasPrefix(url, transport+":") {
+			return newLocalRepoURL(url, transport)
+		}
+	}
 
-	var tag, repo string
-	repoAndTag := slice[len(slice)-1]
-	s := strings.Split(repoAndTag, ":")
-	if len(s) > 2 {
+	// split to registry/path, the registry is the first component and may hold a port like myregistry:5000
+	slice := strings.SplitN(normalizeDockerHubName(url), "/", 2)
+	if len(slice) != 2 {
+		return nil, fmt.Errorf("invalid repository url: %v, repository is empty", url)
+	}
+	path := slice[1]
+
+	// only the last component holds the tag and the digest, a colon before the last slash is invalid
+	var tag, imageDigest string
+	if i := strings.LastIndex(path, "@"); i > strings.LastIndex(path, "/") {
+		imageDigest = path[i+1:]
+		path = path[:i]
+		if _, err := digest.Parse(imageDigest); err != nil {
+			return nil, fmt.Errorf("invalid repository url: %v, digest %s is invalid: %v", url, imageDigest, err)
+		}
+	}
+	if i := strings.LastIndex(path, ":"); i > strings.LastIndex(path, "/") {
+		tag = path[i+1:]
+		path = path[:i]
+	}
+	if strings.ContainsAny(path, ":@") {
 		return nil, fmt.Errorf("invalid repository url: %v", url)
-	} else if len(s) == 2 {
-		repo = s[0]
-		tag = s[1]
-	} else {
-		repo = s[0]
-		tag = ""
-	}
-
-	if len(slice) == 3 {
-		return &RepoURL{
-			url:       url,
-			registry:  slice[0],
-			namespace: slice[1],
-			repo:      repo,
-			tag:       tag,
-		}, nil
-	} else if len(slice) == 2 {
-		// if first string is a domain
-		if strings.Contains(slice[0], ".") {
-			return &RepoURL{
-				url:       url,
-				registry:  slice[0],
-				namespace: "",
-				repo:      repo,
-				tag:       tag,
-			}, nil
+	}
+	for _, component := range strings.Split(path, "/") {
+		if component == "" {
+			return nil, fmt.Errorf("invalid repository url: %v, repository is empty", url)
+		}
+	}
+
+	// the first component of a path with more than one component is the namespace
+	repoURL := &RepoURL{
+		url:      url,
+		registry: slice[0],
+		repo:     path,
+		tag:      tag,
+		digest:   imageDigest,
+	}
+	if i := strings.Index(path, "/"); i >= 0 {
+		repoURL.namespace, repoURL.repo = path[:i], path[i+1:]
+	}
+	return repoURL, nil
+}
+
+// normalizeDockerHubName completes the docker hub short names the way docker does: a bare name like
+// nginx:1.25 is docker.io/library/nginx:1.25, a name whose first component is not a registry host like
+// user/app is docker.io/user/app, and index.docker.io is docker.io. A docker.io name without namespace
+// is an official image
+func normalizeDockerHubName(url string) string {
+	slice := strings.SplitN(url, "/", 2)
+	if len(slice) == 1 {
+		return DockerHubRegistry + "/" + DockerHubOfficialNamespace + "/" + url
+	}
+	if !isRegistryHost(slice[0]) {
+		return DockerHubRegistry + "/" + url
+	}
+	if slice[0] == DockerHubLegacyRegistry {
+		slice[0] = DockerHubRegistry
+	}
+	if slice[0] == DockerHubRegistry && !strings.Contains(slice[1], "/") {
+		return DockerHubRegistry + "/" + DockerHubOfficialNamespace + "/" + slice[1]
+	}
+	return slice[0] + "/" + slice[1]
+}
+
+// isRegistryHost checks if the first component of an image url is a registry host: a domain,
+// a host with port like registry:5000 or localhost
+func isRegistryHost(component string) bool {
+	return strings.ContainsAny(component, ".:") || component == "localhost"
+}
+
+// SplitWildcardRepo splits a url like registry/namespace/* whose repository position is a * into the
+// registry and the namespace, ok is false if the url is not a wildcard
+func SplitWildcardRepo(url string) (registry, namespace string, ok bool) {
+	if !strings.HasSuffix(url, "/*") {
+		return "", "", false
+	}
+	slice := strings.SplitN(strings.TrimSuffix(url, "/*"), "/", 2)
+	if !isRegistryHost(slice[0]) {
+		return "", "", false
+	}
+	if len(slice) == 2 {
+		namespace = slice[1]
+	}
+	return slice[0], namespace, true
+}
+
+// AddDefaultRegistry prepends registry to an image url which has no registry host,
+// e.g. library/nginx:1.25, a local image url or an empty registry keeps the url unchanged
+func AddDefaultRegistry(url, registry string) string {
+	if registry == "" {
+		return url
+	}
+	for _, transport := range localTransports {
+		if strings.HasPrefix(url, transport+":") {
+			return url
 		}
+	}
+	if slice := strings.SplitN(url, "/", 2); len(slice) == 2 && isRegistryHost(slice[0]) {
+		return url
+	}
+	return strings.TrimSuffix(registry, "/") + "/" + url
+}
+
+// newLocalRepoURL creates a RepoURL of a local image, the tag is the part after
+// the last colon which is behind the last slash. An archive holds only one image,
+// so the url of an archive has no tag.
+func newLocalRepoURL(url string, transport string) (*RepoURL, error) {
+	path := strings.TrimPrefix(url, transport+":")
+
+	var tag string
+	if transport == OCILayoutTransport {
+		if i := strings.LastIndex(path, ":"); i > strings.LastIndex(path, "/") {
+			tag = path[i+1:]
+			path = path[:i]
+		}
+	}
 
-		return &RepoURL{
-			url:       url,
-			registry:  "registry.hub.docker.com",
-			namespace: slice[0],
-			repo:      repo,
-			tag:       tag,
-		}, nil
-	} else {
-		return &RepoURL{
-			url:       url,
-			registry:  "registry.hub.docker.com",
-			namespace: "library",
-			repo:      repo,
-			tag:       tag,
-		}, nil
+	if path == "" {
+		return nil, fmt.Errorf("invalid %s url, path should not be empty: %v", transport, url)
 	}
+
+	return &RepoURL{
+		url:       url,
+		repo:      filepath.Base(path),
+		tag:       tag,
+		transport: transport,
+		path:      path,
+	}, nil
 }
 
 // GetURL returns the whole url
@@ -96,6 +237,9 @@ func (r *RepoURL) GetURL() string {
 	if r.tag != "" {
 		url = url + ":" + r.tag
 	}
+	if r.digest != "" {
+		url = url + "@" + r.digest
+	}
 	return url
 }
 
@@ -124,6 +268,20 @@ func (r *RepoURL) GetTag() string {
 	return r.tag
 }
 
+// GetDigest returns the digest in a url, e.g. sha256:... of nginx@sha256:...
+func (r *RepoURL) GetDigest() string {
+	return r.digest
+}
+
+// GetReference returns the reference an image is pulled by, the digest is preferred
+// over the tag as it pins the content
+func (r *RepoURL) GetReference() string {
+	if r.digest != "" {
+		return r.digest
+	}
+	return r.tag
+}
+
 // GetRepoWithNamespace returns namespace/repository in a url
 func (r *RepoURL) GetRepoWithNamespace() string {
 	if r.namespace == "" {
@@ -142,15 +300,57 @@ func (r *RepoURL) GetRepoWithTag() string {
 
 // GetURLWithoutTag returns registry/namespace/repository in a url
 func (r *RepoURL) GetURLWithoutTag() string {
+	if r.IsLocal() {
+		return r.transport + ":" + r.path
+	}
 	if r.namespace == "" {
 		return r.registry + "/" + r.repo
 	}
 	return r.registry + "/" + r.namespace + "/" + r.repo
 }
 
-// CheckIfIncludeTag checks if a repository string includes tag
+// ToLower returns a copy of the url with lower case registry, namespace and repository,
+// the tag is case sensitive and left untouched. A local url is returned as it is.
+func (r *RepoURL) ToLower() *RepoURL {
+	if r.IsLocal() {
+		return r
+	}
+
+	lower := *r
+	lower.registry = strings.ToLower(r.registry)
+	lower.namespace = strings.ToLower(r.namespace)
+	lower.repo = strings.ToLower(r.repo)
+	lower.url = lower.GetURL()
+
+	return &lower
+}
+
+// IsLocal returns if the url is a local image, e.g. an oci layout directory
+func (r *RepoURL) IsLocal() bool {
+	return r.transport != ""
+}
+
+// IsArchive returns if the url is a local archive file which holds only one image
+func (r *RepoURL) IsArchive() bool {
+	return r.transport == DockerArchiveTransport || r.transport == OCIArchiveTransport
+}
+
+// GetTransport returns the transport of a local image
+func (r *RepoURL) GetTransport() string {
+	return r.transport
+}
+
+// GetPath returns the path of a local image
+func (r *RepoURL) GetPath() string {
+	return r.path
+}
+
+// CheckIfIncludeTag checks if a repository string includes a tag or a digest, the tag is after the last
+// colon behind the last slash as NewRepoURL splits it, so the port of registry:5000/ns/repo is not a tag.
+// A repository which can not be parsed is left to the callers to reject
 func CheckIfIncludeTag(repository string) bool {
-	return strings.Contains(repository, ":")
+	repoURL, err := NewRepoURL(repository)
+	return err == nil && repoURL.GetReference() != ""
 }
 
 // IsContain judge the item is in items or not
@@ -162,3 +362,78 @@ func IsContain(items []string, item string) bool {
 	}
 	return false
 }
+
+// RenderTargetTemplate renders a target template like harbor.corp.local/ccr-{namespace}/{repo}
+// for a source repository, a template without {repo} is taken as a base url and
+// "/{namespace}/{repo}" is appended to it. The modifiers of TargetTemplate like {repo|flatten}
+// are supported, {registry} and {tag} are empty
+func RenderTargetTemplate(template, namespace, repo string) string {
+	return renderTemplate(CompleteTargetTemplate(template), &RepoURL{namespace: namespace, repo: repo})
+}
+
+// ReadListFile reads a list file which has an item per line(items can also be separated by commas),
+// empty lines and lines starting with "#" are ignored
+func ReadListFile(path string) ([]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, item := range strings.Split(line, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+
+	return items, nil
+}
+
+// ExpandListFile returns the items of a list file if the only item of list is an existing file,
+// otherwise list is returned
+func ExpandListFile(list []string) ([]string, error) {
+	if len(list) != 1 {
+		return list, nil
+	}
+	if info, err := os.Stat(list[0]); err != nil || info.IsDir() {
+		return list, nil
+	}
+	return ReadListFile(list[0])
+}
+
+// NewTransportWithCA creates a http transport which trusts the certificates in caFile besides the system ones
+func NewTransportWithCA(caFile string) (*http.Transport, error) {
+	caData, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read ca file %s error: %v", caFile, err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(caData) {
+		return nil, fmt.Errorf("no certificate is found in ca file %s", caFile)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return transport, nil
+}
+
+// ReplaceRegistry replaces the registry of a url by domains which map registries to other domains,
+// the url is returned unchanged if its registry is not in domains
+func ReplaceRegistry(url string, domains map[string]string) string {
+	parts := strings.SplitN(url, "/", 2)
+	domain, ok := domains[parts[0]]
+	if !ok || len(parts) != 2 {
+		return url
+	}
+	return domain + "/" + parts[1]
+}
@@ -0,0 +1,319 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package utils
+
+import (
+	"testing"
+)
+
+// repoURLCase is an url with the parts NewRepoURL is expected to divide it to
+type repoURLCase struct {
+	url       string
+	registry  string
+	namespace string
+	repo      string
+	tag       string
+	digest    string
+	full      string
+}
+
+// checkRepoURLs checks the parts of the urls divided by NewRepoURL
+func checkRepoURLs(t *testing.T, cases []repoURLCase) {
+	t.Helper()
+	for _, c := range cases {
+		repoURL, err := NewRepoURL(c.url)
+		if err != nil {
+			t.Errorf("NewRepoURL(%q) error: %v", c.url, err)
+			continue
+		}
+		got := repoURLCase{
+			url:       c.url,
+			registry:  repoURL.GetRegistry(),
+			namespace: repoURL.GetNamespace(),
+			repo:      repoURL.GetRepo(),
+			tag:       repoURL.GetTag(),
+			digest:    repoURL.GetDigest(),
+			full:      repoURL.GetURL(),
+		}
+		if got != c {
+			t.Errorf("NewRepoURL(%q) = %+v, expected %+v", c.url, got, c)
+		}
+	}
+}
+
+func TestNewRepoURLShortNames(t *testing.T) {
+	checkRepoURLs(t, []repoURLCase{
+		{url: "nginx", registry: "docker.io", namespace: "library", repo: "nginx",
+			full: "docker.io/library/nginx"},
+		{url: "ubuntu:22.04", registry: "docker.io", namespace: "library", repo: "ubuntu", tag: "22.04",
+			full: "docker.io/library/ubuntu:22.04"},
+		{url: "user/app", registry: "docker.io", namespace: "user", repo: "app", full: "docker.io/user/app"},
+		{url: "user/app:1.0", registry: "docker.io", namespace: "user", repo: "app", tag: "1.0",
+			full: "docker.io/user/app:1.0"},
+		{url: "library/nginx:1.25", registry: "docker.io", namespace: "library", repo: "nginx", tag: "1.25",
+			full: "docker.io/library/nginx:1.25"},
+		{url: "registry:5000/app", registry: "registry:5000", repo: "app", full: "registry:5000/app"},
+		{url: "localhost/app:v1", registry: "localhost", repo: "app", tag: "v1", full: "localhost/app:v1"},
+		{url: "quay.io/app", registry: "quay.io", repo: "app", full: "quay.io/app"},
+	})
+}
+
+func TestAddDefaultRegistry(t *testing.T) {
+	cases := []struct {
+		url      string
+		registry string
+		expected string
+	}{
+		{url: "nginx", registry: "mirror.example.com", expected: "mirror.example.com/nginx"},
+		{url: "library/nginx:1.25", registry: "mirror.example.com/", expected: "mirror.example.com/library/nginx:1.25"},
+		{url: "registry:5000/app", registry: "mirror.example.com", expected: "registry:5000/app"},
+		{url: "localhost/app", registry: "mirror.example.com", expected: "localhost/app"},
+		{url: "oci:/data/layout:v1", registry: "mirror.example.com", expected: "oci:/data/layout:v1"},
+		{url: "nginx", registry: "", expected: "nginx"},
+	}
+	for _, c := range cases {
+		if url := AddDefaultRegistry(c.url, c.registry); url != c.expected {
+			t.Errorf("AddDefaultRegistry(%q, %q) = %q, expected %q", c.url, c.registry, url, c.expected)
+		}
+	}
+}
+
+// testDigest is a valid sha256 digest
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestNewRepoURLHostPort(t *testing.T) {
+	checkRepoURLs(t, []repoURLCase{
+		{url: "myregistry:5000/ns/app", registry: "myregistry:5000", namespace: "ns", repo: "app",
+			full: "myregistry:5000/ns/app"},
+		{url: "myregistry:5000/ns/app:v1", registry: "myregistry:5000", namespace: "ns", repo: "app", tag: "v1",
+			full: "myregistry:5000/ns/app:v1"},
+		{url: "myregistry:5000/app:v1", registry: "myregistry:5000", repo: "app", tag: "v1",
+			full: "myregistry:5000/app:v1"},
+		{url: "10.0.0.1:5000/ns/app:5000", registry: "10.0.0.1:5000", namespace: "ns", repo: "app", tag: "5000",
+			full: "10.0.0.1:5000/ns/app:5000"},
+		{url: "myregistry:5000/ns/app@" + testDigest, registry: "myregistry:5000", namespace: "ns", repo: "app",
+			digest: testDigest, full: "myregistry:5000/ns/app@" + testDigest},
+		{url: "myregistry:5000/ns/app:v1@" + testDigest, registry: "myregistry:5000", namespace: "ns",
+			repo: "app", tag: "v1", digest: testDigest, full: "myregistry:5000/ns/app:v1@" + testDigest},
+		{url: "localhost:5000/app@" + testDigest, registry: "localhost:5000", repo: "app", digest: testDigest,
+			full: "localhost:5000/app@" + testDigest},
+	})
+}
+
+func TestNewRepoURLInvalidDigest(t *testing.T) {
+	for _, url := range []string{
+		"myregistry:5000/ns/app@sha256:1234",
+		"myregistry:5000/ns/app@latest",
+		"myregistry:5000/ns/app:v1@",
+	} {
+		if _, err := NewRepoURL(url); err == nil {
+			t.Errorf("NewRepoURL(%q) should fail for the invalid digest", url)
+		}
+	}
+}
+
+func TestRepoURLReference(t *testing.T) {
+	cases := map[string]string{
+		"myregistry:5000/ns/app":                  "",
+		"myregistry:5000/ns/app:v1":               "v1",
+		"myregistry:5000/ns/app@" + testDigest:    testDigest,
+		"myregistry:5000/ns/app:v1@" + testDigest: testDigest,
+	}
+	for url, expected := range cases {
+		repoURL, err := NewRepoURL(url)
+		if err != nil {
+			t.Errorf("NewRepoURL(%q) error: %v", url, err)
+			continue
+		}
+		if reference := repoURL.GetReference(); reference != expected {
+			t.Errorf("GetReference of %q = %q, expected %q", url, reference, expected)
+		}
+	}
+}
+
+func TestNewRepoURLDockerHub(t *testing.T) {
+	checkRepoURLs(t, []repoURLCase{
+		{url: "nginx", registry: "docker.io", namespace: "library", repo: "nginx", full: "docker.io/library/nginx"},
+		{url: "nginx@" + testDigest, registry: "docker.io", namespace: "library", repo: "nginx", digest: testDigest,
+			full: "docker.io/library/nginx@" + testDigest},
+		{url: "docker.io/nginx", registry: "docker.io", namespace: "library", repo: "nginx",
+			full: "docker.io/library/nginx"},
+		{url: "docker.io/nginx:1.25", registry: "docker.io", namespace: "library", repo: "nginx", tag: "1.25",
+			full: "docker.io/library/nginx:1.25"},
+		{url: "docker.io/user/app", registry: "docker.io", namespace: "user", repo: "app",
+			full: "docker.io/user/app"},
+		{url: "index.docker.io/nginx", registry: "docker.io", namespace: "library", repo: "nginx",
+			full: "docker.io/library/nginx"},
+		{url: "index.docker.io/library/nginx:1.25", registry: "docker.io", namespace: "library", repo: "nginx",
+			tag: "1.25", full: "docker.io/library/nginx:1.25"},
+		{url: "index.docker.io/user/app:1.0", registry: "docker.io", namespace: "user", repo: "app", tag: "1.0",
+			full: "docker.io/user/app:1.0"},
+		{url: "registry-1.docker.io/user/app", registry: "registry-1.docker.io", namespace: "user", repo: "app",
+			full: "registry-1.docker.io/user/app"},
+	})
+}
+
+func TestNewRepoURLTable(t *testing.T) {
+	checkRepoURLs(t, []repoURLCase{
+		{url: "registry.corp.local:5000/team/platform/base/alpine", registry: "registry.corp.local:5000",
+			namespace: "team", repo: "platform/base/alpine",
+			full: "registry.corp.local:5000/team/platform/base/alpine"},
+		{url: "registry.corp.local:5000/team/platform/base/alpine:3.19", registry: "registry.corp.local:5000",
+			namespace: "team", repo: "platform/base/alpine", tag: "3.19",
+			full: "registry.corp.local:5000/team/platform/base/alpine:3.19"},
+		{url: "registry.corp.local:5000/team/platform/alpine@" + testDigest, registry: "registry.corp.local:5000",
+			namespace: "team", repo: "platform/alpine", digest: testDigest,
+			full: "registry.corp.local:5000/team/platform/alpine@" + testDigest},
+		{url: "registry.corp.local:5000/team/platform/alpine:3.19@" + testDigest,
+			registry: "registry.corp.local:5000", namespace: "team", repo: "platform/alpine", tag: "3.19",
+			digest: testDigest, full: "registry.corp.local:5000/team/platform/alpine:3.19@" + testDigest},
+		{url: "ccr.ccs.tencentyun.com/ns/app:v1.0-rc.1", registry: "ccr.ccs.tencentyun.com", namespace: "ns",
+			repo: "app", tag: "v1.0-rc.1", full: "ccr.ccs.tencentyun.com/ns/app:v1.0-rc.1"},
+	})
+}
+
+func TestNewRepoURLInvalid(t *testing.T) {
+	for _, url := range []string{
+		"registry.corp.local:5000/",
+		"registry.corp.local:5000/team:v1/app",
+		"registry.corp.local:5000/team/app@" + testDigest + "/base",
+		"registry.corp.local//app",
+		"registry.corp.local/team/",
+		"registry.corp.local/team/app@sha256:abc",
+		"oci:",
+		"docker-archive:",
+	} {
+		if repoURL, err := NewRepoURL(url); err == nil {
+			t.Errorf("NewRepoURL(%q) = %q, expected an error", url, repoURL.GetURL())
+		}
+	}
+}
+
+func TestNewRepoURLLocal(t *testing.T) {
+	cases := []struct {
+		url       string
+		transport string
+		path      string
+		repo      string
+		tag       string
+		archive   bool
+	}{
+		{url: "oci:/data/images/alpine", transport: "oci", path: "/data/images/alpine", repo: "alpine"},
+		{url: "oci:/data/images/alpine:3.19", transport: "oci", path: "/data/images/alpine", repo: "alpine",
+			tag: "3.19"},
+		{url: "oci:./alpine:3.19", transport: "oci", path: "./alpine", repo: "alpine", tag: "3.19"},
+		{url: "docker-archive:/data/alpine.tar", transport: "docker-archive", path: "/data/alpine.tar",
+			repo: "alpine.tar", archive: true},
+		{url: "docker-archive:/data/v1:2/alpine.tar", transport: "docker-archive", path: "/data/v1:2/alpine.tar",
+			repo: "alpine.tar", archive: true},
+		{url: "oci-archive:/data/alpine.tar", transport: "oci-archive", path: "/data/alpine.tar",
+			repo: "alpine.tar", archive: true},
+	}
+	for _, c := range cases {
+		repoURL, err := NewRepoURL(c.url)
+		if err != nil {
+			t.Errorf("NewRepoURL(%q) error: %v", c.url, err)
+			continue
+		}
+		if !repoURL.IsLocal() || repoURL.GetTransport() != c.transport || repoURL.GetPath() != c.path ||
+			repoURL.GetRepo() != c.repo || repoURL.GetTag() != c.tag || repoURL.IsArchive() != c.archive {
+			t.Errorf("NewRepoURL(%q) = %s %s %s %s %v, expected %s %s %s %s %v", c.url, repoURL.GetTransport(),
+				repoURL.GetPath(), repoURL.GetRepo(), repoURL.GetTag(), repoURL.IsArchive(), c.transport, c.path,
+				c.repo, c.tag, c.archive)
+		}
+		if repoURL.GetURL() != c.url {
+			t.Errorf("GetURL of %q = %q", c.url, repoURL.GetURL())
+		}
+	}
+}
+
+func TestCheckIfIncludeTag(t *testing.T) {
+	cases := map[string]bool{
+		"ns/repo":                        false,
+		"ns/repo:v1":                     true,
+		"repo:v1":                        true,
+		"ns/repo@" + testDigest:          true,
+		"ns/repo:v1@" + testDigest:       true,
+		"registry:5000/ns/repo":          false,
+		"registry:5000/ns/repo:v1":       true,
+		"team/platform/base/alpine":      false,
+		"team/platform/base/alpine:3.19": true,
+	}
+	for repository, expected := range cases {
+		if included := CheckIfIncludeTag(repository); included != expected {
+			t.Errorf("CheckIfIncludeTag(%q) = %v, expected %v", repository, included, expected)
+		}
+	}
+}
+
+func TestNewRepoURLGHCR(t *testing.T) {
+	checkRepoURLs(t, []repoURLCase{
+		{url: "ghcr.io/my-org/app", registry: "ghcr.io", namespace: "my-org", repo: "app",
+			full: "ghcr.io/my-org/app"},
+		{url: "ghcr.io/my-org/app:1.2", registry: "ghcr.io", namespace: "my-org", repo: "app", tag: "1.2",
+			full: "ghcr.io/my-org/app:1.2"},
+		{url: "ghcr.io/my-org/platform/base:1.2", registry: "ghcr.io", namespace: "my-org", repo: "platform/base",
+			tag: "1.2", full: "ghcr.io/my-org/platform/base:1.2"},
+		{url: "ghcr.io/my-org/platform/images/base/alpine:3.19", registry: "ghcr.io", namespace: "my-org",
+			repo: "platform/images/base/alpine", tag: "3.19", full: "ghcr.io/my-org/platform/images/base/alpine:3.19"},
+		{url: "ghcr.io/my-org/platform/base@" + testDigest, registry: "ghcr.io", namespace: "my-org",
+			repo: "platform/base", digest: testDigest, full: "ghcr.io/my-org/platform/base@" + testDigest},
+		{url: "ghcr.io/My-Org/Platform/Base:V1", registry: "ghcr.io", namespace: "My-Org", repo: "Platform/Base",
+			tag: "V1", full: "ghcr.io/My-Org/Platform/Base:V1"},
+	})
+
+	repos := map[string]string{
+		"ghcr.io/my-org/app":                   "my-org/app",
+		"ghcr.io/my-org/platform/base:1.2":     "my-org/platform/base",
+		"ghcr.io/my-org/a/b/c/d@" + testDigest: "my-org/a/b/c/d",
+	}
+	for url, expected := range repos {
+		repoURL, err := NewRepoURL(url)
+		if err != nil {
+			t.Errorf("NewRepoURL(%q) error: %v", url, err)
+			continue
+		}
+		if repo := repoURL.GetRepoWithNamespace(); repo != expected {
+			t.Errorf("GetRepoWithNamespace of %q = %q, expected %q", url, repo, expected)
+		}
+	}
+}
+
+func TestRepoURLToLower(t *testing.T) {
+	cases := map[string]string{
+		"GHCR.io/My-Org/Platform/Base:V1.2-RC": "ghcr.io/my-org/platform/base:V1.2-RC",
+		"ghcr.io/My-Org/App@" + testDigest:     "ghcr.io/my-org/app@" + testDigest,
+		"ghcr.io/my-org/app:Latest":            "ghcr.io/my-org/app:Latest",
+		"oci:/data/My-Images/Alpine:V1":        "oci:/data/My-Images/Alpine:V1",
+	}
+	for url, expected := range cases {
+		repoURL, err := NewRepoURL(url)
+		if err != nil {
+			t.Errorf("NewRepoURL(%q) error: %v", url, err)
+			continue
+		}
+		lower := repoURL.ToLower()
+		if lower.GetURL() != expected || lower.GetOriginURL() != expected {
+			t.Errorf("ToLower of %q = %q, %q, expected %q", url, lower.GetURL(), lower.GetOriginURL(), expected)
+		}
+		if repoURL.GetURL() != url {
+			t.Errorf("ToLower changed %q to %q", url, repoURL.GetURL())
+		}
+	}
+}
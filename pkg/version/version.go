@@ -0,0 +1,57 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package version
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// the build information is set by ldflags when building, see Makefile
+var (
+	version   = "unknown"
+	gitCommit = "unknown"
+	buildDate = "unknown"
+)
+
+// BuildInfo is the build information of the binary
+type BuildInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"gitCommit"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+	Platform  string `json:"platform"`
+}
+
+// Version returns the build information of the binary
+func Version() BuildInfo {
+	return BuildInfo{
+		Version:   version,
+		GitCommit: gitCommit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+}
+
+// String returns the build information in one line
+func (i BuildInfo) String() string {
+	return fmt.Sprintf("Version: %s, GitCommit: %s, BuildDate: %s, GoVersion: %s, Platform: %s",
+		i.Version, i.GitCommit, i.BuildDate, i.GoVersion, i.Platform)
+}